@@ -0,0 +1,480 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	ggu "github.com/itsvyle/hxi2/global-go/utils"
+)
+
+// Account deletion workflow:
+//  1. the user requests the deletion (POST /api/me/delete, or the /delete_account bot command)
+//  2. an admin confirms it (/deletions bot command); the user is logged out and can't log back in
+//  3. every project with the APIRoleAccountDeletion role lists it in GET /api/project/deletions,
+//     removes or anonymizes its data, then acknowledges it with POST /api/project/deletions/ack
+//  4. once every such project has acknowledged it, the user is removed from the auth database
+const (
+	DeletionStatusRequested = "requested"
+	DeletionStatusConfirmed = "confirmed"
+	DeletionStatusCompleted = "completed"
+	DeletionStatusCancelled = "cancelled"
+)
+
+type DBDeletionRequest struct {
+	ID          int64         `db:"ID" json:"id"`
+	UserID      int64         `db:"user_id" json:"userID"`
+	Status      string        `db:"status" json:"status"`
+	RequestedAt time.Time     `db:"requested_at" json:"requestedAt"`
+	ConfirmedBy sql.NullInt64 `db:"confirmed_by" json:"-"`
+	ConfirmedAt sql.NullTime  `db:"confirmed_at" json:"-"`
+	CompletedAt sql.NullTime  `db:"completed_at" json:"-"`
+}
+
+// Returns the already open request for the user if there is one
+func (db *DatabaseManager) CreateDeletionRequest(userID int64) (*DBDeletionRequest, error) {
+	existing := &DBDeletionRequest{}
+	err := db.DB.Get(existing, "SELECT * FROM DELETION_REQUESTS WHERE user_id = ? AND status IN (?, ?) LIMIT 1", userID, DeletionStatusRequested, DeletionStatusConfirmed)
+	if err == nil {
+		return existing, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	res, err := db.DB.Exec("INSERT INTO DELETION_REQUESTS (user_id, status, requested_at) VALUES (?, ?, ?)", userID, DeletionStatusRequested, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	return db.GetDeletionRequest(id)
+}
+
+func (db *DatabaseManager) GetDeletionRequest(id int64) (*DBDeletionRequest, error) {
+	d := &DBDeletionRequest{}
+	err := db.DB.Get(d, "SELECT * FROM DELETION_REQUESTS WHERE ID = ?", id)
+	return d, err
+}
+
+func (db *DatabaseManager) ListOpenDeletionRequests() ([]DBDeletionRequest, error) {
+	requests := []DBDeletionRequest{}
+	err := db.DB.Select(&requests, "SELECT * FROM DELETION_REQUESTS WHERE status IN (?, ?) ORDER BY requested_at", DeletionStatusRequested, DeletionStatusConfirmed)
+	return requests, err
+}
+
+// Confirming a deletion revokes every session of the user
+func (db *DatabaseManager) ConfirmDeletionRequest(id int64, adminID int64) error {
+	d, err := db.GetDeletionRequest(id)
+	if err != nil {
+		return err
+	}
+	if d.Status != DeletionStatusRequested {
+		return fmt.Errorf("deletion request is %s, it can't be confirmed", d.Status)
+	}
+
+	tx, err := db.DB.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	_, err = tx.Exec("UPDATE DELETION_REQUESTS SET status = ?, confirmed_by = ?, confirmed_at = ? WHERE ID = ?", DeletionStatusConfirmed, adminID, time.Now().UTC(), id)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM REFRESH_TOKENS WHERE associated_user_id = ?", d.UserID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Only requests that weren't confirmed yet can be cancelled, as projects may already have deleted their data
+func (db *DatabaseManager) CancelDeletionRequest(id int64) error {
+	d, err := db.GetDeletionRequest(id)
+	if err != nil {
+		return err
+	}
+	if d.Status != DeletionStatusRequested {
+		return fmt.Errorf("deletion request is %s, it can't be cancelled", d.Status)
+	}
+	_, err = db.DB.Exec("UPDATE DELETION_REQUESTS SET status = ? WHERE ID = ?", DeletionStatusCancelled, id)
+	return err
+}
+
+func (db *DatabaseManager) IsUserBeingDeleted(userID int64) (bool, error) {
+	var count int
+	err := db.DB.Get(&count, "SELECT COUNT(*) FROM DELETION_REQUESTS WHERE user_id = ? AND status = ?", userID, DeletionStatusConfirmed)
+	return count > 0, err
+}
+
+// Lists the confirmed deletions that the given project hasn't acknowledged yet
+func (db *DatabaseManager) ListPendingDeletionsForProject(projectID int64) ([]DBDeletionRequest, error) {
+	requests := []DBDeletionRequest{}
+	err := db.DB.Select(&requests, `
+		SELECT * FROM DELETION_REQUESTS
+		WHERE status = ? AND ID NOT IN (SELECT request_id FROM DELETION_ACKS WHERE project_id = ?)
+		ORDER BY confirmed_at
+	`, DeletionStatusConfirmed, projectID)
+	return requests, err
+}
+
+func (db *DatabaseManager) AckDeletion(requestID int64, projectID int64) error {
+	d, err := db.GetDeletionRequest(requestID)
+	if err != nil {
+		return err
+	}
+	if d.Status != DeletionStatusConfirmed {
+		return fmt.Errorf("deletion request is %s, it can't be acknowledged", d.Status)
+	}
+	_, err = db.DB.Exec("INSERT OR IGNORE INTO DELETION_ACKS (request_id, project_id, acked_at) VALUES (?, ?, ?)", requestID, projectID, time.Now().UTC())
+	return err
+}
+
+// Lists the projects which haven't acknowledged the deletion yet, among those that have to: the projects whose API key
+// has APIRoleAccountDeletion
+func (db *DatabaseManager) ListDeletionMissingAcks(requestID int64) ([]string, error) {
+	missing := []string{}
+	err := db.DB.Select(&missing, `
+		SELECT PROJECTS.name FROM PROJECTS
+		JOIN API_TOKENS ON API_TOKENS.id = PROJECTS.api_token_id
+		WHERE (API_TOKENS.permissions & ?) != 0 AND PROJECTS.ID NOT IN (SELECT project_id FROM DELETION_ACKS WHERE request_id = ?)
+	`, ggu.APIRoleAccountDeletion, requestID)
+	return missing, err
+}
+
+// Deletes the user if every project has acknowledged the deletion; returns whether it did
+func (db *DatabaseManager) TryCompleteDeletion(requestID int64) (bool, error) {
+	d, err := db.GetDeletionRequest(requestID)
+	if err != nil {
+		return false, err
+	}
+	if d.Status != DeletionStatusConfirmed {
+		return false, nil
+	}
+	missing, err := db.ListDeletionMissingAcks(requestID)
+	if err != nil {
+		return false, err
+	}
+	if len(missing) > 0 {
+		return false, nil
+	}
+
+	tx, err := db.DB.Beginx()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	for _, q := range []string{
+		"DELETE FROM REFRESH_TOKENS WHERE associated_user_id = ?",
+		"DELETE FROM ONE_TIME_CODES WHERE user_id = ?",
+		"DELETE FROM USERS WHERE ID = ?",
+	} {
+		if _, err := tx.Exec(q, d.UserID); err != nil {
+			return false, err
+		}
+	}
+	_, err = tx.Exec("UPDATE DELETION_REQUESTS SET status = ?, completed_at = ? WHERE ID = ?", DeletionStatusCompleted, time.Now().UTC(), requestID)
+	if err != nil {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+
+	db.logger.With("deletionID", requestID, "userID", d.UserID).Info("Account deletion completed")
+	EmitUserDeleted(d.UserID)
+	return true, nil
+}
+
+// POST /api/me/delete
+func HandleRequestAccountDeletion(w http.ResponseWriter, r *http.Request) {
+	c, err := authManager.AuthenticateHTTPRequest(w, r, true)
+	if err != nil {
+		return
+	}
+
+	d, err := DB.CreateDeletionRequest(c.IDInt())
+	if err != nil {
+		slog.With("error", err, "userID", c.IDInt()).Error("Failed to create deletion request")
+		http.Error(w, "Failed to create deletion request", http.StatusInternalServerError)
+		return
+	}
+	slog.With("deletionID", d.ID, "userID", d.UserID).Info("Account deletion requested")
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(d)
+	if err != nil {
+		slog.With("error", err).Error("Failed to encode deletion request")
+	}
+}
+
+// GET /api/project/deletions
+func ProjectHandleListDeletions(w http.ResponseWriter, r *http.Request) {
+	project, ok := getProjectOfApiUser(w, r, ggu.APIRoleAccountDeletion)
+	if !ok {
+		return
+	}
+
+	requests, err := DB.ListPendingDeletionsForProject(project.ID)
+	if err != nil {
+		slog.With("error", err, "project", project.Name).Error("Failed to list pending deletions")
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	pending := make([]ggu.PendingDeletion, len(requests))
+	for i, d := range requests {
+		pending[i] = ggu.PendingDeletion{
+			ID:          d.ID,
+			UserID:      d.UserID,
+			ConfirmedAt: d.ConfirmedAt.Time,
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(pending)
+	if err != nil {
+		slog.With("error", err).Error("Error encoding pending deletions")
+	}
+}
+
+// POST /api/project/deletions/ack
+func ProjectHandleAckDeletion(w http.ResponseWriter, r *http.Request) {
+	project, ok := getProjectOfApiUser(w, r, ggu.APIRoleAccountDeletion)
+	if !ok {
+		return
+	}
+
+	var ack ggu.DeletionAckRequest
+	err := json.NewDecoder(r.Body).Decode(&ack)
+	if err != nil || ack.ID == 0 {
+		http.Error(w, "Invalid acknowledgement", http.StatusBadRequest)
+		return
+	}
+
+	l := slog.With("deletionID", ack.ID, "project", project.Name)
+	err = DB.AckDeletion(ack.ID, project.ID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "Deletion request not found", http.StatusNotFound)
+			return
+		}
+		l.With("error", err).Error("Failed to acknowledge deletion")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	l.Info("Project acknowledged account deletion")
+
+	_, err = DB.TryCompleteDeletion(ack.ID)
+	if err != nil {
+		l.With("error", err).Error("Failed to complete account deletion")
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write([]byte(`{"success":true}`))
+	if err != nil {
+		l.With("error", err).Error("Failed to write response")
+	}
+}
+
+func (discordBot *DiscordBot) addCommandDeleteAccount() {
+	const cmdName = "delete_account"
+	var command = &discordgo.ApplicationCommand{
+		Name:        cmdName,
+		Description: "Request the deletion of your hxi2.fr account and all its data",
+	}
+
+	hand := func(session *discordgo.Session, interaction *discordgo.InteractionCreate) {
+		if interaction.Member == nil {
+			return
+		}
+		discordUserID := interaction.Member.User.ID
+		user, err := DB.GetDBUserByDiscordID(discordUserID)
+		if err != nil || user == nil {
+			discordBot.RespondWithError(interaction, "Failed to get hxi2.fr user - maybe you are not registered on hxi2.fr?")
+			return
+		}
+
+		d, err := DB.CreateDeletionRequest(user.ID)
+		if err != nil {
+			discordBot.Logger.With("err", err, "discordUserID", discordUserID).Error("Failed to create deletion request")
+			discordBot.RespondWithError(interaction, "Failed to create deletion request")
+			return
+		}
+		discordBot.Logger.With("deletionID", d.ID, "userID", d.UserID).Info("Account deletion requested")
+
+		err = session.InteractionRespond(interaction.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: &discordgo.InteractionResponseData{
+				Flags: discordgo.MessageFlagsEphemeral,
+				Embeds: []*discordgo.MessageEmbed{
+					{
+						Title:       "Account deletion requested",
+						Description: "Your request (#" + strconv.FormatInt(d.ID, 10) + ") will be reviewed by an admin. Once confirmed, you will be logged out, and your data will be removed from every hxi2.fr service.",
+						Color:       0xFFA500,
+					},
+				},
+			},
+		})
+		if err != nil {
+			discordBot.Logger.With("err", err, "discordUserID", discordUserID).Error("Failed to respond to interaction")
+		}
+	}
+
+	discordBot.AddCommand(cmdName, command, hand)
+}
+
+func (discordBot *DiscordBot) addCommandDeletions() {
+	const cmdName = "deletions"
+	var p int64 = discordgo.PermissionAdministrator | discordgo.PermissionManageRoles | discordgo.PermissionManageGuild
+
+	var command = &discordgo.ApplicationCommand{
+		Name:                     cmdName,
+		Description:              "Manage account deletion requests",
+		DefaultMemberPermissions: &p,
+		Options: []*discordgo.ApplicationCommandOption{
+			{
+				Type:        discordgo.ApplicationCommandOptionString,
+				Name:        "action",
+				Description: "What to do",
+				Required:    true,
+				Choices: []*discordgo.ApplicationCommandOptionChoice{
+					{Name: "list", Value: "list"},
+					{Name: "confirm", Value: "confirm"},
+					{Name: "cancel", Value: "cancel"},
+				},
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionInteger,
+				Name:        "id",
+				Description: "The ID of the deletion request, for confirm and cancel",
+				Required:    false,
+			},
+		},
+	}
+
+	hand := func(session *discordgo.Session, interaction *discordgo.InteractionCreate) {
+		admin, err := discordBot.GetInteractionClaims(interaction)
+		if err != nil || admin == nil {
+			discordBot.RespondWithError(interaction, "Failed to get user claims")
+			return
+		}
+		if !admin.IsAdmin() {
+			discordBot.RespondWithError(interaction, "You do not have permission to use this command")
+			return
+		}
+
+		data := interaction.ApplicationCommandData()
+		var action string
+		var requestID int64
+		for _, option := range data.Options {
+			switch option.Name {
+			case "action":
+				action = option.StringValue()
+			case "id":
+				requestID = option.IntValue()
+			}
+		}
+
+		respond := func(embed *discordgo.MessageEmbed) {
+			err := session.InteractionRespond(interaction.Interaction, &discordgo.InteractionResponse{
+				Type: discordgo.InteractionResponseChannelMessageWithSource,
+				Data: &discordgo.InteractionResponseData{
+					Flags:  discordgo.MessageFlagsEphemeral,
+					Embeds: []*discordgo.MessageEmbed{embed},
+				},
+			})
+			if err != nil {
+				discordBot.Logger.With("err", err).Error("Failed to respond to interaction")
+			}
+		}
+
+		if action == "list" {
+			requests, err := DB.ListOpenDeletionRequests()
+			if err != nil {
+				discordBot.Logger.With("err", err).Error("Failed to list deletion requests")
+				discordBot.RespondWithError(interaction, "Failed to list deletion requests")
+				return
+			}
+			embed := &discordgo.MessageEmbed{
+				Title:       "Open account deletion requests",
+				Description: "No open request",
+				Color:       0xFFA500,
+			}
+			if len(requests) > 0 {
+				embed.Description = ""
+			}
+			for _, d := range requests {
+				value := "User " + strconv.FormatInt(d.UserID, 10) + " - " + d.Status
+				if u, err := DB.GetDBUserByID(d.UserID); err == nil {
+					value = u.FirstName + " (" + u.Username + ", promo " + strconv.Itoa(u.Promotion) + ") - " + d.Status
+				}
+				if d.Status == DeletionStatusConfirmed {
+					if missing, err := DB.ListDeletionMissingAcks(d.ID); err == nil && len(missing) > 0 {
+						value += "\nWaiting for: " + strings.Join(missing, ", ")
+					}
+				}
+				embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{
+					Name:  "#" + strconv.FormatInt(d.ID, 10),
+					Value: value,
+				})
+			}
+			respond(embed)
+			return
+		}
+
+		if requestID == 0 {
+			discordBot.RespondWithError(interaction, "The `id` option is required for this action")
+			return
+		}
+
+		switch action {
+		case "confirm":
+			err = DB.ConfirmDeletionRequest(requestID, admin.IDInt())
+			if err != nil {
+				discordBot.RespondWithError(interaction, "Failed to confirm deletion request: "+err.Error())
+				return
+			}
+			discordBot.Logger.With("deletionID", requestID, "adminID", admin.IDInt()).Info("Account deletion confirmed")
+			completed, err := DB.TryCompleteDeletion(requestID)
+			if err != nil {
+				discordBot.Logger.With("err", err, "deletionID", requestID).Error("Failed to complete account deletion")
+			}
+			description := "The user has been logged out; the deletion will complete once every project has removed its data."
+			if completed {
+				description = "No project holds data for this user, the account has been deleted."
+			}
+			respond(&discordgo.MessageEmbed{
+				Title:       "Deletion #" + strconv.FormatInt(requestID, 10) + " confirmed",
+				Description: description,
+				Color:       0x00FF00,
+			})
+		case "cancel":
+			err = DB.CancelDeletionRequest(requestID)
+			if err != nil {
+				discordBot.RespondWithError(interaction, "Failed to cancel deletion request: "+err.Error())
+				return
+			}
+			respond(&discordgo.MessageEmbed{
+				Title: "Deletion #" + strconv.FormatInt(requestID, 10) + " cancelled",
+				Color: 0x00FF00,
+			})
+		default:
+			discordBot.RespondWithError(interaction, "Unknown action")
+		}
+	}
+
+	discordBot.AddCommand(cmdName, command, hand)
+}
@@ -1,19 +1,18 @@
 package main
 
 import (
+	"database/sql"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
-	"net/url"
 	"strings"
 	"time"
 
 	"github.com/cristalhq/jwt/v5"
 	ggu "github.com/itsvyle/hxi2/global-go/utils"
-	"golang.org/x/net/publicsuffix"
 )
 
 func HandlerPublicKey(w http.ResponseWriter, r *http.Request) {
@@ -42,8 +41,11 @@ func LoginError(w http.ResponseWriter, r *http.Request, err string) {
 	if headerAccepts != "" {
 		if strings.Contains(headerAccepts, "text/html") {
 			errBase64 := base64.StdEncoding.EncodeToString([]byte(err))
+			nonce := contentSecurityPolicy.Apply(w)
 			body := "<html><head><meta http-equiv=\"refresh\" content=\"0; url=" + authManager.LoginPageURL + "\"><style>html{color-scheme: dark;}</style><script>localStorage.setItem('authError', '" + errBase64 + "');</script></head><body>Redirecting...</body></html>"
 			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Header().Set("Cache-Control", "no-store")
+			body = string(ggu.InjectCSPNonce([]byte(body), nonce))
 			w.WriteHeader(http.StatusOK)
 			_, err := w.Write([]byte(body))
 			if err != nil {
@@ -138,11 +140,7 @@ func HandleDiscordCallback(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	} else if redirectCookie.Value != "" {
-		redirectTo = redirectCookie.Value
-		if !IsHXI2BaseDomain(redirectTo) {
-			redirectTo = ConfigDefaultLoginRedirect
-			slog.With("redirectTo", redirectTo).Error("Tried to redirect to a different TLD")
-		}
+		redirectTo = SafeRedirect(redirectCookie.Value)
 	}
 
 	if clientState != r.URL.Query().Get("state") {
@@ -196,6 +194,17 @@ func HandleDiscordCallback(w http.ResponseWriter, r *http.Request) {
 	}
 
 	dbUser, err := DB.GetDBUserByDiscordID(dai.ID)
+	if errors.Is(err, sql.ErrNoRows) && ConfigProvisioningMode != ProvisioningOff {
+		dbUser, err = ProvisionDiscordUser(token, dai)
+		if errors.Is(err, ErrProvisioningPending) {
+			LoginError(w, r, "Your account is waiting for an admin's approval")
+			return
+		}
+		if errors.Is(err, ErrProvisioningNotEligible) {
+			LoginError(w, r, "You must be in the HXi² Discord server with a student role to log in")
+			return
+		}
+	}
 	if err != nil {
 		slog.With("error", err).Error("Failed to get user by discord ID")
 		LoginError(w, r, "Failed to get user by discord ID")
@@ -208,12 +217,14 @@ func HandleDiscordCallback(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if dai.Username != dbUser.Username {
+		oldUser := *dbUser
 		dbUser.Username = dai.Username
 		err = DB.UpdateUser(dbUser)
 		if err != nil {
 			slog.With("error", err, "discordID", dai.ID, "newUsername", dai.Username).Error("Failed to update username on login")
 			return
 		}
+		EmitUserUpdated(&oldUser, dbUser)
 	}
 
 	if !setAuthCookies(w, r, dbUser) {
@@ -224,6 +235,17 @@ func HandleDiscordCallback(w http.ResponseWriter, r *http.Request) {
 }
 
 func setAuthCookies(w http.ResponseWriter, r *http.Request, dbUser *DBUser) bool {
+	beingDeleted, err := DB.IsUserBeingDeleted(dbUser.ID)
+	if err != nil {
+		slog.With("error", err, "userID", dbUser.ID).Error("Failed to check if user is being deleted")
+		LoginError(w, r, "Failed to get user information")
+		return false
+	}
+	if beingDeleted {
+		LoginError(w, r, "This account is being deleted")
+		return false
+	}
+
 	cl := dbUser.GetNewJWTClaims()
 
 	tokenString, err := jwtManager.GenerateToken(cl)
@@ -329,6 +351,7 @@ func HandleRenewToken(w http.ResponseWriter, r *http.Request) {
 	if !checkProjectApiAuth(w, r, ggu.APIRoleAuthentication) {
 		return
 	}
+	logger := ggu.RequestLogger(r.Context())
 	var renewRequest ggu.AuthRenewalRequest
 	err := json.NewDecoder(r.Body).Decode(&renewRequest)
 	if err != nil {
@@ -346,11 +369,12 @@ func HandleRenewToken(w http.ResponseWriter, r *http.Request) {
 	// verify token
 	_, err = jwt.Parse([]byte(renewRequest.Token), jwtManager.verifier)
 	if err != nil {
+		logger.With("error", err).Warn("Renewal: Failed to verify token")
 		http.Error(w, "Failed to verify token", http.StatusUnauthorized)
 		return
 	}
 
-	res, err := RenewTokenActionner(renewRequest.Token, renewRequest.RefreshToken)
+	res, err := RenewTokenActionner(r.Context(), renewRequest.Token, renewRequest.RefreshToken)
 
 	if err != nil {
 		http.Error(w, "Failed to renew token", http.StatusInternalServerError)
@@ -366,7 +390,7 @@ func HandleRenewToken(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	_, err = w.Write(resBytes)
 	if err != nil {
-		slog.With("error", err).Error("Failed to write response")
+		logger.With("error", err).Error("Failed to write response")
 	}
 
 }
@@ -374,8 +398,19 @@ func HandleRenewToken(w http.ResponseWriter, r *http.Request) {
 func HandleTempLogin(w http.ResponseWriter, r *http.Request) {
 	username := r.URL.Query().Get("username")
 	code := r.URL.Query().Get("code")
-	if username == "" || code == "" {
-		http.Error(w, "Username or code is empty", http.StatusBadRequest)
+	projectIDOrName := r.URL.Query().Get("project")
+	if username == "" || code == "" || projectIDOrName == "" {
+		http.Error(w, "Username, code or project is empty", http.StatusBadRequest)
+		return
+	}
+	project, err := FindProject(projectIDOrName)
+	if err != nil {
+		slog.With("error", err, "project", projectIDOrName).Error("Failed to find project for temporary login")
+		http.Error(w, "Failed to find project", http.StatusInternalServerError)
+		return
+	}
+	if project == nil || !project.AllowsGuest(username) {
+		http.Error(w, "Unknown project, or guest not allowed for this project", http.StatusForbidden)
 		return
 	}
 	tempo, err := DB.CheckTempCode(username, code)
@@ -406,30 +441,14 @@ func HandleTempLogin(w http.ResponseWriter, r *http.Request) {
 		Path:   ggu.StringPtr("/"),
 	}))
 
-	redirectTo := ""
-	redirectToCookie, err := r.Cookie("authRedirectTo")
-	if err != nil || redirectToCookie == nil || redirectToCookie.Value == "" {
-		redirectTo = r.URL.Query().Get("redirectTo")
-		if redirectTo == "" {
-			redirectTo = ConfigDefaultLoginRedirect
-		}
-	} else {
-		redirectTo = redirectToCookie.Value
-	}
-
-	body := "<html><head><meta http-equiv=\"refresh\" content=\"0; url=" + redirectTo + "\"></head><body>Redirecting...</body></html>"
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	w.WriteHeader(http.StatusOK)
-	_, err = w.Write([]byte(body))
-	if err != nil {
-		slog.With("error", err).Error("Failed to write redirect response")
-	}
+	writeRedirectPage(w, SafeRedirect(project.DefaultRedirect))
 }
 
 func HandleTempRenew(w http.ResponseWriter, r *http.Request) {
 	if !checkProjectApiAuth(w, r, ggu.APIRoleAuthentication) {
 		return
 	}
+	logger := ggu.RequestLogger(r.Context())
 	var renewRequest ggu.AuthRenewalRequest
 	err := json.NewDecoder(r.Body).Decode(&renewRequest)
 	if err != nil {
@@ -447,6 +466,7 @@ func HandleTempRenew(w http.ResponseWriter, r *http.Request) {
 	var cl *ggu.HXI2JWTClaims
 	t, err := jwt.Parse([]byte(token), jwtManager.verifier)
 	if err != nil {
+		logger.With("error", err).Warn("Renewal: Failed to verify token")
 		http.Error(w, "Failed to verify token", http.StatusUnauthorized)
 		return
 	}
@@ -463,13 +483,13 @@ func HandleTempRenew(w http.ResponseWriter, r *http.Request) {
 
 	tempo, err := DB.GetTempFromUsername(cl.Username)
 	if err != nil || tempo == nil {
-		slog.With("error", err).Error("Failed to get temporary code from username")
+		logger.With("error", err).Error("Failed to get temporary code from username")
 		http.Error(w, "Failed to get temporary code from username", http.StatusInternalServerError)
 		return
 	}
 
 	if tempo.ExpiresAt.Unix() < time.Now().Unix() {
-		slog.With("username", cl.Username).Info("Temporary code expired")
+		logger.With("username", cl.Username).Info("Temporary code expired")
 		http.Error(w, "Temporary code expired", http.StatusUnauthorized)
 		return
 	}
@@ -483,7 +503,7 @@ func HandleTempRenew(w http.ResponseWriter, r *http.Request) {
 
 		newToken, err := jwtManager.builder.Build(newClaims)
 		if err != nil {
-			slog.With("error", err).Error("Failed to build new token")
+			logger.With("error", err).Error("Failed to build new token")
 			http.Error(w, "Failed to build new token", http.StatusInternalServerError)
 			return
 		}
@@ -493,19 +513,6 @@ func HandleTempRenew(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/plain")
 	_, err = w.Write([]byte(token))
 	if err != nil {
-		slog.With("error", err).Error("Failed to write token to response")
-	}
-}
-
-func IsHXI2BaseDomain(rawURL string) bool {
-	parsedURL, err := url.Parse(rawURL)
-	if err != nil {
-		return false
-	}
-	host := parsedURL.Hostname()
-	baseDomain, err := publicsuffix.EffectiveTLDPlusOne(host)
-	if err != nil {
-		return false
+		logger.With("error", err).Error("Failed to write token to response")
 	}
-	return baseDomain == HXI2TLD
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"crypto/sha256"
 	"database/sql"
 	"encoding/hex"
@@ -35,6 +36,19 @@ type DBUser struct {
 	Permissions         int            `db:"permissions" json:"permissions"`
 }
 
+// The version of the user shared with projects
+func (u *DBUser) ProjectUser() ggu.ProjectUser {
+	return ggu.ProjectUser{
+		ID:          u.ID,
+		Username:    u.Username,
+		FirstName:   u.FirstName,
+		LastName:    u.LastName,
+		DiscordID:   u.DiscordID,
+		Promotion:   u.Promotion,
+		Permissions: u.Permissions,
+	}
+}
+
 func (u *DBUser) CheckSchema() error {
 	if u.ID == 0 {
 		return errors.New("ID is missing")
@@ -276,6 +290,42 @@ func (db *DatabaseManager) ListAPIUsers() ([]DBApiUser, error) {
 	return apiUsers, nil
 }
 
+func (db *DatabaseManager) CreateAPIUser(username string, permissions int, validity time.Duration) (*DBApiUser, error) {
+	token, err := ggu.GenerateRandomString(32)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate token: %w", err)
+	}
+	a := &DBApiUser{
+		Username:    username,
+		Token:       token,
+		Permissions: permissions,
+		CreatedAt:   time.Now().UTC(),
+		ExpiresAt:   time.Now().UTC().Add(validity),
+	}
+	res, err := db.DB.NamedExec(`
+		INSERT INTO API_TOKENS (username, token, permissions, created_at, expires_at)
+		VALUES (:username, :token, :permissions, :created_at, :expires_at)
+	`, a)
+	if err != nil {
+		return nil, err
+	}
+	a.ID, err = res.LastInsertId()
+	return a, err
+}
+
+func (db *DatabaseManager) DeleteAPIUser(id int64) error {
+	res, err := db.DB.Exec("DELETE FROM API_TOKENS WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	// the foreign keys aren't enforced by sqlite
+	_, err = db.DB.Exec("UPDATE PROJECTS SET api_token_id = NULL WHERE api_token_id = ?", id)
+	return err
+}
+
 type DBOneTimeCode struct {
 	ID        int64     `db:"ID" json:"id"`
 	UserID    int64     `db:"user_id" json:"userId"`
@@ -284,22 +334,12 @@ type DBOneTimeCode struct {
 	ExpiresAt time.Time `db:"expires_at" json:"expiresAt"`
 }
 
-func (db *DatabaseManager) StartOneTimeCodeCleanupTimer() {
-	cleanupInterval := 5 * time.Minute
-	timer := time.NewTimer(cleanupInterval)
-
-	go func() {
-		for {
-			<-timer.C
-
-			_, err := db.DB.Exec("DELETE FROM ONE_TIME_CODES WHERE expires_at < ?", time.Now().UTC())
-			if err != nil && !errors.Is(err, sql.ErrNoRows) {
-				db.logger.With("error", err).Error("Failed to clean up expired one-time codes")
-			}
-
-			timer.Reset(cleanupInterval)
-		}
-	}()
+// Run every few minutes by the lifecycle of the service
+func (db *DatabaseManager) CleanupExpiredOneTimeCodes(ctx context.Context) {
+	_, err := db.DB.ExecContext(ctx, "DELETE FROM ONE_TIME_CODES WHERE expires_at < ?", time.Now().UTC())
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		db.logger.With("error", err).Error("Failed to clean up expired one-time codes")
+	}
 }
 
 func (db *DatabaseManager) CheckOneTimeCode(code string) (int64, error) {
@@ -445,6 +485,46 @@ func (db *DatabaseManager) GetTempFromUsername(username string) (*DBTemporaryCod
 	return &tempCode, nil
 }
 
+func (db *DatabaseManager) ListTempCodes() ([]DBTemporaryCode, error) {
+	codes := []DBTemporaryCode{}
+	err := db.DB.Select(&codes, "SELECT * FROM TEMPORARY_CODES ORDER BY username")
+	return codes, err
+}
+
+// Creates a temporary code for a service, and returns the code in clear; only its hash is stored
+func (db *DatabaseManager) CreateTempCode(username string, recheckAfter int, validity time.Duration) (string, error) {
+	if username == "" {
+		return "", errors.New("username is empty")
+	}
+	code, err := ggu.GenerateRandomString(32)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate code: %w", err)
+	}
+	codeHash, err := db.hashToken(code)
+	if err != nil {
+		return "", fmt.Errorf("failed to hash code: %w", err)
+	}
+	_, err = db.DB.Exec(`
+		INSERT INTO TEMPORARY_CODES (username, code_hash, recheck_after, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?)
+	`, username, codeHash, recheckAfter, time.Now().UTC(), time.Now().UTC().Add(validity))
+	if err != nil {
+		return "", err
+	}
+	return code, nil
+}
+
+func (db *DatabaseManager) DeleteTempCode(username string) error {
+	res, err := db.DB.Exec("DELETE FROM TEMPORARY_CODES WHERE username = ?", username)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
 func (db *DatabaseManager) hashToken(token string) (string, error) {
 	hasher := sha256.New()
 	_, err := hasher.Write([]byte(token))
@@ -30,6 +30,11 @@ func NewDiscordBot(token string) (*DiscordBot, error) {
 	b.addCommandUpdateUser()
 	b.addCommandParrainsup()
 	b.addCommandTestButton()
+	b.addCommandDeleteAccount()
+	b.addCommandDeletions()
+	b.addCommandPending()
+	b.addCommandRoleSync()
+	b.addCommandRollover()
 	b.DiscordBot.Session.AddHandler(b.onReady2)
 	return b, nil
 }
@@ -70,7 +75,6 @@ func (discordBot *DiscordBot) GetInteractionClaims(interaction *discordgo.Intera
 func (discordBot *DiscordBot) addCommandUpdateUser() {
 	const cmdName = "create"
 	const newUserPermissions = ggu.RoleStudent
-	minp, maxp := ggu.GetPromotionsRange()
 
 	var p int64 = discordgo.PermissionAdministrator | discordgo.PermissionManageRoles | discordgo.PermissionManageGuild
 
@@ -85,13 +89,12 @@ func (discordBot *DiscordBot) addCommandUpdateUser() {
 				Description: "The first name of the user",
 				Required:    true,
 			},
+			// not bounded with MinValue and MaxValue: the command is registered once, and a rollover changes the range
 			{
 				Type:        discordgo.ApplicationCommandOptionInteger,
 				Name:        "promo",
 				Description: "The promo of the user",
 				Required:    true,
-				MinValue:    ggu.F64Ptr(float64(minp)),
-				MaxValue:    float64(maxp),
 			},
 			{
 				Type:        discordgo.ApplicationCommandOptionUser,
@@ -173,6 +176,7 @@ func (discordBot *DiscordBot) addCommandUpdateUser() {
 		} else {
 			promoI64 := data.Options[promoIndex].IntValue()
 			promo = int(promoI64)
+			minp, maxp := ggu.GetPromotionsRange()
 			if promo < minp || promo > maxp {
 				discordBot.RespondWithError(interaction, "Invalid promo value, must be between "+strconv.Itoa(minp)+" and "+strconv.Itoa(maxp))
 				return
@@ -247,6 +251,7 @@ func (discordBot *DiscordBot) addCommandUpdateUser() {
 			discordBot.RespondWithError(interaction, "Failed to create new user")
 			return
 		}
+		EmitUserCreated(newUser)
 		embed := &discordgo.MessageEmbed{
 			Title:       "User created successfully",
 			Description: "The user has been created and can now log in to hxi2.fr.",
@@ -0,0 +1,61 @@
+package main
+
+import (
+	_ "embed"
+	"fmt"
+	"time"
+
+	ggu "github.com/itsvyle/hxi2/global-go/utils"
+	"github.com/jmoiron/sqlx"
+	_ "github.com/mattn/go-sqlite3"
+	"golang.org/x/oauth2"
+)
+
+// Shared by the server (main.go) and the admin CLI (hxi2ctl.go), which are built with different tags
+
+const OneTimeCodeLength = 6
+
+var ConfigDefaultLoginRedirect = "/"
+var HXI2CookiesDomain = ""
+
+var IsLocalDebugInstance = false
+
+var authManager *ggu.AuthManager
+
+// The policy of the pages, for the ones written by the handlers
+var contentSecurityPolicy *ggu.ContentSecurityPolicy
+
+var jwtManager *JWTManager
+var JWTValidityDuration = 10 * time.Minute
+var JWTRefreshTokenValidityDuration = 30 * 24 * time.Hour
+
+var discordOauthConfig *oauth2.Config
+
+// nil if CONFIG_DISCORD_BOT_TOKEN isn't set
+var globalDiscordBot *DiscordBot
+
+var apiUsersCacher *ggu.Cacher[map[string]*DBApiUser]
+var projectsCacher *ggu.Cacher[[]DBProject]
+
+//go:embed schema.sql
+var sqlSchema string
+
+// Opens the sqlite database at path, and creates the missing tables
+func OpenDatabase(path string) (*DatabaseManager, error) {
+	sqlDB, err := sqlx.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	err = sqlDB.Ping()
+	if err != nil {
+		return nil, fmt.Errorf("failed to ping database: %w", err)
+	}
+	_, err = sqlDB.Exec(sqlSchema)
+	if err != nil {
+		return nil, fmt.Errorf("failed to apply schema: %w", err)
+	}
+	return &DatabaseManager{
+		DB:     sqlDB,
+		logger: ggu.GetServiceSpecificLogger("DB", "\033[38;5;226m"),
+	}, nil
+}
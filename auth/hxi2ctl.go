@@ -0,0 +1,724 @@
+//go:build hxi2ctl
+
+package main
+
+// hxi2ctl is the admin command line tool of the auth service
+// It works offline, directly on the sqlite database, and is built from the same package as the server:
+//	go build -tags hxi2ctl -o hxi2ctl .
+
+import (
+	"crypto/ecdsa"
+	"database/sql"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/cristalhq/jwt/v5"
+	ggu "github.com/itsvyle/hxi2/global-go/utils"
+)
+
+type ctlCommand struct {
+	name  string
+	args  string
+	about string
+	// whether the command opens the database
+	needsDB bool
+	run     func(fs *flag.FlagSet, args []string) error
+}
+
+var ctlCommands = []ctlCommand{
+	{"users list", "", "List all users", true, ctlUsersList},
+	{"users show", "<id|discord id|username>", "Show a user", true, ctlUsersShow},
+	{"users create", "-discord-id ID -username NAME -first-name NAME -promotion YEAR [-last-name NAME] [-permissions N]", "Create a user", true, ctlUsersCreate},
+	{"users update", "<id|discord id|username> [-username NAME] [-first-name NAME] [-last-name NAME] [-promotion YEAR] [-permissions N]", "Update the given fields of a user", true, ctlUsersUpdate},
+	{"tokens list", "", "List the project API tokens", true, ctlTokensList},
+	{"tokens create", "-name NAME [-permissions N] [-valid DURATION]", "Create a project API token, and print it", true, ctlTokensCreate},
+	{"tokens revoke", "<id|name>", "Delete a project API token", true, ctlTokensRevoke},
+	{"projects list", "", "List the projects, with the origins they may be redirected to", true, ctlProjectsList},
+	{"projects add", "-name NAME -origins ORIGINS [-guests USERNAMES] [-default-redirect URL] [-api-token ID|NAME]", "Register a project; origins and guests are comma separated lists", true, ctlProjectsAdd},
+	{"projects link", "<id|name> <api token id|name|none>", "Link a project to the API key it calls the project API with", true, ctlProjectsLink},
+	{"webhooks list", "", "List the webhooks of the projects", true, ctlWebhooksList},
+	{"webhooks add", "<project id|name> -url URL -secret SECRET [-events EVENTS]", "Register a webhook for a project; events is a comma separated list, empty for all of them", true, ctlWebhooksAdd},
+	{"temp-codes list", "", "List the temporary codes of services", true, ctlTempCodesList},
+	{"temp-codes create", "-username NAME [-recheck-after SECONDS] [-valid DURATION]", "Create a temporary code for a service, and print it", true, ctlTempCodesCreate},
+	{"temp-codes revoke", "<username>", "Delete the temporary code of a service", true, ctlTempCodesRevoke},
+	{"keys generate", "[-out DIR]", "Generate an ES256 key pair, written to private_<date>.pem and public_<date>.pem", false, ctlKeysGenerate},
+	{"keys inspect", "<pem file>", "Print the type, fingerprint and public part of a key", false, ctlKeysInspect},
+	{"jwt mint", "<id|discord id|username> [-key FILE] [-ttl DURATION]", "Sign a JWT for a user, for testing", true, ctlJWTMint},
+	{"jwt decode", "<token>", "Print the header and claims of a token, without verifying it", false, ctlJWTDecode},
+	{"jwt verify", "<token> [-key FILE]", "Verify the signature and validity of a token", false, ctlJWTVerify},
+}
+
+func ctlUsage() {
+	fmt.Fprintln(os.Stderr, "Usage: hxi2ctl [-db PATH] <command> [arguments]")
+	fmt.Fprintln(os.Stderr, "\nThe database defaults to CONFIG_DB_PATH, and the keys of the jwt commands are loaded like the server does")
+	fmt.Fprintln(os.Stderr, "\nCommands:")
+	w := tabwriter.NewWriter(os.Stderr, 0, 0, 2, ' ', 0)
+	for _, c := range ctlCommands {
+		fmt.Fprintf(w, "  %s\t%s\n", c.name, c.about)
+	}
+	w.Flush()
+}
+
+func main() {
+	// the DB logger stays quiet unless something fails
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelWarn})))
+
+	dbPath := flag.String("db", os.Getenv("CONFIG_DB_PATH"), "path to the sqlite database")
+	flag.Usage = ctlUsage
+	flag.Parse()
+	args := flag.Args()
+	if len(args) < 2 {
+		ctlUsage()
+		os.Exit(2)
+	}
+
+	name := args[0] + " " + args[1]
+	var cmd *ctlCommand
+	for i := range ctlCommands {
+		if ctlCommands[i].name == name {
+			cmd = &ctlCommands[i]
+		}
+	}
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", name)
+		ctlUsage()
+		os.Exit(2)
+	}
+
+	if cmd.needsDB {
+		if *dbPath == "" {
+			ctlFail(errors.New("no database: use -db or CONFIG_DB_PATH"))
+		}
+		if _, err := os.Stat(*dbPath); err != nil {
+			ctlFail(fmt.Errorf("database %s: %w", *dbPath, err))
+		}
+		var err error
+		DB, err = OpenDatabase(*dbPath)
+		if err != nil {
+			ctlFail(err)
+		}
+		DB.logger = slog.Default()
+		refreshPromotionsRange()
+	}
+
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: hxi2ctl %s %s\n", cmd.name, cmd.args)
+		fs.PrintDefaults()
+	}
+	if err := cmd.run(fs, args[2:]); err != nil {
+		ctlFail(err)
+	}
+}
+
+func ctlFail(err error) {
+	fmt.Fprintln(os.Stderr, "Error:", err)
+	os.Exit(1)
+}
+
+// Parses the flags wherever they are among the arguments, and returns the positional ones
+func ctlParse(fs *flag.FlagSet, args []string, positional int) []string {
+	rest := []string{}
+	for len(args) > 0 {
+		_ = fs.Parse(args)
+		args = fs.Args()
+		if len(args) > 0 {
+			rest = append(rest, args[0])
+			args = args[1:]
+		}
+	}
+	if len(rest) != positional {
+		fs.Usage()
+		os.Exit(2)
+	}
+	return rest
+}
+
+func ctlPrintJSON(v any) error {
+	e := json.NewEncoder(os.Stdout)
+	e.SetIndent("", "  ")
+	return e.Encode(v)
+}
+
+// Finds a user by ID, discord ID or username
+func ctlFindUser(ref string) (*DBUser, error) {
+	if id, err := strconv.ParseInt(ref, 10, 64); err == nil {
+		if user, err := DB.GetDBUserByID(id); err == nil {
+			return user, nil
+		}
+		if user, err := DB.GetDBUserByDiscordID(ref); err == nil {
+			return user, nil
+		}
+	}
+	users := []DBUser{}
+	err := DB.DB.Select(&users, "SELECT * FROM users WHERE username = ?", ref)
+	if err != nil {
+		return nil, err
+	}
+	switch len(users) {
+	case 0:
+		return nil, fmt.Errorf("no user matches %q", ref)
+	case 1:
+		return &users[0], nil
+	default:
+		return nil, fmt.Errorf("%d users are named %q, use their ID", len(users), ref)
+	}
+}
+
+// #region Users
+func ctlUsersList(fs *flag.FlagSet, args []string) error {
+	ctlParse(fs, args, 0)
+	users, err := DB.ListUsers()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tUSERNAME\tNAME\tDISCORD ID\tPROMOTION\tPERMISSIONS")
+	for _, u := range users {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%d\t%d\n", u.ID, u.Username, strings.TrimSpace(u.FirstName+" "+u.LastName.String), u.DiscordID, u.Promotion, u.Permissions)
+	}
+	return w.Flush()
+}
+
+func ctlUsersShow(fs *flag.FlagSet, args []string) error {
+	ref := ctlParse(fs, args, 1)[0]
+	user, err := ctlFindUser(ref)
+	if err != nil {
+		return err
+	}
+	return ctlPrintJSON(user.ProjectUser())
+}
+
+func ctlUsersCreate(fs *flag.FlagSet, args []string) error {
+	user := &DBUser{}
+	var lastName string
+	fs.StringVar(&user.DiscordID, "discord-id", "", "discord ID of the user")
+	fs.StringVar(&user.Username, "username", "", "discord username")
+	fs.StringVar(&user.FirstName, "first-name", "", "first name")
+	fs.StringVar(&lastName, "last-name", "", "last name")
+	fs.IntVar(&user.Promotion, "promotion", 0, "first year of mp2i")
+	fs.IntVar(&user.Permissions, "permissions", ggu.RoleStudent, "permissions bitfield")
+	ctlParse(fs, args, 0)
+
+	if user.Username == "" {
+		return errors.New("-username is required")
+	}
+	minp, maxp := ggu.GetPromotionsRange()
+	if user.Promotion < minp || user.Promotion > maxp {
+		return fmt.Errorf("the promotion must be between %d and %d", minp, maxp)
+	}
+	user.LastName = sql.NullString{String: lastName, Valid: lastName != ""}
+
+	err := DB.CreateNewUser(user)
+	if err != nil {
+		return err
+	}
+	EmitUserCreated(user)
+	fmt.Fprintf(os.Stderr, "Created user %d\n", user.ID)
+	return nil
+}
+
+func ctlUsersUpdate(fs *flag.FlagSet, args []string) error {
+	var username, firstName, lastName string
+	var promotion, permissions int
+	fs.StringVar(&username, "username", "", "discord username")
+	fs.StringVar(&firstName, "first-name", "", "first name")
+	fs.StringVar(&lastName, "last-name", "", "last name, empty to remove it")
+	fs.IntVar(&promotion, "promotion", 0, "first year of mp2i")
+	fs.IntVar(&permissions, "permissions", 0, "permissions bitfield")
+	ref := ctlParse(fs, args, 1)[0]
+
+	oldUser, err := ctlFindUser(ref)
+	if err != nil {
+		return err
+	}
+	user := *oldUser
+	changed := false
+	fs.Visit(func(f *flag.Flag) {
+		changed = true
+		switch f.Name {
+		case "username":
+			user.Username = username
+		case "first-name":
+			user.FirstName = firstName
+		case "last-name":
+			user.LastName = sql.NullString{String: lastName, Valid: lastName != ""}
+		case "promotion":
+			user.Promotion = promotion
+		case "permissions":
+			user.Permissions = permissions
+		}
+	})
+	if !changed {
+		return errors.New("nothing to update")
+	}
+	minp, maxp := ggu.GetPromotionsRange()
+	if user.Promotion < minp || user.Promotion > maxp {
+		return fmt.Errorf("the promotion must be between %d and %d", minp, maxp)
+	}
+
+	err = DB.UpdateUser(&user)
+	if err != nil {
+		return err
+	}
+	EmitUserUpdated(oldUser, &user)
+	fmt.Fprintf(os.Stderr, "Updated user %d\n", user.ID)
+	return nil
+}
+
+// #endregion
+
+// #region API tokens
+func ctlTokensList(fs *flag.FlagSet, args []string) error {
+	ctlParse(fs, args, 0)
+	apiUsers, err := DB.ListAPIUsers()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tPERMISSIONS\tCREATED\tEXPIRES")
+	for _, a := range apiUsers {
+		fmt.Fprintf(w, "%d\t%s\t%d\t%s\t%s\n", a.ID, a.Username, a.Permissions, a.CreatedAt.Format(time.DateTime), a.ExpiresAt.Format(time.DateTime))
+	}
+	return w.Flush()
+}
+
+func ctlTokensCreate(fs *flag.FlagSet, args []string) error {
+	name := fs.String("name", "", "name of the project")
+	permissions := fs.Int("permissions", ggu.APIRoleAuthentication, "API permissions bitfield")
+	valid := fs.Duration("valid", 365*24*time.Hour, "validity of the token")
+	ctlParse(fs, args, 0)
+	if *name == "" {
+		return errors.New("-name is required")
+	}
+
+	a, err := DB.CreateAPIUser(*name, *permissions, *valid)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Created API token %d for %s; it won't be shown again:\n", a.ID, a.Username)
+	fmt.Println(a.Token)
+	return nil
+}
+
+// Finds an API token by ID or name
+func ctlFindAPIToken(ref string) (*DBApiUser, error) {
+	apiUsers, err := DB.ListAPIUsers()
+	if err != nil {
+		return nil, err
+	}
+	for i := range apiUsers {
+		if strconv.FormatInt(apiUsers[i].ID, 10) == ref || apiUsers[i].Username == ref {
+			return &apiUsers[i], nil
+		}
+	}
+	return nil, fmt.Errorf("no API token matches %q", ref)
+}
+
+func ctlTokensRevoke(fs *flag.FlagSet, args []string) error {
+	a, err := ctlFindAPIToken(ctlParse(fs, args, 1)[0])
+	if err != nil {
+		return err
+	}
+	err = DB.DeleteAPIUser(a.ID)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Revoked API token %d of %s\n", a.ID, a.Username)
+	return nil
+}
+
+// #endregion
+
+// #region Projects
+func ctlProjectsList(fs *flag.FlagSet, args []string) error {
+	ctlParse(fs, args, 0)
+	projects, err := DB.ListProjects()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tORIGINS\tGUESTS\tDEFAULT REDIRECT\tAPI TOKEN")
+	for _, p := range projects {
+		apiToken := "-"
+		if p.APITokenID != nil {
+			apiToken = strconv.FormatInt(*p.APITokenID, 10)
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\n", p.ID, p.Name, p.RedirectOrigins, p.GuestUsernames, p.DefaultRedirect, apiToken)
+	}
+	return w.Flush()
+}
+
+func ctlProjectsAdd(fs *flag.FlagSet, args []string) error {
+	name := fs.String("name", "", "name of the project, e.g. tree")
+	origins := fs.String("origins", "", "comma separated origins users may be redirected to, e.g. https://tree.hxi2.fr")
+	guests := fs.String("guests", "", "comma separated temporary code usernames that may log in as guests of the project")
+	defaultRedirect := fs.String("default-redirect", "", "where guests are sent after logging in")
+	apiToken := fs.String("api-token", "", "ID or name of the API key the project calls the project API with")
+	ctlParse(fs, args, 0)
+	if *name == "" || *origins == "" {
+		return errors.New("-name and -origins are required")
+	}
+	for _, o := range splitCommaList(*origins) {
+		if u, err := url.Parse(o); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" || strings.Trim(u.Path, "/") != "" {
+			return fmt.Errorf("%q isn't an origin, e.g. https://tree.hxi2.fr", o)
+		}
+	}
+
+	p := &DBProject{Name: *name, RedirectOrigins: *origins, GuestUsernames: *guests, DefaultRedirect: *defaultRedirect}
+	if *apiToken != "" {
+		a, err := ctlFindAPIToken(*apiToken)
+		if err != nil {
+			return err
+		}
+		p.APITokenID = &a.ID
+	}
+	if err := DB.CreateProject(p); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Registered project %d, %s; the running server picks it up within 30s\n", p.ID, p.Name)
+	return nil
+}
+
+// Finds a project by ID or name
+func ctlFindProject(ref string) (*DBProject, error) {
+	projects, err := DB.ListProjects()
+	if err != nil {
+		return nil, err
+	}
+	for i := range projects {
+		if strconv.FormatInt(projects[i].ID, 10) == ref || projects[i].Name == ref {
+			return &projects[i], nil
+		}
+	}
+	return nil, fmt.Errorf("no project matches %q", ref)
+}
+
+func ctlProjectsLink(fs *flag.FlagSet, args []string) error {
+	refs := ctlParse(fs, args, 2)
+	project, err := ctlFindProject(refs[0])
+	if err != nil {
+		return err
+	}
+
+	if refs[1] == "none" {
+		if err := DB.SetProjectAPIToken(project.ID, nil); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Unlinked the API token of %s\n", project.Name)
+		return nil
+	}
+	a, err := ctlFindAPIToken(refs[1])
+	if err != nil {
+		return err
+	}
+	if err := DB.SetProjectAPIToken(project.ID, &a.ID); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Linked %s to the API token %d of %s\n", project.Name, a.ID, a.Username)
+	return nil
+}
+
+// #endregion
+
+// #region Webhooks
+func ctlWebhooksList(fs *flag.FlagSet, args []string) error {
+	ctlParse(fs, args, 0)
+	webhooks, err := DB.ListWebhooks()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tPROJECT\tURL\tEVENTS\tDISABLED")
+	for _, wh := range webhooks {
+		events := wh.Events
+		if events == "" {
+			events = "all"
+		}
+		fmt.Fprintf(w, "%d\t%d\t%s\t%s\t%t\n", wh.ID, wh.ProjectID, wh.CallbackURL, events, wh.Disabled)
+	}
+	return w.Flush()
+}
+
+func ctlWebhooksAdd(fs *flag.FlagSet, args []string) error {
+	callbackURL := fs.String("url", "", "URL the events are posted to")
+	secret := fs.String("secret", "", "shared secret the payloads are signed with")
+	events := fs.String("events", "", "comma separated events to subscribe to, empty for all of them")
+	project, err := ctlFindProject(ctlParse(fs, args, 1)[0])
+	if err != nil {
+		return err
+	}
+	if *secret == "" {
+		return errors.New("-secret is required")
+	}
+	if u, err := url.Parse(*callbackURL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("%q isn't an http or https URL", *callbackURL)
+	}
+
+	wh := &DBProjectWebhook{ProjectID: project.ID, CallbackURL: *callbackURL, Secret: *secret, Events: strings.Join(splitCommaList(*events), ",")}
+	if err := DB.CreateWebhook(wh); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Registered webhook %d for %s\n", wh.ID, project.Name)
+	return nil
+}
+
+// #endregion
+
+// #region Temporary codes
+func ctlTempCodesList(fs *flag.FlagSet, args []string) error {
+	ctlParse(fs, args, 0)
+	codes, err := DB.ListTempCodes()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tUSERNAME\tRECHECK AFTER\tCREATED\tEXPIRES")
+	for _, c := range codes {
+		fmt.Fprintf(w, "%d\t%s\t%ds\t%s\t%s\n", c.ID, c.Username, c.RecheckAfter, c.CreatedAt.Format(time.DateTime), c.ExpiresAt.Format(time.DateTime))
+	}
+	return w.Flush()
+}
+
+func ctlTempCodesCreate(fs *flag.FlagSet, args []string) error {
+	username := fs.String("username", "", "name of the service")
+	recheckAfter := fs.Int("recheck-after", 0, "seconds before the service rechecks its code with the auth server, 0 for never")
+	valid := fs.Duration("valid", 24*time.Hour, "validity of the code")
+	ctlParse(fs, args, 0)
+
+	code, err := DB.CreateTempCode(*username, *recheckAfter, *valid)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Created temporary code for %s; it won't be shown again:\n", *username)
+	fmt.Println(code)
+	return nil
+}
+
+func ctlTempCodesRevoke(fs *flag.FlagSet, args []string) error {
+	username := ctlParse(fs, args, 1)[0]
+	err := DB.DeleteTempCode(username)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("%s has no temporary code", username)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Revoked the temporary code of %s\n", username)
+	return nil
+}
+
+// #endregion
+
+// #region Keys
+func ctlKeysGenerate(fs *flag.FlagSet, args []string) error {
+	out := fs.String("out", ".", "directory to write the keys to, e.g. CONFIG_JWT_KEYS_DIR to rotate the signing key")
+	ctlParse(fs, args, 0)
+
+	password, err := loadJWTKeyPassword()
+	if err != nil {
+		return err
+	}
+	privateKey, err := WriteNewKeyPair(*out, password)
+	if err != nil {
+		return err
+	}
+	fingerprint, _ := ggu.KeyFingerprint(&privateKey.PublicKey)
+	if len(password) > 0 {
+		fmt.Fprintf(os.Stderr, "Wrote an encrypted key pair to %s\n", *out)
+	} else {
+		fmt.Fprintf(os.Stderr, "Wrote an unencrypted key pair to %s; set CONFIG_JWT_KEY_PASSWORD_FILE to encrypt it\n", *out)
+	}
+	fmt.Println(fingerprint)
+	return nil
+}
+
+func ctlKeysInspect(fs *flag.FlagSet, args []string) error {
+	path := ctlParse(fs, args, 1)[0]
+	pemBytes, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	password, err := loadJWTKeyPassword()
+	if err != nil {
+		return err
+	}
+
+	kind := "public"
+	if block, _ := pem.Decode(pemBytes); block != nil && block.Type != "PUBLIC KEY" {
+		kind = "private"
+		if block.Type == "ENCRYPTED PRIVATE KEY" {
+			kind = "encrypted private"
+		}
+		if checkSecretFileMode(path) != nil {
+			kind += " (accessible by other users, it will be refused)"
+		}
+	}
+	publicKey, err := LoadECDSAPublicKeyFromPEM(pemBytes, password)
+	if err != nil {
+		return fmt.Errorf("not an ECDSA key: %w", err)
+	}
+	fingerprint, err := ggu.KeyFingerprint(publicKey)
+	if err != nil {
+		return err
+	}
+	kid, err := ggu.KeyID(publicKey)
+	if err != nil {
+		return err
+	}
+	publicKeyPEM, err := ExportKeyAsPEM(publicKey)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Type:        ECDSA %s key\n", kind)
+	fmt.Printf("Curve:       %s\n", publicKey.Curve.Params().Name)
+	fmt.Printf("Fingerprint: %s\n", fingerprint)
+	fmt.Printf("Key ID:      %s\n", kid)
+	fmt.Printf("\n%s", publicKeyPEM)
+	return nil
+}
+
+// #endregion
+
+// #region JWT
+
+// Loads the keys from the -key file, or like the server does
+func ctlLoadKeys(path string) (*JWTKeySet, error) {
+	if path == "" {
+		if os.Getenv("CONFIG_JWT_PRIVATE_KEY") == "generate" {
+			return nil, errors.New("CONFIG_JWT_PRIVATE_KEY is set to generate, use -key")
+		}
+		return LoadJWTKeysFromEnv()
+	}
+	password, err := loadJWTKeyPassword()
+	if err != nil {
+		return nil, err
+	}
+	pemBytes, err := ReadSecretFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := LoadECDSAPrivateKeyFromPEM(pemBytes, password)
+	if err != nil {
+		return nil, err
+	}
+	return &JWTKeySet{Signing: key}, nil
+}
+
+func ctlJWTMint(fs *flag.FlagSet, args []string) error {
+	keyPath := fs.String("key", "", "private key PEM file")
+	ttl := fs.Duration("ttl", JWTValidityDuration, "validity of the token")
+	ref := ctlParse(fs, args, 1)[0]
+
+	keys, err := ctlLoadKeys(*keyPath)
+	if err != nil {
+		return fmt.Errorf("failed to load the private key: %w", err)
+	}
+	manager, err := NewJWTManager(keys, *ttl, JWTRefreshTokenValidityDuration)
+	if err != nil {
+		return err
+	}
+	user, err := ctlFindUser(ref)
+	if err != nil {
+		return err
+	}
+
+	claims := user.GetNewJWTClaims()
+	token, err := manager.GenerateToken(claims)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Token for %s (%d), expires at %s:\n", user.Username, user.ID, claims.ExpiresAt.Format(time.DateTime))
+	fmt.Println(token)
+	return nil
+}
+
+func ctlJWTDecode(fs *flag.FlagSet, args []string) error {
+	raw := ctlParse(fs, args, 1)[0]
+	t, err := jwt.ParseNoVerify([]byte(raw))
+	if err != nil {
+		return err
+	}
+	var claims map[string]any
+	err = json.Unmarshal(t.Claims(), &claims)
+	if err != nil {
+		return err
+	}
+	// timestamps are easier to read as dates
+	for _, k := range []string{"exp", "iat", "nbf"} {
+		if v, ok := claims[k].(float64); ok {
+			claims[k+"_date"] = time.Unix(int64(v), 0).UTC().Format(time.RFC3339)
+		}
+	}
+	return ctlPrintJSON(map[string]any{
+		"header": t.Header(),
+		"claims": claims,
+	})
+}
+
+func ctlJWTVerify(fs *flag.FlagSet, args []string) error {
+	keyPath := fs.String("key", "", "private key, or public keys PEM file")
+	raw := ctlParse(fs, args, 1)[0]
+
+	var publicKeys []*ecdsa.PublicKey
+	if *keyPath != "" {
+		pemBytes, err := os.ReadFile(*keyPath)
+		if err != nil {
+			return err
+		}
+		password, err := loadJWTKeyPassword()
+		if err != nil {
+			return err
+		}
+		publicKeys, err = ggu.LoadECDSAPublicKeys(pemBytes)
+		if err != nil {
+			publicKey, err := LoadECDSAPublicKeyFromPEM(pemBytes, password)
+			if err != nil {
+				return fmt.Errorf("failed to load the key: %w", err)
+			}
+			publicKeys = []*ecdsa.PublicKey{publicKey}
+		}
+	} else {
+		keys, err := ctlLoadKeys("")
+		if err != nil {
+			return fmt.Errorf("failed to load the keys: %w", err)
+		}
+		publicKeys = keys.PublicKeys()
+	}
+	verifier, err := ggu.NewKeySetVerifier(publicKeys)
+	if err != nil {
+		return err
+	}
+	t, err := jwt.Parse([]byte(raw), verifier)
+	if err != nil {
+		return fmt.Errorf("invalid signature: %w", err)
+	}
+	claims := &ggu.HXI2JWTClaims{}
+	err = t.DecodeClaims(claims)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if !claims.IsValidExpiresAt(now) {
+		return fmt.Errorf("the signature is valid, but the token expired at %s", claims.ExpiresAt.Format(time.DateTime))
+	}
+	if !claims.IsValidNotBefore(now) {
+		return fmt.Errorf("the signature is valid, but the token is not valid before %s", claims.NotBefore.Format(time.DateTime))
+	}
+	fmt.Println("Valid token for", claims.Username)
+	return nil
+}
+
+// #endregion
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"log/slog"
 	"time"
 
@@ -9,7 +10,6 @@ import (
 )
 
 type JWTManager struct {
-	secretKey                    string
 	PublicKeyPEM                 string
 	signer                       jwt.Signer
 	builder                      *jwt.Builder
@@ -18,37 +18,44 @@ type JWTManager struct {
 	RefreshTokenValidityDuration time.Duration
 }
 
-func NewJWTManager(secretKey string, validityDuration time.Duration, refreshTokenValidityDuration time.Duration) (*JWTManager, error) {
+func NewJWTManager(keys *JWTKeySet, validityDuration time.Duration, refreshTokenValidityDuration time.Duration) (*JWTManager, error) {
 	var err error
 
 	j := &JWTManager{
-		secretKey:                    secretKey,
 		JWTValidityDuration:          validityDuration,
 		RefreshTokenValidityDuration: refreshTokenValidityDuration,
 	}
 
-	privateKey, err := LoadECDSAPrivateKeyFromPEM([]byte(secretKey))
+	// served to the projects, signing key first
+	for _, publicKey := range keys.PublicKeys() {
+		k, err := ExportKeyAsPEM(publicKey)
+		if err != nil {
+			return nil, err
+		}
+		j.PublicKeyPEM += string(k)
+	}
+
+	fingerprint, err := ggu.KeyFingerprint(&keys.Signing.PublicKey)
 	if err != nil {
 		return nil, err
 	}
+	slog.With("fingerprint", fingerprint, "previousKeys", len(keys.Previous)).Info("Loaded JWT signing key")
 
-	publicKey := &privateKey.PublicKey
-
-	k, _ := ExportKeyAsPEM(publicKey)
-	j.PublicKeyPEM = string(k)
-	slog.With("publicKey", j.PublicKeyPEM).Debug("Loaded public key")
-
-	j.signer, err = jwt.NewSignerES(jwt.ES256, privateKey)
+	j.signer, err = jwt.NewSignerES(jwt.ES256, keys.Signing)
 	if err != nil {
 		return nil, err
 	}
 
-	j.verifier, err = jwt.NewVerifierES(jwt.ES256, publicKey)
+	j.verifier, err = ggu.NewKeySetVerifier(keys.PublicKeys())
 	if err != nil {
 		return nil, err
 	}
 
-	j.builder = jwt.NewBuilder(j.signer)
+	kid, err := ggu.KeyID(&keys.Signing.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	j.builder = jwt.NewBuilder(j.signer, jwt.WithKeyID(kid))
 
 	return j, nil
 }
@@ -106,11 +113,12 @@ func JWTGenerateRefreshToken() (string, error) {
 }
 
 // THE TOKEN VALIDITY HAS TO BE CHECKED BEFORE CALLING THIS FUNCTION
-func RenewTokenActionner(oldToken, refreshToken string) (res *ggu.AuthRenewalResponse, err error) {
+func RenewTokenActionner(ctx context.Context, oldToken, refreshToken string) (res *ggu.AuthRenewalResponse, err error) {
+	logger := ggu.RequestLogger(ctx)
 	var oldCL *ggu.HXI2JWTClaims
 	t, err := jwt.ParseNoVerify([]byte(oldToken))
 	if err != nil {
-		slog.With("error", err).Error("Renewal: Failed to parse old token")
+		logger.With("error", err).Error("Renewal: Failed to parse old token")
 		return nil, err
 	}
 	err = t.DecodeClaims(&oldCL)
@@ -122,12 +130,12 @@ func RenewTokenActionner(oldToken, refreshToken string) (res *ggu.AuthRenewalRes
 
 	userID, newRefreshToken, newJTI, err := DB.RenewRefreshToken(refreshToken, jti)
 	if err != nil {
-		slog.With("error", err).Error("Renewal: Failed to renew refresh token for valid input JWT")
+		logger.With("error", err).Error("Renewal: Failed to renew refresh token for valid input JWT")
 		return nil, err
 	}
 	dbUser, err := DB.GetDBUserByID(userID)
 	if err != nil {
-		slog.With("error", err).Error("Renewal: Failed to get user by ID for a valid token renewal")
+		logger.With("error", err, "userID", userID).Error("Renewal: Failed to get user by ID for a valid token renewal")
 		return nil, err
 	}
 
@@ -135,7 +143,7 @@ func RenewTokenActionner(oldToken, refreshToken string) (res *ggu.AuthRenewalRes
 	cl.ID = newJTI
 	token, err := jwtManager.GenerateToken(cl)
 	if err != nil {
-		slog.With("error", err).Error("Failed to generate token")
+		logger.With("error", err).Error("Failed to generate token")
 		return nil, err
 	}
 
@@ -6,7 +6,18 @@ import (
 	"crypto/rand"
 	"crypto/x509"
 	"encoding/pem"
+	"errors"
 	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	ggu "github.com/itsvyle/hxi2/global-go/utils"
+	"github.com/itsvyle/hxi2/global-go/utils/config"
+	"github.com/youmark/pkcs8"
 )
 
 func GenerateECDSAKeys() (*ecdsa.PrivateKey, *ecdsa.PublicKey, error) {
@@ -44,10 +55,287 @@ func ExportKeyAsPEM(key interface{}) ([]byte, error) {
 	return pem.EncodeToMemory(block), nil
 }
 
-func LoadECDSAPrivateKeyFromPEM(pemBytes []byte) (*ecdsa.PrivateKey, error) {
+// Encodes the private key as a password-encrypted PKCS#8 PEM (PBKDF2 and AES-256-CBC)
+func ExportEncryptedKeyAsPEM(privateKey *ecdsa.PrivateKey, password []byte) ([]byte, error) {
+	if len(password) == 0 {
+		return nil, errors.New("the password is empty")
+	}
+	der, err := pkcs8.MarshalPrivateKey(privateKey, password, nil)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "ENCRYPTED PRIVATE KEY", Bytes: der}), nil
+}
+
+// Loads a SEC1 or PKCS#8 private key; the password is only used for encrypted PKCS#8 keys
+func LoadECDSAPrivateKeyFromPEM(pemBytes []byte, password []byte) (*ecdsa.PrivateKey, error) {
 	block, _ := pem.Decode(pemBytes)
 	if block == nil {
 		return nil, fmt.Errorf("failed to decode PEM block")
 	}
-	return x509.ParseECPrivateKey(block.Bytes)
+	switch block.Type {
+	case "ENCRYPTED PRIVATE KEY":
+		if len(password) == 0 {
+			return nil, errors.New("the key is encrypted, but no password is set")
+		}
+		return pkcs8.ParsePKCS8PrivateKeyECDSA(block.Bytes, password)
+	case "EC PRIVATE KEY", "PRIVATE KEY":
+		// ExportKeyAsPEM writes SEC1 keys as "PRIVATE KEY"
+		if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+			return key, nil
+		}
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		ecdsaKey, ok := key.(*ecdsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("unsupported key type %T", key)
+		}
+		return ecdsaKey, nil
+	default:
+		return nil, fmt.Errorf("not a private key: %s", block.Type)
+	}
+}
+
+// Loads the public key from a PEM file holding either a public or a private key
+func LoadECDSAPublicKeyFromPEM(pemBytes []byte, password []byte) (*ecdsa.PublicKey, error) {
+	if privateKey, err := LoadECDSAPrivateKeyFromPEM(pemBytes, password); err == nil {
+		return &privateKey.PublicKey, nil
+	}
+	keys, err := ggu.LoadECDSAPublicKeys(pemBytes)
+	if err != nil {
+		return nil, err
+	}
+	return keys[0], nil
+}
+
+// Refuses key and password files that other users can access
+func checkSecretFileMode(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.Mode().Perm()&0o007 != 0 {
+		return fmt.Errorf("%s is accessible by other users (mode %s), run chmod o-rwx on it", path, info.Mode().Perm())
+	}
+	return nil
+}
+
+func ReadSecretFile(path string) ([]byte, error) {
+	err := checkSecretFileMode(path)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(path)
+}
+
+// The key used to sign tokens, and the keys of previous rotations, whose tokens are still accepted
+type JWTKeySet struct {
+	Signing  *ecdsa.PrivateKey
+	Previous []*ecdsa.PublicKey
+}
+
+// The public keys of the set, signing key first
+func (ks *JWTKeySet) PublicKeys() []*ecdsa.PublicKey {
+	return append([]*ecdsa.PublicKey{&ks.Signing.PublicKey}, ks.Previous...)
+}
+
+// Loads a directory of rotating keys: the last private key in alphabetical order signs the tokens,
+// and all the other keys (private, or public only for retired keys) are still accepted
+// Keys are named by date, like private_<date>.pem
+func LoadJWTKeysDir(dir string, password []byte) (*JWTKeySet, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+	slices.Sort(paths)
+
+	ks := &JWTKeySet{}
+	public := []*ecdsa.PublicKey{}
+	for _, path := range paths {
+		pemBytes, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		block, _ := pem.Decode(pemBytes)
+		if block == nil {
+			return nil, fmt.Errorf("%s: failed to decode PEM block", path)
+		}
+		if block.Type == "PUBLIC KEY" {
+			keys, err := ggu.LoadECDSAPublicKeys(pemBytes)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", path, err)
+			}
+			public = append(public, keys...)
+			continue
+		}
+		err = checkSecretFileMode(path)
+		if err != nil {
+			return nil, err
+		}
+		key, err := LoadECDSAPrivateKeyFromPEM(pemBytes, password)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if ks.Signing != nil {
+			public = append(public, &ks.Signing.PublicKey)
+		}
+		ks.Signing = key
+	}
+	if ks.Signing == nil {
+		return nil, fmt.Errorf("no private key in %s", dir)
+	}
+
+	// public_<date>.pem files next to their private key are skipped
+	for _, key := range public {
+		known := slices.ContainsFunc(ks.Previous, func(k *ecdsa.PublicKey) bool { return k.Equal(key) })
+		if !key.Equal(&ks.Signing.PublicKey) && !known {
+			ks.Previous = append(ks.Previous, key)
+		}
+	}
+	slices.Reverse(ks.Previous)
+	return ks, nil
+}
+
+// Writes a new key pair as private_<date>.pem and public_<date>.pem; the private key is encrypted if a password is given
+func WriteNewKeyPair(dir string, password []byte) (*ecdsa.PrivateKey, error) {
+	privateKey, publicKey, err := GenerateECDSAKeys()
+	if err != nil {
+		return nil, err
+	}
+	var privateKeyPEM []byte
+	if len(password) > 0 {
+		privateKeyPEM, err = ExportEncryptedKeyAsPEM(privateKey, password)
+	} else {
+		privateKeyPEM, err = ExportKeyAsPEM(privateKey)
+	}
+	if err != nil {
+		return nil, err
+	}
+	publicKeyPEM, err := ExportKeyAsPEM(publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	tnow := time.Now().UTC().Format(time.RFC3339)
+	err = os.WriteFile(filepath.Join(dir, "private_"+tnow+".pem"), privateKeyPEM, 0600)
+	if err != nil {
+		return nil, err
+	}
+	err = os.WriteFile(filepath.Join(dir, "public_"+tnow+".pem"), publicKeyPEM, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return privateKey, nil
+}
+
+// Where the JWT keys are loaded from, see LoadJWTKeys
+type JWTKeysConfig struct {
+	KeysDir        string `env:"CONFIG_JWT_KEYS_DIR"`
+	PrivateKeyFile string `env:"CONFIG_JWT_PRIVATE_KEY_FILE"`
+	PrivateKey     string `env:"CONFIG_JWT_PRIVATE_KEY" secret:"true"`
+	// the password of encrypted keys
+	PasswordFile string `env:"CONFIG_JWT_KEY_PASSWORD_FILE"`
+	Password     string `env:"CONFIG_JWT_KEY_PASSWORD" secret:"true"`
+}
+
+func jwtKeysConfigFromEnv() (*JWTKeysConfig, error) {
+	c := &JWTKeysConfig{}
+	err := config.Load(c, "", os.LookupEnv)
+	return c, err
+}
+
+// Exactly one of the key sources must be set
+func (c *JWTKeysConfig) checkSources() error {
+	set := 0
+	for _, v := range []string{c.KeysDir, c.PrivateKeyFile, c.PrivateKey} {
+		if v != "" {
+			set++
+		}
+	}
+	if set == 0 {
+		return errors.New("CONFIG_JWT_KEYS_DIR, CONFIG_JWT_PRIVATE_KEY_FILE or CONFIG_JWT_PRIVATE_KEY must be defined")
+	}
+	if set > 1 {
+		return errors.New("only one of CONFIG_JWT_KEYS_DIR, CONFIG_JWT_PRIVATE_KEY_FILE and CONFIG_JWT_PRIVATE_KEY can be defined")
+	}
+	return nil
+}
+
+// Reads the password of encrypted keys from PasswordFile, or Password
+func (c *JWTKeysConfig) password() ([]byte, error) {
+	if c.PasswordFile != "" {
+		password, err := ReadSecretFile(c.PasswordFile)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(strings.TrimRight(string(password), "\r\n")), nil
+	}
+	return []byte(c.Password), nil
+}
+
+// Reads the password of encrypted keys from CONFIG_JWT_KEY_PASSWORD_FILE or CONFIG_JWT_KEY_PASSWORD
+func loadJWTKeyPassword() ([]byte, error) {
+	c, err := jwtKeysConfigFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	return c.password()
+}
+
+// Loads the JWT keys from one of:
+//   - CONFIG_JWT_KEYS_DIR: a directory of rotating keys, see LoadJWTKeysDir
+//   - CONFIG_JWT_PRIVATE_KEY_FILE: a single key file
+//   - CONFIG_JWT_PRIVATE_KEY: the PEM itself, or "generate" to create a key in the working directory
+func LoadJWTKeys(c *JWTKeysConfig) (*JWTKeySet, error) {
+	err := c.checkSources()
+	if err != nil {
+		return nil, err
+	}
+	password, err := c.password()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the key password: %w", err)
+	}
+
+	switch {
+	case c.KeysDir != "":
+		return LoadJWTKeysDir(c.KeysDir, password)
+	case c.PrivateKeyFile != "":
+		pemBytes, err := ReadSecretFile(c.PrivateKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		key, err := LoadECDSAPrivateKeyFromPEM(pemBytes, password)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", c.PrivateKeyFile, err)
+		}
+		return &JWTKeySet{Signing: key}, nil
+	case c.PrivateKey == "generate":
+		if len(password) == 0 {
+			slog.Warn("Writing the generated private key unencrypted; set CONFIG_JWT_KEY_PASSWORD_FILE to encrypt it")
+		}
+		key, err := WriteNewKeyPair(".", password)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate keys: %w", err)
+		}
+		fingerprint, _ := ggu.KeyFingerprint(&key.PublicKey)
+		slog.With("fingerprint", fingerprint).Info("Generated ECDSA keys in the working directory")
+		return &JWTKeySet{Signing: key}, nil
+	default:
+		key, err := LoadECDSAPrivateKeyFromPEM([]byte(c.PrivateKey), password)
+		if err != nil {
+			return nil, fmt.Errorf("CONFIG_JWT_PRIVATE_KEY: %w", err)
+		}
+		return &JWTKeySet{Signing: key}, nil
+	}
+}
+
+// LoadJWTKeys, configured from the environment
+func LoadJWTKeysFromEnv() (*JWTKeySet, error) {
+	c, err := jwtKeysConfigFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	return LoadJWTKeys(c)
 }
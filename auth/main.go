@@ -1,129 +1,61 @@
+//go:build !hxi2ctl
+
 package main
 
 import (
+	"context"
 	"embed"
+	"errors"
+	"fmt"
 	"log/slog"
 	"net/http"
 	"os"
 	"strings"
 	"time"
 
-	_ "embed"
-
 	ggu "github.com/itsvyle/hxi2/global-go/utils"
-	"github.com/jmoiron/sqlx"
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/itsvyle/hxi2/global-go/utils/config"
+	"github.com/itsvyle/hxi2/global-go/utils/metrics"
 	"golang.org/x/oauth2"
 )
 
-const OneTimeCodeLength = 6
-
-var ConfigRunningPort = "8080"
-var ConfigDBPath = ""
-var ConfigJWTPrivateKey = ""
-var ConfigRedirectURL = ""
-var ConfigDiscordApplicationID = ""
-var ConfigDiscordClientID = ""
-var ConfigDiscordClientSecret = ""
-var ConfigDefaultLoginRedirect = "/"
-
-var HXI2AuthURL = ""
-var HXI2CookiesDomain = ""
-var HXI2TLD = ""
-
-var IsLocalDebugInstance = false
-
-var authManager *ggu.AuthManager
-var jwtManager *JWTManager
-var JWTValidityDuration = 10 * time.Minute
-var JWTRefreshTokenValidityDuration = 30 * 24 * time.Hour
-
-var discordOauthConfig *oauth2.Config
-
-var apiUsersCacher *ggu.Cacher[map[string]*DBApiUser]
-
-//go:embed schema.sql
-var sqlSchema string
-
-func init() {
-
-	ggu.InitGlobalSlog()
-
-	//#region Load from environment
-	fails := []string{}
-	fail := func(key string) {
-		fails = append(fails, key)
-	}
-	loadOrFail := func(key string) string {
-		v := os.Getenv(key)
-		if v == "" {
-			fail(key + " is not defined")
-		}
-		return v
-	}
-
-	if os.Getenv("CONFIG_RUNNING_PORT") != "" {
-		ConfigRunningPort = os.Getenv("CONFIG_RUNNING_PORT")
-	}
-	if os.Getenv("HXI2_COOKIES_DOMAIN") != "" {
-		HXI2CookiesDomain = os.Getenv("HXI2_COOKIES_DOMAIN")
-	}
-	if os.Getenv("CONFIG_DEFAULT_LOGIN_REDIRECT") != "" {
-		ConfigDefaultLoginRedirect = os.Getenv("CONFIG_DEFAULT_LOGIN_REDIRECT")
-	}
-	if os.Getenv("CONFIG_JWT_PRIVATE_KEY") != "" {
-		ConfigJWTPrivateKey = os.Getenv("CONFIG_JWT_PRIVATE_KEY")
-
-		if ConfigJWTPrivateKey == "generate" {
-			privateKey, publicKey, err := GenerateECDSAKeys()
-			if err != nil {
-				slog.With("error", err).Error("Failed to generate ECDSA keys")
-				panic(err)
-			}
-			privateKeyPEM, _ := ExportKeyAsPEM(privateKey)
-			publicKeyPEM, _ := ExportKeyAsPEM(publicKey)
-
-			tnow := time.Now().Format(time.RFC3339)
-
-			err = os.WriteFile("private_"+tnow+".pem", privateKeyPEM, 0600)
-			if err != nil {
-				slog.With("error", err).Error("Failed to write private key to file")
-				panic(err)
-			}
-			err = os.WriteFile("public_"+tnow+".pem", publicKeyPEM, 0600)
-			if err != nil {
-				slog.With("error", err).Error("Failed to write public key to file")
-				panic(err)
-			}
-
-			slog.Info("Generated ECDSA keys and saved to files private_" + tnow + ".pem and public_" + tnow + ".pem")
-
-			ConfigJWTPrivateKey = string(privateKeyPEM)
-		}
+type Config struct {
+	RunningPort          string `env:"CONFIG_RUNNING_PORT" default:"8080"`
+	DBPath               string `env:"CONFIG_DB_PATH" required:"true"`
+	DiscordClientID      string `env:"CONFIG_DISCORD_CLIENT_ID" required:"true"`
+	DiscordClientSecret  string `env:"CONFIG_DISCORD_CLIENT_SECRET" required:"true" secret:"true"`
+	DiscordBotToken      string `env:"CONFIG_DISCORD_BOT_TOKEN" secret:"true"`
+	DefaultLoginRedirect string `env:"CONFIG_DEFAULT_LOGIN_REDIRECT" default:"/"`
+	ProvisioningMode     string `env:"CONFIG_PROVISIONING_MODE" default:"off" oneof:"off|auto|approval"`
+	ProvisioningRules    string `env:"CONFIG_PROVISIONING_RULES"`
+	RoleSyncRules        string `env:"CONFIG_ROLE_SYNC_RULES"`
+	AuthURL              string `env:"HXI2_AUTH_URL" required:"true"`
+	AuthEndpoint         string `env:"HXI2_AUTH_ENDPOINT" required:"true"`
+	CookiesDomain        string `env:"HXI2_COOKIES_DOMAIN"`
+	TLD                  string `env:"HXI2_TLD" required:"true"`
+	LocalDebugInstance   bool   `env:"LOCAL_DEBUG_INSTANCE"`
+	JWTKeys              JWTKeysConfig
+	Statics              ggu.StaticsConfig
+}
 
-	} else {
-		fail("CONFIG_JWT_PRIVATE_KEY is not defined")
+func (c *Config) Validate() error {
+	errs := []error{c.JWTKeys.checkSources()}
+	if c.ProvisioningMode != ProvisioningOff && c.ProvisioningRules == "" {
+		errs = append(errs, errors.New("CONFIG_PROVISIONING_RULES is not defined, and is required when CONFIG_PROVISIONING_MODE isn't off"))
 	}
+	return errors.Join(errs...)
+}
 
-	ConfigDBPath = loadOrFail("CONFIG_DB_PATH")
-	ConfigDiscordApplicationID = loadOrFail("CONFIG_DISCORD_APPLICATION_ID")
-	ConfigDiscordClientID = loadOrFail("CONFIG_DISCORD_CLIENT_ID")
-	ConfigDiscordClientSecret = loadOrFail("CONFIG_DISCORD_CLIENT_SECRET")
-	HXI2AuthURL = loadOrFail("HXI2_AUTH_URL")
-	Hxi2AuthEndpoint := loadOrFail("HXI2_AUTH_ENDPOINT")
-	HXI2TLD = loadOrFail("HXI2_TLD")
-
-	IsLocalDebugInstance = os.Getenv("LOCAL_DEBUG_INSTANCE") == "1"
-
-	ConfigRedirectURL = HXI2AuthURL + "/api/discord_callback"
+func setup(cfg *Config) error {
+	HXI2CookiesDomain = cfg.CookiesDomain
+	ConfigDefaultLoginRedirect = cfg.DefaultLoginRedirect
+	ConfigProvisioningMode = cfg.ProvisioningMode
+	IsLocalDebugInstance = cfg.LocalDebugInstance
 
-	if len(fails) > 0 {
-		for _, f := range fails {
-			slog.Error(f)
-		}
-		panic("Failed to load configuration")
+	jwtKeys, err := LoadJWTKeys(&cfg.JWTKeys)
+	if err != nil {
+		return fmt.Errorf("failed to load the JWT keys: %w", err)
 	}
-	//#endregion
 
 	//#region Start database
 
@@ -134,27 +66,38 @@ func init() {
 	// 		panic(err)
 	// 	}
 	// }
-	sqlDB, err := sqlx.Open("sqlite3", ConfigDBPath)
-	if err != nil {
-		slog.With("error", err).Error("Failed to open database")
-		panic(err)
-	}
-	err = sqlDB.Ping()
+	DB, err = OpenDatabase(cfg.DBPath)
 	if err != nil {
-		slog.With("error", err).Error("Failed to ping database")
-		panic(err)
+		return fmt.Errorf("failed to open database: %w", err)
 	}
 
-	sqlDB.MustExec(sqlSchema)
+	slog.With("file", cfg.DBPath).Info("Connected to database")
 
-	DB = &DatabaseManager{
-		DB:     sqlDB,
-		logger: ggu.GetServiceSpecificLogger("DB", "\033[38;5;226m"),
+	err = DB.SeedPromotions()
+	if err != nil {
+		return fmt.Errorf("failed to seed promotions: %w", err)
 	}
-
-	slog.With("file", ConfigDBPath).Info("Connected to database")
+	err = DB.SeedProjects(cfg.TLD)
+	if err != nil {
+		return fmt.Errorf("failed to seed projects: %w", err)
+	}
+	refreshPromotionsRange()
 	//#endregion
 
+	// validated against the promotions of the database, which rollovers extend
+	if cfg.ProvisioningMode != ProvisioningOff {
+		provisioningConfig, err = LoadProvisioningConfig(cfg.ProvisioningRules)
+		if err != nil {
+			return err
+		}
+	}
+	if cfg.RoleSyncRules != "" {
+		roleSyncConfig, err = LoadRoleSyncConfig(cfg.RoleSyncRules)
+		if err != nil {
+			return err
+		}
+	}
+
 	// #region Cachers
 	apiUsersCacher = ggu.NewCacher("apiUsersCacher", func() (map[string]*DBApiUser, error) {
 		a, err := DB.ListAPIUsers()
@@ -168,13 +111,16 @@ func init() {
 		return m, nil
 	}, 30*time.Second, 0)
 
+	projectsCacher = ggu.NewCacher("projectsCacher", func() ([]DBProject, error) {
+		return DB.ListProjects()
+	}, 30*time.Second, 0)
+
 	// #endregion
 
 	//#region Create JWT manager
-	jwtManager, err = NewJWTManager(ConfigJWTPrivateKey, JWTValidityDuration, JWTRefreshTokenValidityDuration)
+	jwtManager, err = NewJWTManager(jwtKeys, JWTValidityDuration, JWTRefreshTokenValidityDuration)
 	if err != nil {
-		slog.With("error", err).Error("Failed to create JWT manager")
-		panic(err)
+		return fmt.Errorf("failed to create JWT manager: %w", err)
 	}
 	//#endregion
 
@@ -183,12 +129,12 @@ func init() {
 	a := &ggu.AuthManager{
 		Logger:       ggu.GetAuthLogger(),
 		AutoFetchKey: false,
-		AuthURL:      HXI2AuthURL,
-		AuthEndpoint: Hxi2AuthEndpoint,
-		LoginPageURL: HXI2AuthURL + "/login",
+		AuthURL:      cfg.AuthURL,
+		AuthEndpoint: cfg.AuthEndpoint,
+		LoginPageURL: cfg.AuthURL + "/login",
 		CookieDomain: HXI2CookiesDomain,
-		RenewToken: func(_ *ggu.AuthManager, oldToken, refreshToken string) (res *ggu.AuthRenewalResponse, err error) {
-			return RenewTokenActionner(oldToken, refreshToken)
+		RenewToken: func(ctx context.Context, _ *ggu.AuthManager, oldToken, refreshToken string) (res *ggu.AuthRenewalResponse, err error) {
+			return RenewTokenActionner(ctx, oldToken, refreshToken)
 		},
 	}
 	authManager, err = ggu.NewAuthManagerPublicKey(
@@ -196,17 +142,21 @@ func init() {
 		jwtManager.PublicKeyPEM,
 	)
 	if err != nil {
-		slog.With("error", err).Error("Failed to create auth manager")
-		panic(err)
+		return fmt.Errorf("failed to create auth manager: %w", err)
 	}
 	//#endregion
 
 	//#region Create oauth2 manager
+	discordScopes := []string{"identify"}
+	if ConfigProvisioningMode != ProvisioningOff {
+		// to check the server membership and roles of unknown users
+		discordScopes = append(discordScopes, "guilds.members.read")
+	}
 	discordOauthConfig = &oauth2.Config{
-		ClientID:     ConfigDiscordClientID,
-		ClientSecret: ConfigDiscordClientSecret,
-		RedirectURL:  ConfigRedirectURL,
-		Scopes:       []string{"identify"},
+		ClientID:     cfg.DiscordClientID,
+		ClientSecret: cfg.DiscordClientSecret,
+		RedirectURL:  cfg.AuthURL + "/api/discord_callback",
+		Scopes:       discordScopes,
 		Endpoint: oauth2.Endpoint{
 			AuthURL:  "https://discord.com/api/oauth2/authorize",
 			TokenURL: "https://discord.com/api/oauth2/token",
@@ -215,37 +165,68 @@ func init() {
 	//#endregion
 
 	//#region Create discord bot
-	if os.Getenv("CONFIG_DISCORD_BOT_TOKEN") != "" {
-		discordBot, err := NewDiscordBot(os.Getenv("CONFIG_DISCORD_BOT_TOKEN"))
+	if cfg.DiscordBotToken != "" {
+		globalDiscordBot, err = NewDiscordBot(cfg.DiscordBotToken)
 		if err != nil {
-			slog.With("error", err).Error("Failed to create discord bot")
-			panic(err)
+			return fmt.Errorf("failed to create discord bot: %w", err)
+		}
+		err = globalDiscordBot.Start()
+		if err != nil {
+			slog.With("error", err).Error("Failed to start discord bot")
 		}
-		err = discordBot.Start()
 	}
 	//#endregion
+	return nil
 }
 
 //go:embed dist/*
 var staticsFS embed.FS
 
 func main() {
-	DB.StartOneTimeCodeCleanupTimer()
+	ggu.InitGlobalSlog()
+	var cfg Config
+	config.MustLoad(&cfg)
+	err := setup(&cfg)
+	if err != nil {
+		slog.With("error", err).Error("Failed to start")
+		os.Exit(1)
+	}
+
+	lc := ggu.NewLifecycle()
+	lc.OnShutdown("database", DB.DB.Close)
+	lc.OnShutdown("cachers", func() error {
+		apiUsersCacher.Stop()
+		projectsCacher.Stop()
+		return nil
+	})
+	if globalDiscordBot != nil {
+		lc.OnShutdown("discord bot", globalDiscordBot.Stop)
+	}
+	lc.OnShutdown("auth manager", authManager.Close)
+
+	lc.Every("one-time codes cleanup", 5*time.Minute, DB.CleanupExpiredOneTimeCodes)
+	webhookDispatcher = NewWebhookDispatcher(DB)
+	lc.Go("webhook dispatcher", webhookDispatcher.Run)
 
 	slog.Info("Starting auth-backend")
 	router := http.NewServeMux()
 
 	server := &http.Server{
-		Addr:              ":" + ConfigRunningPort,
-		Handler:           router,
+		Addr:              ":" + cfg.RunningPort,
+		Handler:           ggu.RequestLoggingMiddleware(metrics.Middleware(router)),
 		ReadHeaderTimeout: 5 * time.Second,
 	}
 
-	staticsManager := ggu.NewStaticFilesManager(
+	staticsManager := ggu.NewStaticFilesManagerFromConfig(
+		cfg.Statics,
 		staticsFS,
 		"dist",
-		ggu.StaticsDefaultContentSecurityPolicy(HXI2TLD),
+		ggu.DefaultContentSecurityPolicy(cfg.TLD),
 	)
+	contentSecurityPolicy = staticsManager.ContentSecurityPolicy()
+	lc.Go("statics watcher", staticsManager.RunDevWatcher)
+	staticsManager.MountDevRoutes(router)
+	staticsManager.MountCSPReportRoute(router)
 
 	loginHTML, loginJS, loginCSS := staticsManager.WholeRouteHandlers("login")
 	redirectCookOpts := &ggu.OverwriteCookieOptions{
@@ -261,7 +242,7 @@ func main() {
 			if code != "" {
 				tryQuickRedirect := func() bool {
 					redirectTo := r.URL.Query().Get("redirectTo")
-					if redirectTo == "" {
+					if redirectTo == "" || !IsAllowedRedirect(redirectTo) {
 						return false
 					}
 					http.Redirect(w, r, redirectTo, http.StatusFound)
@@ -295,28 +276,16 @@ func main() {
 				redirectToCookie, err := r.Cookie("authRedirectTo")
 				if err != nil || redirectToCookie == nil || redirectToCookie.Value == "" {
 					redirectTo = r.URL.Query().Get("redirectTo")
-					if redirectTo == "" {
-						redirectTo = ConfigDefaultLoginRedirect
-					}
 				} else {
 					redirectTo = redirectToCookie.Value
 				}
 
-				body := "<html><head><meta http-equiv=\"refresh\" content=\"0; url=" + redirectTo + "\"></head><body>Redirecting...</body></html>"
-				w.Header().Set("Content-Type", "text/html; charset=utf-8")
-				w.WriteHeader(http.StatusOK)
-				_, err = w.Write([]byte(body))
-				if err != nil {
-					slog.With("error", err).Error("Failed to write redirect response")
-				}
+				writeRedirectPage(w, SafeRedirect(redirectTo))
 				return
 			}
 		}
 
-		redirectTo := r.URL.Query().Get("redirectTo")
-		if redirectTo == "" {
-			redirectTo = ConfigDefaultLoginRedirect
-		}
+		redirectTo := SafeRedirect(r.URL.Query().Get("redirectTo"))
 
 		http.SetCookie(w, ggu.GenerateCookieObject("authRedirectTo", redirectTo, 30*time.Minute, redirectCookOpts))
 
@@ -335,12 +304,34 @@ func main() {
 	router.Handle("GET /temp_login", http.HandlerFunc(HandleTempLogin))
 	router.Handle("POST /api/temp_renew", http.HandlerFunc(HandleTempRenew))
 
+	// the handlers authenticate the users themselves, so the tokens aren't bound to them; scripts should use a bearer token instead
+	csrf := ggu.NewCSRFProtection()
+	router.Handle("GET "+ggu.CSRFTokenPath, http.HandlerFunc(csrf.HandleToken))
+	router.Handle("POST /api/me/delete", csrf.Protect(http.HandlerFunc(HandleRequestAccountDeletion)))
+
 	router.Handle("GET /api/project/list_users", http.HandlerFunc(ProjectHandleListUsers))
+	router.Handle("GET /api/project/deletions", http.HandlerFunc(ProjectHandleListDeletions))
+	router.Handle("POST /api/project/deletions/ack", http.HandlerFunc(ProjectHandleAckDeletion))
+	router.Handle("GET /api/project/promotions", http.HandlerFunc(ProjectHandleListPromotions))
+
+	router.Handle("POST /api/admin/rollover", csrf.Protect(http.HandlerFunc(HandleRolloverPreview)))
+	router.Handle("POST /api/admin/rollover/{id}/apply", csrf.Protect(HandleRolloverRun(false)))
+	router.Handle("POST /api/admin/rollover/{id}/revert", csrf.Protect(HandleRolloverRun(true)))
 
 	router.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, "/login", http.StatusFound)
 	}))
 
-	slog.With("port", ConfigRunningPort).Info("Server is running")
-	slog.With("error", server.ListenAndServe()).Error("Server crashed")
+	authManager.MountMetrics(router)
+
+	health := ggu.NewHealthRegistry()
+	health.AddReadinessCheck("database", DB.DB.PingContext)
+	health.AddReadinessCheck("apiUsersCacher", apiUsersCacher.HealthCheck)
+	health.AddReadinessCheck("projectsCacher", projectsCacher.HealthCheck)
+	health.Mount(router)
+
+	slog.With("port", cfg.RunningPort).Info("Server is running")
+	if err := lc.Serve(server); err != nil {
+		os.Exit(1)
+	}
 }
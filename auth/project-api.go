@@ -1,7 +1,9 @@
 package main
 
 import (
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"log/slog"
 	"net/http"
 
@@ -9,39 +11,78 @@ import (
 )
 
 func checkProjectApiAuth(w http.ResponseWriter, r *http.Request, necessaryPerms int) bool {
-	if IsLocalDebugInstance {
-		return true
+	_, ok := getProjectApiUser(w, r, necessaryPerms)
+	return ok
+}
+
+// Same as checkProjectApiAuth, but also returns the project making the request
+// On a local debug instance, requests without a valid token are attributed to a placeholder project with ID 0
+func getProjectApiUser(w http.ResponseWriter, r *http.Request, necessaryPerms int) (*DBApiUser, bool) {
+	localDebugUser := &DBApiUser{Username: "local-debug", Permissions: -1}
+	unauthorized := func() (*DBApiUser, bool) {
+		if IsLocalDebugInstance {
+			return localDebugUser, true
+		}
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return nil, false
 	}
+
 	authHeader := r.Header.Get("Authorization")
 	if authHeader == "" {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return false
+		return unauthorized()
 	}
 
 	if len(authHeader) < 7 || authHeader[:7] != "Bearer " {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return false
+		return unauthorized()
 	}
 
 	token := authHeader[7:]
 	apiUsers, err := apiUsersCacher.Get()
 	if err != nil {
+		if IsLocalDebugInstance {
+			return localDebugUser, true
+		}
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		return false
+		return nil, false
 	}
 	apiUser, ok := (*apiUsers)[token]
 	if !ok {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return false
+		return unauthorized()
 	}
 
 	if !apiUser.HasPermission(necessaryPerms) {
+		if IsLocalDebugInstance {
+			return apiUser, true
+		}
 		slog.With("user", apiUser.Username, "url", r.URL.Path, "needsPerms", necessaryPerms).Warn("Forbidden access to project API, but token is valid")
 		http.Error(w, "Forbidden", http.StatusForbidden)
-		return false
+		return nil, false
 	}
 
-	return true
+	return apiUser, true
+}
+
+// Same as getProjectApiUser, but returns the project the API key is linked to; responds 403 if it isn't linked to one
+// The placeholder of a local debug instance gets a placeholder project with ID 0
+func getProjectOfApiUser(w http.ResponseWriter, r *http.Request, necessaryPerms int) (*DBProject, bool) {
+	apiUser, ok := getProjectApiUser(w, r, necessaryPerms)
+	if !ok {
+		return nil, false
+	}
+	if apiUser.ID == 0 && IsLocalDebugInstance {
+		return &DBProject{Name: apiUser.Username}, true
+	}
+	project, err := DB.GetProjectByAPIToken(apiUser.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		slog.With("user", apiUser.Username, "url", r.URL.Path).Warn("API token isn't linked to a project")
+		http.Error(w, "This API key isn't linked to a project", http.StatusForbidden)
+		return nil, false
+	} else if err != nil {
+		slog.With("error", err, "user", apiUser.Username).Error("Failed to get the project of an API token")
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return nil, false
+	}
+	return project, true
 }
 
 func ProjectHandleListUsers(w http.ResponseWriter, r *http.Request) {
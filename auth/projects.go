@@ -0,0 +1,202 @@
+package main
+
+import (
+	"database/sql"
+	"html"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A project (tree, parrainsup...) registered in the auth service
+// Users can only be redirected to the origins of registered projects after logging in
+// The project API key linked to it identifies the project in its webhooks and deletion acknowledgements
+type DBProject struct {
+	ID              int64     `db:"ID" json:"id"`
+	Name            string    `db:"name" json:"name"`
+	RedirectOrigins string    `db:"redirect_origins" json:"redirectOrigins"`
+	GuestUsernames  string    `db:"guest_usernames" json:"guestUsernames"`
+	DefaultRedirect string    `db:"default_redirect" json:"defaultRedirect"`
+	APITokenID      *int64    `db:"api_token_id" json:"apiTokenID"`
+	CreatedAt       time.Time `db:"created_at" json:"createdAt"`
+}
+
+func splitCommaList(list string) []string {
+	res := []string{}
+	for _, v := range strings.Split(list, ",") {
+		v = strings.TrimSpace(v)
+		if v != "" {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
+func (p *DBProject) AllowsOrigin(origin string) bool {
+	for _, o := range splitCommaList(p.RedirectOrigins) {
+		if strings.EqualFold(strings.TrimSuffix(o, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *DBProject) AllowsGuest(username string) bool {
+	for _, u := range splitCommaList(p.GuestUsernames) {
+		if u == username {
+			return true
+		}
+	}
+	return false
+}
+
+func (db *DatabaseManager) ListProjects() ([]DBProject, error) {
+	projects := []DBProject{}
+	err := db.DB.Select(&projects, "SELECT * FROM PROJECTS ORDER BY ID")
+	if err != nil {
+		db.logger.With("error", err).Error("Failed to list projects")
+		return nil, err
+	}
+	return projects, nil
+}
+
+func (db *DatabaseManager) CreateProject(p *DBProject) error {
+	res, err := db.DB.Exec("INSERT INTO PROJECTS (name, redirect_origins, guest_usernames, default_redirect, api_token_id) VALUES (?, ?, ?, ?, ?)",
+		p.Name, p.RedirectOrigins, p.GuestUsernames, p.DefaultRedirect, p.APITokenID)
+	if err != nil {
+		db.logger.With("error", err, "name", p.Name).Error("Failed to create project")
+		return err
+	}
+	p.ID, err = res.LastInsertId()
+	return err
+}
+
+// Links the project to an API key, or unlinks it with nil; a key can only be linked to one project
+func (db *DatabaseManager) SetProjectAPIToken(projectID int64, apiTokenID *int64) error {
+	res, err := db.DB.Exec("UPDATE PROJECTS SET api_token_id = ? WHERE ID = ?", apiTokenID, projectID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// Returns the project the API key is linked to, or sql.ErrNoRows
+func (db *DatabaseManager) GetProjectByAPIToken(apiTokenID int64) (*DBProject, error) {
+	p := &DBProject{}
+	err := db.DB.Get(p, "SELECT * FROM PROJECTS WHERE api_token_id = ?", apiTokenID)
+	return p, err
+}
+
+// The projects of hxi2, on the subdomains of tld: registered when the table is empty, so that the redirects to them
+// work right after a deploy; each is linked to the API key with its name, if there is one
+func DefaultProjects(tld string) []DBProject {
+	return []DBProject{
+		{Name: "pages", RedirectOrigins: "https://" + tld},
+		{Name: "tree", RedirectOrigins: "https://tree." + tld},
+		{Name: "parrainsup", RedirectOrigins: "https://parrainsup." + tld, GuestUsernames: "parrainsup", DefaultRedirect: "https://parrainsup." + tld},
+	}
+}
+
+func (db *DatabaseManager) SeedProjects(tld string) error {
+	var count int
+	err := db.DB.Get(&count, "SELECT COUNT(*) FROM PROJECTS")
+	if err != nil || count > 0 {
+		return err
+	}
+	apiUsers, err := db.ListAPIUsers()
+	if err != nil {
+		return err
+	}
+	for _, p := range DefaultProjects(tld) {
+		for _, a := range apiUsers {
+			if a.Username == p.Name {
+				p.APITokenID = &a.ID
+			}
+		}
+		if err = db.CreateProject(&p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Finds a project by its ID or its name
+func FindProject(idOrName string) (*DBProject, error) {
+	projects, err := projectsCacher.Get()
+	if err != nil {
+		return nil, err
+	}
+	id, idErr := strconv.ParseInt(idOrName, 10, 64)
+	for i := range *projects {
+		p := &(*projects)[i]
+		if (idErr == nil && p.ID == id) || p.Name == idOrName {
+			return p, nil
+		}
+	}
+	return nil, nil
+}
+
+// Whether users can be redirected to rawURL after logging in:
+// either a path on the auth service itself, or a URL on the origin of a registered project
+func IsAllowedRedirect(rawURL string) bool {
+	if rawURL == "" {
+		return false
+	}
+	parsedURL, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+	if !parsedURL.IsAbs() {
+		// "//evil.com" and "/\evil.com" are treated as absolute by browsers
+		return parsedURL.Host == "" && strings.HasPrefix(rawURL, "/") && !strings.HasPrefix(rawURL, "//") && !strings.HasPrefix(rawURL, "/\\")
+	}
+	if parsedURL.Scheme != "https" && parsedURL.Scheme != "http" {
+		return false
+	}
+	origin := parsedURL.Scheme + "://" + parsedURL.Host
+
+	if d, err := url.Parse(ConfigDefaultLoginRedirect); err == nil && d.IsAbs() && strings.EqualFold(d.Scheme+"://"+d.Host, origin) {
+		return true
+	}
+
+	projects, err := projectsCacher.Get()
+	if err != nil {
+		slog.With("error", err).Error("Failed to get projects to check redirect")
+		return false
+	}
+	for i := range *projects {
+		if (*projects)[i].AllowsOrigin(origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns redirectTo if it is allowed, the default login redirect otherwise
+func SafeRedirect(redirectTo string) string {
+	if redirectTo == "" {
+		return ConfigDefaultLoginRedirect
+	}
+	if !IsAllowedRedirect(redirectTo) {
+		slog.With("redirectTo", redirectTo).Warn("Refused redirect to an unregistered origin")
+		return ConfigDefaultLoginRedirect
+	}
+	return redirectTo
+}
+
+// Redirects through a meta refresh page; redirectTo must already have been validated
+func writeRedirectPage(w http.ResponseWriter, redirectTo string) {
+	body := "<html><head><meta http-equiv=\"refresh\" content=\"0; url=" + html.EscapeString(redirectTo) + "\"></head><body>Redirecting...</body></html>"
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	_, err := w.Write([]byte(body))
+	if err != nil {
+		slog.With("error", err).Error("Failed to write redirect response")
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	ggu "github.com/itsvyle/hxi2/global-go/utils"
+)
+
+func TestSeedProjectsLinksAPITokens(t *testing.T) {
+	openTestDatabase(t)
+	tree, err := DB.CreateAPIUser("tree", ggu.APIRoleListUsers, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := DB.SeedProjects("hxi2.test"); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := DB.GetProjectByAPIToken(tree.ID)
+	if err != nil || p.Name != "tree" {
+		t.Fatalf("project of the tree token: %+v, %v", p, err)
+	}
+	projects, _ := DB.ListProjects()
+	for _, p := range projects {
+		if p.Name != "tree" && p.APITokenID != nil {
+			t.Errorf("%s was linked to the token %d", p.Name, *p.APITokenID)
+		}
+	}
+
+	// revoking the token unlinks it
+	if err := DB.DeleteAPIUser(tree.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DB.GetProjectByAPIToken(tree.ID); err == nil {
+		t.Error("the project is still linked to the revoked token")
+	}
+}
+
+func TestDeletionAcksByProject(t *testing.T) {
+	openTestDatabase(t)
+	if err := DB.SeedProjects("hxi2.test"); err != nil {
+		t.Fatal(err)
+	}
+	projects, _ := DB.ListProjects()
+	// only the projects linked to a key with APIRoleAccountDeletion have to acknowledge
+	deleting, err := DB.CreateAPIUser("tree-key", ggu.APIRoleAccountDeletion, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listing, err := DB.CreateAPIUser("parrainsup-key", ggu.APIRoleListUsers, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := DB.SetProjectAPIToken(projects[1].ID, &deleting.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := DB.SetProjectAPIToken(projects[2].ID, &listing.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := DB.CreateDeletionRequest(42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := DB.ConfirmDeletionRequest(d.ID, 1); err != nil {
+		t.Fatal(err)
+	}
+	if missing, _ := DB.ListDeletionMissingAcks(d.ID); !slices.Equal(missing, []string{projects[1].Name}) {
+		t.Fatalf("missing acks: %v", missing)
+	}
+	if pending, _ := DB.ListPendingDeletionsForProject(projects[1].ID); len(pending) != 1 {
+		t.Fatalf("pending deletions of %s: %v", projects[1].Name, pending)
+	}
+
+	if err := DB.AckDeletion(d.ID, projects[1].ID); err != nil {
+		t.Fatal(err)
+	}
+	if missing, _ := DB.ListDeletionMissingAcks(d.ID); len(missing) != 0 {
+		t.Fatalf("missing acks after the ack: %v", missing)
+	}
+	if pending, _ := DB.ListPendingDeletionsForProject(projects[1].ID); len(pending) != 0 {
+		t.Fatalf("pending deletions after the ack: %v", pending)
+	}
+}
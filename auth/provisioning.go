@@ -0,0 +1,396 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	ggu "github.com/itsvyle/hxi2/global-go/utils"
+	"golang.org/x/oauth2"
+)
+
+// Provisioning creates the account of unknown users on their first login, if they are in the HXi² Discord server with a mapped role
+// It is opt-in: by default, students must be created by an admin with /create
+
+const (
+	ProvisioningOff = "off"
+	// accounts are created right away
+	ProvisioningAuto = "auto"
+	// accounts are put in PENDING_USERS, and created once an admin approves them with /pending
+	ProvisioningApproval = "approval"
+)
+
+var ErrProvisioningNotEligible = errors.New("user is not in the server with a mapped role")
+var ErrProvisioningPending = errors.New("account is waiting for approval")
+
+type ProvisioningRule struct {
+	RoleID      string `json:"role_id"`
+	Promotion   int    `json:"promotion"`
+	Permissions int    `json:"permissions"`
+}
+
+type ProvisioningConfig struct {
+	GuildID string `json:"guild_id"`
+	// The first rule matching one of the user's roles is used
+	Rules []ProvisioningRule `json:"rules"`
+}
+
+var ConfigProvisioningMode = ProvisioningOff
+var provisioningConfig *ProvisioningConfig
+
+func LoadProvisioningConfig(path string) (*ProvisioningConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var pc ProvisioningConfig
+	err = json.Unmarshal(data, &pc)
+	if err != nil {
+		return nil, fmt.Errorf("invalid provisioning rules: %w", err)
+	}
+	if pc.GuildID == "" {
+		return nil, errors.New("provisioning rules: guild_id is missing")
+	}
+	if len(pc.Rules) == 0 {
+		return nil, errors.New("provisioning rules: no rule defined")
+	}
+	minp, maxp := ggu.GetPromotionsRange()
+	for i := range pc.Rules {
+		rule := &pc.Rules[i]
+		if rule.RoleID == "" {
+			return nil, fmt.Errorf("provisioning rules: rule %d has no role_id", i)
+		}
+		if rule.Promotion < minp || rule.Promotion > maxp {
+			return nil, fmt.Errorf("provisioning rules: rule %d has an invalid promotion %d", i, rule.Promotion)
+		}
+		if rule.Permissions == 0 {
+			rule.Permissions = ggu.RoleStudent
+		}
+	}
+	return &pc, nil
+}
+
+func (pc *ProvisioningConfig) MatchRoles(roles []string) *ProvisioningRule {
+	for i := range pc.Rules {
+		for _, role := range roles {
+			if pc.Rules[i].RoleID == role {
+				return &pc.Rules[i]
+			}
+		}
+	}
+	return nil
+}
+
+type DiscordGuildMember struct {
+	Nick  string   `json:"nick"`
+	Roles []string `json:"roles"`
+}
+
+// Fetches the user's membership in the guild, with the guilds.members.read scope; returns nil if the user isn't in the guild
+func fetchDiscordGuildMember(token *oauth2.Token, guildID string) (*DiscordGuildMember, error) {
+	resp, body, err := ggu.GetWithAuthorizationHeader("https://discord.com/api/users/@me/guilds/"+guildID+"/member", fmt.Sprintf("%s %s", token.TokenType, token.AccessToken))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status code not OK: %s", resp.Status)
+	}
+	member := &DiscordGuildMember{}
+	err = json.Unmarshal([]byte(body), member)
+	if err != nil {
+		return nil, err
+	}
+	return member, nil
+}
+
+// Creates the account of a user logging in for the first time, or puts it in the pending list
+// Returns ErrProvisioningNotEligible or ErrProvisioningPending when the user can't log in yet
+func ProvisionDiscordUser(token *oauth2.Token, dai *DiscordAuthorizationInfo) (*DBUser, error) {
+	rejected, err := DB.IsRejectedUser(dai.ID)
+	if err != nil {
+		return nil, err
+	}
+	if rejected {
+		return nil, ErrProvisioningNotEligible
+	}
+	member, err := fetchDiscordGuildMember(token, provisioningConfig.GuildID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get guild member: %w", err)
+	}
+	if member == nil {
+		return nil, ErrProvisioningNotEligible
+	}
+	rule := provisioningConfig.MatchRoles(member.Roles)
+	if rule == nil {
+		return nil, ErrProvisioningNotEligible
+	}
+
+	firstName := dai.GlobalName
+	if firstName == "" {
+		firstName = member.Nick
+	}
+	if firstName == "" {
+		firstName = dai.Username
+	}
+
+	if ConfigProvisioningMode == ProvisioningApproval {
+		err = DB.AddPendingUser(&DBPendingUser{
+			DiscordID:     dai.ID,
+			Username:      dai.Username,
+			FirstName:     firstName,
+			Promotion:     rule.Promotion,
+			Permissions:   rule.Permissions,
+			MatchedRoleID: rule.RoleID,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return nil, ErrProvisioningPending
+	}
+
+	user := &DBUser{
+		DiscordID:   dai.ID,
+		Username:    dai.Username,
+		FirstName:   firstName,
+		Promotion:   rule.Promotion,
+		Permissions: rule.Permissions,
+	}
+	err = DB.CreateNewUser(user)
+	if err != nil {
+		return nil, err
+	}
+	DB.logger.With("userID", user.ID, "discordID", user.DiscordID, "roleID", rule.RoleID).Info("Provisioned new user")
+	EmitUserCreated(user)
+	return user, nil
+}
+
+type DBPendingUser struct {
+	ID            int64     `db:"ID" json:"id"`
+	DiscordID     string    `db:"discord_id" json:"discordID"`
+	Username      string    `db:"username" json:"username"`
+	FirstName     string    `db:"first_name" json:"firstName"`
+	Promotion     int       `db:"promotion" json:"promotion"`
+	Permissions   int       `db:"permissions" json:"permissions"`
+	MatchedRoleID string    `db:"matched_role_id" json:"matchedRoleID"`
+	RequestedAt   time.Time `db:"requested_at" json:"requestedAt"`
+}
+
+// Adds the user to the pending list, or refreshes its entry if it is already there
+func (db *DatabaseManager) AddPendingUser(p *DBPendingUser) error {
+	_, err := db.DB.Exec(`
+		INSERT INTO PENDING_USERS (discord_id, username, first_name, promotion, permissions, matched_role_id, requested_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(discord_id) DO UPDATE SET
+			username = excluded.username, first_name = excluded.first_name, promotion = excluded.promotion,
+			permissions = excluded.permissions, matched_role_id = excluded.matched_role_id
+	`, p.DiscordID, p.Username, p.FirstName, p.Promotion, p.Permissions, p.MatchedRoleID, time.Now().UTC())
+	return err
+}
+
+func (db *DatabaseManager) ListPendingUsers() ([]DBPendingUser, error) {
+	pending := []DBPendingUser{}
+	err := db.DB.Select(&pending, "SELECT * FROM PENDING_USERS ORDER BY ID")
+	return pending, err
+}
+
+func (db *DatabaseManager) GetPendingUser(id int64) (*DBPendingUser, error) {
+	p := &DBPendingUser{}
+	err := db.DB.Get(p, "SELECT * FROM PENDING_USERS WHERE ID = ?", id)
+	return p, err
+}
+
+func (db *DatabaseManager) DeletePendingUser(id int64) error {
+	_, err := db.DB.Exec("DELETE FROM PENDING_USERS WHERE ID = ?", id)
+	return err
+}
+
+// Removes the user from the pending list, and records the rejection so they aren't added back on their next login
+func (db *DatabaseManager) RejectPendingUser(id int64, adminID int64) (*DBPendingUser, error) {
+	p, err := db.GetPendingUser(id)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := db.DB.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	_, err = tx.Exec("INSERT INTO REJECTED_USERS (discord_id, username, rejected_by, rejected_at) VALUES (?, ?, ?, ?) ON CONFLICT(discord_id) DO NOTHING",
+		p.DiscordID, p.Username, adminID, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec("DELETE FROM PENDING_USERS WHERE ID = ?", id)
+	if err != nil {
+		return nil, err
+	}
+	return p, tx.Commit()
+}
+
+func (db *DatabaseManager) IsRejectedUser(discordID string) (bool, error) {
+	var count int
+	err := db.DB.Get(&count, "SELECT COUNT(*) FROM REJECTED_USERS WHERE discord_id = ?", discordID)
+	return count > 0, err
+}
+
+func (db *DatabaseManager) ApprovePendingUser(id int64) (*DBUser, error) {
+	p, err := db.GetPendingUser(id)
+	if err != nil {
+		return nil, err
+	}
+	user := &DBUser{
+		DiscordID:   p.DiscordID,
+		Username:    p.Username,
+		FirstName:   p.FirstName,
+		Promotion:   p.Promotion,
+		Permissions: p.Permissions,
+	}
+	err = db.CreateNewUser(user)
+	if err != nil {
+		return nil, err
+	}
+	err = db.DeletePendingUser(id)
+	if err != nil {
+		db.logger.With("error", err, "pendingID", id).Error("Failed to remove approved user from the pending list")
+	}
+	return user, nil
+}
+
+func (discordBot *DiscordBot) addCommandPending() {
+	const cmdName = "pending"
+	var p int64 = discordgo.PermissionAdministrator | discordgo.PermissionManageRoles | discordgo.PermissionManageGuild
+
+	var command = &discordgo.ApplicationCommand{
+		Name:                     cmdName,
+		Description:              "Manage the accounts waiting for approval",
+		DefaultMemberPermissions: &p,
+		Options: []*discordgo.ApplicationCommandOption{
+			{
+				Type:        discordgo.ApplicationCommandOptionString,
+				Name:        "action",
+				Description: "What to do",
+				Required:    true,
+				Choices: []*discordgo.ApplicationCommandOptionChoice{
+					{Name: "list", Value: "list"},
+					{Name: "approve", Value: "approve"},
+					{Name: "reject", Value: "reject"},
+				},
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionInteger,
+				Name:        "id",
+				Description: "The ID of the pending account, for approve and reject",
+				Required:    false,
+			},
+		},
+	}
+
+	hand := func(session *discordgo.Session, interaction *discordgo.InteractionCreate) {
+		admin, err := discordBot.GetInteractionClaims(interaction)
+		if err != nil || admin == nil {
+			discordBot.RespondWithError(interaction, "Failed to get user claims")
+			return
+		}
+		if !admin.IsAdmin() {
+			discordBot.RespondWithError(interaction, "You do not have permission to use this command")
+			return
+		}
+
+		data := interaction.ApplicationCommandData()
+		var action string
+		var pendingID int64
+		for _, option := range data.Options {
+			switch option.Name {
+			case "action":
+				action = option.StringValue()
+			case "id":
+				pendingID = option.IntValue()
+			}
+		}
+
+		respond := func(embed *discordgo.MessageEmbed) {
+			err := session.InteractionRespond(interaction.Interaction, &discordgo.InteractionResponse{
+				Type: discordgo.InteractionResponseChannelMessageWithSource,
+				Data: &discordgo.InteractionResponseData{
+					Flags:  discordgo.MessageFlagsEphemeral,
+					Embeds: []*discordgo.MessageEmbed{embed},
+				},
+			})
+			if err != nil {
+				discordBot.Logger.With("err", err).Error("Failed to respond to interaction")
+			}
+		}
+
+		if action == "list" {
+			pending, err := DB.ListPendingUsers()
+			if err != nil {
+				discordBot.Logger.With("err", err).Error("Failed to list pending users")
+				discordBot.RespondWithError(interaction, "Failed to list pending users")
+				return
+			}
+			embed := &discordgo.MessageEmbed{
+				Title:       "Accounts waiting for approval",
+				Description: "No pending account",
+				Color:       0xFFA500,
+			}
+			if len(pending) > 0 {
+				embed.Description = ""
+			}
+			for _, u := range pending {
+				embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{
+					Name:  "#" + strconv.FormatInt(u.ID, 10),
+					Value: u.FirstName + " (<@" + u.DiscordID + ">, promo " + strconv.Itoa(u.Promotion) + ", permissions " + strconv.Itoa(u.Permissions) + ")",
+				})
+			}
+			respond(embed)
+			return
+		}
+
+		if pendingID == 0 {
+			discordBot.RespondWithError(interaction, "The `id` option is required for this action")
+			return
+		}
+
+		switch action {
+		case "approve":
+			user, err := DB.ApprovePendingUser(pendingID)
+			if err != nil {
+				discordBot.RespondWithError(interaction, "Failed to approve account: "+err.Error())
+				return
+			}
+			discordBot.Logger.With("pendingID", pendingID, "userID", user.ID, "adminID", admin.IDInt()).Info("Pending account approved")
+			EmitUserCreated(user)
+			respond(&discordgo.MessageEmbed{
+				Title:       "Account #" + strconv.FormatInt(pendingID, 10) + " approved",
+				Description: "<@" + user.DiscordID + "> can now log in to hxi2.fr.",
+				Color:       0x00FF00,
+			})
+		case "reject":
+			p, err := DB.RejectPendingUser(pendingID, admin.IDInt())
+			if err != nil {
+				discordBot.RespondWithError(interaction, "Failed to reject account: "+err.Error())
+				return
+			}
+			discordBot.Logger.With("pendingID", pendingID, "discordID", p.DiscordID, "adminID", admin.IDInt()).Info("Pending account rejected")
+			respond(&discordgo.MessageEmbed{
+				Title:       "Account #" + strconv.FormatInt(pendingID, 10) + " rejected",
+				Description: "<@" + p.DiscordID + "> won't be added back to the pending list when they log in.",
+				Color:       0x00FF00,
+			})
+		default:
+			discordBot.RespondWithError(interaction, "Unknown action")
+		}
+	}
+
+	discordBot.AddCommand(cmdName, command, hand)
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRejectedUsersAreNotProvisioned(t *testing.T) {
+	openTestDatabase(t)
+	err := DB.AddPendingUser(&DBPendingUser{DiscordID: "42", Username: "rejected", FirstName: "Rejected", MatchedRoleID: "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending, _ := DB.ListPendingUsers()
+	if len(pending) != 1 {
+		t.Fatalf("pending users: %+v", pending)
+	}
+
+	if _, err := DB.RejectPendingUser(pending[0].ID, 1); err != nil {
+		t.Fatal(err)
+	}
+	if pending, _ := DB.ListPendingUsers(); len(pending) != 0 {
+		t.Fatalf("the rejected user is still pending: %+v", pending)
+	}
+
+	// the rejection is checked before the Discord member is fetched
+	_, err = ProvisionDiscordUser(nil, &DiscordAuthorizationInfo{ID: "42", Username: "rejected"})
+	if !errors.Is(err, ErrProvisioningNotEligible) {
+		t.Fatalf("login of a rejected user: %v", err)
+	}
+	if pending, _ := DB.ListPendingUsers(); len(pending) != 0 {
+		t.Fatalf("the rejected user was queued again: %+v", pending)
+	}
+
+	if _, err := DB.RejectPendingUser(pending[0].ID, 1); err == nil {
+		t.Error("an unknown pending user was rejected")
+	}
+}
@@ -0,0 +1,525 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	ggu "github.com/itsvyle/hxi2/global-go/utils"
+	"github.com/jmoiron/sqlx"
+)
+
+// Role sync keeps the roles of the HXi² Discord server in line with the promotions and permissions of the auth database
+// A sync computes the roles to add and remove as a transaction, which admins preview, then apply, and can revert with /rolesync
+// Only the roles listed in the rules are managed, and members unknown to the database are left alone
+
+const (
+	RoleSyncStatusPreview = "preview"
+	// claimed by an apply or a revert, while the roles are updated
+	RoleSyncStatusApplying  = "applying"
+	RoleSyncStatusReverting = "reverting"
+	RoleSyncStatusApplied   = "applied"
+	// some role updates failed; the transaction can be reverted, which also retries the failed reverts
+	RoleSyncStatusPartial  = "partial"
+	RoleSyncStatusReverted = "reverted"
+)
+
+// Previews older than this must be generated again before being applied, as the roles may have changed since
+const RoleSyncPreviewValidity = 1 * time.Hour
+
+type RoleSyncRule struct {
+	RoleID string `json:"role_id"`
+	// 0 matches every promotion
+	Promotion int `json:"promotion"`
+	// state of the user's promotion (mp2i, mpi...), which unlike promotion keeps working across rollovers; empty matches every state
+	State string `json:"state"`
+	// every bit must be set on the user; 0 matches every user
+	Permissions int `json:"permissions"`
+}
+
+func (rule *RoleSyncRule) Matches(user *DBUser, promotions ggu.PromotionsInfo) bool {
+	if rule.Promotion != 0 && rule.Promotion != user.Promotion {
+		return false
+	}
+	if rule.State != "" {
+		p := promotions.Get(user.Promotion)
+		if p == nil || p.State != rule.State {
+			return false
+		}
+	}
+	return user.Permissions&rule.Permissions == rule.Permissions
+}
+
+type RoleSyncConfig struct {
+	GuildID string         `json:"guild_id"`
+	Rules   []RoleSyncRule `json:"rules"`
+}
+
+var roleSyncConfig *RoleSyncConfig
+
+func LoadRoleSyncConfig(path string) (*RoleSyncConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rc RoleSyncConfig
+	err = json.Unmarshal(data, &rc)
+	if err != nil {
+		return nil, fmt.Errorf("invalid role sync rules: %w", err)
+	}
+	if rc.GuildID == "" {
+		return nil, errors.New("role sync rules: guild_id is missing")
+	}
+	if len(rc.Rules) == 0 {
+		return nil, errors.New("role sync rules: no rule defined")
+	}
+	for i, rule := range rc.Rules {
+		if rule.RoleID == "" {
+			return nil, fmt.Errorf("role sync rules: rule %d has no role_id", i)
+		}
+		if rule.Promotion == 0 && rule.State == "" && rule.Permissions == 0 {
+			return nil, fmt.Errorf("role sync rules: rule %d needs a promotion, state or permissions", i)
+		}
+		if rule.State != "" && !slices.Contains(ggu.PromotionLifecycle, rule.State) {
+			return nil, fmt.Errorf("role sync rules: rule %d has an invalid state %q", i, rule.State)
+		}
+	}
+	return &rc, nil
+}
+
+// The roles managed by the sync; other roles are never touched
+func (rc *RoleSyncConfig) ManagedRoles() []string {
+	roles := []string{}
+	for _, rule := range rc.Rules {
+		if !slices.Contains(roles, rule.RoleID) {
+			roles = append(roles, rule.RoleID)
+		}
+	}
+	return roles
+}
+
+func (rc *RoleSyncConfig) DesiredRoles(user *DBUser, promotions ggu.PromotionsInfo) []string {
+	roles := []string{}
+	for i := range rc.Rules {
+		if rc.Rules[i].Matches(user, promotions) && !slices.Contains(roles, rc.Rules[i].RoleID) {
+			roles = append(roles, rc.Rules[i].RoleID)
+		}
+	}
+	return roles
+}
+
+// The Discord REST calls used by the role sync; implemented by *discordgo.Session
+type RoleSyncDiscordClient interface {
+	GuildMembers(guildID string, after string, limit int, options ...discordgo.RequestOption) ([]*discordgo.Member, error)
+	GuildMemberRoleAdd(guildID, userID, roleID string, options ...discordgo.RequestOption) error
+	GuildMemberRoleRemove(guildID, userID, roleID string, options ...discordgo.RequestOption) error
+}
+
+// Same format as the transactions of scripts/discord-role-migration
+type RoleSyncUserChange struct {
+	Added     []string `json:"added"`
+	Removed   []string `json:"removed"`
+	DebugName string   `json:"debug_name,omitempty"`
+}
+
+type RoleSyncChanges map[string]*RoleSyncUserChange
+
+func listAllGuildMembers(client RoleSyncDiscordClient, guildID string) ([]*discordgo.Member, error) {
+	members := []*discordgo.Member{}
+	after := ""
+	for {
+		page, err := client.GuildMembers(guildID, after, 1000)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, page...)
+		if len(page) < 1000 {
+			return members, nil
+		}
+		after = page[len(page)-1].User.ID
+	}
+}
+
+// Computes the roles to add and remove so that the guild matches the database
+func ComputeRoleSyncChanges(client RoleSyncDiscordClient, rc *RoleSyncConfig, users []DBUser, promotions ggu.PromotionsInfo) (RoleSyncChanges, error) {
+	members, err := listAllGuildMembers(client, rc.GuildID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list guild members: %w", err)
+	}
+	usersByDiscordID := make(map[string]*DBUser, len(users))
+	for i := range users {
+		usersByDiscordID[users[i].DiscordID] = &users[i]
+	}
+	managed := rc.ManagedRoles()
+
+	changes := RoleSyncChanges{}
+	for _, member := range members {
+		if member.User == nil {
+			continue
+		}
+		user, ok := usersByDiscordID[member.User.ID]
+		if !ok {
+			continue
+		}
+		desired := rc.DesiredRoles(user, promotions)
+		change := &RoleSyncUserChange{Added: []string{}, Removed: []string{}, DebugName: user.Username}
+		for _, role := range desired {
+			if !slices.Contains(member.Roles, role) {
+				change.Added = append(change.Added, role)
+			}
+		}
+		for _, role := range member.Roles {
+			if slices.Contains(managed, role) && !slices.Contains(desired, role) {
+				change.Removed = append(change.Removed, role)
+			}
+		}
+		if len(change.Added) > 0 || len(change.Removed) > 0 {
+			changes[member.User.ID] = change
+		}
+	}
+	return changes, nil
+}
+
+// Applies the changes, or their opposite when reverting; returns the number of role updates that failed
+func ExecuteRoleSyncChanges(client RoleSyncDiscordClient, guildID string, changes RoleSyncChanges, revert bool) int {
+	logger := ggu.GetServiceSpecificLogger("ROLSYN", "\033[38;2;88;101;242m")
+	failures := 0
+	for discordID, change := range changes {
+		toAdd, toRemove := change.Added, change.Removed
+		if revert {
+			toAdd, toRemove = change.Removed, change.Added
+		}
+		for _, role := range toAdd {
+			if err := client.GuildMemberRoleAdd(guildID, discordID, role); err != nil {
+				logger.With("error", err, "discordID", discordID, "roleID", role).Error("Failed to add role")
+				failures++
+			}
+		}
+		for _, role := range toRemove {
+			if err := client.GuildMemberRoleRemove(guildID, discordID, role); err != nil {
+				logger.With("error", err, "discordID", discordID, "roleID", role).Error("Failed to remove role")
+				failures++
+			}
+		}
+	}
+	return failures
+}
+
+type DBRoleSyncTransaction struct {
+	ID         int64      `db:"ID"`
+	GuildID    string     `db:"guild_id"`
+	Changes    string     `db:"changes"`
+	Status     string     `db:"status"`
+	CreatedBy  int64      `db:"created_by"`
+	CreatedAt  time.Time  `db:"created_at"`
+	AppliedAt  *time.Time `db:"applied_at"`
+	RevertedAt *time.Time `db:"reverted_at"`
+}
+
+func (t *DBRoleSyncTransaction) ParseChanges() (RoleSyncChanges, error) {
+	changes := RoleSyncChanges{}
+	err := json.Unmarshal([]byte(t.Changes), &changes)
+	return changes, err
+}
+
+func (db *DatabaseManager) CreateRoleSyncTransaction(guildID string, changes RoleSyncChanges, createdBy int64) (int64, error) {
+	data, err := json.Marshal(changes)
+	if err != nil {
+		return 0, err
+	}
+	res, err := db.DB.Exec(`
+		INSERT INTO ROLE_SYNC_TRANSACTIONS (guild_id, changes, status, created_by, created_at)
+		VALUES (?, ?, ?, ?, ?)
+	`, guildID, string(data), RoleSyncStatusPreview, createdBy, time.Now().UTC())
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+func (db *DatabaseManager) GetRoleSyncTransaction(id int64) (*DBRoleSyncTransaction, error) {
+	t := &DBRoleSyncTransaction{}
+	err := db.DB.Get(t, "SELECT * FROM ROLE_SYNC_TRANSACTIONS WHERE ID = ?", id)
+	return t, err
+}
+
+func (db *DatabaseManager) ListRoleSyncTransactions(limit int) ([]DBRoleSyncTransaction, error) {
+	transactions := []DBRoleSyncTransaction{}
+	err := db.DB.Select(&transactions, "SELECT * FROM ROLE_SYNC_TRANSACTIONS ORDER BY ID DESC LIMIT ?", limit)
+	return transactions, err
+}
+
+// Moves a transaction from one of the statuses in from to status; returns false if it was in none of them,
+// e.g. when a concurrent apply claimed it first
+func (db *DatabaseManager) claimRoleSyncTransaction(id int64, status string, from ...string) (bool, error) {
+	query, args, err := sqlx.In("UPDATE ROLE_SYNC_TRANSACTIONS SET status = ? WHERE ID = ? AND status IN (?)", status, id, from)
+	if err != nil {
+		return false, err
+	}
+	res, err := db.DB.Exec(query, args...)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// Records the end of an apply, or of a revert
+func (db *DatabaseManager) SetRoleSyncTransactionStatus(id int64, status string, revert bool) error {
+	column := "applied_at"
+	if revert {
+		column = "reverted_at"
+	}
+	_, err := db.DB.Exec("UPDATE ROLE_SYNC_TRANSACTIONS SET status = ?, "+column+" = ? WHERE ID = ?", status, time.Now().UTC(), id)
+	return err
+}
+
+// Applies a previewed transaction, or reverts an applied or partial one; returns the number of role updates that failed
+// The transaction is claimed before any role is updated, so that concurrent runs don't update the roles twice
+// When some updates fail, the transaction is left partial, and can be reverted
+func RunRoleSyncTransaction(client RoleSyncDiscordClient, id int64, revert bool) (int, error) {
+	t, err := DB.GetRoleSyncTransaction(id)
+	if err != nil {
+		return 0, err
+	}
+	if !revert && t.Status == RoleSyncStatusPreview && time.Since(t.CreatedAt) > RoleSyncPreviewValidity {
+		return 0, errors.New("this preview is outdated, generate a new one")
+	}
+	changes, err := t.ParseChanges()
+	if err != nil {
+		return 0, err
+	}
+
+	claimed := false
+	if revert {
+		claimed, err = DB.claimRoleSyncTransaction(id, RoleSyncStatusReverting, RoleSyncStatusApplied, RoleSyncStatusPartial)
+	} else {
+		claimed, err = DB.claimRoleSyncTransaction(id, RoleSyncStatusApplying, RoleSyncStatusPreview)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if !claimed && revert {
+		return 0, errors.New("only applied or partial transactions can be reverted")
+	}
+	if !claimed {
+		return 0, errors.New("this transaction was already applied, or is being applied")
+	}
+
+	failures := ExecuteRoleSyncChanges(client, t.GuildID, changes, revert)
+	status := RoleSyncStatusApplied
+	if revert {
+		status = RoleSyncStatusReverted
+	}
+	if failures > 0 {
+		status = RoleSyncStatusPartial
+	}
+	return failures, DB.SetRoleSyncTransactionStatus(id, status, revert)
+}
+
+func describeRoleSyncChanges(changes RoleSyncChanges) string {
+	if len(changes) == 0 {
+		return "Roles are already in sync, nothing to do."
+	}
+	lines := []string{}
+	for discordID, change := range changes {
+		line := "<@" + discordID + ">"
+		for _, role := range change.Added {
+			line += " +<@&" + role + ">"
+		}
+		for _, role := range change.Removed {
+			line += " -<@&" + role + ">"
+		}
+		lines = append(lines, line)
+	}
+	sort.Strings(lines)
+	// embed descriptions are limited to 4096 characters
+	description := ""
+	for i, line := range lines {
+		if len(description)+len(line) > 3900 {
+			description += "... and " + strconv.Itoa(len(lines)-i) + " more"
+			break
+		}
+		description += line + "\n"
+	}
+	return description
+}
+
+func (discordBot *DiscordBot) addCommandRoleSync() {
+	const cmdName = "rolesync"
+	var p int64 = discordgo.PermissionAdministrator | discordgo.PermissionManageRoles | discordgo.PermissionManageGuild
+
+	var command = &discordgo.ApplicationCommand{
+		Name:                     cmdName,
+		Description:              "Sync the server roles with the promotions and permissions of the accounts",
+		DefaultMemberPermissions: &p,
+		Options: []*discordgo.ApplicationCommandOption{
+			{
+				Type:        discordgo.ApplicationCommandOptionString,
+				Name:        "action",
+				Description: "What to do",
+				Required:    true,
+				Choices: []*discordgo.ApplicationCommandOptionChoice{
+					{Name: "preview", Value: "preview"},
+					{Name: "apply", Value: "apply"},
+					{Name: "revert", Value: "revert"},
+					{Name: "list", Value: "list"},
+				},
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionInteger,
+				Name:        "id",
+				Description: "The ID of the transaction, for apply and revert",
+				Required:    false,
+			},
+		},
+	}
+
+	hand := func(session *discordgo.Session, interaction *discordgo.InteractionCreate) {
+		admin, err := discordBot.GetInteractionClaims(interaction)
+		if err != nil || admin == nil {
+			discordBot.RespondWithError(interaction, "Failed to get user claims")
+			return
+		}
+		if !admin.IsAdmin() {
+			discordBot.RespondWithError(interaction, "You do not have permission to use this command")
+			return
+		}
+		if roleSyncConfig == nil {
+			discordBot.RespondWithError(interaction, "Role sync is not configured (CONFIG_ROLE_SYNC_RULES)")
+			return
+		}
+
+		data := interaction.ApplicationCommandData()
+		var action string
+		var transactionID int64
+		for _, option := range data.Options {
+			switch option.Name {
+			case "action":
+				action = option.StringValue()
+			case "id":
+				transactionID = option.IntValue()
+			}
+		}
+		if (action == "apply" || action == "revert") && transactionID == 0 {
+			discordBot.RespondWithError(interaction, "The `id` option is required for this action")
+			return
+		}
+
+		// listing the members and updating roles can take longer than the interaction deadline
+		err = session.InteractionRespond(interaction.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+			Data: &discordgo.InteractionResponseData{
+				Flags: discordgo.MessageFlagsEphemeral,
+			},
+		})
+		if err != nil {
+			discordBot.Logger.With("err", err).Error("Failed to defer interaction response")
+			return
+		}
+		respond := func(embed *discordgo.MessageEmbed) {
+			_, err := session.InteractionResponseEdit(interaction.Interaction, &discordgo.WebhookEdit{
+				Embeds: &[]*discordgo.MessageEmbed{embed},
+			})
+			if err != nil {
+				discordBot.Logger.With("err", err).Error("Failed to edit interaction response")
+			}
+		}
+		respondError := func(text string) {
+			respond(&discordgo.MessageEmbed{
+				Title:       "Error",
+				Description: text,
+				Color:       0xFF0000,
+			})
+		}
+
+		switch action {
+		case "preview":
+			users, err := DB.ListUsers()
+			if err != nil {
+				discordBot.Logger.With("err", err).Error("Failed to list users")
+				respondError("Failed to list users")
+				return
+			}
+			promotions, err := DB.ListPromotions()
+			if err != nil {
+				discordBot.Logger.With("err", err).Error("Failed to list promotions")
+				respondError("Failed to list promotions")
+				return
+			}
+			changes, err := ComputeRoleSyncChanges(session, roleSyncConfig, users, promotions)
+			if err != nil {
+				discordBot.Logger.With("err", err).Error("Failed to compute role sync")
+				respondError("Failed to compute role sync: " + err.Error())
+				return
+			}
+			title := "Roles are in sync"
+			if len(changes) > 0 {
+				id, err := DB.CreateRoleSyncTransaction(roleSyncConfig.GuildID, changes, admin.IDInt())
+				if err != nil {
+					discordBot.Logger.With("err", err).Error("Failed to store role sync transaction")
+					respondError("Failed to store the transaction")
+					return
+				}
+				title = "Role sync #" + strconv.FormatInt(id, 10) + " - apply it with /rolesync action:apply id:" + strconv.FormatInt(id, 10)
+			}
+			respond(&discordgo.MessageEmbed{
+				Title:       title,
+				Description: describeRoleSyncChanges(changes),
+				Color:       0xFFA500,
+			})
+		case "apply", "revert":
+			revert := action == "revert"
+			failures, err := RunRoleSyncTransaction(session, transactionID, revert)
+			if err != nil {
+				respondError("Failed to " + action + " transaction: " + err.Error())
+				return
+			}
+			discordBot.Logger.With("transactionID", transactionID, "action", action, "failures", failures, "adminID", admin.IDInt()).Info("Ran role sync transaction")
+			description := "Every role was updated."
+			color := 0x00FF00
+			if failures > 0 {
+				description = strconv.Itoa(failures) + " role updates failed, check the logs. The transaction is partial: revert it, or preview a new sync."
+				color = 0xFFA500
+			}
+			respond(&discordgo.MessageEmbed{
+				Title:       "Role sync #" + strconv.FormatInt(transactionID, 10) + " " + action + " done",
+				Description: description,
+				Color:       color,
+			})
+		case "list":
+			transactions, err := DB.ListRoleSyncTransactions(10)
+			if err != nil {
+				discordBot.Logger.With("err", err).Error("Failed to list role sync transactions")
+				respondError("Failed to list transactions")
+				return
+			}
+			embed := &discordgo.MessageEmbed{
+				Title:       "Latest role sync transactions",
+				Description: "No transaction",
+				Color:       0xFFA500,
+			}
+			if len(transactions) > 0 {
+				embed.Description = ""
+			}
+			for _, t := range transactions {
+				changes, _ := t.ParseChanges()
+				embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{
+					Name:  "#" + strconv.FormatInt(t.ID, 10) + " - " + t.Status,
+					Value: strconv.Itoa(len(changes)) + " members, created " + t.CreatedAt.Format("2006-01-02 15:04"),
+				})
+			}
+			respond(embed)
+		default:
+			respondError("Unknown action")
+		}
+	}
+
+	discordBot.AddCommand(cmdName, command, hand)
+}
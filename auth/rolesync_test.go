@@ -0,0 +1,335 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+	ggu "github.com/itsvyle/hxi2/global-go/utils"
+)
+
+const testGuildID = "100"
+
+// A guild served by the fake Discord REST API: the roles of its members, and the role updates it received
+type fakeGuild struct {
+	mu      sync.Mutex
+	members map[string][]string
+	updates map[string]int
+	// role updates answered with a 403, as "user/role"
+	forbidden map[string]bool
+}
+
+func (g *fakeGuild) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/v"+discordgo.APIVersion+"/guilds/"+testGuildID+"/members"), "/")
+
+	if r.Method == http.MethodGet && len(parts) == 1 {
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		ids := []string{}
+		for id := range g.members {
+			if id > r.URL.Query().Get("after") {
+				ids = append(ids, id)
+			}
+		}
+		sort.Strings(ids)
+		if len(ids) > limit {
+			ids = ids[:limit]
+		}
+		page := []*discordgo.Member{}
+		for _, id := range ids {
+			page = append(page, &discordgo.Member{User: &discordgo.User{ID: id}, Roles: slices.Clone(g.members[id])})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(page)
+		return
+	}
+
+	// /{user}/roles/{role}
+	if len(parts) != 4 || parts[2] != "roles" {
+		http.NotFound(w, r)
+		return
+	}
+	user, role := parts[1], parts[3]
+	if g.forbidden[user+"/"+role] {
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte(`{"message": "Missing Permissions", "code": 50013}`))
+		return
+	}
+	g.updates[r.Method+" "+user+"/"+role]++
+	switch r.Method {
+	case http.MethodPut:
+		if !slices.Contains(g.members[user], role) {
+			g.members[user] = append(g.members[user], role)
+		}
+	case http.MethodDelete:
+		g.members[user] = slices.DeleteFunc(g.members[user], func(r string) bool { return r == role })
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (g *fakeGuild) roles(user string) []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	roles := slices.Clone(g.members[user])
+	sort.Strings(roles)
+	return roles
+}
+
+// Sends the requests of the session to the test server instead of discord.com
+type rewriteTransport struct {
+	target *url.URL
+}
+
+func (t rewriteTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.URL.Scheme = t.target.Scheme
+	r.URL.Host = t.target.Host
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func newFakeDiscord(t *testing.T, members map[string][]string) (*discordgo.Session, *fakeGuild) {
+	t.Helper()
+	guild := &fakeGuild{members: members, updates: map[string]int{}, forbidden: map[string]bool{}}
+	server := httptest.NewServer(guild)
+	t.Cleanup(server.Close)
+	target, _ := url.Parse(server.URL)
+
+	session, err := discordgo.New("Bot test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.Client = &http.Client{Transport: rewriteTransport{target: target}}
+	session.MaxRestRetries = 0
+	return session, guild
+}
+
+func openTestDatabase(t *testing.T) {
+	t.Helper()
+	db, err := OpenDatabase(filepath.Join(t.TempDir(), "test.sqlite3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.DB.Close() })
+	DB = db
+	if err := DB.SeedPromotions(); err != nil {
+		t.Fatal(err)
+	}
+	refreshPromotionsRange()
+}
+
+// Roles: 1 for the 2024 promotion, 2 for mpi, 3 for admins; 9 isn't managed
+var testRoleSyncConfig = &RoleSyncConfig{
+	GuildID: testGuildID,
+	Rules: []RoleSyncRule{
+		{RoleID: "1", Promotion: 2024},
+		{RoleID: "2", State: ggu.PromotionStateMPI},
+		{RoleID: "3", Permissions: ggu.RoleAdmin},
+	},
+}
+
+func setupRoleSync(t *testing.T) (*discordgo.Session, *fakeGuild, RoleSyncChanges) {
+	t.Helper()
+	openTestDatabase(t)
+	for _, u := range []DBUser{
+		{Username: "alice", FirstName: "Alice", DiscordID: "201", Promotion: 2024},
+		{Username: "bob", FirstName: "Bob", DiscordID: "202", Promotion: 2023, Permissions: ggu.RoleAdmin},
+		{Username: "carol", FirstName: "Carol", DiscordID: "203", Promotion: 2023},
+	} {
+		if err := DB.CreateNewUser(&u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	members := map[string][]string{
+		"201": {"9"},      // missing 1, keeps the unmanaged 9
+		"202": {"1", "2"}, // 1 removed, 3 added
+		"203": {"2"},      // in sync
+		"204": {"1"},      // unknown to the database, left alone
+	}
+	session, guild := newFakeDiscord(t, members)
+
+	users, err := DB.ListUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	promotions, err := DB.ListPromotions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes, err := ComputeRoleSyncChanges(session, testRoleSyncConfig, users, promotions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return session, guild, changes
+}
+
+func TestComputeRoleSyncChanges(t *testing.T) {
+	_, _, changes := setupRoleSync(t)
+
+	if len(changes) != 2 {
+		t.Fatalf("expected changes for 2 members, got %v", changes)
+	}
+	if c := changes["201"]; c == nil || !slices.Equal(c.Added, []string{"1"}) || len(c.Removed) != 0 {
+		t.Errorf("alice: got %+v", c)
+	}
+	if c := changes["202"]; c == nil || !slices.Equal(c.Added, []string{"3"}) || !slices.Equal(c.Removed, []string{"1"}) {
+		t.Errorf("bob: got %+v", c)
+	}
+}
+
+func TestComputeRoleSyncChangesPaginates(t *testing.T) {
+	openTestDatabase(t)
+	members := map[string][]string{}
+	for i := range 1500 {
+		members[strconv.Itoa(100000+i)] = nil
+	}
+	last := strconv.Itoa(100000 + 1499)
+	user := DBUser{Username: "last", FirstName: "Last", DiscordID: last, Promotion: 2024}
+	if err := DB.CreateNewUser(&user); err != nil {
+		t.Fatal(err)
+	}
+	session, _ := newFakeDiscord(t, members)
+
+	changes, err := ComputeRoleSyncChanges(session, testRoleSyncConfig, []DBUser{user}, ggu.DefaultPromotions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changes[last] == nil {
+		t.Fatal("the member of the second page wasn't listed")
+	}
+}
+
+func TestRunRoleSyncTransactionApplyAndRevert(t *testing.T) {
+	session, guild, changes := setupRoleSync(t)
+	id, err := DB.CreateRoleSyncTransaction(testGuildID, changes, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := RunRoleSyncTransaction(session, id, true); err == nil {
+		t.Error("a preview was reverted")
+	}
+	failures, err := RunRoleSyncTransaction(session, id, false)
+	if err != nil || failures != 0 {
+		t.Fatalf("apply: %d failures, %v", failures, err)
+	}
+	if r := guild.roles("201"); !slices.Equal(r, []string{"1", "9"}) {
+		t.Errorf("alice after apply: %v", r)
+	}
+	if r := guild.roles("202"); !slices.Equal(r, []string{"2", "3"}) {
+		t.Errorf("bob after apply: %v", r)
+	}
+	if r := guild.roles("204"); !slices.Equal(r, []string{"1"}) {
+		t.Errorf("unknown member after apply: %v", r)
+	}
+	if tr, _ := DB.GetRoleSyncTransaction(id); tr.Status != RoleSyncStatusApplied || tr.AppliedAt == nil {
+		t.Errorf("status after apply: %s", tr.Status)
+	}
+	if _, err := RunRoleSyncTransaction(session, id, false); err == nil {
+		t.Error("the transaction was applied twice")
+	}
+
+	failures, err = RunRoleSyncTransaction(session, id, true)
+	if err != nil || failures != 0 {
+		t.Fatalf("revert: %d failures, %v", failures, err)
+	}
+	if r := guild.roles("201"); !slices.Equal(r, []string{"9"}) {
+		t.Errorf("alice after revert: %v", r)
+	}
+	if r := guild.roles("202"); !slices.Equal(r, []string{"1", "2"}) {
+		t.Errorf("bob after revert: %v", r)
+	}
+	if tr, _ := DB.GetRoleSyncTransaction(id); tr.Status != RoleSyncStatusReverted || tr.RevertedAt == nil {
+		t.Errorf("status after revert: %s", tr.Status)
+	}
+	if _, err := RunRoleSyncTransaction(session, id, true); err == nil {
+		t.Error("the transaction was reverted twice")
+	}
+}
+
+func TestRunRoleSyncTransactionConcurrentApplies(t *testing.T) {
+	session, guild, changes := setupRoleSync(t)
+	id, err := DB.CreateRoleSyncTransaction(testGuildID, changes, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const runs = 8
+	var wg sync.WaitGroup
+	errs := make(chan error, runs)
+	for range runs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := RunRoleSyncTransaction(session, id, false)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	succeeded := 0
+	for err := range errs {
+		if err == nil {
+			succeeded++
+		}
+	}
+	if succeeded != 1 {
+		t.Fatalf("%d applies succeeded, expected 1", succeeded)
+	}
+	for update, n := range guild.updates {
+		if n != 1 {
+			t.Errorf("%s was sent %d times", update, n)
+		}
+	}
+	if len(guild.updates) != 3 {
+		t.Errorf("expected 3 role updates, got %v", guild.updates)
+	}
+}
+
+func TestRunRoleSyncTransactionPartial(t *testing.T) {
+	session, guild, changes := setupRoleSync(t)
+	id, err := DB.CreateRoleSyncTransaction(testGuildID, changes, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	guild.forbidden["202/3"] = true
+
+	failures, err := RunRoleSyncTransaction(session, id, false)
+	if err != nil || failures != 1 {
+		t.Fatalf("apply: %d failures, %v", failures, err)
+	}
+	if tr, _ := DB.GetRoleSyncTransaction(id); tr.Status != RoleSyncStatusPartial {
+		t.Errorf("status after a failed update: %s", tr.Status)
+	}
+
+	// the revert undoes what was applied; the role that was never added fails again, and is only logged
+	failures, err = RunRoleSyncTransaction(session, id, true)
+	if err != nil || failures != 1 {
+		t.Fatalf("revert: %d failures, %v", failures, err)
+	}
+	if r := guild.roles("201"); !slices.Equal(r, []string{"9"}) {
+		t.Errorf("alice after revert: %v", r)
+	}
+	if r := guild.roles("202"); !slices.Equal(r, []string{"1", "2"}) {
+		t.Errorf("bob after revert: %v", r)
+	}
+
+	delete(guild.forbidden, "202/3")
+	failures, err = RunRoleSyncTransaction(session, id, true)
+	if err != nil || failures != 0 {
+		t.Fatalf("second revert: %d failures, %v", failures, err)
+	}
+	if tr, _ := DB.GetRoleSyncTransaction(id); tr.Status != RoleSyncStatusReverted {
+		t.Errorf("status after the second revert: %s", tr.Status)
+	}
+}
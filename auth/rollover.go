@@ -0,0 +1,558 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	ggu "github.com/itsvyle/hxi2/global-go/utils"
+	"github.com/jmoiron/sqlx"
+)
+
+// The academic year rollover moves every promotion to its next state (incoming -> mp2i -> mpi -> alumni),
+// and opens the next incoming promotion. Like role syncs, it is previewed, then applied, and can be reverted.
+// Applying it also runs a role sync if it is configured, and notifies the projects with a promotions.changed webhook.
+
+const (
+	RolloverStatusPreview  = "preview"
+	RolloverStatusApplied  = "applied"
+	RolloverStatusReverted = "reverted"
+)
+
+// Returned when a rollover can't run from its current status, or over the current promotions; the message is meant for the admin
+type RolloverConflictError string
+
+func (e RolloverConflictError) Error() string {
+	return string(e)
+}
+
+// Colors given to new promotions in the tree, in order
+var rolloverPromotionColors = []string{"#b9291b", "#00c0c6", "#a05fdd", "#48e675", "#e6a448", "#e648b4"}
+
+func (db *DatabaseManager) ListPromotions() (ggu.PromotionsInfo, error) {
+	promotions := ggu.PromotionsInfo{}
+	err := db.DB.Select(&promotions, "SELECT * FROM PROMOTIONS ORDER BY promotion")
+	return promotions, err
+}
+
+// Fills PROMOTIONS with the promotions that were hardcoded before, on the first start
+func (db *DatabaseManager) SeedPromotions() error {
+	var count int
+	err := db.DB.Get(&count, "SELECT COUNT(*) FROM PROMOTIONS")
+	if err != nil || count > 0 {
+		return err
+	}
+	for _, p := range ggu.DefaultPromotions() {
+		_, err = db.DB.Exec("INSERT INTO PROMOTIONS (promotion, state, color) VALUES (?, ?, ?)", p.Promotion, p.State, p.Color)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// the caller commits the transaction
+func replacePromotions(tx *sqlx.Tx, promotions ggu.PromotionsInfo) error {
+	if _, err := tx.Exec("DELETE FROM PROMOTIONS"); err != nil {
+		return err
+	}
+	for _, p := range promotions {
+		_, err := tx.Exec("INSERT INTO PROMOTIONS (promotion, state, color) VALUES (?, ?, ?)", p.Promotion, p.State, p.Color)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Keeps ggu.GetPromotionsRange in line with the database
+func refreshPromotionsRange() {
+	promotions, err := DB.ListPromotions()
+	if err != nil {
+		slog.With("error", err).Error("Failed to list promotions")
+		return
+	}
+	if len(promotions) > 0 {
+		ggu.SetPromotionsRange(promotions.Range())
+	}
+}
+
+// Returns the promotions after a rollover
+func ComputeRollover(current ggu.PromotionsInfo) ggu.PromotionsInfo {
+	next := make(ggu.PromotionsInfo, 0, len(current)+1)
+	for _, p := range current {
+		p.State = ggu.NextPromotionState(p.State)
+		next = append(next, p)
+	}
+	_, maxp := current.Range()
+	next = append(next, ggu.PromotionInfo{
+		Promotion: maxp + 1,
+		State:     ggu.PromotionStateIncoming,
+		Color:     nextPromotionColor(current.Get(maxp).Color, maxp+1),
+	})
+	return next
+}
+
+// The color that follows the one of the newest promotion in rolloverPromotionColors, so that consecutive
+// promotions never share one; by year if the newest promotion has a custom color
+func nextPromotionColor(newestColor string, promotion int) string {
+	if i := slices.Index(rolloverPromotionColors, newestColor); i >= 0 {
+		return rolloverPromotionColors[(i+1)%len(rolloverPromotionColors)]
+	}
+	return rolloverPromotionColors[promotion%len(rolloverPromotionColors)]
+}
+
+type DBRolloverTransaction struct {
+	ID                    int64      `db:"ID" json:"id"`
+	AcademicYear          int        `db:"academic_year" json:"academicYear"`
+	PreviousState         string     `db:"previous_state" json:"previousState"`
+	NewState              string     `db:"new_state" json:"newState"`
+	RoleSyncTransactionID *int64     `db:"role_sync_transaction_id" json:"roleSyncTransactionID"`
+	Status                string     `db:"status" json:"status"`
+	CreatedBy             int64      `db:"created_by" json:"createdBy"`
+	CreatedAt             time.Time  `db:"created_at" json:"createdAt"`
+	AppliedAt             *time.Time `db:"applied_at" json:"appliedAt"`
+	RevertedAt            *time.Time `db:"reverted_at" json:"revertedAt"`
+}
+
+func (t *DBRolloverTransaction) States() (ggu.PromotionsInfo, ggu.PromotionsInfo, error) {
+	var previous, next ggu.PromotionsInfo
+	if err := json.Unmarshal([]byte(t.PreviousState), &previous); err != nil {
+		return nil, nil, err
+	}
+	if err := json.Unmarshal([]byte(t.NewState), &next); err != nil {
+		return nil, nil, err
+	}
+	return previous, next, nil
+}
+
+func (db *DatabaseManager) GetRolloverTransaction(id int64) (*DBRolloverTransaction, error) {
+	t := &DBRolloverTransaction{}
+	err := db.DB.Get(t, "SELECT * FROM ROLLOVER_TRANSACTIONS WHERE ID = ?", id)
+	return t, err
+}
+
+func (db *DatabaseManager) ListRolloverTransactions(limit int) ([]DBRolloverTransaction, error) {
+	transactions := []DBRolloverTransaction{}
+	err := db.DB.Select(&transactions, "SELECT * FROM ROLLOVER_TRANSACTIONS ORDER BY ID DESC LIMIT ?", limit)
+	return transactions, err
+}
+
+// Stores the rollover of the current promotions as a transaction to review
+func (db *DatabaseManager) PreviewRollover(createdBy int64) (*DBRolloverTransaction, error) {
+	current, err := db.ListPromotions()
+	if err != nil {
+		return nil, err
+	}
+	if len(current) == 0 {
+		return nil, errors.New("no promotion to roll over")
+	}
+	next := ComputeRollover(current)
+	previousJSON, err := json.Marshal(current)
+	if err != nil {
+		return nil, err
+	}
+	nextJSON, err := json.Marshal(next)
+	if err != nil {
+		return nil, err
+	}
+	academicYear := current.WithState(ggu.PromotionStateMP2I)
+
+	res, err := db.DB.Exec(`
+		INSERT INTO ROLLOVER_TRANSACTIONS (academic_year, previous_state, new_state, status, created_by, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, academicYear, string(previousJSON), string(nextJSON), RolloverStatusPreview, createdBy, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	return db.GetRolloverTransaction(id)
+}
+
+func samePromotions(a, b ggu.PromotionsInfo) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Moves the transaction from expected to status, and replaces the promotions from with to, all at once
+// Fails without changing anything if a concurrent run moved the transaction first, or if the promotions changed
+func (db *DatabaseManager) runRollover(id int64, from, to ggu.PromotionsInfo, expected, status, column string) error {
+	tx, err := db.DB.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	res, err := tx.Exec("UPDATE ROLLOVER_TRANSACTIONS SET status = ?, "+column+" = ? WHERE ID = ? AND status = ?", status, time.Now().UTC(), id, expected)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n != 1 {
+		return RolloverConflictError("this rollover is no longer " + expected)
+	}
+
+	current := ggu.PromotionsInfo{}
+	if err := tx.Select(&current, "SELECT * FROM PROMOTIONS ORDER BY promotion"); err != nil {
+		return err
+	}
+	if !samePromotions(current, from) {
+		return RolloverConflictError("the promotions changed since this transaction was created")
+	}
+	if err := replacePromotions(tx, to); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Applies a previewed rollover, or reverts an applied one
+// client is used to run the role sync along with it; it can be nil, e.g. when the bot isn't running
+func RunRolloverTransaction(client RoleSyncDiscordClient, id int64, revert bool, adminID int64) (*DBRolloverTransaction, error) {
+	t, err := DB.GetRolloverTransaction(id)
+	if err != nil {
+		return nil, err
+	}
+	if revert && t.Status != RolloverStatusApplied {
+		return nil, RolloverConflictError("only applied rollovers can be reverted")
+	}
+	if !revert && t.Status != RolloverStatusPreview {
+		return nil, RolloverConflictError("this rollover was already applied")
+	}
+	previous, next, err := t.States()
+	if err != nil {
+		return nil, err
+	}
+	from, to := previous, next
+	status, column, expected := RolloverStatusApplied, "applied_at", RolloverStatusPreview
+	if revert {
+		from, to = next, previous
+		status, column, expected = RolloverStatusReverted, "reverted_at", RolloverStatusApplied
+	}
+	if err := DB.runRollover(id, from, to, expected, status, column); err != nil {
+		return nil, err
+	}
+	DB.logger.With("rolloverID", id, "status", status, "academicYear", t.AcademicYear).Info("Ran academic year rollover")
+
+	refreshPromotionsRange()
+	EmitWebhookEvent(ggu.WebhookEventPromotionsChanged, to)
+
+	if client != nil && roleSyncConfig != nil {
+		runRolloverRoleSync(client, t, revert, adminID)
+	}
+
+	return DB.GetRolloverTransaction(id)
+}
+
+// Role sync failures are only logged: the promotions are the source of truth, and /rolesync can be run again
+func runRolloverRoleSync(client RoleSyncDiscordClient, t *DBRolloverTransaction, revert bool, adminID int64) {
+	l := DB.logger.With("rolloverID", t.ID)
+	if revert {
+		if t.RoleSyncTransactionID == nil {
+			return
+		}
+		if _, err := RunRoleSyncTransaction(client, *t.RoleSyncTransactionID, true); err != nil {
+			l.With("error", err).Error("Failed to revert the role sync of the rollover")
+		}
+		return
+	}
+
+	users, err := DB.ListUsers()
+	if err != nil {
+		l.With("error", err).Error("Failed to list users for the rollover role sync")
+		return
+	}
+	promotions, err := DB.ListPromotions()
+	if err != nil {
+		l.With("error", err).Error("Failed to list promotions for the rollover role sync")
+		return
+	}
+	changes, err := ComputeRoleSyncChanges(client, roleSyncConfig, users, promotions)
+	if err != nil {
+		l.With("error", err).Error("Failed to compute the rollover role sync")
+		return
+	}
+	roleSyncID, err := DB.CreateRoleSyncTransaction(roleSyncConfig.GuildID, changes, adminID)
+	if err != nil {
+		l.With("error", err).Error("Failed to store the rollover role sync")
+		return
+	}
+	if _, err := DB.DB.Exec("UPDATE ROLLOVER_TRANSACTIONS SET role_sync_transaction_id = ? WHERE ID = ?", roleSyncID, t.ID); err != nil {
+		l.With("error", err).Error("Failed to link the role sync to the rollover")
+	}
+	failures, err := RunRoleSyncTransaction(client, roleSyncID, false)
+	if err != nil || failures > 0 {
+		l.With("error", err, "failures", failures, "roleSyncID", roleSyncID).Error("Role sync of the rollover didn't fully succeed")
+	}
+}
+
+func describePromotionsChange(previous, next ggu.PromotionsInfo) string {
+	lines := []string{}
+	for _, p := range next {
+		before := previous.Get(p.Promotion)
+		if before == nil {
+			lines = append(lines, strconv.Itoa(p.Promotion)+": new, "+p.State)
+		} else if before.State != p.State {
+			lines = append(lines, strconv.Itoa(p.Promotion)+": "+before.State+" -> "+p.State)
+		}
+	}
+	for _, p := range previous {
+		if next.Get(p.Promotion) == nil {
+			lines = append(lines, strconv.Itoa(p.Promotion)+": removed")
+		}
+	}
+	if len(lines) == 0 {
+		return "No change"
+	}
+	return strings.Join(lines, "\n")
+}
+
+// the bot is used to run the role sync along with the rollover, if it is running
+func rolloverDiscordClient() RoleSyncDiscordClient {
+	if globalDiscordBot == nil {
+		return nil
+	}
+	return globalDiscordBot.Session
+}
+
+func authenticateAdmin(w http.ResponseWriter, r *http.Request) (*ggu.HXI2JWTClaims, bool) {
+	user, err := authManager.AuthenticateHTTPRequest(w, r, true)
+	if err != nil {
+		return nil, false
+	}
+	if !user.HasPermission(ggu.RoleAdmin) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return nil, false
+	}
+	return user, true
+}
+
+func writeRolloverTransaction(w http.ResponseWriter, t *DBRolloverTransaction) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(t)
+	if err != nil {
+		slog.With("error", err).Error("Failed to write rollover transaction")
+	}
+}
+
+// POST /api/admin/rollover
+func HandleRolloverPreview(w http.ResponseWriter, r *http.Request) {
+	admin, ok := authenticateAdmin(w, r)
+	if !ok {
+		return
+	}
+	t, err := DB.PreviewRollover(admin.IDInt())
+	if err != nil {
+		slog.With("error", err).Error("Failed to preview rollover")
+		http.Error(w, "Failed to preview rollover: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeRolloverTransaction(w, t)
+}
+
+// POST /api/admin/rollover/{id}/apply and POST /api/admin/rollover/{id}/revert
+func HandleRolloverRun(revert bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		admin, ok := authenticateAdmin(w, r)
+		if !ok {
+			return
+		}
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid ID", http.StatusBadRequest)
+			return
+		}
+		t, err := RunRolloverTransaction(rolloverDiscordClient(), id, revert, admin.IDInt())
+		var conflict RolloverConflictError
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "Rollover not found", http.StatusNotFound)
+			return
+		} else if errors.As(err, &conflict) {
+			http.Error(w, conflict.Error(), http.StatusConflict)
+			return
+		} else if err != nil {
+			slog.With("error", err, "rolloverID", id, "revert", revert).Error("Failed to run rollover")
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		writeRolloverTransaction(w, t)
+	}
+}
+
+// GET /api/project/promotions
+func ProjectHandleListPromotions(w http.ResponseWriter, r *http.Request) {
+	if !checkProjectApiAuth(w, r, ggu.APIRoleAuthentication) {
+		return
+	}
+	promotions, err := DB.ListPromotions()
+	if err != nil {
+		slog.With("error", err).Error("Error listing promotions")
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(promotions)
+	if err != nil {
+		slog.With("error", err).Error("Error encoding promotions")
+	}
+}
+
+func (discordBot *DiscordBot) addCommandRollover() {
+	const cmdName = "rollover"
+	var p int64 = discordgo.PermissionAdministrator | discordgo.PermissionManageRoles | discordgo.PermissionManageGuild
+
+	var command = &discordgo.ApplicationCommand{
+		Name:                     cmdName,
+		Description:              "Move every promotion to the next academic year",
+		DefaultMemberPermissions: &p,
+		Options: []*discordgo.ApplicationCommandOption{
+			{
+				Type:        discordgo.ApplicationCommandOptionString,
+				Name:        "action",
+				Description: "What to do",
+				Required:    true,
+				Choices: []*discordgo.ApplicationCommandOptionChoice{
+					{Name: "preview", Value: "preview"},
+					{Name: "apply", Value: "apply"},
+					{Name: "revert", Value: "revert"},
+					{Name: "list", Value: "list"},
+				},
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionInteger,
+				Name:        "id",
+				Description: "The ID of the rollover, for apply and revert",
+				Required:    false,
+			},
+		},
+	}
+
+	hand := func(session *discordgo.Session, interaction *discordgo.InteractionCreate) {
+		admin, err := discordBot.GetInteractionClaims(interaction)
+		if err != nil || admin == nil {
+			discordBot.RespondWithError(interaction, "Failed to get user claims")
+			return
+		}
+		if !admin.IsAdmin() {
+			discordBot.RespondWithError(interaction, "You do not have permission to use this command")
+			return
+		}
+
+		data := interaction.ApplicationCommandData()
+		var action string
+		var rolloverID int64
+		for _, option := range data.Options {
+			switch option.Name {
+			case "action":
+				action = option.StringValue()
+			case "id":
+				rolloverID = option.IntValue()
+			}
+		}
+		if (action == "apply" || action == "revert") && rolloverID == 0 {
+			discordBot.RespondWithError(interaction, "The `id` option is required for this action")
+			return
+		}
+
+		// the role sync run with the rollover can take longer than the interaction deadline
+		err = session.InteractionRespond(interaction.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+			Data: &discordgo.InteractionResponseData{
+				Flags: discordgo.MessageFlagsEphemeral,
+			},
+		})
+		if err != nil {
+			discordBot.Logger.With("err", err).Error("Failed to defer interaction response")
+			return
+		}
+		respond := func(embed *discordgo.MessageEmbed) {
+			_, err := session.InteractionResponseEdit(interaction.Interaction, &discordgo.WebhookEdit{
+				Embeds: &[]*discordgo.MessageEmbed{embed},
+			})
+			if err != nil {
+				discordBot.Logger.With("err", err).Error("Failed to edit interaction response")
+			}
+		}
+		respondError := func(text string) {
+			respond(&discordgo.MessageEmbed{
+				Title:       "Error",
+				Description: text,
+				Color:       0xFF0000,
+			})
+		}
+
+		switch action {
+		case "preview":
+			t, err := DB.PreviewRollover(admin.IDInt())
+			if err != nil {
+				discordBot.Logger.With("err", err).Error("Failed to preview rollover")
+				respondError("Failed to preview rollover: " + err.Error())
+				return
+			}
+			previous, next, _ := t.States()
+			respond(&discordgo.MessageEmbed{
+				Title:       "Rollover #" + strconv.FormatInt(t.ID, 10) + " - apply it with /rollover action:apply id:" + strconv.FormatInt(t.ID, 10),
+				Description: describePromotionsChange(previous, next),
+				Color:       0xFFA500,
+			})
+		case "apply", "revert":
+			t, err := RunRolloverTransaction(session, rolloverID, action == "revert", admin.IDInt())
+			if err != nil {
+				respondError("Failed to " + action + " rollover: " + err.Error())
+				return
+			}
+			previous, next, _ := t.States()
+			if action == "revert" {
+				previous, next = next, previous
+			}
+			respond(&discordgo.MessageEmbed{
+				Title:       "Rollover #" + strconv.FormatInt(rolloverID, 10) + " " + action + " done",
+				Description: describePromotionsChange(previous, next),
+				Color:       0x00FF00,
+			})
+		case "list":
+			transactions, err := DB.ListRolloverTransactions(10)
+			if err != nil {
+				discordBot.Logger.With("err", err).Error("Failed to list rollovers")
+				respondError("Failed to list rollovers")
+				return
+			}
+			embed := &discordgo.MessageEmbed{
+				Title:       "Latest rollovers",
+				Description: "No rollover",
+				Color:       0xFFA500,
+			}
+			if len(transactions) > 0 {
+				embed.Description = ""
+			}
+			for _, t := range transactions {
+				embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{
+					Name:  "#" + strconv.FormatInt(t.ID, 10) + " - " + t.Status,
+					Value: "Year " + strconv.Itoa(t.AcademicYear) + "-" + strconv.Itoa(t.AcademicYear+1) + ", created " + t.CreatedAt.Format("2006-01-02 15:04"),
+				})
+			}
+			respond(embed)
+		default:
+			respondError("Unknown action")
+		}
+	}
+
+	discordBot.AddCommand(cmdName, command, hand)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"sync"
+	"testing"
+
+	ggu "github.com/itsvyle/hxi2/global-go/utils"
+)
+
+func TestComputeRolloverColors(t *testing.T) {
+	current := ggu.DefaultPromotions()
+	for range len(rolloverPromotionColors) {
+		next := ComputeRollover(current)
+		_, maxp := next.Range()
+		if next.Get(maxp).Color == next.Get(maxp-1).Color {
+			t.Fatalf("%d has the color of the promotion before it: %s", maxp, next.Get(maxp).Color)
+		}
+		current = next
+	}
+
+	custom := ggu.PromotionsInfo{{Promotion: 2030, State: ggu.PromotionStateIncoming, Color: "#123456"}}
+	if c := ComputeRollover(custom).Get(2031).Color; c != rolloverPromotionColors[2031%len(rolloverPromotionColors)] {
+		t.Errorf("after a custom color: %s", c)
+	}
+}
+
+func TestRunRolloverTransactionConcurrentApplies(t *testing.T) {
+	openTestDatabase(t)
+	before, _ := DB.ListPromotions()
+	rollover, err := DB.PreviewRollover(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const runs = 8
+	var wg sync.WaitGroup
+	errs := make(chan error, runs)
+	for range runs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := RunRolloverTransaction(nil, rollover.ID, false, 1)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	succeeded := 0
+	for err := range errs {
+		if err == nil {
+			succeeded++
+		}
+	}
+	if succeeded != 1 {
+		t.Fatalf("%d applies succeeded, expected 1", succeeded)
+	}
+
+	after, _ := DB.ListPromotions()
+	_, next, _ := rollover.States()
+	if !samePromotions(after, next) {
+		t.Fatalf("promotions after apply: %v", after)
+	}
+	if _, maxp := ggu.GetPromotionsRange(); maxp != 2026 {
+		t.Errorf("the promotions range wasn't refreshed: %d", maxp)
+	}
+
+	if _, err := RunRolloverTransaction(nil, rollover.ID, true, 1); err != nil {
+		t.Fatal(err)
+	}
+	reverted, _ := DB.ListPromotions()
+	if !samePromotions(reverted, before) {
+		t.Fatalf("promotions after revert: %v", reverted)
+	}
+	if tr, _ := DB.GetRolloverTransaction(rollover.ID); tr.Status != RolloverStatusReverted {
+		t.Errorf("status after revert: %s", tr.Status)
+	}
+}
+
+func TestRunRolloverTransactionPromotionsChanged(t *testing.T) {
+	openTestDatabase(t)
+	rollover, err := DB.PreviewRollover(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DB.DB.Exec("UPDATE PROMOTIONS SET color = '#000000' WHERE promotion = 2021"); err != nil {
+		t.Fatal(err)
+	}
+	var conflict RolloverConflictError
+	if _, err := RunRolloverTransaction(nil, rollover.ID, false, 1); !errors.As(err, &conflict) {
+		t.Fatalf("the rollover was applied over changed promotions: %v", err)
+	}
+	if _, err := RunRolloverTransaction(nil, rollover.ID+1, false, 1); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("unknown rollover: %v", err)
+	}
+	// the status update was rolled back with the rest
+	if tr, _ := DB.GetRolloverTransaction(rollover.ID); tr.Status != RolloverStatusPreview || tr.AppliedAt != nil {
+		t.Errorf("status after the failed apply: %s", tr.Status)
+	}
+}
@@ -42,4 +42,114 @@ CREATE TABLE IF NOT EXISTS TEMPORARY_CODES (
     recheck_after INTEGER NOT NULL DEFAULT 0, -- seconds before rechecking with auth server if service is still valid - 0 means no recheck
     created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
     expires_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS DELETION_REQUESTS (
+    ID INTEGER PRIMARY KEY,
+    user_id INTEGER NOT NULL, -- no foreign key, as the user is deleted once the request completes
+    status TEXT NOT NULL DEFAULT 'requested', -- requested, confirmed, completed, cancelled
+    requested_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    confirmed_by INTEGER, -- ID of the admin who confirmed the deletion
+    confirmed_at DATETIME,
+    completed_at DATETIME
+);
+
+CREATE TABLE IF NOT EXISTS DELETION_ACKS (
+    request_id INTEGER NOT NULL,
+    project_id INTEGER NOT NULL, -- PROJECTS.ID of the project that processed the deletion
+    acked_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE(request_id, project_id),
+    FOREIGN KEY (request_id) REFERENCES DELETION_REQUESTS(ID) ON DELETE CASCADE,
+    FOREIGN KEY (project_id) REFERENCES PROJECTS(ID) ON DELETE CASCADE
+)
+;
+
+CREATE TABLE IF NOT EXISTS PROJECT_WEBHOOKS (
+    ID INTEGER PRIMARY KEY,
+    project_id INTEGER NOT NULL, -- PROJECTS.ID of the project receiving the webhooks
+    callback_url TEXT NOT NULL,
+    secret TEXT NOT NULL, -- shared secret used to sign the payloads
+    events TEXT NOT NULL DEFAULT '', -- comma separated list of subscribed events, empty for all
+    disabled INTEGER NOT NULL DEFAULT 0,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (project_id) REFERENCES PROJECTS(ID) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS WEBHOOK_DELIVERIES (
+    ID INTEGER PRIMARY KEY,
+    webhook_id INTEGER NOT NULL,
+    event_id TEXT NOT NULL,
+    event_type TEXT NOT NULL,
+    payload TEXT NOT NULL,
+    status TEXT NOT NULL DEFAULT 'pending', -- pending, delivered, failed
+    attempts INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    last_status_code INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT NOT NULL DEFAULT '',
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    delivered_at DATETIME,
+    FOREIGN KEY (webhook_id) REFERENCES PROJECT_WEBHOOKS(ID) ON DELETE CASCADE
+)
+;
+
+CREATE TABLE IF NOT EXISTS PROJECTS (
+    ID INTEGER PRIMARY KEY,
+    name TEXT NOT NULL UNIQUE,
+    redirect_origins TEXT NOT NULL DEFAULT '', -- comma separated list of origins users may be redirected to after login, e.g. https://tree.hxi2.fr
+    guest_usernames TEXT NOT NULL DEFAULT '', -- comma separated list of TEMPORARY_CODES usernames that may log in to this project
+    default_redirect TEXT NOT NULL DEFAULT '', -- where guests are sent after a temporary login
+    api_token_id INTEGER UNIQUE, -- API_TOKENS.id of the key the project calls the project API with, NULL if it has none
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (api_token_id) REFERENCES API_TOKENS(id) ON DELETE SET NULL
+);
+
+CREATE TABLE IF NOT EXISTS PENDING_USERS (
+    ID INTEGER PRIMARY KEY,
+    discord_id TEXT NOT NULL UNIQUE,
+    username TEXT NOT NULL,
+    first_name TEXT NOT NULL,
+    promotion SMALLINT DEFAULT 0,
+    permissions INTEGER DEFAULT 0,
+    matched_role_id TEXT NOT NULL, -- the Discord role the promotion and permissions were derived from
+    requested_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+-- users rejected from the pending list, who are no longer provisioned when they log in
+CREATE TABLE IF NOT EXISTS REJECTED_USERS (
+    ID INTEGER PRIMARY KEY,
+    discord_id TEXT NOT NULL UNIQUE,
+    username TEXT NOT NULL,
+    rejected_by INTEGER NOT NULL, -- the ID of the admin
+    rejected_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS ROLE_SYNC_TRANSACTIONS (
+    ID INTEGER PRIMARY KEY,
+    guild_id TEXT NOT NULL,
+    changes TEXT NOT NULL, -- JSON: discord ID -> roles added and removed, same format as scripts/discord-role-migration transactions
+    status TEXT NOT NULL DEFAULT 'preview', -- preview, applying, applied, partial (some updates failed), reverting, reverted
+    created_by INTEGER NOT NULL, -- admin user ID
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    applied_at DATETIME,
+    reverted_at DATETIME
+);
+
+CREATE TABLE IF NOT EXISTS PROMOTIONS (
+    promotion INTEGER PRIMARY KEY, -- first year of mp2i
+    state TEXT NOT NULL, -- incoming, mp2i, mpi, alumni
+    color TEXT NOT NULL DEFAULT '' -- background color in the tree
+);
+
+CREATE TABLE IF NOT EXISTS ROLLOVER_TRANSACTIONS (
+    ID INTEGER PRIMARY KEY,
+    academic_year INTEGER NOT NULL, -- the year being archived, e.g. 2024 for 2024-2025
+    previous_state TEXT NOT NULL, -- JSON snapshot of PROMOTIONS before the rollover
+    new_state TEXT NOT NULL, -- JSON snapshot of PROMOTIONS after the rollover
+    role_sync_transaction_id INTEGER, -- the role sync run along with the rollover, if any
+    status TEXT NOT NULL DEFAULT 'preview', -- preview, applied, reverted
+    created_by INTEGER NOT NULL, -- admin user ID
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    applied_at DATETIME,
+    reverted_at DATETIME,
+    FOREIGN KEY (role_sync_transaction_id) REFERENCES ROLE_SYNC_TRANSACTIONS(ID)
 )
\ No newline at end of file
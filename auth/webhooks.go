@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	ggu "github.com/itsvyle/hxi2/global-go/utils"
+)
+
+// Webhooks notify projects of changes to users, so they don't have to poll the whole user list.
+// Every event is stored as one delivery per subscribed webhook in WEBHOOK_DELIVERIES, which acts as the delivery log;
+// the dispatcher then sends them, retrying failed ones with an exponential backoff.
+
+const (
+	WebhookDeliveryPending   = "pending"
+	WebhookDeliveryDelivered = "delivered"
+	WebhookDeliveryFailed    = "failed"
+)
+
+const webhookMaxAttempts = 12
+const webhookBaseRetryDelay = 30 * time.Second
+const webhookMaxRetryDelay = 6 * time.Hour
+
+// Delivered webhooks are removed from the log after this duration; failed ones are kept
+const webhookDeliveryLogRetention = 30 * 24 * time.Hour
+
+type DBProjectWebhook struct {
+	ID          int64     `db:"ID" json:"id"`
+	ProjectID   int64     `db:"project_id" json:"projectID"`
+	CallbackURL string    `db:"callback_url" json:"callbackURL"`
+	Secret      string    `db:"secret" json:"-"`
+	Events      string    `db:"events" json:"events"`
+	Disabled    bool      `db:"disabled" json:"disabled"`
+	CreatedAt   time.Time `db:"created_at" json:"createdAt"`
+}
+
+func (wh *DBProjectWebhook) IsSubscribed(eventType string) bool {
+	if wh.Events == "" {
+		return true
+	}
+	for _, e := range strings.Split(wh.Events, ",") {
+		if strings.TrimSpace(e) == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+type DBWebhookDelivery struct {
+	ID             int64      `db:"ID"`
+	WebhookID      int64      `db:"webhook_id"`
+	EventID        string     `db:"event_id"`
+	EventType      string     `db:"event_type"`
+	Payload        string     `db:"payload"`
+	Status         string     `db:"status"`
+	Attempts       int        `db:"attempts"`
+	NextAttemptAt  time.Time  `db:"next_attempt_at"`
+	LastStatusCode int        `db:"last_status_code"`
+	LastError      string     `db:"last_error"`
+	CreatedAt      time.Time  `db:"created_at"`
+	DeliveredAt    *time.Time `db:"delivered_at"`
+	// joined from PROJECT_WEBHOOKS
+	CallbackURL string `db:"callback_url"`
+	Secret      string `db:"secret"`
+}
+
+func (db *DatabaseManager) ListEnabledWebhooks() ([]DBProjectWebhook, error) {
+	webhooks := []DBProjectWebhook{}
+	err := db.DB.Select(&webhooks, "SELECT * FROM PROJECT_WEBHOOKS WHERE disabled = 0")
+	return webhooks, err
+}
+
+func (db *DatabaseManager) ListWebhooks() ([]DBProjectWebhook, error) {
+	webhooks := []DBProjectWebhook{}
+	err := db.DB.Select(&webhooks, "SELECT * FROM PROJECT_WEBHOOKS ORDER BY ID")
+	return webhooks, err
+}
+
+func (db *DatabaseManager) CreateWebhook(wh *DBProjectWebhook) error {
+	wh.CreatedAt = time.Now().UTC()
+	res, err := db.DB.NamedExec(`
+		INSERT INTO PROJECT_WEBHOOKS (project_id, callback_url, secret, events, created_at)
+		VALUES (:project_id, :callback_url, :secret, :events, :created_at)
+	`, wh)
+	if err != nil {
+		return err
+	}
+	wh.ID, err = res.LastInsertId()
+	return err
+}
+
+// Stores one pending delivery per webhook subscribed to the event
+func (db *DatabaseManager) EnqueueWebhookEvent(eventType string, data any) error {
+	webhooks, err := db.ListEnabledWebhooks()
+	if err != nil {
+		return err
+	}
+
+	eventID, err := ggu.GenerateRandomString(16)
+	if err != nil {
+		return err
+	}
+	dataBytes, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(ggu.WebhookEvent{
+		ID:        eventID,
+		Type:      eventType,
+		CreatedAt: time.Now().UTC(),
+		Data:      dataBytes,
+	})
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	for _, wh := range webhooks {
+		if !wh.IsSubscribed(eventType) {
+			continue
+		}
+		_, err = db.DB.Exec(`
+			INSERT INTO WEBHOOK_DELIVERIES (webhook_id, event_id, event_type, payload, status, next_attempt_at, created_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?)
+		`, wh.ID, eventID, eventType, string(payload), WebhookDeliveryPending, now, now)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *DatabaseManager) ListDueWebhookDeliveries(limit int) ([]DBWebhookDelivery, error) {
+	deliveries := []DBWebhookDelivery{}
+	err := db.DB.Select(&deliveries, `
+		SELECT d.*, w.callback_url, w.secret FROM WEBHOOK_DELIVERIES d
+		JOIN PROJECT_WEBHOOKS w ON w.ID = d.webhook_id
+		WHERE d.status = ? AND d.next_attempt_at <= ? AND w.disabled = 0
+		ORDER BY d.ID
+		LIMIT ?
+	`, WebhookDeliveryPending, time.Now().UTC(), limit)
+	return deliveries, err
+}
+
+func (db *DatabaseManager) RecordWebhookAttempt(d *DBWebhookDelivery) error {
+	_, err := db.DB.Exec(`
+		UPDATE WEBHOOK_DELIVERIES
+		SET status = ?, attempts = ?, next_attempt_at = ?, last_status_code = ?, last_error = ?, delivered_at = ?
+		WHERE ID = ?
+	`, d.Status, d.Attempts, d.NextAttemptAt, d.LastStatusCode, d.LastError, d.DeliveredAt, d.ID)
+	return err
+}
+
+func (db *DatabaseManager) PruneWebhookDeliveries() error {
+	_, err := db.DB.Exec("DELETE FROM WEBHOOK_DELIVERIES WHERE status = ? AND delivered_at < ?", WebhookDeliveryDelivered, time.Now().UTC().Add(-webhookDeliveryLogRetention))
+	return err
+}
+
+type WebhookDispatcher struct {
+	db     *DatabaseManager
+	client *http.Client
+	wake   chan struct{}
+	logger *slog.Logger
+}
+
+var webhookDispatcher *WebhookDispatcher
+
+func NewWebhookDispatcher(db *DatabaseManager) *WebhookDispatcher {
+	return &WebhookDispatcher{
+		db:     db,
+		client: &http.Client{Timeout: 10 * time.Second},
+		wake:   make(chan struct{}, 1),
+		logger: ggu.GetServiceSpecificLogger("WEBHOK", "\033[38;2;0;150;100m"),
+	}
+}
+
+// Makes the dispatcher send the pending deliveries right away, instead of waiting for the next tick
+func (wd *WebhookDispatcher) Wake() {
+	select {
+	case wd.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Sends the due deliveries until ctx is cancelled
+func (wd *WebhookDispatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(15 * time.Second)
+	defer ticker.Stop()
+	pruneTicker := time.NewTicker(1 * time.Hour)
+	defer pruneTicker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-wd.wake:
+		case <-pruneTicker.C:
+			if err := wd.db.PruneWebhookDeliveries(); err != nil {
+				wd.logger.With("error", err).Error("Failed to prune webhook delivery log")
+			}
+			continue
+		}
+		wd.dispatchDue()
+	}
+}
+
+func (wd *WebhookDispatcher) dispatchDue() {
+	for {
+		deliveries, err := wd.db.ListDueWebhookDeliveries(50)
+		if err != nil {
+			wd.logger.With("error", err).Error("Failed to list due webhook deliveries")
+			return
+		}
+		for i := range deliveries {
+			wd.deliver(&deliveries[i])
+		}
+		if len(deliveries) < 50 {
+			return
+		}
+	}
+}
+
+func (wd *WebhookDispatcher) deliver(d *DBWebhookDelivery) {
+	l := wd.logger.With("deliveryID", d.ID, "event", d.EventType, "url", d.CallbackURL)
+	d.Attempts++
+
+	statusCode, err := wd.send(d)
+	d.LastStatusCode = statusCode
+	if err == nil {
+		now := time.Now().UTC()
+		d.Status = WebhookDeliveryDelivered
+		d.DeliveredAt = &now
+		d.LastError = ""
+		l.Debug("Delivered webhook")
+	} else {
+		d.LastError = err.Error()
+		if d.Attempts >= webhookMaxAttempts {
+			d.Status = WebhookDeliveryFailed
+			l.With("error", err, "attempts", d.Attempts).Error("Giving up on webhook delivery")
+		} else {
+			d.NextAttemptAt = time.Now().UTC().Add(webhookRetryDelay(d.Attempts))
+			l.With("error", err, "attempts", d.Attempts, "nextAttempt", d.NextAttemptAt).Warn("Failed to deliver webhook, will retry")
+		}
+	}
+
+	if err := wd.db.RecordWebhookAttempt(d); err != nil {
+		l.With("error", err).Error("Failed to record webhook delivery attempt")
+	}
+}
+
+func (wd *WebhookDispatcher) send(d *DBWebhookDelivery) (int, error) {
+	body := []byte(d.Payload)
+	req, err := http.NewRequest(http.MethodPost, d.CallbackURL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(ggu.WebhookEventHeader, d.EventType)
+	req.Header.Set(ggu.WebhookDeliveryHeader, d.EventID)
+	req.Header.Set(ggu.WebhookSignatureHeader, ggu.SignWebhookPayload([]byte(d.Secret), time.Now(), body))
+
+	resp, err := wd.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("status code not OK: %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+func webhookRetryDelay(attempts int) time.Duration {
+	delay := webhookBaseRetryDelay
+	for i := 1; i < attempts && delay < webhookMaxRetryDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, webhookMaxRetryDelay)
+}
+
+// Queues the event for every subscribed project; errors are only logged, as they must not fail the change itself
+func EmitWebhookEvent(eventType string, data any) {
+	err := DB.EnqueueWebhookEvent(eventType, data)
+	if err != nil {
+		slog.With("error", err, "event", eventType).Error("Failed to enqueue webhook event")
+		return
+	}
+	if webhookDispatcher != nil {
+		webhookDispatcher.Wake()
+	}
+}
+
+func EmitUserCreated(user *DBUser) {
+	EmitWebhookEvent(ggu.WebhookEventUserCreated, ggu.WebhookUserData{User: user.ProjectUser()})
+}
+
+// Emits user.updated, and permissions.changed if the permissions differ between the two versions
+func EmitUserUpdated(oldUser *DBUser, newUser *DBUser) {
+	EmitWebhookEvent(ggu.WebhookEventUserUpdated, ggu.WebhookUserData{User: newUser.ProjectUser()})
+	if oldUser != nil && oldUser.Permissions != newUser.Permissions {
+		EmitWebhookEvent(ggu.WebhookEventPermissionsChanged, ggu.WebhookUserData{
+			User:           newUser.ProjectUser(),
+			OldPermissions: oldUser.Permissions,
+		})
+	}
+}
+
+func EmitUserDeleted(userID int64) {
+	EmitWebhookEvent(ggu.WebhookEventUserDeleted, ggu.WebhookUserDeletedData{UserID: userID})
+}
@@ -0,0 +1,36 @@
+// The services refuse state-changing requests that don't come from their own pages (see CSRFProtection in global-go)
+// Browsers prove it with the Origin header; the token from /api/csrf is sent too, for the browsers that don't
+
+let csrfToken: Promise<string> | null = null;
+
+export function getCSRFToken(refresh = false): Promise<string> {
+    if (!csrfToken || refresh) {
+        csrfToken = fetch(`/api/csrf`, { cache: "no-store" })
+            .then((res) => (res.ok ? res.json() : { token: "" }))
+            .then((data: { token: string }) => data.token)
+            // the Origin checks can still let the request through
+            .catch(() => "");
+    }
+    return csrfToken;
+}
+
+// fetch, with the CSRF token; retries once with a new token if it was refused, e.g. after the service restarted
+export async function csrfFetch(
+    input: RequestInfo | URL,
+    init: RequestInit = {},
+): Promise<Response> {
+    const send = async (refresh: boolean) => {
+        const headers = new Headers(init.headers);
+        const token = await getCSRFToken(refresh);
+        if (token) {
+            headers.set("X-CSRF-Token", token);
+        }
+        return fetch(input, { ...init, headers });
+    };
+
+    const res = await send(false);
+    if (res.status === 403 && res.headers.has("X-CSRF-Error")) {
+        return send(true);
+    }
+    return res;
+}
@@ -59,6 +59,17 @@ func (discordBot *DiscordBot) Start() error {
 	return nil
 }
 
+// Closes the connection to Discord
+func (discordBot *DiscordBot) Stop() error {
+	err := discordBot.Session.Close()
+	if err != nil {
+		discordBot.Logger.With("err", err).Error("Failed to close the discord session")
+		return err
+	}
+	discordBot.Logger.Debug("Discord bot stopped")
+	return nil
+}
+
 func (discordBot *DiscordBot) onReady(session *discordgo.Session, _ *discordgo.Ready) {
 	discordBot.Logger.With("username", session.State.User.Username).Info("Bot is ready")
 	session.AddHandler(discordBot.onCommandInteraction)
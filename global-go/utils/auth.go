@@ -2,21 +2,25 @@ package globalgoutils
 
 import (
 	"bytes"
-	"crypto/ecdsa"
-	"crypto/x509"
+	"context"
 	"database/sql"
 	"encoding/base64"
 	"encoding/json"
-	"encoding/pem"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
 	"net/url"
 	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/cristalhq/jwt/v5"
+	"github.com/itsvyle/hxi2/global-go/utils/config"
+	"github.com/itsvyle/hxi2/global-go/utils/metrics"
 )
 
 const CookieToken = "HXI2_TOKEN"
@@ -34,6 +38,8 @@ const (
 const (
 	APIRoleListUsers      = 1 << 1 // 2
 	APIRoleAuthentication = 1 << 2 // 4
+	// Projects with this role hold user data, and have to acknowledge account deletions before they complete
+	APIRoleAccountDeletion = 1 << 3 // 8
 )
 
 // this is stored in a cookie accessible by javascript, and is used only to display client side information
@@ -72,9 +78,10 @@ func (c *HXI2JWTClaims) IsStudent() bool {
 	return c.HasPermission(RoleStudent)
 }
 
+// Responds 403 when the user doesn't have the permission; the user is authenticated, so it isn't a 401
 func (c *HXI2JWTClaims) CheckPermHTTP(w http.ResponseWriter, permission int) bool {
 	if !c.HasPermission(permission) {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		http.Error(w, "Forbidden", http.StatusForbidden)
 		return false
 	}
 	return true
@@ -93,49 +100,63 @@ type AuthManager struct {
 	verifier      jwt.Verifier
 	Logger        *slog.Logger
 	projectAPIKey string
+	// error of the last periodic fetch of the public key, nil when it succeeded
+	keyFetchErr atomic.Pointer[error]
+	// closed by Close to stop refetching the public key
+	stopKeyFetch     chan struct{}
+	stopKeyFetchOnce sync.Once
 	// the oldToken has already been verified for the signature
-	RenewToken func(a *AuthManager, oldToken, refreshToken string) (res *AuthRenewalResponse, err error)
+	RenewToken func(ctx context.Context, a *AuthManager, oldToken, refreshToken string) (res *AuthRenewalResponse, err error)
+	// valid tokens expiring within RenewBefore are renewed ahead of time, so that the requests of a page rarely find them expired; 0 to disable
+	RenewBefore time.Duration
+	// renewals in progress or recently done, by refresh token
+	renewals   map[string]*renewalCall
+	renewalsMu sync.Mutex
 }
 
-func NewAuthManagerFromEnv() (*AuthManager, error) {
-	Hxi2AuthURL := os.Getenv("HXI2_AUTH_URL")
-	if Hxi2AuthURL == "" {
-		return nil, fmt.Errorf("HXI2_AUTH_URL not set")
-	}
-
-	Hxi2AuthEndpoint := os.Getenv("HXI2_AUTH_ENDPOINT")
-	if Hxi2AuthEndpoint == "" {
-		return nil, fmt.Errorf("HXI2_AUTH_ENDPOINT not set")
-	}
+// The variables of NewAuthManagerFromConfig, for the config of the services
+type AuthManagerConfig struct {
+	AuthURL       string `env:"HXI2_AUTH_URL" required:"true"`
+	AuthEndpoint  string `env:"HXI2_AUTH_ENDPOINT" required:"true"`
+	CookiesDomain string `env:"HXI2_COOKIES_DOMAIN" required:"true"`
+	// fetched from the auth service if empty
+	PublicKeyPEM  string        `env:"HXI2_PUBLIC_KEY_PEM"`
+	ProjectAPIKey string        `env:"HXI2_PROJECT_API_KEY" secret:"true"`
+	RenewBefore   time.Duration `env:"HXI2_AUTH_RENEW_BEFORE" default:"1m"`
+}
 
-	HXI2AuthCookieDomain := os.Getenv("HXI2_COOKIES_DOMAIN")
-	if HXI2AuthCookieDomain == "" {
-		return nil, fmt.Errorf("HXI2_COOKIES_DOMAIN not set")
+func NewAuthManagerFromEnv() (*AuthManager, error) {
+	var c AuthManagerConfig
+	err := config.Load(&c, "", os.LookupEnv)
+	if err != nil {
+		return nil, err
 	}
-	HXI2PublicKeyPEM := os.Getenv("HXI2_PUBLIC_KEY_PEM")
+	return NewAuthManagerFromConfig(c)
+}
 
+func NewAuthManagerFromConfig(c AuthManagerConfig) (*AuthManager, error) {
 	var err error
 	var a *AuthManager = &AuthManager{
 		Logger:       GetAuthLogger(),
 		AutoFetchKey: false,
-		AuthURL:      Hxi2AuthURL,
-		AuthEndpoint: Hxi2AuthEndpoint,
-		LoginPageURL: Hxi2AuthURL + "/login",
-		CookieDomain: HXI2AuthCookieDomain,
+		AuthURL:      c.AuthURL,
+		AuthEndpoint: c.AuthEndpoint,
+		LoginPageURL: c.AuthURL + "/login",
+		CookieDomain: c.CookiesDomain,
 		RenewToken:   DefaultRenewToken,
+		RenewBefore:  c.RenewBefore,
 	}
-	HXI2ProjectAPIKey := os.Getenv("HXI2_PROJECT_API_KEY")
-	if HXI2ProjectAPIKey != "" {
-		a.projectAPIKey = HXI2ProjectAPIKey
+	if c.ProjectAPIKey != "" {
+		a.projectAPIKey = c.ProjectAPIKey
 		a.Logger.Debug("Project API key set")
 	} else {
 		a.Logger.Info("Couldn't find a HXI2_PROJECT_API_KEY; you will need one to make requests to the authentication api in production")
 	}
 
-	if HXI2PublicKeyPEM == "" {
+	if c.PublicKeyPEM == "" {
 		a, err = NewAuthManagerAutoFetchKey(a)
 	} else {
-		a, err = NewAuthManagerPublicKey(a, HXI2PublicKeyPEM)
+		a, err = NewAuthManagerPublicKey(a, c.PublicKeyPEM)
 	}
 	if err != nil {
 		return nil, err
@@ -145,40 +166,18 @@ func NewAuthManagerFromEnv() (*AuthManager, error) {
 
 }
 
-func loadECDSAPublicKey(pemData []byte) (*ecdsa.PublicKey, error) {
-	// Decode the PEM block
-	block, _ := pem.Decode(pemData)
-	if block == nil || block.Type != "PUBLIC KEY" {
-		return nil, fmt.Errorf("failed to decode PEM block or incorrect type: %s", block.Type)
-	}
-
-	// Parse the public key
-	pubKey, err := x509.ParsePKIXPublicKey(block.Bytes)
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse public key: %w", err)
-	}
-
-	// Assert that the parsed key is an ECDSA public key
-	ecdsaPubKey, ok := pubKey.(*ecdsa.PublicKey)
-	if !ok {
-		return nil, fmt.Errorf("public key is not of type ECDSA")
-	}
-
-	return ecdsaPubKey, nil
-}
-
 func GetAuthLogger() *slog.Logger {
 	return GetServiceSpecificLogger("AUTHEN", "\033[38;2;100;0;150m")
 }
 
 func NewAuthManagerPublicKey(a *AuthManager, publicKeyPEM string) (*AuthManager, error) {
 	var err error
-	publicKey, err := loadECDSAPublicKey([]byte(publicKeyPEM))
+	publicKeys, err := LoadECDSAPublicKeys([]byte(publicKeyPEM))
 	if err != nil {
 		return nil, err
 	}
 
-	a.verifier, err = jwt.NewVerifierES(jwt.ES256, publicKey)
+	a.verifier, err = NewKeySetVerifier(publicKeys)
 	if err != nil {
 		return nil, err
 	}
@@ -206,7 +205,8 @@ func NewAuthManagerAutoFetchKey(a *AuthManager) (*AuthManager, error) {
 	}
 
 	ticker := time.NewTicker(5 * time.Minute)
-	quit := make(chan struct{})
+	a.stopKeyFetch = make(chan struct{})
+	quit := a.stopKeyFetch
 	go func() {
 		for {
 			select {
@@ -214,6 +214,9 @@ func NewAuthManagerAutoFetchKey(a *AuthManager) (*AuthManager, error) {
 				err := a.FetchKey()
 				if err != nil {
 					a.Logger.With("error", err).Error("Failed to refetch public authentication key")
+					a.keyFetchErr.Store(&err)
+				} else {
+					a.keyFetchErr.Store(nil)
 				}
 			case <-quit:
 				ticker.Stop()
@@ -225,6 +228,16 @@ func NewAuthManagerAutoFetchKey(a *AuthManager) (*AuthManager, error) {
 	return a, nil
 }
 
+// Stops refetching the public key
+func (a *AuthManager) Close() error {
+	a.stopKeyFetchOnce.Do(func() {
+		if a.stopKeyFetch != nil {
+			close(a.stopKeyFetch)
+		}
+	})
+	return nil
+}
+
 func (a *AuthManager) FetchKey() error {
 	// Fetch the public key from the remote URL
 	if !a.AutoFetchKey {
@@ -235,17 +248,12 @@ func (a *AuthManager) FetchKey() error {
 	}
 	fetchURL := a.AuthEndpoint + AuthRemotePublicKeyPath
 
-	req, err := http.NewRequest(http.MethodGet, fetchURL, nil)
+	req, err := a.newAuthRequest(context.Background(), http.MethodGet, fetchURL, nil)
 	if err != nil {
 		a.Logger.With("error", err, "url", fetchURL).Error("Failed to create project request")
 		return err
 	}
 
-	req.Header.Set("Content-Type", "application/json")
-	if a.projectAPIKey != "" {
-		req.Header.Set("Authorization", "Bearer "+a.projectAPIKey)
-	}
-
 	client := &http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
@@ -262,12 +270,13 @@ func (a *AuthManager) FetchKey() error {
 		return fmt.Errorf("failed to read response body: %w", err)
 	}
 
-	publicKey, err := loadECDSAPublicKey(body)
+	// the signing key of the auth service, followed by the keys it signed with previously
+	publicKeys, err := LoadECDSAPublicKeys(body)
 	if err != nil {
-		return fmt.Errorf("failed to load ECDSA public key: %w", err)
+		return fmt.Errorf("failed to load ECDSA public keys: %w", err)
 	}
 
-	v, err := jwt.NewVerifierES(jwt.ES256, publicKey)
+	v, err := NewKeySetVerifier(publicKeys)
 	if err != nil {
 		return fmt.Errorf("failed to create JWT verifier: %w", err)
 	}
@@ -277,6 +286,32 @@ func (a *AuthManager) FetchKey() error {
 	return nil
 }
 
+// Health check: a public key is loaded, and the auth service answers on its internal endpoint
+func (a *AuthManager) HealthCheck(ctx context.Context) error {
+	if a.verifier == nil {
+		return errors.New("no public key loaded")
+	}
+	if err := a.keyFetchErr.Load(); err != nil {
+		return fmt.Errorf("failed to refetch the public key: %w", *err)
+	}
+	if a.AuthEndpoint == "" {
+		return nil
+	}
+	req, err := a.newAuthRequest(ctx, http.MethodGet, a.AuthEndpoint+"/healthz", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("auth service unreachable: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("auth service unhealthy: status %d", resp.StatusCode)
+	}
+	return nil
+}
+
 // doesn't check expiry
 func (a *AuthManager) VerifyTokenNoDate(token string) (*HXI2JWTClaims, error) {
 	if a.verifier == nil {
@@ -308,102 +343,119 @@ type AuthRenewalResponse struct {
 	SmallData             *SmallData `json:"small_data"`
 }
 
-func DefaultRenewToken(a *AuthManager, token, refreshToken string) (*AuthRenewalResponse, error) {
+// Builds a request to the auth service, authenticated with the project API key,
+// and forwarding the ID of the request being handled, if any
+func (a *AuthManager) newAuthRequest(ctx context.Context, method, url string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if a.projectAPIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+a.projectAPIKey)
+	}
+	if id := RequestID(ctx); id != "" {
+		req.Header.Set(HeaderRequestID, id)
+	}
+	return req, nil
+}
+
+// The auth manager's logger, with the ID of the request being handled
+func (a *AuthManager) requestLogger(ctx context.Context) *slog.Logger {
+	if id := RequestID(ctx); id != "" {
+		return a.Logger.With("requestID", id)
+	}
+	return a.Logger
+}
+
+func DefaultRenewToken(ctx context.Context, a *AuthManager, token, refreshToken string) (*AuthRenewalResponse, error) {
 	data, err := json.Marshal(AuthRenewalRequest{
 		Token:        token,
 		RefreshToken: refreshToken,
 	})
 	if err != nil {
-		a.Logger.With("error", err, "token", token, "refreshToken", refreshToken).Error("Failed to marshal renewal request data")
+		a.requestLogger(ctx).With("error", err).Error("Failed to marshal renewal request data")
 		return nil, err
 	}
 
 	url := a.AuthEndpoint + AuthRemoteRenewPath
-	req, err := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(data))
+	logger := a.requestLogger(ctx)
+	req, err := a.newAuthRequest(ctx, http.MethodPost, url, bytes.NewBuffer(data))
 	if err != nil {
-		a.Logger.With("error", err, "url", url).Error("Failed to create request to renew token")
+		logger.With("error", err, "url", url).Error("Failed to create request to renew token")
 		return nil, err
 	}
 
-	req.Header.Set("Content-Type", "application/json")
-	if a.projectAPIKey != "" {
-		req.Header.Set("Authorization", "Bearer "+a.projectAPIKey)
-	}
-
 	client := &http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
-		a.Logger.With("error", err, "url", url).Error("Failed to send request to renew token")
+		logger.With("error", err, "url", url).Error("Failed to send request to renew token")
 		return nil, err
 	}
 	defer resp.Body.Close()
 
 	bodyBytes, err := io.ReadAll(resp.Body)
 	if err != nil {
-		a.Logger.With("error", err, "url", url).Error("Failed to read response body")
+		logger.With("error", err, "url", url).Error("Failed to read response body")
 		return nil, err
 	}
 
 	if resp.StatusCode != http.StatusOK {
 		err = fmt.Errorf("status code not OK: %s", resp.Status)
-		a.Logger.With("status", resp.Status, "url", url, "resBody", string(bodyBytes)).Error("Failed to renew token")
+		logger.With("status", resp.Status, "url", url, "resBody", string(bodyBytes)).Error("Failed to renew token")
 		return nil, err
 	}
 
 	var renewalResponse AuthRenewalResponse
 	err = json.Unmarshal(bodyBytes, &renewalResponse)
 	if err != nil {
-		a.Logger.With("error", err, "url", url, "resBody", string(bodyBytes)).Error("Failed to unmarshal response body")
+		logger.With("error", err, "url", url, "resBody", string(bodyBytes)).Error("Failed to unmarshal response body")
 		return nil, err
 	}
 
 	return &renewalResponse, nil
 }
 
-func (a *AuthManager) RenewTemporaryToken(token string) (string, error) {
+func (a *AuthManager) RenewTemporaryToken(ctx context.Context, token string) (string, error) {
 	data, err := json.Marshal(AuthRenewalRequest{
 		Token: token,
 	})
 	if err != nil {
-		a.Logger.With("error", err, "token", token).Error("Failed to marshal renewal temporary request data")
+		a.requestLogger(ctx).With("error", err).Error("Failed to marshal renewal temporary request data")
 		return "", err
 	}
 
 	url := a.AuthEndpoint + AuthRemoteTempRenewPath
-	req, err := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(data))
+	logger := a.requestLogger(ctx)
+	req, err := a.newAuthRequest(ctx, http.MethodPost, url, bytes.NewBuffer(data))
 	if err != nil {
-		a.Logger.With("error", err, "url", url).Error("Failed to create request to renew token")
+		logger.With("error", err, "url", url).Error("Failed to create request to renew token")
 		return "", err
 	}
 
-	req.Header.Set("Content-Type", "application/json")
-	if a.projectAPIKey != "" {
-		req.Header.Set("Authorization", "Bearer "+a.projectAPIKey)
-	}
-
 	client := &http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
-		a.Logger.With("error", err, "url", url).Error("Failed to send request to renew token")
+		logger.With("error", err, "url", url).Error("Failed to send request to renew token")
 		return "", err
 	}
 	defer resp.Body.Close()
 
 	bodyBytes, err := io.ReadAll(resp.Body)
 	if err != nil {
-		a.Logger.With("error", err, "url", url).Error("Failed to read response body")
+		logger.With("error", err, "url", url).Error("Failed to read response body")
 		return "", err
 	}
 
 	if resp.StatusCode != http.StatusOK {
 		err = fmt.Errorf("status code not OK: %s", resp.Status)
-		a.Logger.With("status", resp.Status, "url", url, "resBody", string(bodyBytes)).Error("Failed to renew token")
+		logger.With("status", resp.Status, "url", url, "resBody", string(bodyBytes)).Error("Failed to renew token")
 		return "", err
 	}
 
 	newToken := string(bodyBytes)
 	if newToken == "" {
-		a.Logger.Error("RenewTemporaryToken returned empty token")
+		logger.Error("RenewTemporaryToken returned empty token")
 		return "", fmt.Errorf("renewed token is empty")
 	}
 
@@ -415,29 +467,50 @@ type ProcessRequestAuthResponse struct {
 	RenewalResponse *AuthRenewalResponse
 }
 
-func (a *AuthManager) ProcessRequestAuth(providedToken string, providedRefreshToken string) (*ProcessRequestAuthResponse, error) {
+func (a *AuthManager) ProcessRequestAuth(ctx context.Context, providedToken string, providedRefreshToken string) (*ProcessRequestAuthResponse, error) {
 	claims, err := a.VerifyTokenNoDate(providedToken)
 	if err != nil {
+		metrics.AuthVerifications.WithLabelValues("invalid").Inc()
 		return nil, fmt.Errorf("failed to verify token: %w", err)
 	}
 	var renewalResponse *AuthRenewalResponse = nil
 	if !claims.IsValidAt(time.Now().UTC()) {
 		if claims.Temporary {
+			metrics.AuthVerifications.WithLabelValues("expired").Inc()
 			return nil, fmt.Errorf("your temporary access token has expired, please log in again")
 		}
 		if providedRefreshToken == "" {
+			metrics.AuthVerifications.WithLabelValues("expired").Inc()
 			return nil, fmt.Errorf("failed to get refresh cookie: %w", err)
 		}
-		renewalResponse, err = a.RenewToken(a, providedToken, providedRefreshToken)
+		renewalResponse, err = a.renewTokenShared(ctx, providedToken, providedRefreshToken)
 		if err != nil {
+			metrics.AuthVerifications.WithLabelValues("expired").Inc()
 			return nil, fmt.Errorf("failed to renew token")
 		}
 
 		claims, err = a.VerifyTokenNoDate(renewalResponse.Token)
 		if err != nil || !claims.IsValidAt(time.Now().UTC()) {
-			a.Logger.With("error", err).Error("Failed to verify renewed token")
+			metrics.AuthVerifications.WithLabelValues("invalid").Inc()
+			a.requestLogger(ctx).With("error", err).Error("Failed to verify renewed token")
 			return nil, fmt.Errorf("failed to verify renewed token")
 		}
+		metrics.AuthVerifications.WithLabelValues("renewed").Inc()
+	} else if a.shouldRenewEarly(claims, providedRefreshToken) {
+		// the token is still valid, so the request goes through even if the renewal fails
+		res, err := a.renewTokenShared(ctx, providedToken, providedRefreshToken)
+		if err != nil {
+			a.requestLogger(ctx).With("error", err).Warn("Failed to renew token ahead of expiry")
+			metrics.AuthVerifications.WithLabelValues("valid").Inc()
+		} else if renewed, err := a.VerifyTokenNoDate(res.Token); err != nil || !renewed.IsValidAt(time.Now().UTC()) {
+			a.requestLogger(ctx).With("error", err).Error("Failed to verify renewed token")
+			metrics.AuthVerifications.WithLabelValues("valid").Inc()
+		} else {
+			claims, renewalResponse = renewed, res
+			metrics.AuthVerifications.WithLabelValues("renewed").Inc()
+		}
+	} else {
+		metrics.AuthVerifications.WithLabelValues("valid").Inc()
 	}
 
 	return &ProcessRequestAuthResponse{
@@ -446,19 +519,39 @@ func (a *AuthManager) ProcessRequestAuth(providedToken string, providedRefreshTo
 	}, nil
 }
 
-func (a *AuthManager) extractTokenFromRequest(r *http.Request) (string, error) {
+// The token comes from the Authorization header if the request has one, for scripts and other services, and from the cookie otherwise
+// Requests with an Authorization header are always treated as API requests: they are never redirected nor given cookies
+func (a *AuthManager) extractTokenFromRequest(r *http.Request) (token string, bearer bool, err error) {
+	if isBearerRequest(r) {
+		scheme, token, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+		token = strings.TrimSpace(token)
+		if !strings.EqualFold(scheme, "Bearer") || token == "" {
+			return "", true, fmt.Errorf("malformed Authorization header, expected Bearer <token>")
+		}
+		return token, true, nil
+	}
 	tokenCookie, err := r.Cookie(CookieToken)
 	if err != nil || tokenCookie == nil || tokenCookie.Value == "" {
-		return "", fmt.Errorf("no token cookie found")
+		return "", false, fmt.Errorf("no token cookie found")
 	}
-	return tokenCookie.Value, nil
+	return tokenCookie.Value, false, nil
 }
 
 // if isAPI it won't redirect, it will return a 401
 // if this function returns an error, it has already sent a response, just exit your handler
 func (a *AuthManager) _authenticateHTTPRequestDO_NOT_USE(w http.ResponseWriter, r *http.Request, isAPI bool) (*HXI2JWTClaims, error) {
+	token, bearer, err := a.extractTokenFromRequest(r)
 	redirect := func(e error) (*HXI2JWTClaims, error) {
+		if bearer && token == "" {
+			writeBearerError(w, http.StatusBadRequest, "invalid_request", e.Error())
+			return nil, e
+		}
+		if bearer {
+			writeBearerError(w, http.StatusUnauthorized, "invalid_token", e.Error())
+			return nil, e
+		}
 		if isAPI {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+bearerRealm+`"`)
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return nil, e
 		}
@@ -474,24 +567,41 @@ func (a *AuthManager) _authenticateHTTPRequestDO_NOT_USE(w http.ResponseWriter,
 		return nil, e
 	}
 
-	tokenCookie, err := a.extractTokenFromRequest(r)
-	if err != nil || tokenCookie == "" {
+	if err != nil || token == "" {
+		metrics.AuthFailures.WithLabelValues("no_token").Inc()
 		return redirect(err)
 	}
 
+	if bearer {
+		// no refresh token: an expired bearer token is refused, and the client has to get a new one
+		res, err := a.ProcessRequestAuth(r.Context(), token, "")
+		if err != nil {
+			metrics.AuthFailures.WithLabelValues("invalid_token").Inc()
+			a.requestLogger(r.Context()).With("error", err).Warn("Refused bearer token")
+			return redirect(fmt.Errorf("invalid or expired token"))
+		}
+		if res.Claims.Temporary {
+			// they are rechecked by renewing the cookie, so they can't be used as bearer tokens
+			metrics.AuthFailures.WithLabelValues("temporary_forbidden").Inc()
+			return redirect(fmt.Errorf("temporary tokens can't be used as bearer tokens"))
+		}
+		return res.Claims, nil
+	}
+
 	providedRefresh := ""
 	refreshCookie, err := r.Cookie(CookieRefresh)
 	if err == nil && refreshCookie != nil {
 		providedRefresh = refreshCookie.Value
 	}
 
-	res, err := a.ProcessRequestAuth(tokenCookie, providedRefresh)
+	res, err := a.ProcessRequestAuth(r.Context(), token, providedRefresh)
 	if err != nil {
-		a.Logger.With("error", err).Error("Failed to process request auth")
+		metrics.AuthFailures.WithLabelValues("invalid_token").Inc()
+		a.requestLogger(r.Context()).With("error", err).Error("Failed to process request auth")
 		return redirect(err)
 	}
 	if res == nil {
-		a.Logger.Error("ProcessRequestAuth returned nil")
+		a.requestLogger(r.Context()).Error("ProcessRequestAuth returned nil")
 		return redirect(fmt.Errorf("ProcessRequestAuth returned nil"))
 	}
 
@@ -531,17 +641,8 @@ func (a *AuthManager) AuthenticateHTTPRequest(w http.ResponseWriter, r *http.Req
 		return nil, err
 	}
 	if claims.Temporary {
-		if isAPI {
-			http.Error(w, "Temporary accounts are not allowed to access this resource", http.StatusForbidden)
-		} else {
-			body := "<html style=\"color-scheme: dark;\"><head><title>Forbidden</title><body>You aren't allowed to access this page with a temporary account. <a href=\"" + a.LoginPageURL + "\">Click here to login if you have an account</a></body></html>"
-			w.Header().Set("Content-Type", "text/html; charset=utf-8")
-			w.WriteHeader(http.StatusForbidden)
-			_, err = w.Write([]byte(body))
-			if err != nil {
-				slog.With("error", err).Error("Failed to write redirect response")
-			}
-		}
+		metrics.AuthFailures.WithLabelValues("temporary_forbidden").Inc()
+		a.writeForbidden(w, r, isAPI, "Temporary accounts are not allowed to access this resource", "You aren't allowed to access this page with a temporary account.")
 		return nil, fmt.Errorf("temporary accounts are not allowed to access this resource")
 	}
 	return claims, nil
@@ -554,25 +655,19 @@ func (a *AuthManager) AuthenticateHTTPRequestIncludingTemporary(w http.ResponseW
 	}
 	if claims.Temporary && claims.TemporaryRecheckAfter > 0 {
 		if claims.IssuedAt.Add(time.Duration(claims.TemporaryRecheckAfter) * time.Second).Before(time.Now().UTC()) {
-			tok, err := a.extractTokenFromRequest(r)
+			tok, _, err := a.extractTokenFromRequest(r)
 			if err != nil {
 				http.Error(w, "Failed to extract token from request", http.StatusUnauthorized)
 				return nil, fmt.Errorf("failed to extract token from request: %w", err)
 			}
 
-			newToken, err := a.RenewTemporaryToken(tok)
+			start := time.Now()
+			newToken, err := a.RenewTemporaryToken(r.Context(), tok)
+			metrics.AuthRenewalDuration.WithLabelValues("temporary").Observe(time.Since(start).Seconds())
+			metrics.AuthRenewals.WithLabelValues("temporary", metrics.Result(err)).Inc()
 			if err != nil {
-				if isAPI {
-					http.Error(w, "Temporary token expired", http.StatusForbidden)
-				} else {
-					body := "<html style=\"color-scheme: dark;\"><head><title>Forbidden</title><body>Your temporary token is expired and couldn't be renewed - you will need to login with a real account to access this ressource. <a href=\"" + a.LoginPageURL + "\">Click here to login if you have an account</a></body></html>"
-					w.Header().Set("Content-Type", "text/html; charset=utf-8")
-					w.WriteHeader(http.StatusForbidden)
-					_, err = w.Write([]byte(body))
-					if err != nil {
-						slog.With("error", err).Error("Failed to write redirect response")
-					}
-				}
+				metrics.AuthFailures.WithLabelValues("temporary_expired").Inc()
+				a.writeForbidden(w, r, isAPI, "Temporary token expired", "Your temporary token is expired and couldn't be renewed - you will need to login with a real account to access this ressource.")
 				return nil, fmt.Errorf("temporary token expired: %w", err)
 			}
 
@@ -591,13 +686,16 @@ func (a *AuthManager) AuthenticateHTTPRequestIncludingTemporary(w http.ResponseW
 	return claims, nil
 }
 
-func (a *AuthManager) HandleTempLogin(username string, redirectTo string) http.HandlerFunc {
+// Logs in the guest with the code passed as the raw query; project is the ID or name of the project in the auth service,
+// which decides where the guest is redirected afterwards
+func (a *AuthManager) HandleTempLogin(username string, project string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		query := r.URL.RawQuery
 		if query == "" {
 			http.Error(w, "Missing code", http.StatusBadRequest)
+			return
 		}
-		url := a.AuthURL + "/temp_login?username=" + url.QueryEscape(username) + "&redirectTo=" + url.QueryEscape(redirectTo) + "&code=" + url.QueryEscape(query)
+		url := a.AuthURL + "/temp_login?username=" + url.QueryEscape(username) + "&project=" + url.QueryEscape(project) + "&code=" + url.QueryEscape(query)
 
 		http.Redirect(w, r, url, http.StatusFound)
 	}
@@ -624,15 +722,46 @@ func (p *ProjectUser) DisplayName() string {
 }
 
 func (a *AuthManager) ProjectGetRequest(url string) ([]byte, error) {
-	req, err := http.NewRequest(http.MethodGet, url, nil)
+	req, err := a.newAuthRequest(context.Background(), http.MethodGet, url, nil)
 	if err != nil {
 		a.Logger.With("error", err, "url", url).Error("Failed to create project request")
 		return nil, err
 	}
 
-	req.Header.Set("Content-Type", "application/json")
-	if a.projectAPIKey != "" {
-		req.Header.Set("Authorization", "Bearer "+a.projectAPIKey)
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		a.Logger.With("error", err, "url", url).Error("Failed to send project request")
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	bodyBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		a.Logger.With("error", err, "url", url).Error("Failed to read response body")
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("status code not OK: %s", resp.Status)
+		a.Logger.With("status", resp.Status, "url", url, "resBody", string(bodyBytes)).Error("Failed to execute project request")
+		return nil, err
+	}
+
+	return bodyBytes, nil
+}
+
+func (a *AuthManager) ProjectPostRequest(url string, body any) ([]byte, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		a.Logger.With("error", err, "url", url).Error("Failed to marshal project request body")
+		return nil, err
+	}
+
+	req, err := a.newAuthRequest(context.Background(), http.MethodPost, url, bytes.NewBuffer(data))
+	if err != nil {
+		a.Logger.With("error", err, "url", url).Error("Failed to create project request")
+		return nil, err
 	}
 
 	client := &http.Client{}
@@ -0,0 +1,121 @@
+package globalgoutils
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/itsvyle/hxi2/global-go/utils/metrics"
+)
+
+type claimsContextKey struct{}
+
+// Returns the claims stored by the authentication middlewares, or nil outside of them
+func ClaimsFromContext(ctx context.Context) *HXI2JWTClaims {
+	c, _ := ctx.Value(claimsContextKey{}).(*HXI2JWTClaims)
+	return c
+}
+
+func withClaims(r *http.Request, c *HXI2JWTClaims) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), claimsContextKey{}, c))
+}
+
+// Browsers loading a page send text/html in Accept, while fetch() calls from the frontend don't
+// Pages redirect to the login page and get HTML errors, APIs get plain 401 and 403 responses
+func isAPIRequest(r *http.Request) bool {
+	return isBearerRequest(r) || !strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// Whether the request is authenticated with the Authorization header rather than the cookies
+func isBearerRequest(r *http.Request) bool {
+	return r.Header.Get("Authorization") != ""
+}
+
+const bearerRealm = "hxi2"
+
+// Responds with an RFC 6750 error, e.g. invalid_token or insufficient_scope
+func writeBearerError(w http.ResponseWriter, status int, code string, description string) {
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf("Bearer realm=%q, error=%q, error_description=%q", bearerRealm, code, description))
+	http.Error(w, description, status)
+}
+
+// Responds 403; apiMessage is sent to APIs, and htmlMessage is shown on pages with a link to the login page
+func (a *AuthManager) writeForbidden(w http.ResponseWriter, r *http.Request, isAPI bool, apiMessage string, htmlMessage string) {
+	if isBearerRequest(r) {
+		writeBearerError(w, http.StatusForbidden, "insufficient_scope", apiMessage)
+		return
+	}
+	if isAPI {
+		http.Error(w, apiMessage, http.StatusForbidden)
+		return
+	}
+	body := "<html style=\"color-scheme: dark;\"><head><title>Forbidden</title><body>" + html.EscapeString(htmlMessage) + " <a href=\"" + a.LoginPageURL + "\">Click here to login if you have an account</a></body></html>"
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusForbidden)
+	_, err := w.Write([]byte(body))
+	if err != nil {
+		slog.With("error", err).Error("Failed to write forbidden response")
+	}
+}
+
+func (a *AuthManager) checkPermission(w http.ResponseWriter, r *http.Request, c *HXI2JWTClaims, permission int) bool {
+	if c.HasPermission(permission) {
+		return true
+	}
+	metrics.AuthFailures.WithLabelValues("missing_permission").Inc()
+	a.writeForbidden(w, r, isAPIRequest(r), "Forbidden", "You don't have the permissions to access this page.")
+	return false
+}
+
+// Lets through users with a valid, non temporary token, and stores their claims in the context of the request
+//   - 401, or a redirect to the login page, when the request isn't authenticated
+//   - 403 for temporary accounts
+func (a *AuthManager) RequireAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := a.AuthenticateHTTPRequest(w, r, isAPIRequest(r))
+		if err != nil {
+			return
+		}
+		next.ServeHTTP(w, withClaims(r, c))
+	})
+}
+
+// Like RequireAuth, and responds 403 to the users without the permission
+func (a *AuthManager) RequirePermission(permission int) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			c, err := a.AuthenticateHTTPRequest(w, r, isAPIRequest(r))
+			if err != nil || !a.checkPermission(w, r, c, permission) {
+				return
+			}
+			next.ServeHTTP(w, withClaims(r, c))
+		})
+	}
+}
+
+// Like RequirePermission, but also lets through the temporary accounts of audience, the username given to HandleTempLogin
+// Temporary tokens are renewed when they have to be rechecked; temporary accounts of other audiences get a 403
+func (a *AuthManager) AllowTemporary(audience string, permission int) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			isAPI := isAPIRequest(r)
+			c, err := a.AuthenticateHTTPRequestIncludingTemporary(w, r, isAPI)
+			if err != nil {
+				return
+			}
+			if c.Temporary {
+				if c.Username != audience {
+					metrics.AuthFailures.WithLabelValues("temporary_forbidden").Inc()
+					a.writeForbidden(w, r, isAPI, "Temporary accounts are not allowed to access this resource", "You aren't allowed to access this page with this temporary account.")
+					return
+				}
+			} else if !a.checkPermission(w, r, c, permission) {
+				return
+			}
+			next.ServeHTTP(w, withClaims(r, c))
+		})
+	}
+}
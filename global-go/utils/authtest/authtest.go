@@ -0,0 +1,349 @@
+// Package authtest runs an in-process fake of the auth service, so that the handlers of the services can be tested
+// without it: it signs tokens for arbitrary claims, and serves the endpoints used by AuthManager from fixtures
+//
+//	s := authtest.NewServer(t)
+//	s.Users = []ggu.ProjectUser{{ID: 1, Username: "alice", Permissions: ggu.RoleStudent}}
+//	authManager = s.AuthManager(t)
+//	r := httptest.NewRequest("GET", "/api/list_users", nil)
+//	s.Authenticate(r, authtest.User(1, ggu.RoleStudent))
+package authtest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cristalhq/jwt/v5"
+	ggu "github.com/itsvyle/hxi2/global-go/utils"
+)
+
+// The project API key AuthManager is configured with, and that the server expects
+const APIKey = "authtest-project-api-key"
+
+const CookiesDomain = "hxi2.test"
+
+// Lifetime of the tokens minted by /api/renew and the claims helpers, like in the auth service
+const TokenLifetime = 10 * time.Minute
+
+const RefreshTokenLifetime = 30 * 24 * time.Hour
+
+type Server struct {
+	*httptest.Server
+	// served at /api/project/list_users
+	Users []ggu.ProjectUser
+	// served at /api/project/promotions; ggu.DefaultPromotions() by default
+	Promotions ggu.PromotionsInfo
+	// served at /api/project/deletions, and removed when acknowledged
+	Deletions []ggu.PendingDeletion
+
+	key     *ecdsa.PrivateKey
+	builder *jwt.Builder
+	mu      sync.Mutex
+	// refresh token -> claims of the user it renews; refresh tokens are single use, like in the auth service
+	refreshTokens map[string]*ggu.HXI2JWTClaims
+	// usernames of the temporary accounts whose code was revoked
+	revokedTemporary map[string]bool
+	renewals         atomic.Int64
+	tempRenewals     atomic.Int64
+}
+
+// Starts a server with a new key pair; it is closed when the test ends
+func NewServer(t testing.TB) *Server {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("authtest: failed to generate key: %v", err)
+	}
+	kid, err := ggu.KeyID(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("authtest: failed to compute key ID: %v", err)
+	}
+	signer, err := jwt.NewSignerES(jwt.ES256, key)
+	if err != nil {
+		t.Fatalf("authtest: failed to create signer: %v", err)
+	}
+
+	s := &Server{
+		Promotions:       ggu.DefaultPromotions(),
+		key:              key,
+		builder:          jwt.NewBuilder(signer, jwt.WithKeyID(kid)),
+		refreshTokens:    map[string]*ggu.HXI2JWTClaims{},
+		revokedTemporary: map[string]bool{},
+	}
+
+	router := http.NewServeMux()
+	router.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {})
+	router.HandleFunc("GET "+ggu.AuthRemotePublicKeyPath, s.handlePublicKey)
+	router.HandleFunc("POST "+ggu.AuthRemoteRenewPath, s.projectOnly(s.handleRenew))
+	router.HandleFunc("POST "+ggu.AuthRemoteTempRenewPath, s.projectOnly(s.handleTempRenew))
+	router.HandleFunc("GET /api/project/list_users", s.projectOnly(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		writeJSON(w, s.Users)
+	}))
+	router.HandleFunc("GET "+ggu.AuthRemotePromotionsPath, s.projectOnly(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		writeJSON(w, s.Promotions)
+	}))
+	router.HandleFunc("GET "+ggu.AuthRemoteDeletionsPath, s.projectOnly(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		writeJSON(w, s.Deletions)
+	}))
+	router.HandleFunc("POST "+ggu.AuthRemoteDeletionAckPath, s.projectOnly(s.handleDeletionAck))
+
+	s.Server = httptest.NewServer(router)
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Returns an AuthManager pointed at the server, which fetched its public key; it is closed when the test ends
+func (s *Server) AuthManager(t testing.TB) *ggu.AuthManager {
+	t.Helper()
+	a, err := ggu.NewAuthManagerFromConfig(ggu.AuthManagerConfig{
+		AuthURL:       s.URL,
+		AuthEndpoint:  s.URL,
+		CookiesDomain: CookiesDomain,
+		ProjectAPIKey: APIKey,
+	})
+	if err != nil {
+		t.Fatalf("authtest: failed to create the auth manager: %v", err)
+	}
+	t.Cleanup(func() { _ = a.Close() })
+	return a
+}
+
+// The PEM encoded public key, for HXI2_PUBLIC_KEY_PEM
+func (s *Server) PublicKeyPEM() string {
+	der, err := x509.MarshalPKIXPublicKey(&s.key.PublicKey)
+	if err != nil {
+		panic(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+// Claims of a user, valid for TokenLifetime
+func User(userID int64, permissions int) *ggu.HXI2JWTClaims {
+	now := time.Now().UTC()
+	return &ggu.HXI2JWTClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        rand.Text(),
+			Subject:   strconv.FormatInt(userID, 10),
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(TokenLifetime)),
+		},
+		Username:    "user" + strconv.FormatInt(userID, 10),
+		Permissions: permissions,
+	}
+}
+
+func Student(userID int64) *ggu.HXI2JWTClaims {
+	return User(userID, ggu.RoleStudent)
+}
+
+func Admin(userID int64) *ggu.HXI2JWTClaims {
+	return User(userID, ggu.RoleStudent|ggu.RoleAdmin)
+}
+
+// Claims of a temporary account, as given by HandleTempLogin; recheckAfter is in seconds, 0 to never recheck
+func Temporary(username string, recheckAfter int64) *ggu.HXI2JWTClaims {
+	c := User(0, 0)
+	c.Subject = ""
+	c.Username = username
+	c.Temporary = true
+	c.TemporaryRecheckAfter = recheckAfter
+	return c
+}
+
+// Moves the validity of the claims into the past, so that the token has to be renewed
+func Expired(c *ggu.HXI2JWTClaims) *ggu.HXI2JWTClaims {
+	issued := time.Now().UTC().Add(-2 * TokenLifetime)
+	c.IssuedAt = jwt.NewNumericDate(issued)
+	c.NotBefore = jwt.NewNumericDate(issued)
+	c.ExpiresAt = jwt.NewNumericDate(issued.Add(TokenLifetime))
+	return c
+}
+
+// Signs the claims as they are
+func (s *Server) Token(c *ggu.HXI2JWTClaims) string {
+	token, err := s.builder.Build(c)
+	if err != nil {
+		panic(err)
+	}
+	return token.String()
+}
+
+// Signs the claims, and returns a refresh token that renews them once
+func (s *Server) Login(c *ggu.HXI2JWTClaims) (token string, refreshToken string) {
+	refreshToken = rand.Text()
+	s.mu.Lock()
+	s.refreshTokens[refreshToken] = c
+	s.mu.Unlock()
+	return s.Token(c), refreshToken
+}
+
+// Sets the cookies of a user logged in with the claims on the request
+func (s *Server) Authenticate(r *http.Request, c *ggu.HXI2JWTClaims) {
+	token, refreshToken := s.Login(c)
+	r.AddCookie(&http.Cookie{Name: ggu.CookieToken, Value: token})
+	if !c.Temporary {
+		r.AddCookie(&http.Cookie{Name: ggu.CookieRefresh, Value: refreshToken})
+	}
+}
+
+// Makes /api/temp_renew refuse the temporary account, as when its code expires
+func (s *Server) RevokeTemporary(username string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.revokedTemporary[username] = true
+}
+
+// Number of successful calls to /api/renew
+func (s *Server) Renewals() int64 {
+	return s.renewals.Load()
+}
+
+// Number of successful calls to /api/temp_renew
+func (s *Server) TempRenewals() int64 {
+	return s.tempRenewals.Load()
+}
+
+func (s *Server) projectOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+APIKey {
+			http.Error(w, "Invalid API key", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (s *Server) handlePublicKey(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	_, _ = w.Write([]byte(s.PublicKeyPEM()))
+}
+
+// Checks the signature of the token, like the auth service; expired tokens are accepted
+func (s *Server) verify(token string) (*ggu.HXI2JWTClaims, error) {
+	verifier, err := ggu.NewKeySetVerifier([]*ecdsa.PublicKey{&s.key.PublicKey})
+	if err != nil {
+		return nil, err
+	}
+	t, err := jwt.Parse([]byte(token), verifier)
+	if err != nil {
+		return nil, err
+	}
+	c := &ggu.HXI2JWTClaims{}
+	if err := t.DecodeClaims(c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (s *Server) handleRenew(w http.ResponseWriter, r *http.Request) {
+	var req ggu.AuthRenewalRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" || req.RefreshToken == "" {
+		http.Error(w, "Token or refreshToken is empty", http.StatusBadRequest)
+		return
+	}
+	if _, err := s.verify(req.Token); err != nil {
+		http.Error(w, "Failed to verify token", http.StatusUnauthorized)
+		return
+	}
+
+	s.mu.Lock()
+	old, ok := s.refreshTokens[req.RefreshToken]
+	delete(s.refreshTokens, req.RefreshToken)
+	s.mu.Unlock()
+	if !ok {
+		http.Error(w, "Failed to renew token", http.StatusInternalServerError)
+		return
+	}
+
+	renewed := *old
+	fresh := User(0, 0)
+	renewed.ID = fresh.ID
+	renewed.IssuedAt = fresh.IssuedAt
+	renewed.NotBefore = fresh.NotBefore
+	renewed.ExpiresAt = fresh.ExpiresAt
+	token, refreshToken := s.Login(&renewed)
+	s.renewals.Add(1)
+
+	id, _ := strconv.ParseInt(renewed.Subject, 10, 64)
+	writeJSON(w, ggu.AuthRenewalResponse{
+		Token:                 token,
+		RefreshToken:          refreshToken,
+		RefreshTokenExpiresAt: time.Now().UTC().Add(RefreshTokenLifetime),
+		SmallData: &ggu.SmallData{
+			UserID:      id,
+			Username:    renewed.Username,
+			Permissions: renewed.Permissions,
+			Promotion:   renewed.Promotion,
+		},
+	})
+}
+
+func (s *Server) handleTempRenew(w http.ResponseWriter, r *http.Request) {
+	var req ggu.AuthRenewalRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+		http.Error(w, "Token is empty", http.StatusBadRequest)
+		return
+	}
+	c, err := s.verify(req.Token)
+	if err != nil {
+		http.Error(w, "Failed to verify token", http.StatusUnauthorized)
+		return
+	}
+	if !c.Temporary {
+		http.Error(w, "Token is not temporary", http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	revoked := s.revokedTemporary[c.Username]
+	s.mu.Unlock()
+	if revoked {
+		http.Error(w, "Temporary code expired", http.StatusUnauthorized)
+		return
+	}
+
+	renewed := Temporary(c.Username, c.TemporaryRecheckAfter)
+	renewed.ExpiresAt = c.ExpiresAt
+	s.tempRenewals.Add(1)
+	_, _ = w.Write([]byte(s.Token(renewed)))
+}
+
+func (s *Server) handleDeletionAck(w http.ResponseWriter, r *http.Request) {
+	var req ggu.DeletionAckRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, d := range s.Deletions {
+		if d.ID == req.ID {
+			s.Deletions = append(s.Deletions[:i], s.Deletions[i+1:]...)
+			writeJSON(w, map[string]bool{"success": true})
+			return
+		}
+	}
+	http.Error(w, fmt.Sprintf("No pending deletion %d", req.ID), http.StatusNotFound)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,260 @@
+package authtest
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	ggu "github.com/itsvyle/hxi2/global-go/utils"
+)
+
+// Responds with the ID of the user the middleware let through
+var echoClaims = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	_, _ = w.Write([]byte(ggu.ClaimsFromContext(r.Context()).Subject))
+})
+
+func findCookie(res *http.Response, name string) *http.Cookie {
+	for _, c := range res.Cookies() {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+func TestRequirePermission(t *testing.T) {
+	s := NewServer(t)
+	a := s.AuthManager(t)
+	handler := a.RequirePermission(ggu.RoleAdmin)(echoClaims)
+
+	for _, tc := range []struct {
+		name   string
+		claims *ggu.HXI2JWTClaims
+		status int
+	}{
+		{"admin", Admin(1), http.StatusOK},
+		{"student", Student(2), http.StatusForbidden},
+		{"temporary", Temporary("guest", 0), http.StatusForbidden},
+		{"anonymous", nil, http.StatusUnauthorized},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/api/admin", nil)
+			if tc.claims != nil {
+				s.Authenticate(r, tc.claims)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tc.status {
+				t.Fatalf("got %d, expected %d: %s", w.Code, tc.status, w.Body.String())
+			}
+			if tc.status == http.StatusOK && w.Body.String() != tc.claims.Subject {
+				t.Errorf("the claims in the context are those of %q", w.Body.String())
+			}
+		})
+	}
+
+	// bearer tokens go through the same checks
+	r := httptest.NewRequest(http.MethodGet, "/api/admin", nil)
+	r.Header.Set("Authorization", "Bearer "+s.Token(Admin(3)))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Body.String() != "3" {
+		t.Fatalf("bearer admin: %d %s", w.Code, w.Body.String())
+	}
+
+	// a token signed by another key is refused
+	other := NewServer(t)
+	r = httptest.NewRequest(http.MethodGet, "/api/admin", nil)
+	r.Header.Set("Authorization", "Bearer "+other.Token(Admin(1)))
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("token of another key: %d", w.Code)
+	}
+}
+
+func TestExpiredTokenIsRenewed(t *testing.T) {
+	s := NewServer(t)
+	a := s.AuthManager(t)
+	handler := a.RequirePermission(ggu.RoleStudent)(echoClaims)
+
+	r := httptest.NewRequest(http.MethodGet, "/api/me", nil)
+	s.Authenticate(r, Expired(Student(7)))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Body.String() != "7" {
+		t.Fatalf("got %d: %s", w.Code, w.Body.String())
+	}
+	if s.Renewals() != 1 {
+		t.Fatalf("%d renewals, expected 1", s.Renewals())
+	}
+
+	res := w.Result()
+	token, refresh := findCookie(res, ggu.CookieToken), findCookie(res, ggu.CookieRefresh)
+	if token == nil || refresh == nil || findCookie(res, ggu.CookieSmallData) == nil {
+		t.Fatalf("the renewed cookies weren't set: %v", res.Cookies())
+	}
+	if token.Domain != CookiesDomain {
+		t.Errorf("cookie domain: %q", token.Domain)
+	}
+	claims, err := a.VerifyTokenNoDate(token.Value)
+	if err != nil || claims.Subject != "7" || claims.ExpiresAt.Before(time.Now()) {
+		t.Fatalf("renewed token: %+v, %v", claims, err)
+	}
+
+	// the renewed cookies are used as they are, without another renewal
+	r = httptest.NewRequest(http.MethodGet, "/api/me", nil)
+	r.AddCookie(token)
+	r.AddCookie(refresh)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || s.Renewals() != 1 {
+		t.Fatalf("with the renewed cookies: %d, %d renewals", w.Code, s.Renewals())
+	}
+}
+
+func TestExpiredTokenRenewalFailures(t *testing.T) {
+	s := NewServer(t)
+	a := s.AuthManager(t)
+	handler := a.RequirePermission(ggu.RoleStudent)(echoClaims)
+
+	// the requests sent with the same expired cookies share one renewal, as the auth service rotates the refresh token
+	token, refresh := s.Login(Expired(Student(8)))
+	serve := func(handler http.Handler) int {
+		r := httptest.NewRequest(http.MethodGet, "/api/me", nil)
+		r.AddCookie(&http.Cookie{Name: ggu.CookieToken, Value: token})
+		r.AddCookie(&http.Cookie{Name: ggu.CookieRefresh, Value: refresh})
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+	for i := range 2 {
+		if code := serve(handler); code != http.StatusOK || s.Renewals() != 1 {
+			t.Fatalf("request %d with the expired cookies: %d, %d renewals", i+1, code, s.Renewals())
+		}
+	}
+	// another instance can't reuse the refresh token, which is single use
+	if code := serve(s.AuthManager(t).RequirePermission(ggu.RoleStudent)(echoClaims)); code != http.StatusUnauthorized {
+		t.Fatalf("reused refresh token: %d", code)
+	}
+
+	// an expired bearer token isn't renewed
+	r := httptest.NewRequest(http.MethodGet, "/api/me", nil)
+	r.Header.Set("Authorization", "Bearer "+s.Token(Expired(Student(9))))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized || s.Renewals() != 1 {
+		t.Fatalf("expired bearer token: %d, %d renewals", w.Code, s.Renewals())
+	}
+
+	// pages are redirected to the login page instead
+	r = httptest.NewRequest(http.MethodGet, "/me", nil)
+	r.Header.Set("Accept", "text/html")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusTemporaryRedirect {
+		t.Fatalf("anonymous page: %d", w.Code)
+	}
+}
+
+func TestTemporaryRecheck(t *testing.T) {
+	s := NewServer(t)
+	a := s.AuthManager(t)
+	handler := a.AllowTemporary("guest", ggu.RoleStudent)(echoClaims)
+
+	serve := func(c *ggu.HXI2JWTClaims) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/api/guest", nil)
+		s.Authenticate(r, c)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := serve(Temporary("guest", 60)); w.Code != http.StatusOK || s.TempRenewals() != 0 {
+		t.Fatalf("fresh temporary token: %d, %d renewals", w.Code, s.TempRenewals())
+	}
+	if w := serve(Temporary("other", 0)); w.Code != http.StatusForbidden {
+		t.Fatalf("temporary account of another audience: %d", w.Code)
+	}
+
+	// past its recheck delay, the token is renewed
+	due := Temporary("guest", 60)
+	due.IssuedAt.Time = due.IssuedAt.Add(-2 * time.Minute)
+	w := serve(due)
+	if w.Code != http.StatusOK || s.TempRenewals() != 1 || findCookie(w.Result(), ggu.CookieToken) == nil {
+		t.Fatalf("temporary token to recheck: %d, %d renewals", w.Code, s.TempRenewals())
+	}
+
+	// and refused once its code is revoked
+	s.RevokeTemporary("guest")
+	if w := serve(due); w.Code != http.StatusForbidden {
+		t.Fatalf("revoked temporary token: %d", w.Code)
+	}
+	if w := serve(Temporary("guest", 0)); w.Code != http.StatusOK {
+		t.Fatalf("temporary token that is never rechecked: %d", w.Code)
+	}
+}
+
+func TestProjectEndpoints(t *testing.T) {
+	s := NewServer(t)
+	s.Users = []ggu.ProjectUser{{ID: 1, Username: "alice", Permissions: ggu.RoleStudent}}
+	s.Deletions = []ggu.PendingDeletion{{ID: 10, UserID: 1}, {ID: 11, UserID: 2}}
+	a := s.AuthManager(t)
+
+	users, err := a.ProjectListUsers()
+	if err != nil || len(users) != 1 || users[0].Username != "alice" {
+		t.Fatalf("users: %v, %v", users, err)
+	}
+	promotions, err := a.ProjectGetPromotions()
+	if err != nil || len(promotions) != len(ggu.DefaultPromotions()) {
+		t.Fatalf("promotions: %v, %v", promotions, err)
+	}
+
+	// the deletion of user 2 fails once, and is retried on the next tick
+	var mu sync.Mutex
+	var handled []int64
+	failed := false
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		a.RunDeletionWatcher(ctx, 20*time.Millisecond, func(userID int64) error {
+			mu.Lock()
+			defer mu.Unlock()
+			if userID == 2 && !failed {
+				failed = true
+				return context.DeadlineExceeded
+			}
+			handled = append(handled, userID)
+			return nil
+		})
+		close(done)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s.mu.Lock()
+		remaining := len(s.Deletions)
+		s.mu.Unlock()
+		if remaining == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d deletions weren't acknowledged", remaining)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	<-done
+	mu.Lock()
+	defer mu.Unlock()
+	if !slices.Equal(handled, []int64{1, 2}) {
+		t.Fatalf("handled deletions: %v", handled)
+	}
+
+	if err := a.ProjectAckDeletion(10); err == nil {
+		t.Error("a deletion was acknowledged twice")
+	}
+}
@@ -1,129 +1,492 @@
 package globalgoutils
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log/slog"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/itsvyle/hxi2/global-go/utils/metrics"
 )
 
-// should be sync safe
+var errCacherStopped = errors.New("cacher stopped")
+
+// A failing getter is retried after 1s, 2s, 4s... up to cacherMaxBackoff
+const cacherMinBackoff = time.Second
+const cacherMaxBackoff = 5 * time.Minute
+
+// Stale values are served for at least this long while the getter fails
+const DefaultCacheMaxStaleness = time.Hour
+
+// A fetched value; snapshots are never modified, they are replaced
+type cacheSnapshot[T any] struct {
+	value *T
+	// when the getter returned the value, for the staleness
+	fetchedAt time.Time
+	// when the value last changed, including by Patch
+	updatedAt time.Time
+	// the ForceInvalidate generation when the fetch started; the value is stale once it changes
+	generation uint64
+	// incremented every time the value changes; the dependents record it
+	version uint64
+	// the versions of the upstreams when the fetch started, in the order of Cacher.upstreams
+	upstreamVersions []uint64
+}
+
+type cacheFailure struct {
+	err      error
+	failures int
+	retryAt  time.Time
+}
+
+// Caches the value of getter, and refreshes it every RefreshRate; safe for concurrent use
+//   - stale values are served while a single background refresh runs, until they are older than MaxStaleness:
+//     Get then waits for the refresh, and fails if it fails
+//   - after an error, the getter isn't called again before an exponential backoff, and Get fails right away
+//     when it has no value to serve
+//   - with DependsOn, the value is refreshed whenever an upstream value changes
 type Cacher[T any] struct {
-	CachedValue *T
-	getter      func() (T, error)
-	fetchMutex  sync.Mutex
-	cacherName  string
+	getter     func() (T, error)
+	cacherName string
+	// Seconds
 	RefreshRate int64
-	LastUpdated int64
 	// The minimum time to wait before allowing cache refresh requests
 	// Seconds, 0 to disable
-	MinimumWait         int64
-	lastRefreshAsked    int64
-	isWaitingForRefresh bool
-	logger              *slog.Logger
+	MinimumWait int64
+	// Beyond this age, the value isn't served anymore
+	MaxStaleness time.Duration
+	logger       *slog.Logger
+
+	snapshot atomic.Pointer[cacheSnapshot[T]]
+	// incremented by ForceInvalidate
+	generation atomic.Uint64
+	// nil when the last refresh succeeded
+	failure atomic.Pointer[cacheFailure]
+	// serializes the calls to the getter, and Patch
+	fetchMutex sync.Mutex
+	// set while a background refresh is running or about to
+	refreshing atomic.Bool
+	// set by Stop: the value is no longer refreshed
+	stopped atomic.Bool
+
+	// set by DependsOn, before the first Get
+	upstreams       []CacheDependency
+	dependentsMutex sync.Mutex
+	dependents      []CacheDependency
+
+	// debouncing of AskCacheRefresh
+	askMutex         sync.Mutex
+	nextAskedRefresh time.Time
+	askScheduled     bool
 }
 
 func NewCacher[T any](cacheName string, getter func() (T, error), refreshRate time.Duration, minimumWait int64) *Cacher[T] {
-	// get the name of the T type and put it in cacherName
 	c := &Cacher[T]{
-		getter:              getter,
-		RefreshRate:         int64(refreshRate.Seconds()),
-		fetchMutex:          sync.Mutex{},
-		cacherName:          cacheName,
-		MinimumWait:         minimumWait,
-		LastUpdated:         1,
-		lastRefreshAsked:    0,
-		isWaitingForRefresh: false,
-		logger:              slog.With("cacheName", cacheName),
+		getter:       getter,
+		RefreshRate:  int64(refreshRate.Seconds()),
+		cacherName:   cacheName,
+		MinimumWait:  minimumWait,
+		MaxStaleness: max(DefaultCacheMaxStaleness, 2*refreshRate),
+		logger:       slog.With("cacheName", cacheName),
 	}
+	metrics.RegisterCacheAge(cacheName, func() (float64, bool) {
+		age, ok := c.Age()
+		return age.Seconds(), ok
+	})
 
 	return c
 }
 
-// WARNING: This function isn't thread safe, and it bypasses the refresh rate limit
-func (c *Cacher[T]) refreshCache() error {
+func (c *Cacher[T]) isFresh(s *cacheSnapshot[T]) bool {
+	return s.generation == c.generation.Load() &&
+		time.Since(s.fetchedAt) <= time.Duration(c.RefreshRate)*time.Second &&
+		c.upToDateWithUpstreams(s)
+}
+
+// Calls the getter and stores its value; the caller must hold fetchMutex, and cascade after releasing it
+func (c *Cacher[T]) fetch() error {
+	if c.stopped.Load() {
+		return errCacherStopped
+	}
+	generation := c.generation.Load()
+	// read before the getter gets the upstream values, so that they are never older than recorded
+	upstreamVersions := c.currentUpstreamVersions()
+	start := time.Now()
 	v, err := c.getter()
+	metrics.CacheRefreshDuration.WithLabelValues(c.cacherName).Observe(time.Since(start).Seconds())
+	metrics.CacheRefreshes.WithLabelValues(c.cacherName, metrics.Result(err)).Inc()
 	if err != nil {
+		failures := 1
+		if previous := c.failure.Load(); previous != nil {
+			failures = previous.failures + 1
+		}
+		backoff := cacherMaxBackoff
+		if failures < 20 {
+			backoff = min(cacherMinBackoff<<(failures-1), cacherMaxBackoff)
+		}
+		c.failure.Store(&cacheFailure{err: err, failures: failures, retryAt: time.Now().Add(backoff)})
+		c.logger.With("error", err, "failures", failures, "retryIn", backoff).Warn("[cacher] Failed to refresh value")
 		return err
 	}
-	c.CachedValue = &v
-	c.LastUpdated = time.Now().Unix()
+	c.failure.Store(nil)
+	now := time.Now()
+	c.snapshot.Store(&cacheSnapshot[T]{
+		value:            &v,
+		fetchedAt:        now,
+		updatedAt:        now,
+		generation:       generation,
+		version:          c.cacheVersion() + 1,
+		upstreamVersions: upstreamVersions,
+	})
 	c.logger.Debug("[cacher] Updated value")
 	return nil
 }
 
-func (c *Cacher[T]) Get() (*T, error) {
-	if c.CachedValue == nil || time.Now().Unix()-c.LastUpdated > c.RefreshRate {
+// The error of the last refresh if the getter shouldn't be called yet
+func (c *Cacher[T]) backoffError() error {
+	if f := c.failure.Load(); f != nil && time.Now().Before(f.retryAt) {
+		return fmt.Errorf("%s: last refresh failed, retrying in %s: %w", c.cacherName, time.Until(f.retryAt).Round(time.Second), f.err)
+	}
+	return nil
+}
+
+// Fetches the value in the foreground, unless another caller just did
+func (c *Cacher[T]) refreshNow() (*T, error) {
+	c.fetchMutex.Lock()
+	if s := c.snapshot.Load(); s != nil && c.isFresh(s) {
+		c.fetchMutex.Unlock()
+		return s.value, nil
+	}
+	if err := c.backoffError(); err != nil {
+		c.fetchMutex.Unlock()
+		return nil, err
+	}
+	err := c.fetch()
+	s := c.snapshot.Load()
+	c.fetchMutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	// the caller doesn't wait for the dependents
+	go c.cascade()
+	return s.value, nil
+}
+
+// Starts a refresh in the background, unless one is running or the getter is backing off
+func (c *Cacher[T]) refreshInBackground() {
+	if c.stopped.Load() || c.backoffError() != nil || !c.refreshing.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		defer c.refreshing.Store(false)
 		c.fetchMutex.Lock()
-		defer c.fetchMutex.Unlock()
-		// Check again in case another goroutine updated the value
-		if c.CachedValue == nil || time.Now().Unix()-c.LastUpdated > c.RefreshRate {
-			err := c.refreshCache()
-			if err != nil {
-				c.logger.With("error", err).Debug("[cacher] Failed to get value")
-				return nil, err
-			}
+		if s := c.snapshot.Load(); s != nil && c.isFresh(s) {
+			c.fetchMutex.Unlock()
+			return
+		}
+		err := c.fetch()
+		c.fetchMutex.Unlock()
+		if err == nil {
+			c.cascade()
+		}
+	}()
+}
+
+// Returns the value; a stale one is returned while it is refreshed in the background
+// Only waits for the getter when there is no value yet, or when it is older than MaxStaleness
+func (c *Cacher[T]) Get() (*T, error) {
+	if s := c.snapshot.Load(); s != nil {
+		if c.isFresh(s) {
+			metrics.CacheRequests.WithLabelValues(c.cacherName, "hit").Inc()
+			return s.value, nil
 		}
+		if time.Since(s.fetchedAt) <= c.MaxStaleness {
+			metrics.CacheRequests.WithLabelValues(c.cacherName, "stale").Inc()
+			c.refreshInBackground()
+			return s.value, nil
+		}
+	}
+	metrics.CacheRequests.WithLabelValues(c.cacherName, "miss").Inc()
+	v, err := c.refreshNow()
+	if err != nil {
+		c.logger.With("error", err).Debug("[cacher] Failed to get value")
+		return nil, err
 	}
+	return v, nil
+}
 
-	return c.CachedValue, nil
+// Time since the value was fetched, false before the first fetch
+func (c *Cacher[T]) Age() (time.Duration, bool) {
+	s := c.snapshot.Load()
+	if s == nil {
+		return 0, false
+	}
+	return time.Since(s.fetchedAt), true
 }
 
-// GetNow returns the cached value without checking if it's outdated
-// If it's outdated, it will start a fetch in the background
-// If it's nil, it will start a fetch in the foreground
-func (c *Cacher[T]) GetNow() (*T, error) {
-	if c.CachedValue == nil {
-		return c.Get()
+// When the value last changed, by a fetch or Patch; zero before the first fetch
+func (c *Cacher[T]) LastUpdated() time.Time {
+	if s := c.snapshot.Load(); s != nil {
+		return s.updatedAt
 	}
-	if time.Now().Unix()-c.LastUpdated > c.RefreshRate {
-		go func() {
-			_, _ = c.Get()
-		}()
+	return time.Time{}
+}
+
+// The error of the last refresh, nil if it succeeded
+func (c *Cacher[T]) LastError() error {
+	if f := c.failure.Load(); f != nil {
+		return f.err
 	}
-	return c.CachedValue, nil
+	return nil
+}
+
+// Stops refreshing the value, e.g. before the database is closed; waits for a refresh in progress
+// Get then keeps returning the last value until it is older than MaxStaleness, and fails afterwards
+func (c *Cacher[T]) Stop() {
+	c.stopped.Store(true)
+	c.fetchMutex.Lock()
+	defer c.fetchMutex.Unlock()
+}
+
+// Health check: fails when the last refresh failed, as the value is then missing or outdated
+func (c *Cacher[T]) HealthCheck(_ context.Context) error {
+	err := c.LastError()
+	if err == nil {
+		return nil
+	}
+	if age, ok := c.Age(); ok {
+		return fmt.Errorf("last refresh failed, serving a value from %s ago: %w", age.Round(time.Second), err)
+	}
+	return fmt.Errorf("last refresh failed: %w", err)
 }
 
+// Marks the value as stale, and refreshes it in the background; Get serves the stale value until then
+// The dependents are refreshed once the new value is fetched
 func (c *Cacher[T]) ForceInvalidate() {
-	c.LastUpdated = 0
+	c.generation.Add(1)
+	c.refreshInBackground()
 }
 
+// Refreshes the value because it changed, ignoring the backoff
+// Synchronous if MinimumWait is 0; otherwise in the background, at most once every MinimumWait seconds,
+// and the requests made while a refresh is pending are merged into it
+// The dependents are refreshed afterwards, so only the cacher whose source changed needs to be asked
 func (c *Cacher[T]) AskCacheRefresh() {
 	if c.MinimumWait <= 0 {
 		c.fetchMutex.Lock()
-		defer c.fetchMutex.Unlock()
-		_ = c.refreshCache()
+		err := c.fetch()
+		c.fetchMutex.Unlock()
+		if err == nil {
+			c.cascade()
+		}
 		return
 	}
-	if c.isWaitingForRefresh {
-		c.lastRefreshAsked = time.Now().Unix()
+
+	c.askMutex.Lock()
+	defer c.askMutex.Unlock()
+	if c.askScheduled {
 		return
 	}
-	// im on cooldown, but not yet waiting for refresh, so start a request ASAP
-	if time.Now().Unix()-c.lastRefreshAsked < c.MinimumWait {
-		c.lastRefreshAsked = time.Now().Unix()
-		c.isWaitingForRefresh = true
-		go func() {
-			time.Sleep(time.Duration(c.MinimumWait) * time.Second)
-			c.fetchMutex.Lock()
-			defer c.fetchMutex.Unlock()
-			if !c.isWaitingForRefresh {
-				return
-			}
-			err := c.refreshCache()
-			if err != nil {
-				c.logger.With("error", err).Debug("[cacher] Failed to get value on refresh request")
-			}
-			c.isWaitingForRefresh = false
-		}()
-		return
+	now := time.Now()
+	at := now
+	if c.nextAskedRefresh.After(now) {
+		at = c.nextAskedRefresh
 	}
-	c.lastRefreshAsked = time.Now().Unix()
-	go func() {
+	c.nextAskedRefresh = at.Add(time.Duration(c.MinimumWait) * time.Second)
+	c.askScheduled = true
+	time.AfterFunc(at.Sub(now), func() {
+		// the requests made from now on need another refresh, as this one may have started before their change
+		c.askMutex.Lock()
+		c.askScheduled = false
+		c.askMutex.Unlock()
+
 		c.fetchMutex.Lock()
-		defer c.fetchMutex.Unlock()
-		err := c.refreshCache()
+		err := c.fetch()
+		c.fetchMutex.Unlock()
 		if err != nil {
 			c.logger.With("error", err).Debug("[cacher] Failed to get value on refresh request")
+			return
 		}
-	}()
+		c.cascade()
+	})
+}
+
+// Patch replaces the cached value with patch(current value), without calling the getter
+// Does nothing if no value was fetched yet, as the next Get will fetch an up to date one anyway
+func (c *Cacher[T]) Patch(patch func(current T) T) {
+	c.fetchMutex.Lock()
+	s := c.snapshot.Load()
+	if s == nil {
+		c.fetchMutex.Unlock()
+		return
+	}
+	v := patch(*s.value)
+	c.snapshot.Store(&cacheSnapshot[T]{
+		value:            &v,
+		fetchedAt:        s.fetchedAt,
+		updatedAt:        time.Now(),
+		generation:       s.generation,
+		version:          s.version + 1,
+		upstreamVersions: s.upstreamVersions,
+	})
+	c.fetchMutex.Unlock()
+	c.logger.Debug("[cacher] Patched value")
+	c.cascade()
+}
+
+// A cacher that others can depend on, see DependsOn; implemented by every Cacher
+type CacheDependency interface {
+	cacheName() string
+	// the version of the current value, 0 before the first fetch
+	cacheVersion() uint64
+	upstreamCachers() []CacheDependency
+	dependentCachers() []CacheDependency
+	addDependent(d CacheDependency)
+	// refreshes the value if an upstream changed since it was fetched; deferred holds the cachers that will
+	// be refreshed later, whose dependents must wait for them
+	refreshFromUpstreams(deferred map[CacheDependency]bool)
+}
+
+func (c *Cacher[T]) cacheName() string {
+	return c.cacherName
+}
+
+func (c *Cacher[T]) cacheVersion() uint64 {
+	if s := c.snapshot.Load(); s != nil {
+		return s.version
+	}
+	return 0
+}
+
+func (c *Cacher[T]) upstreamCachers() []CacheDependency {
+	return c.upstreams
+}
+
+func (c *Cacher[T]) dependentCachers() []CacheDependency {
+	c.dependentsMutex.Lock()
+	defer c.dependentsMutex.Unlock()
+	return slices.Clone(c.dependents)
+}
+
+func (c *Cacher[T]) addDependent(d CacheDependency) {
+	c.dependentsMutex.Lock()
+	defer c.dependentsMutex.Unlock()
+	c.dependents = append(c.dependents, d)
+}
+
+// Declares that the getter reads the values of upstreams, with their Get:
+//   - the value is stale as soon as an upstream value changes, and Get then refreshes it in the background
+//   - after an upstream value changes, the cachers depending on it are refreshed in topological order,
+//     so that each is built from the new values of all of its upstreams
+//
+// Must be called before the first Get; panics if it creates a cycle
+func (c *Cacher[T]) DependsOn(upstreams ...CacheDependency) {
+	for _, u := range upstreams {
+		if u == CacheDependency(c) || slices.Contains(transitiveUpstreams(u), CacheDependency(c)) {
+			panic(fmt.Sprintf("cacher %s can't depend on %s: it would create a cycle", c.cacherName, u.cacheName()))
+		}
+		c.upstreams = append(c.upstreams, u)
+		u.addDependent(c)
+	}
+}
+
+func transitiveUpstreams(d CacheDependency) []CacheDependency {
+	var all []CacheDependency
+	for _, u := range d.upstreamCachers() {
+		if !slices.Contains(all, u) {
+			all = append(all, u)
+			all = append(all, transitiveUpstreams(u)...)
+		}
+	}
+	return all
+}
+
+// The cachers depending on root, directly or not, each one after all of its upstreams
+func transitiveDependents(root CacheDependency) []CacheDependency {
+	visited := map[CacheDependency]bool{}
+	var order []CacheDependency
+	var visit func(d CacheDependency)
+	visit = func(d CacheDependency) {
+		for _, dependent := range d.dependentCachers() {
+			if !visited[dependent] {
+				visited[dependent] = true
+				visit(dependent)
+				order = append(order, dependent)
+			}
+		}
+	}
+	visit(root)
+	slices.Reverse(order)
+	return order
+}
+
+func (c *Cacher[T]) currentUpstreamVersions() []uint64 {
+	if len(c.upstreams) == 0 {
+		return nil
+	}
+	versions := make([]uint64, len(c.upstreams))
+	for i, u := range c.upstreams {
+		versions[i] = u.cacheVersion()
+	}
+	return versions
+}
+
+func (c *Cacher[T]) upToDateWithUpstreams(s *cacheSnapshot[T]) bool {
+	for i, u := range c.upstreams {
+		if i >= len(s.upstreamVersions) || s.upstreamVersions[i] != u.cacheVersion() {
+			return false
+		}
+	}
+	return true
+}
+
+// Refreshes the dependents after the value changed; must be called without holding fetchMutex,
+// as the getters of the dependents read the value
+func (c *Cacher[T]) cascade() {
+	dependents := transitiveDependents(c)
+	if len(dependents) == 0 {
+		return
+	}
+	deferred := map[CacheDependency]bool{}
+	for _, d := range dependents {
+		d.refreshFromUpstreams(deferred)
+	}
+}
+
+func (c *Cacher[T]) refreshFromUpstreams(deferred map[CacheDependency]bool) {
+	for _, u := range c.upstreams {
+		if deferred[u] {
+			// refreshed once the upstream is, by its own cascade
+			deferred[c] = true
+			return
+		}
+	}
+	if c.stopped.Load() {
+		return
+	}
+	// a value never read yet is fetched by the first Get
+	s := c.snapshot.Load()
+	if s == nil || c.upToDateWithUpstreams(s) {
+		return
+	}
+	if c.MinimumWait > 0 {
+		// debounced, and its dependents are refreshed after it
+		deferred[c] = true
+		c.AskCacheRefresh()
+		return
+	}
+	c.fetchMutex.Lock()
+	if s := c.snapshot.Load(); s != nil && c.upToDateWithUpstreams(s) {
+		c.fetchMutex.Unlock()
+		return
+	}
+	err := c.fetch()
+	c.fetchMutex.Unlock()
+	if err != nil {
+		c.logger.With("error", err).Debug("[cacher] Failed to refresh value after an upstream change")
+	}
 }
@@ -0,0 +1,207 @@
+package globalgoutils
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCacherConcurrentUse(t *testing.T) {
+	var calls atomic.Int64
+	c := NewCacher("test_concurrent", func() (map[string]int, error) {
+		n := calls.Add(1)
+		return map[string]int{"calls": int(n)}, nil
+	}, time.Second, 0)
+	debounced := NewCacher("test_concurrent_debounced", func() (int, error) {
+		return int(calls.Load()), nil
+	}, time.Second, 1)
+	debounced.DependsOn(c)
+	if _, err := debounced.Get(); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(300 * time.Millisecond)
+	var wg sync.WaitGroup
+	for i := range 16 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for time.Now().Before(deadline) {
+				switch i % 4 {
+				case 0:
+					v, err := c.Get()
+					if err != nil || v == nil || (*v)["calls"] == 0 {
+						t.Errorf("Get returned %v, %v", v, err)
+						return
+					}
+				case 1:
+					c.ForceInvalidate()
+				case 2:
+					c.AskCacheRefresh()
+					debounced.AskCacheRefresh()
+				case 3:
+					// the patch works on a copy: the value returned to the other Gets is never modified
+					c.Patch(func(current map[string]int) map[string]int {
+						patched := map[string]int{"patched": 1}
+						for k, v := range current {
+							patched[k] = v
+						}
+						return patched
+					})
+				}
+				if _, err := debounced.Get(); err != nil {
+					t.Errorf("dependent Get: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	c.Stop()
+	debounced.Stop()
+}
+
+func TestCacherBackoff(t *testing.T) {
+	var calls atomic.Int64
+	c := NewCacher("test_backoff", func() (int, error) {
+		calls.Add(1)
+		return 0, errors.New("source down")
+	}, time.Minute, 0)
+
+	if _, err := c.Get(); err == nil {
+		t.Fatal("Get succeeded with a failing getter")
+	}
+	// within the backoff, Get fails right away without calling the getter
+	_, err := c.Get()
+	if err == nil || !strings.Contains(err.Error(), "retrying in") || calls.Load() != 1 {
+		t.Fatalf("during the backoff: %v, %d calls", err, calls.Load())
+	}
+	if f := c.failure.Load(); f == nil || time.Until(f.retryAt) > cacherMinBackoff {
+		t.Fatalf("first backoff: %+v", f)
+	}
+
+	time.Sleep(cacherMinBackoff + 50*time.Millisecond)
+	if _, err := c.Get(); err == nil || calls.Load() != 2 {
+		t.Fatalf("after the backoff: %v, %d calls", err, calls.Load())
+	}
+	// the backoff doubles
+	if f := c.failure.Load(); f == nil || f.failures != 2 || time.Until(f.retryAt) <= cacherMinBackoff || time.Until(f.retryAt) > 2*cacherMinBackoff {
+		t.Fatalf("second backoff: %+v", f)
+	}
+
+	// AskCacheRefresh ignores the backoff
+	c.AskCacheRefresh()
+	if calls.Load() != 3 {
+		t.Fatalf("AskCacheRefresh didn't call the getter: %d calls", calls.Load())
+	}
+}
+
+func TestCacherMaxStaleness(t *testing.T) {
+	var failing atomic.Bool
+	c := NewCacher("test_staleness", func() (int, error) {
+		if failing.Load() {
+			return 0, errors.New("source down")
+		}
+		return 42, nil
+	}, 0, 0)
+	c.MaxStaleness = 200 * time.Millisecond
+
+	if v, err := c.Get(); err != nil || *v != 42 {
+		t.Fatalf("first Get: %v, %v", v, err)
+	}
+	failing.Store(true)
+
+	// the refresh fails in the background, and the stale value is served meanwhile
+	time.Sleep(10 * time.Millisecond)
+	if v, err := c.Get(); err != nil || *v != 42 {
+		t.Fatalf("stale Get: %v, %v", v, err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if c.LastError() == nil {
+		t.Fatal("the background refresh didn't run")
+	}
+
+	time.Sleep(c.MaxStaleness)
+	if v, err := c.Get(); err == nil {
+		t.Fatalf("a value older than MaxStaleness was served: %v", *v)
+	}
+}
+
+func TestCacherDependsOnCascadeOrder(t *testing.T) {
+	var mu sync.Mutex
+	var order []string
+	record := func(name string) {
+		mu.Lock()
+		order = append(order, name)
+		mu.Unlock()
+	}
+
+	// a diamond: b and c read a, d reads b and c
+	var version atomic.Int64
+	a := NewCacher("test_a", func() (int64, error) {
+		record("a")
+		return version.Load(), nil
+	}, time.Hour, 0)
+	b := NewCacher("test_b", func() (int64, error) {
+		record("b")
+		v, err := a.Get()
+		return *v, err
+	}, time.Hour, 0)
+	c := NewCacher("test_c", func() (int64, error) {
+		record("c")
+		v, err := a.Get()
+		return *v, err
+	}, time.Hour, 0)
+	d := NewCacher("test_d", func() (int64, error) {
+		record("d")
+		vb, err := b.Get()
+		if err != nil {
+			return 0, err
+		}
+		vc, err := c.Get()
+		if err != nil {
+			return 0, err
+		}
+		return *vb + *vc, nil
+	}, time.Hour, 0)
+	b.DependsOn(a)
+	c.DependsOn(a)
+	d.DependsOn(b, c)
+
+	if v, err := d.Get(); err != nil || *v != 0 {
+		t.Fatalf("first Get: %v, %v", v, err)
+	}
+	mu.Lock()
+	order = nil
+	mu.Unlock()
+
+	version.Store(1)
+	a.AskCacheRefresh()
+
+	mu.Lock()
+	got := slices.Clone(order)
+	mu.Unlock()
+	if len(got) != 4 || got[0] != "a" || got[3] != "d" || !slices.Contains(got, "b") || !slices.Contains(got, "c") {
+		t.Fatalf("expected a, then b and c, then d once; got %v", got)
+	}
+	if v, err := d.Get(); err != nil || *v != 2 {
+		t.Fatalf("d after the cascade: %v, %v", v, err)
+	}
+
+	// Patch cascades too
+	a.Patch(func(int64) int64 { return 5 })
+	if v, _ := d.Get(); *v != 10 {
+		t.Fatalf("d after a patch of a: %v", *v)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("a cycle was accepted")
+		}
+	}()
+	a.DependsOn(d)
+}
@@ -0,0 +1,249 @@
+package globalgoutils
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// Smaller bodies aren't worth compressing
+const compressMinSize = 1024
+
+// Content types that are already compressed; image/svg+xml is compressed anyway
+var incompressibleContentTypes = []string{
+	"image/",
+	"video/",
+	"audio/",
+	"font/woff",
+	"application/zip",
+	"application/gzip",
+	"application/x-gzip",
+	"application/x-brotli",
+	"application/octet-stream",
+}
+
+// Buffers the response of the handler, until it is done or flushes
+type bufferedResponseWriter struct {
+	w           http.ResponseWriter
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+	// set once the handler flushed: the rest is written as is, e.g. for event streams
+	passthrough bool
+}
+
+func (b *bufferedResponseWriter) Header() http.Header {
+	return b.w.Header()
+}
+
+func (b *bufferedResponseWriter) WriteHeader(status int) {
+	if b.passthrough {
+		b.w.WriteHeader(status)
+		return
+	}
+	if !b.wroteHeader {
+		b.status = status
+		b.wroteHeader = true
+	}
+}
+
+func (b *bufferedResponseWriter) Write(p []byte) (int, error) {
+	if b.passthrough {
+		return b.w.Write(p)
+	}
+	if !b.wroteHeader {
+		b.WriteHeader(http.StatusOK)
+	}
+	return b.body.Write(p)
+}
+
+// Sends what was buffered, uncompressed, and stops buffering
+func (b *bufferedResponseWriter) Flush() {
+	if !b.passthrough {
+		b.passthrough = true
+		if !b.wroteHeader {
+			b.status = http.StatusOK
+		}
+		b.w.WriteHeader(b.status)
+		_, _ = b.w.Write(b.body.Bytes())
+		b.body.Reset()
+	}
+	_ = http.NewResponseController(b.w).Flush()
+}
+
+func (b *bufferedResponseWriter) Unwrap() http.ResponseWriter {
+	return b.w
+}
+
+// The encoding to use for a request: "br", "gzip", or "" for none
+// Brotli is preferred, unless the client gives gzip a higher q-value
+func negotiateEncoding(acceptEncoding string) string {
+	q := map[string]float64{}
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		weight := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				weight = f
+			}
+		}
+		if name != "" {
+			q[strings.ToLower(name)] = weight
+		}
+	}
+	weight := func(encoding string) float64 {
+		if w, ok := q[encoding]; ok {
+			return w
+		}
+		return q["*"]
+	}
+	br, gz := weight("br"), weight("gzip")
+	switch {
+	case br > 0 && br >= gz:
+		return "br"
+	case gz > 0:
+		return "gzip"
+	}
+	return ""
+}
+
+func compressible(h http.Header, status int, size int) bool {
+	if size < compressMinSize || status == http.StatusNoContent || h.Get("Content-Encoding") != "" {
+		return false
+	}
+	contentType := h.Get("Content-Type")
+	for _, prefix := range incompressibleContentTypes {
+		if strings.HasPrefix(contentType, prefix) && !strings.HasPrefix(contentType, "image/svg") {
+			return false
+		}
+	}
+	return true
+}
+
+func compressBody(encoding string, body []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	if encoding == "br" {
+		w = brotli.NewWriterLevel(&buf, brotli.DefaultCompression)
+	} else {
+		w = gzip.NewWriter(&buf)
+	}
+	if _, err := w.Write(body); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Whether an If-None-Match header matches the ETag, with the weak comparison of RFC 9110
+func etagMatches(ifNoneMatch string, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func addVary(h http.Header, value string) {
+	for _, v := range h.Values("Vary") {
+		for _, existing := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(existing), value) {
+				return
+			}
+		}
+	}
+	h.Add("Vary", value)
+}
+
+// Compresses the responses with brotli or gzip, as the client accepts, and adds a strong ETag to the successful ones
+//   - the ETag is a hash of the uncompressed body, with the encoding appended, unless the handler set its own;
+//     responses with Cache-Control: no-store get none
+//   - requests with a matching If-None-Match get a 304 without body
+//   - small responses, and content types that are already compressed, are sent as is
+//
+// Buffers the entire response: use it on APIs, not on downloads; a handler that flushes, e.g. an event stream,
+// is sent as is from then on
+func CompressionMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b := &bufferedResponseWriter{w: w, status: http.StatusOK}
+		next.ServeHTTP(b, r)
+		if b.passthrough {
+			return
+		}
+
+		h := w.Header()
+		body := b.body.Bytes()
+		addVary(h, "Accept-Encoding")
+		if h.Get("Content-Type") == "" && len(body) > 0 {
+			// sniffed before compressing, as net/http would sniff the compressed body
+			h.Set("Content-Type", http.DetectContentType(body))
+		}
+
+		encoding := ""
+		if compressible(h, b.status, len(body)) {
+			encoding = negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		}
+		// compressed before the ETag is computed: if it fails, the identity body is sent, under its own ETag
+		var compressed []byte
+		if encoding != "" {
+			var err error
+			compressed, err = compressBody(encoding, body)
+			if err != nil {
+				slog.With("error", err, "encoding", encoding).Error("Failed to compress response")
+				encoding = ""
+			}
+		}
+
+		// a response that isn't stored isn't revalidated either, e.g. a page with a CSP nonce
+		cacheable := !strings.Contains(h.Get("Cache-Control"), "no-store")
+		if cacheable && b.status == http.StatusOK && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+			etag := h.Get("ETag")
+			if etag == "" {
+				sum := sha256.Sum256(body)
+				tag := hex.EncodeToString(sum[:16])
+				// each encoding is a different representation, with its own strong ETag
+				if encoding != "" {
+					tag += "-" + encoding
+				}
+				etag = `"` + tag + `"`
+				h.Set("ETag", etag)
+			}
+			if etagMatches(r.Header.Get("If-None-Match"), etag) {
+				h.Del("Content-Type")
+				h.Del("Content-Length")
+				h.Del("Content-Encoding")
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+
+		if encoding != "" {
+			body = compressed
+			h.Set("Content-Encoding", encoding)
+		}
+		h.Set("Content-Length", strconv.Itoa(len(body)))
+		w.WriteHeader(b.status)
+		if r.Method == http.MethodHead {
+			return
+		}
+		if _, err := w.Write(body); err != nil {
+			slog.With("error", err).Debug("Failed to write response")
+		}
+	})
+}
@@ -0,0 +1,302 @@
+// Package config loads the configuration of a service into a typed struct
+// Each field names its environment variable in an `env` tag, and can have:
+//   - default:"value", used when the variable isn't set
+//   - required:"true", to refuse an empty value
+//   - secret:"true", to redact the value when printed
+//   - oneof:"a|b|c", to restrict the accepted values
+//
+// Values are taken from, in increasing priority: the defaults, the config file, the environment
+// The config file is a JSON object keyed by the variable names, given with -config or CONFIG_FILE
+// Fields without an `env` tag that are structs are walked, so configs can be composed
+// Supported types are string, bool, ints, time.Duration and []string (comma separated, or a JSON array in the file)
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Implemented by configs that check fields against each other, after every field was loaded
+// Return several problems with errors.Join
+type Validator interface {
+	Validate() error
+}
+
+// Every problem found while loading a config
+type Error struct {
+	Problems []string
+}
+
+func (e *Error) Error() string {
+	return "invalid configuration:\n  - " + strings.Join(e.Problems, "\n  - ")
+}
+
+type field struct {
+	value    reflect.Value
+	env      string
+	def      string
+	hasDef   bool
+	required bool
+	secret   bool
+	oneof    []string
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+func collectFields(v reflect.Value, fields *[]field) error {
+	t := v.Type()
+	for i := range t.NumField() {
+		sf := t.Field(i)
+		if !sf.IsExported() {
+			continue
+		}
+		fv := v.Field(i)
+		env, ok := sf.Tag.Lookup("env")
+		if !ok {
+			if fv.Kind() == reflect.Struct {
+				if err := collectFields(fv, fields); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		f := field{
+			value:    fv,
+			env:      env,
+			required: sf.Tag.Get("required") == "true",
+			secret:   sf.Tag.Get("secret") == "true",
+		}
+		f.def, f.hasDef = sf.Tag.Lookup("default")
+		if oneof := sf.Tag.Get("oneof"); oneof != "" {
+			f.oneof = strings.Split(oneof, "|")
+		}
+		switch fv.Kind() {
+		case reflect.String, reflect.Bool, reflect.Int, reflect.Int64:
+		case reflect.Slice:
+			if fv.Type().Elem().Kind() != reflect.String {
+				return fmt.Errorf("config: unsupported type %s for %s", fv.Type(), env)
+			}
+		default:
+			return fmt.Errorf("config: unsupported type %s for %s", fv.Type(), env)
+		}
+		*fields = append(*fields, f)
+	}
+	return nil
+}
+
+func fieldsOf(dst any) ([]field, error) {
+	v := reflect.ValueOf(dst)
+	if v.Kind() != reflect.Pointer || v.Elem().Kind() != reflect.Struct {
+		return nil, fmt.Errorf("config: expected a pointer to a struct, got %T", dst)
+	}
+	fields := []field{}
+	err := collectFields(v.Elem(), &fields)
+	return fields, err
+}
+
+func (f *field) set(raw string) error {
+	v := f.value
+	switch {
+	case v.Type() == durationType:
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return fmt.Errorf("%s: invalid duration %q", f.env, raw)
+		}
+		v.SetInt(int64(d))
+	case v.Kind() == reflect.String:
+		v.SetString(raw)
+	case v.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("%s: invalid boolean %q", f.env, raw)
+		}
+		v.SetBool(b)
+	case v.Kind() == reflect.Int || v.Kind() == reflect.Int64:
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%s: invalid integer %q", f.env, raw)
+		}
+		v.SetInt(n)
+	case v.Kind() == reflect.Slice:
+		items := []string{}
+		if strings.HasPrefix(strings.TrimSpace(raw), "[") {
+			if err := json.Unmarshal([]byte(raw), &items); err != nil {
+				return fmt.Errorf("%s: invalid list: %w", f.env, err)
+			}
+		} else {
+			for _, item := range strings.Split(raw, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					items = append(items, item)
+				}
+			}
+		}
+		v.Set(reflect.ValueOf(items))
+	}
+	return nil
+}
+
+func (f *field) isZero() bool {
+	if f.value.Kind() == reflect.Slice {
+		return f.value.Len() == 0
+	}
+	return f.value.IsZero()
+}
+
+// Reads a config file into raw values; strings are kept as is, other JSON values as their JSON text
+func readFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	values := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &values); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	raw := make(map[string]string, len(values))
+	for key, v := range values {
+		var s string
+		if json.Unmarshal(v, &s) == nil {
+			raw[key] = s
+		} else {
+			raw[key] = string(v)
+		}
+	}
+	return raw, nil
+}
+
+// Loads dst from its defaults, the config file if not empty, and lookup (os.LookupEnv outside of tests)
+// All the problems are reported at once, in an *Error
+func Load(dst any, file string, lookup func(key string) (string, bool)) error {
+	fields, err := fieldsOf(dst)
+	if err != nil {
+		return err
+	}
+
+	fileValues := map[string]string{}
+	problems := []string{}
+	if file != "" {
+		fileValues, err = readFile(file)
+		if err != nil {
+			problems = append(problems, "failed to read the config file: "+err.Error())
+		}
+	}
+
+	known := map[string]bool{}
+	for i := range fields {
+		f := &fields[i]
+		known[f.env] = true
+
+		// empty variables count as unset
+		raw, _ := lookup(f.env)
+		if raw == "" {
+			raw = fileValues[f.env]
+		}
+		if raw == "" && f.hasDef {
+			raw = f.def
+		}
+		if raw != "" {
+			if err := f.set(raw); err != nil {
+				problems = append(problems, err.Error())
+				continue
+			}
+		}
+
+		if f.required && f.isZero() {
+			problems = append(problems, f.env+" is not defined")
+			continue
+		}
+		if len(f.oneof) > 0 && !f.isZero() && !slices.Contains(f.oneof, fmt.Sprint(f.value.Interface())) {
+			problems = append(problems, fmt.Sprintf("%s must be one of %s", f.env, strings.Join(f.oneof, ", ")))
+		}
+	}
+	for key := range fileValues {
+		if !known[key] {
+			problems = append(problems, "unknown key in the config file: "+key)
+		}
+	}
+
+	if v, ok := dst.(Validator); ok {
+		if err := v.Validate(); err != nil {
+			problems = append(problems, unwrapProblems(err)...)
+		}
+	}
+	if len(problems) > 0 {
+		slices.Sort(problems)
+		return &Error{Problems: problems}
+	}
+	return nil
+}
+
+func unwrapProblems(err error) []string {
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		problems := []string{}
+		for _, e := range joined.Unwrap() {
+			problems = append(problems, unwrapProblems(e)...)
+		}
+		return problems
+	}
+	return []string{err.Error()}
+}
+
+const redacted = "<redacted>"
+
+// Prints the config as VARIABLE=value lines, with the secrets redacted
+func Print(w io.Writer, src any) error {
+	fields, err := fieldsOf(src)
+	if err != nil {
+		return err
+	}
+	for _, f := range fields {
+		var value string
+		switch {
+		case f.secret && !f.isZero():
+			value = redacted
+		case f.value.Kind() == reflect.Slice:
+			value = strings.Join(f.value.Interface().([]string), ",")
+		default:
+			value = fmt.Sprint(f.value.Interface())
+		}
+		if _, err := fmt.Fprintf(w, "%s=%s\n", f.env, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Loads the config of a service from its command line and environment:
+//   - -config <file> (or CONFIG_FILE) sets the config file
+//   - -print-config prints the config with the secrets redacted, and exits
+//
+// Exits with the list of problems if the config is invalid
+func MustLoad(dst any) {
+	flags := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	file := flags.String("config", os.Getenv("CONFIG_FILE"), "JSON config file, keyed by environment variable names")
+	printConfig := flags.Bool("print-config", false, "print the configuration, with the secrets redacted, and exit")
+	_ = flags.Parse(os.Args[1:])
+
+	err := Load(dst, *file, os.LookupEnv)
+	var configErr *Error
+	if err != nil && !errors.As(err, &configErr) {
+		panic(err)
+	}
+
+	if *printConfig {
+		_ = Print(os.Stdout, dst)
+	}
+	if configErr != nil {
+		fmt.Fprintln(os.Stderr, configErr.Error())
+		os.Exit(2)
+	}
+	if *printConfig {
+		os.Exit(0)
+	}
+}
@@ -0,0 +1,246 @@
+package globalgoutils
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/itsvyle/hxi2/global-go/utils/metrics"
+)
+
+const (
+	// Reports accepted per minute; a broken page sends one per violation, on every load
+	cspReportsPerMinute = 120
+	// Distinct violations kept; the next ones are only counted in the metrics
+	cspMaxViolations = 500
+	cspMaxReportSize = 64 << 10
+)
+
+// A violation, aggregated over the reports: the URLs are stripped of their query strings
+type cspViolationKey struct {
+	directive   string
+	blockedURL  string
+	documentURL string
+}
+
+type cspViolation struct {
+	count       int
+	disposition string
+	sourceFile  string
+	lineNumber  int
+}
+
+// The fields of a report that are kept, for both formats
+type cspReport struct {
+	documentURL string
+	directive   string
+	blockedURL  string
+	sourceFile  string
+	lineNumber  int
+	disposition string
+}
+
+// Receives the violation reports that browsers send to the ReportURI of a ContentSecurityPolicy
+//   - each violation is logged the first time it is seen, then at its 10th, 100th... occurrence
+//   - every report is counted in metrics.CSPViolations
+//   - beyond cspReportsPerMinute, reports are dropped with a 429
+type CSPReportCollector struct {
+	logger *slog.Logger
+
+	mu          sync.Mutex
+	violations  map[cspViolationKey]*cspViolation
+	windowStart time.Time
+	windowCount int
+}
+
+func NewCSPReportCollector() *CSPReportCollector {
+	return &CSPReportCollector{
+		logger:     GetServiceSpecificLogger("CSPREP", "\033[38;5;203m"),
+		violations: map[cspViolationKey]*cspViolation{},
+	}
+}
+
+// Mounts a CSPReportCollector on the ReportURI of the policy of the manager, if it is a path
+func (manager *StaticFilesManager) MountCSPReportRoute(router *http.ServeMux) {
+	if manager.csp == nil || !strings.HasPrefix(manager.csp.ReportURI, "/") {
+		return
+	}
+	router.HandleFunc("POST "+manager.csp.ReportURI, NewCSPReportCollector().HandleReport)
+}
+
+// Accepts the application/csp-report format of report-uri, and the application/reports+json one of report-to
+func (c *CSPReportCollector) HandleReport(w http.ResponseWriter, r *http.Request) {
+	if !c.allow() {
+		metrics.CSPReportsDropped.WithLabelValues("rate_limited").Inc()
+		http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, cspMaxReportSize))
+	if err != nil {
+		metrics.CSPReportsDropped.WithLabelValues("invalid").Inc()
+		http.Error(w, "Invalid report", http.StatusBadRequest)
+		return
+	}
+	reports, err := parseCSPReports(r.Header.Get("Content-Type"), body)
+	if err != nil || len(reports) == 0 {
+		metrics.CSPReportsDropped.WithLabelValues("invalid").Inc()
+		http.Error(w, "Invalid report", http.StatusBadRequest)
+		return
+	}
+	for _, report := range reports {
+		c.record(report)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Counts the report in the window of the current minute
+func (c *CSPReportCollector) allow() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now := time.Now(); now.Sub(c.windowStart) >= time.Minute {
+		c.windowStart = now
+		c.windowCount = 0
+	}
+	c.windowCount++
+	return c.windowCount <= cspReportsPerMinute
+}
+
+// The directives that can be violated; the reports are sent by anyone, and the other values would flood the metrics
+var cspReportedDirectives = map[string]bool{
+	"default-src": true, "child-src": true, "connect-src": true, "font-src": true, "frame-src": true, "img-src": true,
+	"manifest-src": true, "media-src": true, "object-src": true, "script-src": true, "script-src-elem": true,
+	"script-src-attr": true, "style-src": true, "style-src-elem": true, "style-src-attr": true, "worker-src": true,
+	"base-uri": true, "form-action": true, "frame-ancestors": true, "require-trusted-types-for": true, "trusted-types": true,
+}
+
+func (c *CSPReportCollector) record(report cspReport) {
+	if !cspReportedDirectives[report.directive] {
+		report.directive = "other"
+	}
+	if report.disposition != "report" {
+		report.disposition = "enforce"
+	}
+	metrics.CSPViolations.WithLabelValues(report.directive, report.disposition).Inc()
+
+	key := cspViolationKey{
+		directive:   report.directive,
+		blockedURL:  stripQuery(report.blockedURL),
+		documentURL: stripQuery(report.documentURL),
+	}
+	c.mu.Lock()
+	v, ok := c.violations[key]
+	if !ok {
+		if len(c.violations) >= cspMaxViolations {
+			c.mu.Unlock()
+			c.logger.With("directive", key.directive, "blocked", key.blockedURL).Debug("Too many distinct CSP violations, not aggregated")
+			return
+		}
+		v = &cspViolation{disposition: report.disposition, sourceFile: stripQuery(report.sourceFile), lineNumber: report.lineNumber}
+		c.violations[key] = v
+	}
+	v.count++
+	count := v.count
+	c.mu.Unlock()
+
+	if !isPowerOfTen(count) {
+		return
+	}
+	c.logger.With(
+		"directive", key.directive,
+		"blocked", key.blockedURL,
+		"document", key.documentURL,
+		"source", v.sourceFile,
+		"line", v.lineNumber,
+		"disposition", v.disposition,
+		"count", count,
+	).Warn("Content Security Policy violation")
+}
+
+func isPowerOfTen(n int) bool {
+	for n >= 10 && n%10 == 0 {
+		n /= 10
+	}
+	return n == 1
+}
+
+// Keeps the origin and path of a URL; values such as "inline" or "eval" are kept as is
+func stripQuery(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme == "" {
+		return raw
+	}
+	u.RawQuery = ""
+	u.Fragment = ""
+	u.User = nil
+	return u.String()
+}
+
+func parseCSPReports(contentType string, body []byte) ([]cspReport, error) {
+	if strings.HasPrefix(contentType, "application/reports+json") {
+		var reports []struct {
+			Type string `json:"type"`
+			Body struct {
+				DocumentURL        string `json:"documentURL"`
+				EffectiveDirective string `json:"effectiveDirective"`
+				BlockedURL         string `json:"blockedURL"`
+				SourceFile         string `json:"sourceFile"`
+				LineNumber         int    `json:"lineNumber"`
+				Disposition        string `json:"disposition"`
+			} `json:"body"`
+		}
+		if err := json.Unmarshal(body, &reports); err != nil {
+			return nil, err
+		}
+		parsed := make([]cspReport, 0, len(reports))
+		for _, r := range reports {
+			if r.Type != "csp-violation" {
+				continue
+			}
+			parsed = append(parsed, cspReport{
+				documentURL: r.Body.DocumentURL,
+				directive:   r.Body.EffectiveDirective,
+				blockedURL:  r.Body.BlockedURL,
+				sourceFile:  r.Body.SourceFile,
+				lineNumber:  r.Body.LineNumber,
+				disposition: r.Body.Disposition,
+			})
+		}
+		return parsed, nil
+	}
+
+	var report struct {
+		Report struct {
+			DocumentURI        string `json:"document-uri"`
+			ViolatedDirective  string `json:"violated-directive"`
+			EffectiveDirective string `json:"effective-directive"`
+			BlockedURI         string `json:"blocked-uri"`
+			SourceFile         string `json:"source-file"`
+			LineNumber         int    `json:"line-number"`
+			Disposition        string `json:"disposition"`
+		} `json:"csp-report"`
+	}
+	if err := json.Unmarshal(body, &report); err != nil {
+		return nil, err
+	}
+	directive := report.Report.EffectiveDirective
+	if directive == "" {
+		// older browsers only send the violated directive, with its sources
+		directive, _, _ = strings.Cut(report.Report.ViolatedDirective, " ")
+	}
+	if directive == "" {
+		return nil, nil
+	}
+	return []cspReport{{
+		documentURL: report.Report.DocumentURI,
+		directive:   directive,
+		blockedURL:  report.Report.BlockedURI,
+		sourceFile:  report.Report.SourceFile,
+		lineNumber:  report.Report.LineNumber,
+		disposition: report.Report.Disposition,
+	}}, nil
+}
@@ -0,0 +1,224 @@
+package globalgoutils
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// In the sources of a directive, replaced by the nonce of each page, e.g. Add("script-src", CSPNonce)
+const CSPNonce = "'nonce'"
+
+// Where the default policy sends its violation reports, see CSPReportCollector
+const CSPReportPath = "/api/csp-report"
+
+// The name of the endpoint in the Reporting-Endpoints header, for report-to
+const cspReportGroup = "csp-endpoint"
+
+type cspDirective struct {
+	name    string
+	sources []string
+}
+
+// A Content Security Policy, built by each service from DefaultContentSecurityPolicy
+//   - the CSPNonce sources are replaced by a nonce generated for each page, also added to its <script> and <style> tags
+//   - with ReportOnly, violations are only reported: to try a stricter policy without breaking the pages
+type ContentSecurityPolicy struct {
+	directives []cspDirective
+	ReportOnly bool
+	// Where browsers send the violations, with report-uri and report-to; "" for none
+	ReportURI string
+}
+
+const iconifyScriptSource = "https://cdn.jsdelivr.net/npm/iconify-icon@2.3.0/dist/iconify-icon.min.js"
+
+var iconifyIconsSources = []string{
+	"https://api.iconify.design/",
+	"https://api.unisvg.com/",
+	"https://api.simplesvg.com/",
+}
+
+// The policy of the pages of hxi2: scripts from the service, with a nonce, and iconify; violations reported to CSPReportPath
+// The styles still allow 'unsafe-inline', for the web components that inject theirs
+func DefaultContentSecurityPolicy(hxi2Domain string) *ContentSecurityPolicy {
+	var static []string
+	if hxi2Domain = strings.TrimSpace(hxi2Domain); hxi2Domain != "" {
+		static = []string{"https://static." + hxi2Domain}
+	}
+	objectSources := static
+	if len(objectSources) == 0 {
+		objectSources = []string{"'none'"}
+	}
+	return (&ContentSecurityPolicy{ReportURI: CSPReportPath}).
+		Set("default-src", "'self'").
+		Set("connect-src", append([]string{"'self'"}, iconifyIconsSources...)...).
+		Set("img-src", append([]string{"'self'"}, static...)...).
+		Set("script-src", append([]string{"'self'", CSPNonce, iconifyScriptSource}, static...)...).
+		Set("style-src", append([]string{"'self'", "'unsafe-inline'"}, static...)...).
+		Set("object-src", objectSources...).
+		Set("frame-src", "'none'").
+		Set("base-uri", "'self'").
+		Set("form-action", "'self'").
+		Set("frame-ancestors", "'none'").
+		Set("manifest-src", "'self'")
+}
+
+// Parses a policy written as a header value, e.g. "default-src 'self'; img-src *"
+// Returns nil for an empty policy
+func ParseContentSecurityPolicy(policy string) *ContentSecurityPolicy {
+	p := &ContentSecurityPolicy{}
+	for _, directive := range strings.Split(policy, ";") {
+		fields := strings.Fields(directive)
+		if len(fields) == 0 {
+			continue
+		}
+		switch name := strings.ToLower(fields[0]); name {
+		case "report-uri":
+			p.ReportURI = strings.Join(fields[1:], " ")
+		case "report-to":
+			// set from ReportURI
+		default:
+			p.Set(name, fields[1:]...)
+		}
+	}
+	if len(p.directives) == 0 && p.ReportURI == "" {
+		return nil
+	}
+	return p
+}
+
+func (p *ContentSecurityPolicy) directive(name string) *cspDirective {
+	for i := range p.directives {
+		if p.directives[i].name == name {
+			return &p.directives[i]
+		}
+	}
+	return nil
+}
+
+// Replaces the sources of a directive, adding it if it is missing
+func (p *ContentSecurityPolicy) Set(name string, sources ...string) *ContentSecurityPolicy {
+	if d := p.directive(name); d != nil {
+		d.sources = slices.Clone(sources)
+		return p
+	}
+	p.directives = append(p.directives, cspDirective{name: name, sources: slices.Clone(sources)})
+	return p
+}
+
+// Adds sources to a directive, e.g. Add("script-src", "https://unpkg.com/...")
+func (p *ContentSecurityPolicy) Add(name string, sources ...string) *ContentSecurityPolicy {
+	d := p.directive(name)
+	if d == nil {
+		return p.Set(name, sources...)
+	}
+	for _, source := range sources {
+		if !slices.Contains(d.sources, source) {
+			d.sources = append(d.sources, source)
+		}
+	}
+	return p
+}
+
+// Removes sources from a directive, e.g. Remove("style-src", "'unsafe-inline'"); without sources, removes the directive
+func (p *ContentSecurityPolicy) Remove(name string, sources ...string) *ContentSecurityPolicy {
+	if len(sources) == 0 {
+		p.directives = slices.DeleteFunc(p.directives, func(d cspDirective) bool { return d.name == name })
+		return p
+	}
+	if d := p.directive(name); d != nil {
+		d.sources = slices.DeleteFunc(d.sources, func(s string) bool { return slices.Contains(sources, s) })
+	}
+	return p
+}
+
+func (p *ContentSecurityPolicy) Clone() *ContentSecurityPolicy {
+	clone := *p
+	clone.directives = make([]cspDirective, len(p.directives))
+	for i, d := range p.directives {
+		clone.directives[i] = cspDirective{name: d.name, sources: slices.Clone(d.sources)}
+	}
+	return &clone
+}
+
+// Whether the pages need a nonce for this policy
+func (p *ContentSecurityPolicy) UsesNonce() bool {
+	if p == nil {
+		return false
+	}
+	for _, d := range p.directives {
+		if slices.Contains(d.sources, CSPNonce) {
+			return true
+		}
+	}
+	return false
+}
+
+// The header value, with the nonce of the page; without a nonce, the CSPNonce sources are left out
+func (p *ContentSecurityPolicy) String(nonce string) string {
+	var sb strings.Builder
+	for _, d := range p.directives {
+		sb.WriteString(d.name)
+		for _, source := range d.sources {
+			if source == CSPNonce {
+				if nonce == "" {
+					continue
+				}
+				source = "'nonce-" + nonce + "'"
+			}
+			sb.WriteString(" " + source)
+		}
+		sb.WriteString("; ")
+	}
+	if p.ReportURI != "" {
+		sb.WriteString("report-uri " + p.ReportURI + "; report-to " + cspReportGroup + "; ")
+	}
+	return strings.TrimSuffix(sb.String(), " ")
+}
+
+// Sets the policy headers of a response with the nonce
+func (p *ContentSecurityPolicy) setHeaders(w http.ResponseWriter, nonce string) {
+	if p == nil {
+		return
+	}
+	header := "Content-Security-Policy"
+	if p.ReportOnly {
+		header = "Content-Security-Policy-Report-Only"
+	}
+	w.Header().Set(header, p.String(nonce))
+	if p.ReportURI != "" {
+		w.Header().Set("Reporting-Endpoints", cspReportGroup+`="`+p.ReportURI+`"`)
+	}
+}
+
+// For the HTML handlers: sets the policy headers with a new nonce, and returns it, to use in the page as
+// <script nonce="...">; returns "" if the policy doesn't use nonces
+// The page must not be cached, as its nonce would no longer match the header
+func (p *ContentSecurityPolicy) Apply(w http.ResponseWriter) string {
+	nonce := ""
+	if p.UsesNonce() {
+		nonce = NewCSPNonce()
+	}
+	p.setHeaders(w, nonce)
+	return nonce
+}
+
+// 128 random bits, base64 encoded
+func NewCSPNonce() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b) // never fails, see crypto/rand.Read
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+var nonceTagRegex = regexp.MustCompile(`(?i)<(script|style)([\s>])`)
+
+// Adds the nonce to the <script> and <style> tags of a page
+func InjectCSPNonce(page []byte, nonce string) []byte {
+	if nonce == "" {
+		return page
+	}
+	return nonceTagRegex.ReplaceAll(page, []byte(`<$1 nonce="`+nonce+`"$2`))
+}
@@ -0,0 +1,151 @@
+package globalgoutils
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The auth cookies are shared by every subdomain, so a request to a service could be forged by a page of another subdomain
+// CSRFProtection refuses the state-changing requests that a browser didn't send from the service itself or a trusted origin:
+//   - Sec-Fetch-Site must be same-origin, or the Origin header must be the service or a trusted origin
+//   - when a client sends neither header, e.g. an old browser or a script using the cookies, it must send the token
+//     from GET /api/csrf in the X-CSRF-Token header; the frontend sends it with csrfFetch from global-frontend-dependencies
+//
+// Requests authenticated with an Authorization header are let through, as they can't be forged by a browser
+type CSRFProtection struct {
+	key            []byte
+	trustedOrigins map[string]bool
+	logger         *slog.Logger
+}
+
+const HeaderCSRFToken = "X-CSRF-Token"
+
+// Set on the responses to refused requests, with the reason, so that the frontend knows to refetch the token and retry
+const HeaderCSRFError = "X-CSRF-Error"
+
+const CSRFTokenPath = "/api/csrf"
+
+const csrfTokenLifetime = 12 * time.Hour
+
+// trustedOrigins are the other origins allowed to send requests, e.g. "https://hxi2.fr"; the service itself always is
+// The tokens are signed with a key generated on startup, so they are invalidated by restarts
+func NewCSRFProtection(trustedOrigins ...string) *CSRFProtection {
+	key := make([]byte, 32)
+	_, _ = rand.Read(key)
+	c := &CSRFProtection{
+		key:            key,
+		trustedOrigins: make(map[string]bool, len(trustedOrigins)),
+		logger:         GetServiceSpecificLogger("CSRF", "\033[38;5;208m"),
+	}
+	for _, o := range trustedOrigins {
+		c.trustedOrigins[strings.TrimSuffix(o, "/")] = true
+	}
+	return c
+}
+
+// The tokens are bound to the user, when the route is behind an authentication middleware
+func csrfSubject(claims *HXI2JWTClaims) string {
+	if claims == nil {
+		return ""
+	}
+	if claims.Temporary {
+		return "temporary:" + claims.Username
+	}
+	return claims.Subject
+}
+
+func (c *CSRFProtection) sign(subject string, expires int64) string {
+	mac := hmac.New(sha256.New, c.key)
+	mac.Write([]byte(subject + "|" + strconv.FormatInt(expires, 10)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Returns a token for the user, valid for csrfTokenLifetime
+func (c *CSRFProtection) Token(claims *HXI2JWTClaims) string {
+	expires := time.Now().Add(csrfTokenLifetime).Unix()
+	return strconv.FormatInt(expires, 10) + "." + c.sign(csrfSubject(claims), expires)
+}
+
+func (c *CSRFProtection) validToken(token string, claims *HXI2JWTClaims) bool {
+	expiresRaw, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		return false
+	}
+	expires, err := strconv.ParseInt(expiresRaw, 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+	return hmac.Equal([]byte(signature), []byte(c.sign(csrfSubject(claims), expires)))
+}
+
+func (c *CSRFProtection) allowedOrigin(r *http.Request, origin string) bool {
+	if c.trustedOrigins[origin] {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host != "" && u.Host == r.Host
+}
+
+// Returns why the request must be refused, or nil
+func (c *CSRFProtection) check(r *http.Request) error {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return nil
+	}
+	if isBearerRequest(r) {
+		return nil
+	}
+
+	site := r.Header.Get("Sec-Fetch-Site")
+	origin := r.Header.Get("Origin")
+	switch {
+	case site == "same-origin" || site == "none":
+		return nil
+	case origin != "":
+		if !c.allowedOrigin(r, origin) {
+			return errors.New("origin not allowed")
+		}
+		return nil
+	case site != "":
+		return errors.New("cross-origin request")
+	}
+
+	if !c.validToken(r.Header.Get(HeaderCSRFToken), ClaimsFromContext(r.Context())) {
+		return errors.New("missing or invalid token")
+	}
+	return nil
+}
+
+// Refuses the forged state-changing requests with a 403
+// Put it behind the authentication middlewares, so that the tokens are checked against the user
+func (c *CSRFProtection) Protect(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := c.check(r); err != nil {
+			RequestLogger(r.Context()).With("error", err, "origin", r.Header.Get("Origin"), "secFetchSite", r.Header.Get("Sec-Fetch-Site")).Warn("Refused request failing the CSRF check")
+			w.Header().Set(HeaderCSRFError, err.Error())
+			http.Error(w, "CSRF check failed: "+err.Error(), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Serves a token for the user of the request as {"token": "..."}
+func (c *CSRFProtection) HandleToken(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	err := json.NewEncoder(w).Encode(map[string]string{"token": c.Token(ClaimsFromContext(r.Context()))})
+	if err != nil {
+		c.logger.With("error", err).Error("Failed to write CSRF token")
+	}
+}
@@ -0,0 +1,87 @@
+package globalgoutils
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+const AuthRemoteDeletionsPath = "/api/project/deletions"
+const AuthRemoteDeletionAckPath = "/api/project/deletions/ack"
+
+// An account deletion that was confirmed by an admin, and that this project hasn't acknowledged yet
+type PendingDeletion struct {
+	ID          int64     `json:"id"`
+	UserID      int64     `json:"userID"`
+	ConfirmedAt time.Time `json:"confirmedAt"`
+}
+
+type DeletionAckRequest struct {
+	ID int64 `json:"id"`
+}
+
+// Lists the confirmed account deletions this project still has to process
+// The project API key needs the APIRoleAccountDeletion role
+func (a *AuthManager) ProjectListPendingDeletions() ([]PendingDeletion, error) {
+	url := a.AuthEndpoint + AuthRemoteDeletionsPath
+
+	bodyBytes, err := a.ProjectGetRequest(url)
+	if err != nil {
+		return nil, err
+	}
+
+	var deletions []PendingDeletion
+	err = json.Unmarshal(bodyBytes, &deletions)
+	if err != nil {
+		a.Logger.With("error", err, "url", url, "resBody", string(bodyBytes)).Error("Failed to unmarshal response body")
+		return nil, err
+	}
+
+	return deletions, nil
+}
+
+// Tells the auth service that this project has removed or anonymized all the data of the deleted user
+func (a *AuthManager) ProjectAckDeletion(deletionID int64) error {
+	_, err := a.ProjectPostRequest(a.AuthEndpoint+AuthRemoteDeletionAckPath, DeletionAckRequest{ID: deletionID})
+	return err
+}
+
+// Periodically fetches the pending account deletions, and calls handler for each of them, until ctx is cancelled
+// The deletion is only acknowledged if handler doesn't return an error, so it will be retried on the next tick otherwise
+// handler must be idempotent
+func (a *AuthManager) RunDeletionWatcher(ctx context.Context, interval time.Duration, handler func(userID int64) error) {
+	process := func() {
+		deletions, err := a.ProjectListPendingDeletions()
+		if err != nil {
+			a.Logger.With("error", err).Error("Failed to list pending account deletions")
+			return
+		}
+		for _, d := range deletions {
+			if ctx.Err() != nil {
+				return
+			}
+			l := a.Logger.With("deletionID", d.ID, "userID", d.UserID)
+			if err := handler(d.UserID); err != nil {
+				l.With("error", err).Error("Failed to process account deletion, will retry")
+				continue
+			}
+			if err := a.ProjectAckDeletion(d.ID); err != nil {
+				l.With("error", err).Error("Failed to acknowledge account deletion, will retry")
+				continue
+			}
+			l.Info("Processed account deletion")
+		}
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	process()
+	for {
+		select {
+		case <-ticker.C:
+			process()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package globalgoutils
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Returns nil when the dependency works
+type HealthCheckFunc func(ctx context.Context) error
+
+const healthCheckTimeout = 5 * time.Second
+
+type healthCheck struct {
+	name     string
+	check    HealthCheckFunc
+	liveness bool
+}
+
+// The checks of a service, served at /healthz and /readyz:
+//   - /healthz fails only when a liveness check fails, i.e. when the service should be restarted
+//   - /readyz runs every check, and fails when the service can't handle requests, e.g. because a dependency is down
+type HealthRegistry struct {
+	mu     sync.Mutex
+	checks []healthCheck
+}
+
+func NewHealthRegistry() *HealthRegistry {
+	return &HealthRegistry{}
+}
+
+// Adds a check to /healthz and /readyz
+func (h *HealthRegistry) AddLivenessCheck(name string, check HealthCheckFunc) {
+	h.add(healthCheck{name: name, check: check, liveness: true})
+}
+
+// Adds a check to /readyz
+func (h *HealthRegistry) AddReadinessCheck(name string, check HealthCheckFunc) {
+	h.add(healthCheck{name: name, check: check})
+}
+
+func (h *HealthRegistry) add(c healthCheck) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.checks = append(h.checks, c)
+}
+
+type HealthCheckResult struct {
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+}
+
+type HealthReport struct {
+	Status string                       `json:"status"`
+	Checks map[string]HealthCheckResult `json:"checks"`
+}
+
+const (
+	HealthStatusOK   = "ok"
+	HealthStatusFail = "fail"
+)
+
+// Runs the checks concurrently, each with a timeout; only the liveness checks if livenessOnly
+func (h *HealthRegistry) Run(ctx context.Context, livenessOnly bool) HealthReport {
+	h.mu.Lock()
+	checks := make([]healthCheck, 0, len(h.checks))
+	for _, c := range h.checks {
+		if c.liveness || !livenessOnly {
+			checks = append(checks, c)
+		}
+	}
+	h.mu.Unlock()
+
+	report := HealthReport{Status: HealthStatusOK, Checks: make(map[string]HealthCheckResult, len(checks))}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, c := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+			defer cancel()
+			start := time.Now()
+			err := c.check(ctx)
+			result := HealthCheckResult{Status: HealthStatusOK, Duration: time.Since(start).Round(time.Microsecond).String()}
+			if err != nil {
+				result.Status = HealthStatusFail
+				result.Error = err.Error()
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			report.Checks[c.name] = result
+			if err != nil {
+				report.Status = HealthStatusFail
+			}
+		}()
+	}
+	wg.Wait()
+	return report
+}
+
+func (h *HealthRegistry) handler(livenessOnly bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report := h.Run(r.Context(), livenessOnly)
+		if report.Status != HealthStatusOK {
+			logger := RequestLogger(r.Context())
+			for name, result := range report.Checks {
+				if result.Status != HealthStatusOK {
+					logger.With("check", name, "error", result.Error).Warn("Health check failed")
+				}
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if report.Status != HealthStatusOK {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		err := json.NewEncoder(w).Encode(report)
+		if err != nil {
+			slog.With("error", err).Error("Failed to write health report")
+		}
+	}
+}
+
+// Serves GET /healthz and GET /readyz; they return 503 when a check fails, with the result of every check
+func (h *HealthRegistry) Mount(router *http.ServeMux) {
+	router.HandleFunc("GET /healthz", h.handler(true))
+	router.HandleFunc("GET /readyz", h.handler(false))
+}
@@ -1,16 +1,10 @@
 package globalgoutils
 
 import (
-	"bytes"
-	"compress/gzip"
 	"errors"
-	"fmt"
-	"hash"
-	"hash/fnv"
 	"io"
 	"log/slog"
 	"net/http"
-	"strings"
 	"time"
 )
 
@@ -128,93 +122,3 @@ func SlogHTTPInfo(r *http.Request) slog.Attr {
 	}
 
 }
-
-// gzipResponseWriter wraps http.ResponseWriter to support gzip compression
-type gzipResponseWriter struct {
-	http.ResponseWriter
-	Writer *gzip.Writer
-}
-
-func (w gzipResponseWriter) Write(b []byte) (int, error) {
-	return w.Writer.Write(b)
-}
-
-func GzipMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Check if the client supports gzip
-		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
-			next.ServeHTTP(w, r)
-			return
-		}
-
-		// Set the response header to indicate gzip encoding
-		w.Header().Set("Content-Encoding", "gzip")
-
-		// Create a gzip writer
-		gz := gzip.NewWriter(w)
-		defer gz.Close()
-
-		// Wrap the response writer
-		gzw := gzipResponseWriter{ResponseWriter: w, Writer: gz}
-		next.ServeHTTP(gzw, r)
-	})
-}
-
-// etagResponseRecorder wraps http.ResponseWriter to capture response data
-type etagResponseRecorder struct {
-	http.ResponseWriter
-	body       *bytes.Buffer
-	hash       hash.Hash64
-	status     int
-	headerSent bool
-}
-
-func NewResponseRecorder(w http.ResponseWriter) *etagResponseRecorder { //nolint:revive
-	return &etagResponseRecorder{
-		ResponseWriter: w,
-		body:           &bytes.Buffer{},
-		hash:           fnv.New64a(),
-		status:         http.StatusOK,
-	}
-}
-
-func (r *etagResponseRecorder) WriteHeader(statusCode int) {
-	if !r.headerSent {
-		r.status = statusCode
-		r.headerSent = true
-	}
-}
-
-func (r *etagResponseRecorder) Write(b []byte) (int, error) {
-	r.hash.Write(b)
-	return r.body.Write(b)
-}
-
-// Only use on medium to small responses, as it buffers the entire response
-// This doesn't work with gzip middleware, so not recommended to use for now
-func ETagMiddleware(cacheControl StaticFileCacheControlHeader, next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		rec := NewResponseRecorder(w)
-		next.ServeHTTP(rec, r)
-
-		etag := fmt.Sprintf(`"%x"`, rec.hash.Sum64())
-
-		if match := r.Header.Get("If-None-Match"); match == etag {
-			w.WriteHeader(http.StatusNotModified)
-			return
-		}
-
-		for key, values := range rec.Header() {
-			for _, value := range values {
-				w.Header().Add(key, value)
-			}
-		}
-
-		w.Header().Set("Cache-Control", cacheControl.Chose(r.URL.RawQuery))
-
-		w.Header().Set("ETag", etag)
-		w.WriteHeader(rec.status)
-
-		_, _ = io.Copy(w, rec.body)
-	})
-}
@@ -0,0 +1,110 @@
+package globalgoutils
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+
+	"github.com/cristalhq/jwt/v5"
+)
+
+// The auth service can sign with a key while tokens signed with the previous ones are still valid:
+// it serves all its public keys, signing key first, and sets the ID of the key in the `kid` header of the tokens
+
+// SHA-256 of the DER encoded public key, to tell keys apart without printing them
+func KeyFingerprint(publicKey *ecdsa.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(der)
+	return "SHA256:" + hex.EncodeToString(sum[:]), nil
+}
+
+// The `kid` of the tokens signed with the key: the start of its fingerprint
+func KeyID(publicKey *ecdsa.PublicKey) (string, error) {
+	fingerprint, err := KeyFingerprint(publicKey)
+	if err != nil {
+		return "", err
+	}
+	return fingerprint[len("SHA256:") : len("SHA256:")+16], nil
+}
+
+// Loads every ECDSA public key of a PEM bundle
+func LoadECDSAPublicKeys(pemData []byte) ([]*ecdsa.PublicKey, error) {
+	keys := []*ecdsa.PublicKey{}
+	for {
+		var block *pem.Block
+		block, pemData = pem.Decode(pemData)
+		if block == nil {
+			break
+		}
+		if block.Type != "PUBLIC KEY" {
+			return nil, fmt.Errorf("incorrect PEM block type: %s", block.Type)
+		}
+		pubKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse public key: %w", err)
+		}
+		ecdsaPubKey, ok := pubKey.(*ecdsa.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("public key is not of type ECDSA")
+		}
+		keys = append(keys, ecdsaPubKey)
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("failed to decode PEM block")
+	}
+	return keys, nil
+}
+
+type keySetVerifier struct {
+	byKeyID map[string]jwt.Verifier
+	all     []jwt.Verifier
+}
+
+// Verifies ES256 tokens signed with any of the keys; the `kid` header picks the key, and tokens without one are tried against all of them
+func NewKeySetVerifier(keys []*ecdsa.PublicKey) (jwt.Verifier, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("no public key")
+	}
+	v := &keySetVerifier{byKeyID: make(map[string]jwt.Verifier, len(keys))}
+	for _, key := range keys {
+		verifier, err := jwt.NewVerifierES(jwt.ES256, key)
+		if err != nil {
+			return nil, err
+		}
+		kid, err := KeyID(key)
+		if err != nil {
+			return nil, err
+		}
+		v.byKeyID[kid] = verifier
+		v.all = append(v.all, verifier)
+	}
+	return v, nil
+}
+
+func (v *keySetVerifier) Algorithm() jwt.Algorithm {
+	return jwt.ES256
+}
+
+func (v *keySetVerifier) Verify(token *jwt.Token) error {
+	if kid := token.Header().KeyID; kid != "" {
+		verifier, ok := v.byKeyID[kid]
+		if !ok {
+			return fmt.Errorf("unknown key %q", kid)
+		}
+		return verifier.Verify(token)
+	}
+	err := jwt.ErrInvalidSignature
+	for _, verifier := range v.all {
+		if err = verifier.Verify(token); err == nil {
+			return nil
+		}
+	}
+	return err
+}
@@ -0,0 +1,188 @@
+package globalgoutils
+
+import (
+	"container/list"
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/itsvyle/hxi2/global-go/utils/metrics"
+)
+
+type keyedEntry[K comparable, V any] struct {
+	key      K
+	value    V
+	loadedAt time.Time
+}
+
+type keyedLoad[V any] struct {
+	done  chan struct{}
+	value V
+	err   error
+}
+
+// Caches a value per key, loaded on demand; safe for concurrent use
+//   - entries expire after TTL (0 to keep them until evicted), and the least recently used ones are evicted
+//     beyond MaxEntries (0 for no limit)
+//   - concurrent Gets of a missing key share a single call to the loader; errors aren't cached
+//   - a load that was invalidated while running returns its value to its callers, but doesn't store it
+type KeyedCache[K comparable, V any] struct {
+	loader     func(key K) (V, error)
+	cacheName  string
+	TTL        time.Duration
+	MaxEntries int
+	logger     *slog.Logger
+
+	mu sync.Mutex
+	// most recently used first
+	lru     *list.List
+	entries map[K]*list.Element
+	loading map[K]*keyedLoad[V]
+}
+
+func NewKeyedCache[K comparable, V any](cacheName string, loader func(key K) (V, error), ttl time.Duration, maxEntries int) *KeyedCache[K, V] {
+	return &KeyedCache[K, V]{
+		loader:     loader,
+		cacheName:  cacheName,
+		TTL:        ttl,
+		MaxEntries: maxEntries,
+		logger:     slog.With("cacheName", cacheName),
+		lru:        list.New(),
+		entries:    map[K]*list.Element{},
+		loading:    map[K]*keyedLoad[V]{},
+	}
+}
+
+func (c *KeyedCache[K, V]) expired(e *keyedEntry[K, V]) bool {
+	return c.TTL > 0 && time.Since(e.loadedAt) > c.TTL
+}
+
+// Returns the value of key, loading it if it is missing or expired
+func (c *KeyedCache[K, V]) Get(key K) (V, error) {
+	c.mu.Lock()
+	if el, ok := c.entries[key]; ok {
+		e := el.Value.(*keyedEntry[K, V])
+		if !c.expired(e) {
+			c.lru.MoveToFront(el)
+			c.mu.Unlock()
+			metrics.CacheRequests.WithLabelValues(c.cacheName, "hit").Inc()
+			return e.value, nil
+		}
+		c.removeElement(el, "expired")
+	}
+	metrics.CacheRequests.WithLabelValues(c.cacheName, "miss").Inc()
+	if load, ok := c.loading[key]; ok {
+		c.mu.Unlock()
+		<-load.done
+		return load.value, load.err
+	}
+	load := &keyedLoad[V]{done: make(chan struct{})}
+	c.loading[key] = load
+	c.mu.Unlock()
+
+	func() {
+		// a panic of the loader is returned as an error, and the waiting callers are released: the next Gets
+		// of key load it again
+		defer func() {
+			if r := recover(); r != nil {
+				load.err = fmt.Errorf("%s: loader panicked: %v", c.cacheName, r)
+				c.logger.With("error", load.err, "key", key, "stack", string(debug.Stack())).Error("[cacher] Loader panicked")
+				metrics.CacheRefreshes.WithLabelValues(c.cacheName, metrics.Result(load.err)).Inc()
+			}
+			close(load.done)
+		}()
+		start := time.Now()
+		load.value, load.err = c.loader(key)
+		metrics.CacheRefreshDuration.WithLabelValues(c.cacheName).Observe(time.Since(start).Seconds())
+		metrics.CacheRefreshes.WithLabelValues(c.cacheName, metrics.Result(load.err)).Inc()
+	}()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// the load is no longer registered if the key was invalidated meanwhile
+	if c.loading[key] != load {
+		return load.value, load.err
+	}
+	delete(c.loading, key)
+	if load.err != nil {
+		c.logger.With("error", load.err, "key", key).Debug("[cacher] Failed to load value")
+		return load.value, load.err
+	}
+	c.store(key, load.value)
+	return load.value, nil
+}
+
+// Stores a value without calling the loader, e.g. when it is already known
+func (c *KeyedCache[K, V]) Set(key K, value V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// a load in progress would store an older value
+	delete(c.loading, key)
+	c.store(key, value)
+}
+
+// the caller must hold mu
+func (c *KeyedCache[K, V]) store(key K, value V) {
+	if el, ok := c.entries[key]; ok {
+		c.removeElement(el, "replaced")
+	}
+	c.entries[key] = c.lru.PushFront(&keyedEntry[K, V]{key: key, value: value, loadedAt: time.Now()})
+	for c.MaxEntries > 0 && c.lru.Len() > c.MaxEntries {
+		c.removeElement(c.lru.Back(), "capacity")
+	}
+}
+
+// the caller must hold mu
+func (c *KeyedCache[K, V]) removeElement(el *list.Element, reason string) {
+	e := c.lru.Remove(el).(*keyedEntry[K, V])
+	delete(c.entries, e.key)
+	if reason != "replaced" {
+		metrics.CacheEvictions.WithLabelValues(c.cacheName, reason).Inc()
+	}
+}
+
+// Removes the value of key; a load of it in progress won't be stored
+func (c *KeyedCache[K, V]) Invalidate(key K) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.loading, key)
+	if el, ok := c.entries[key]; ok {
+		c.removeElement(el, "invalidated")
+	}
+}
+
+// Removes the values for which match returns true, and returns how many were removed
+// The loads in progress aren't stored, as their values can't be matched yet
+func (c *KeyedCache[K, V]) InvalidateFunc(match func(key K, value V) bool) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	clear(c.loading)
+	removed := 0
+	for el := c.lru.Front(); el != nil; {
+		next := el.Next()
+		e := el.Value.(*keyedEntry[K, V])
+		if match(e.key, e.value) {
+			c.removeElement(el, "invalidated")
+			removed++
+		}
+		el = next
+	}
+	if removed > 0 {
+		c.logger.With("removed", removed).Debug("[cacher] Invalidated values")
+	}
+	return removed
+}
+
+// Removes every value
+func (c *KeyedCache[K, V]) InvalidateAll() {
+	c.InvalidateFunc(func(K, V) bool { return true })
+}
+
+// Number of stored values, including the expired ones that weren't evicted yet
+func (c *KeyedCache[K, V]) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
@@ -0,0 +1,154 @@
+package globalgoutils
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestKeyedCacheSharesLoads(t *testing.T) {
+	var calls atomic.Int64
+	release := make(chan struct{})
+	c := NewKeyedCache("test_keyed_shared", func(key string) (string, error) {
+		calls.Add(1)
+		<-release
+		return "value of " + key, nil
+	}, time.Minute, 0)
+
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if v, err := c.Get("a"); err != nil || v != "value of a" {
+				t.Errorf("Get: %q, %v", v, err)
+			}
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if calls.Load() != 1 {
+		t.Fatalf("the loader was called %d times", calls.Load())
+	}
+	if _, err := c.Get("a"); err != nil || calls.Load() != 1 {
+		t.Fatalf("the value wasn't stored: %v, %d calls", err, calls.Load())
+	}
+}
+
+func TestKeyedCacheErrorsArentCached(t *testing.T) {
+	var failing atomic.Bool
+	failing.Store(true)
+	c := NewKeyedCache("test_keyed_errors", func(key int) (int, error) {
+		if failing.Load() {
+			return 0, errors.New("source down")
+		}
+		return key * 2, nil
+	}, time.Minute, 0)
+
+	if _, err := c.Get(1); err == nil {
+		t.Fatal("Get succeeded with a failing loader")
+	}
+	failing.Store(false)
+	if v, err := c.Get(1); err != nil || v != 2 {
+		t.Fatalf("Get after the failure: %d, %v", v, err)
+	}
+}
+
+func TestKeyedCacheLoaderPanic(t *testing.T) {
+	var panicking atomic.Bool
+	panicking.Store(true)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	c := NewKeyedCache("test_keyed_panic", func(key string) (string, error) {
+		if panicking.Load() {
+			close(started)
+			<-release
+			panic("boom")
+		}
+		return "value of " + key, nil
+	}, time.Minute, 0)
+
+	// a caller waiting on the load gets the error too
+	waiterErr := make(chan error)
+	go func() {
+		_, err := c.Get("a")
+		waiterErr <- err
+	}()
+	loaderErr := make(chan error)
+	go func() {
+		<-started
+		go func() {
+			_, err := c.Get("a")
+			loaderErr <- err
+		}()
+		time.Sleep(20 * time.Millisecond)
+		close(release)
+	}()
+	for _, ch := range []chan error{waiterErr, loaderErr} {
+		select {
+		case err := <-ch:
+			if err == nil || !strings.Contains(err.Error(), "loader panicked: boom") {
+				t.Fatalf("Get during the panic: %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("a Get is still waiting on the load that panicked")
+		}
+	}
+
+	// the panicked load isn't registered anymore, and the next Get loads the key again
+	panicking.Store(false)
+	if v, err := c.Get("a"); err != nil || v != "value of a" {
+		t.Fatalf("Get after the panic: %q, %v", v, err)
+	}
+}
+
+func TestKeyedCacheInvalidateDuringLoad(t *testing.T) {
+	var calls atomic.Int64
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	c := NewKeyedCache("test_keyed_invalidate", func(key string) (int64, error) {
+		n := calls.Add(1)
+		if n == 1 {
+			started <- struct{}{}
+			<-release
+		}
+		return n, nil
+	}, time.Minute, 0)
+
+	done := make(chan int64)
+	go func() {
+		v, _ := c.Get("a")
+		done <- v
+	}()
+	<-started
+	c.Invalidate("a")
+	close(release)
+	if v := <-done; v != 1 {
+		t.Fatalf("the invalidated load returned %d", v)
+	}
+	if v, _ := c.Get("a"); v != 2 {
+		t.Fatalf("the invalidated load was stored: got %d", v)
+	}
+}
+
+func TestKeyedCacheEviction(t *testing.T) {
+	c := NewKeyedCache("test_keyed_eviction", func(key int) (int, error) {
+		return key, nil
+	}, time.Minute, 2)
+
+	for k := range 3 {
+		if _, err := c.Get(k); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if c.Len() != 2 {
+		t.Fatalf("%d entries, expected 2", c.Len())
+	}
+	if n := c.InvalidateFunc(func(k, _ int) bool { return k == 0 }); n != 0 {
+		t.Fatalf("the least recently used entry wasn't evicted: %d removed", n)
+	}
+}
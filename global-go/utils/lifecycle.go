@@ -0,0 +1,147 @@
+package globalgoutils
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Below the 10s Docker waits after SIGTERM before killing the container
+const DefaultShutdownTimeout = 8 * time.Second
+
+type shutdownHook struct {
+	name string
+	fn   func() error
+}
+
+// Runs the HTTP server and the background workers of a service until SIGINT or SIGTERM, then stops them in order:
+//  1. the server stops accepting connections, and in-flight requests are drained
+//  2. the context of the workers is cancelled, and they are waited for
+//  3. the shutdown hooks run, in reverse order of registration (e.g. close the Discord session, then the database)
+//
+// Steps 1 and 2 share ShutdownTimeout; a second signal exits right away
+type Lifecycle struct {
+	ShutdownTimeout time.Duration
+	ctx             context.Context
+	stopSignals     context.CancelFunc
+	cancel          context.CancelFunc
+	workers         sync.WaitGroup
+	mu              sync.Mutex
+	hooks           []shutdownHook
+	logger          *slog.Logger
+}
+
+func NewLifecycle() *Lifecycle {
+	signalCtx, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	ctx, cancel := context.WithCancel(signalCtx)
+	return &Lifecycle{
+		ShutdownTimeout: DefaultShutdownTimeout,
+		ctx:             ctx,
+		stopSignals:     stopSignals,
+		cancel:          cancel,
+		logger:          GetServiceSpecificLogger("LIFECY", "\033[38;5;141m"),
+	}
+}
+
+// Cancelled when the service starts shutting down
+func (l *Lifecycle) Context() context.Context {
+	return l.ctx
+}
+
+// Runs a background worker, which must return once ctx is cancelled
+func (l *Lifecycle) Go(name string, worker func(ctx context.Context)) {
+	l.workers.Add(1)
+	go func() {
+		defer l.workers.Done()
+		worker(l.ctx)
+		l.logger.With("worker", name).Debug("Worker stopped")
+	}()
+}
+
+// Calls fn every interval until shutdown; a call in progress is waited for
+func (l *Lifecycle) Every(name string, interval time.Duration, fn func(ctx context.Context)) {
+	l.Go(name, func(ctx context.Context) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				fn(ctx)
+			case <-ctx.Done():
+				return
+			}
+		}
+	})
+}
+
+// Registers a function to run once the server and the workers are stopped
+func (l *Lifecycle) OnShutdown(name string, fn func() error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.hooks = append(l.hooks, shutdownHook{name: name, fn: fn})
+}
+
+// Serves until a signal is received, or the server fails, then shuts everything down
+// Returns the error of the server if it failed, e.g. because the port is taken
+func (l *Lifecycle) Serve(server *http.Server) error {
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.ListenAndServe()
+	}()
+
+	var err error
+	select {
+	case err = <-serveErr:
+		l.logger.With("error", err).Error("Server crashed")
+	case <-l.ctx.Done():
+		// a second signal kills the process
+		l.stopSignals()
+		l.logger.With("timeout", l.ShutdownTimeout).Info("Shutting down")
+	}
+	l.cancel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), l.ShutdownTimeout)
+	defer cancel()
+
+	if err == nil {
+		if shutdownErr := server.Shutdown(ctx); shutdownErr != nil {
+			l.logger.With("error", shutdownErr).Warn("Failed to drain connections before the timeout, closing them")
+			_ = server.Close()
+		}
+	}
+
+	workersDone := make(chan struct{})
+	go func() {
+		l.workers.Wait()
+		close(workersDone)
+	}()
+	select {
+	case <-workersDone:
+	case <-ctx.Done():
+		l.logger.Warn("Workers didn't stop before the timeout")
+	}
+
+	l.mu.Lock()
+	hooks := l.hooks
+	l.mu.Unlock()
+	for i := len(hooks) - 1; i >= 0; i-- {
+		if hookErr := hooks[i].fn(); hookErr != nil {
+			l.logger.With("error", hookErr, "hook", hooks[i].name).Error("Shutdown hook failed")
+		}
+	}
+
+	l.stopSignals()
+	if errors.Is(err, http.ErrServerClosed) {
+		err = nil
+	}
+	if err == nil {
+		l.logger.Info("Stopped")
+	}
+	return err
+}
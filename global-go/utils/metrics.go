@@ -0,0 +1,16 @@
+package globalgoutils
+
+import (
+	"net/http"
+
+	"github.com/itsvyle/hxi2/global-go/utils/metrics"
+)
+
+// Serves the Prometheus metrics on the internal METRICS_ADDR if it is set,
+// and otherwise at /metrics on the router, for admins only
+func (a *AuthManager) MountMetrics(router *http.ServeMux) {
+	if metrics.ListenFromEnv() {
+		return
+	}
+	router.Handle("GET /metrics", a.RequirePermission(RoleAdmin)(metrics.Handler()))
+}
@@ -0,0 +1,246 @@
+// Package metrics holds the Prometheus metrics shared by every service
+// The HTTP middleware, the cachers and the auth manager of global-go report to Registry;
+// services add their own metrics with Factory
+package metrics
+
+import (
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const Namespace = "hxi2"
+
+var Registry = prometheus.NewRegistry()
+
+// Registers new metrics in Registry, e.g. metrics.Factory.NewHistogram(...)
+var Factory = promauto.With(Registry)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		cacheAge,
+	)
+}
+
+// #region HTTP
+var (
+	httpRequests = Factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests, by route pattern, method and status code",
+	}, []string{"route", "method", "code"})
+	httpDuration = Factory.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Time to handle HTTP requests, by route pattern",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method"})
+	httpInFlight = Factory.NewGauge(prometheus.GaugeOpts{
+		Namespace: Namespace,
+		Name:      "http_requests_in_flight",
+		Help:      "HTTP requests being handled",
+	})
+)
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(statusCode int) {
+	if r.status == 0 {
+		r.status = statusCode
+	}
+	r.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// for http.ResponseController
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// Measures the requests handled by next, which should be the router of the service:
+// requests are labelled with the pattern of the route that matched them, to keep the number of series bounded
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		httpInFlight.Inc()
+		defer httpInFlight.Dec()
+
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		// set by http.ServeMux on the request once it has been routed
+		route := r.Pattern
+		if route == "" {
+			route = "other"
+		}
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		httpRequests.WithLabelValues(route, r.Method, strconv.Itoa(rec.status)).Inc()
+		httpDuration.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+	})
+}
+
+// #endregion
+
+// #region Cachers
+var (
+	CacheRequests = Factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "cache_requests_total",
+		Help:      "Reads of a cacher, by result: hit, miss (the value was fetched) or stale (a stale value was returned while refreshing)",
+	}, []string{"cache", "result"})
+	CacheRefreshes = Factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "cache_refreshes_total",
+		Help:      "Refreshes of a cacher, by result: success or error",
+	}, []string{"cache", "result"})
+	CacheRefreshDuration = Factory.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Name:      "cache_refresh_duration_seconds",
+		Help:      "Time to fetch the value of a cacher",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"cache"})
+	CacheEvictions = Factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "cache_evictions_total",
+		Help:      "Values removed from a keyed cache, by reason: capacity, expired or invalidated",
+	}, []string{"cache", "reason"})
+)
+
+var cacheAge = &cacheAgeCollector{
+	desc: prometheus.NewDesc(Namespace+"_cache_age_seconds", "Time since the value of a cacher was last fetched", []string{"cache"}, nil),
+	ages: map[string]func() (float64, bool){},
+}
+
+// Computes the age of every cacher when the metrics are scraped
+type cacheAgeCollector struct {
+	desc *prometheus.Desc
+	mu   sync.Mutex
+	ages map[string]func() (float64, bool)
+}
+
+func (c *cacheAgeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *cacheAgeCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for name, age := range c.ages {
+		if v, ok := age(); ok {
+			ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, v, name)
+		}
+	}
+}
+
+// Reports the staleness of a cacher, age returns false until a value was fetched
+// A cacher created with the same name replaces the previous one
+func RegisterCacheAge(cache string, age func() (float64, bool)) {
+	cacheAge.mu.Lock()
+	defer cacheAge.mu.Unlock()
+	cacheAge.ages[cache] = age
+}
+
+// #endregion
+
+// #region Auth
+var (
+	AuthVerifications = Factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "auth_verifications_total",
+		Help:      "Tokens checked by the auth manager, by result: valid, renewed, invalid, expired",
+	}, []string{"result"})
+	AuthRenewals = Factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "auth_renewals_total",
+		Help:      "Token renewals requested to the auth service, by kind (token or temporary) and result (success or error)",
+	}, []string{"kind", "result"})
+	AuthRenewalsShared = Factory.NewCounter(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "auth_renewals_shared_total",
+		Help:      "Token renewals served by a concurrent or recent renewal of the same refresh token",
+	})
+	AuthRenewalDuration = Factory.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: Namespace,
+		Name:      "auth_renewal_duration_seconds",
+		Help:      "Time to renew a token with the auth service",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"kind"})
+	AuthFailures = Factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "auth_failures_total",
+		Help:      "Requests refused by the auth manager, by reason",
+	}, []string{"reason"})
+)
+
+// Returns "success" or "error", for the result labels
+func Result(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "success"
+}
+
+// #endregion
+
+// #region CSP
+var (
+	CSPViolations = Factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "csp_violations_total",
+		Help:      "Content Security Policy violations reported by browsers, by directive and disposition (enforce or report)",
+	}, []string{"directive", "disposition"})
+	CSPReportsDropped = Factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: Namespace,
+		Name:      "csp_reports_dropped_total",
+		Help:      "Content Security Policy reports ignored, by reason: rate_limited or invalid",
+	}, []string{"reason"})
+)
+
+// #endregion
+
+// Serves the metrics of Registry
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{Registry: Registry})
+}
+
+// Serves the metrics on the internal address in METRICS_ADDR (e.g. "127.0.0.1:9100"), if it is set
+// Returns whether it did
+func ListenFromEnv() bool {
+	addr := os.Getenv("METRICS_ADDR")
+	if addr == "" {
+		return false
+	}
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", Handler())
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	go func() {
+		slog.With("error", server.ListenAndServe(), "addr", addr).Error("Metrics server crashed")
+	}()
+	slog.With("addr", addr).Info("Serving metrics")
+	return true
+}
@@ -0,0 +1,99 @@
+package globalgoutils
+
+import (
+	"encoding/json"
+)
+
+// Promotions are named after the year their students start MP2I, and go through these states, one per academic year
+const (
+	// admitted, but hasn't started MP2I yet
+	PromotionStateIncoming = "incoming"
+	PromotionStateMP2I     = "mp2i"
+	PromotionStateMPI      = "mpi"
+	PromotionStateAlumni   = "alumni"
+)
+
+var PromotionLifecycle = []string{PromotionStateIncoming, PromotionStateMP2I, PromotionStateMPI, PromotionStateAlumni}
+
+// The state of a promotion after a rollover; alumni stay alumni
+func NextPromotionState(state string) string {
+	for i, s := range PromotionLifecycle {
+		if s == state && i+1 < len(PromotionLifecycle) {
+			return PromotionLifecycle[i+1]
+		}
+	}
+	return PromotionStateAlumni
+}
+
+const AuthRemotePromotionsPath = "/api/project/promotions"
+
+type PromotionInfo struct {
+	Promotion int    `db:"promotion" json:"promotion"`
+	State     string `db:"state" json:"state"`
+	// background color of the promotion in the tree
+	Color string `db:"color" json:"color"`
+}
+
+// The promotions, sorted by year
+type PromotionsInfo []PromotionInfo
+
+// The promotions before the auth service managed them; used to seed it, and as a fallback
+func DefaultPromotions() PromotionsInfo {
+	return PromotionsInfo{
+		{Promotion: 2021, State: PromotionStateAlumni, Color: "#b9291b"},
+		{Promotion: 2022, State: PromotionStateAlumni, Color: "#00c0c6"},
+		{Promotion: 2023, State: PromotionStateMPI, Color: "#a05fdd"},
+		{Promotion: 2024, State: PromotionStateMP2I, Color: "#48e675"},
+		{Promotion: 2025, State: PromotionStateIncoming, Color: "#e6a448"},
+	}
+}
+
+func (pi PromotionsInfo) Range() (int, int) {
+	if len(pi) == 0 {
+		return 0, 0
+	}
+	minp, maxp := pi[0].Promotion, pi[0].Promotion
+	for _, p := range pi {
+		minp = min(minp, p.Promotion)
+		maxp = max(maxp, p.Promotion)
+	}
+	return minp, maxp
+}
+
+// Returns the latest promotion in the given state, or 0
+func (pi PromotionsInfo) WithState(state string) int {
+	res := 0
+	for _, p := range pi {
+		if p.State == state {
+			res = max(res, p.Promotion)
+		}
+	}
+	return res
+}
+
+func (pi PromotionsInfo) Get(promotion int) *PromotionInfo {
+	for i := range pi {
+		if pi[i].Promotion == promotion {
+			return &pi[i]
+		}
+	}
+	return nil
+}
+
+func (a *AuthManager) ProjectGetPromotions() (PromotionsInfo, error) {
+	url := a.AuthEndpoint + AuthRemotePromotionsPath
+
+	bodyBytes, err := a.ProjectGetRequest(url)
+	if err != nil {
+		return nil, err
+	}
+
+	var promotions PromotionsInfo
+	err = json.Unmarshal(bodyBytes, &promotions)
+	if err != nil {
+		a.Logger.With("error", err, "url", url, "resBody", string(bodyBytes)).Error("Failed to unmarshal response body")
+		return nil, err
+	}
+
+	return promotions, nil
+}
@@ -0,0 +1,75 @@
+package globalgoutils
+
+import (
+	"context"
+	"time"
+
+	"github.com/itsvyle/hxi2/global-go/utils/metrics"
+)
+
+// The auth service rotates the refresh token on each renewal, so when the requests of a page all find the token expired,
+// only the first renewal would succeed and the others would log the user out
+// Renewals of the same refresh token share a single call to the auth service instead, and a successful one is reused
+// for renewalReuseDuration, for the requests that were sent before the browser got the new cookies
+const renewalReuseDuration = 30 * time.Second
+
+type renewalCall struct {
+	done chan struct{}
+	res  *AuthRenewalResponse
+	err  error
+}
+
+// Calls RenewToken once per refresh token, for all the concurrent callers
+func (a *AuthManager) renewTokenShared(ctx context.Context, oldToken, refreshToken string) (*AuthRenewalResponse, error) {
+	a.renewalsMu.Lock()
+	if call, ok := a.renewals[refreshToken]; ok {
+		a.renewalsMu.Unlock()
+		metrics.AuthRenewalsShared.Inc()
+		select {
+		case <-call.done:
+			return call.res, call.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if a.renewals == nil {
+		a.renewals = map[string]*renewalCall{}
+	}
+	call := &renewalCall{done: make(chan struct{})}
+	a.renewals[refreshToken] = call
+	a.renewalsMu.Unlock()
+
+	forget := func() {
+		a.renewalsMu.Lock()
+		defer a.renewalsMu.Unlock()
+		if a.renewals[refreshToken] == call {
+			delete(a.renewals, refreshToken)
+		}
+	}
+
+	func() {
+		// the waiting callers are released even if RenewToken panics
+		defer close(call.done)
+		start := time.Now()
+		// not cancelled with the request: the others wait for it, and the auth service rotates the refresh token anyway
+		call.res, call.err = a.RenewToken(context.WithoutCancel(ctx), a, oldToken, refreshToken)
+		metrics.AuthRenewalDuration.WithLabelValues("token").Observe(time.Since(start).Seconds())
+		metrics.AuthRenewals.WithLabelValues("token", metrics.Result(call.err)).Inc()
+	}()
+
+	// a failed renewal can be retried, e.g. if the auth service was unreachable
+	if call.err != nil {
+		forget()
+	} else {
+		time.AfterFunc(renewalReuseDuration, forget)
+	}
+	return call.res, call.err
+}
+
+// Whether a valid token is close enough to expiry to be renewed ahead of time
+func (a *AuthManager) shouldRenewEarly(claims *HXI2JWTClaims, refreshToken string) bool {
+	if a.RenewBefore <= 0 || claims.Temporary || refreshToken == "" || claims.ExpiresAt == nil {
+		return false
+	}
+	return time.Until(claims.ExpiresAt.Time) < a.RenewBefore
+}
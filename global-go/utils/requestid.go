@@ -0,0 +1,116 @@
+package globalgoutils
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// Each request gets an ID, which is echoed in the response, added to every log line of the request, and forwarded by
+// AuthManager to the auth service
+// The X-Request-ID header of any client is used as the ID when it is valid (see isValidRequestID), so that a service
+// calling another one shares its ID; it only correlates logs, and must not be trusted for anything else
+const HeaderRequestID = "X-Request-ID"
+
+type requestContextKey struct{}
+
+type requestContext struct {
+	id     string
+	logger *slog.Logger
+}
+
+// Returns the ID of the request, or "" outside of RequestLoggingMiddleware
+func RequestID(ctx context.Context) string {
+	if rc, ok := ctx.Value(requestContextKey{}).(*requestContext); ok {
+		return rc.id
+	}
+	return ""
+}
+
+// Returns the logger of the request, with its ID; falls back to the default logger
+func RequestLogger(ctx context.Context) *slog.Logger {
+	if rc, ok := ctx.Value(requestContextKey{}).(*requestContext); ok {
+		return rc.logger
+	}
+	return slog.Default()
+}
+
+// Accepts IDs of up to 128 characters from [A-Za-z0-9._-]
+func isValidRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '_' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+func NewRequestID() string {
+	id, err := GenerateRandomString(12)
+	if err != nil {
+		return "unknown"
+	}
+	return id
+}
+
+type accessLogRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (r *accessLogRecorder) WriteHeader(statusCode int) {
+	if r.status == 0 {
+		r.status = statusCode
+	}
+	r.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (r *accessLogRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += n
+	return n, err
+}
+
+// for http.ResponseController
+func (r *accessLogRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// Assigns or propagates the request ID, puts the request logger in the context, and logs an access line per request
+// It should wrap everything else, as the request passed to next is a copy
+func RequestLoggingMiddleware(next http.Handler) http.Handler {
+	accessLogger := GetServiceSpecificLogger("ACCESS", "\033[38;5;245m")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := r.Header.Get(HeaderRequestID)
+		if !isValidRequestID(id) {
+			id = NewRequestID()
+		}
+		w.Header().Set(HeaderRequestID, id)
+
+		rc := &requestContext{
+			id:     id,
+			logger: slog.Default().With("requestID", id, SlogHTTPInfo(r)),
+		}
+		rec := &accessLogRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), requestContextKey{}, rc)))
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		accessLogger.With("requestID", id, SlogHTTPInfo(r)).Info("Request",
+			"status", rec.status,
+			"duration", time.Since(start).Round(time.Microsecond),
+			"bytes", rec.bytes,
+			"remote", r.RemoteAddr,
+		)
+	})
+}
@@ -0,0 +1,271 @@
+package globalgoutils
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Configuration of the StaticFilesManager, to embed in the config of a service
+type StaticsConfig struct {
+	// Serves the frontend from the disk instead of the binary, and reloads the pages when webpack rebuilds it
+	Dev bool `env:"HXI2_STATICS_DEV"`
+	// In dev mode, the directory holding the dist directory: usually the directory of the service, where `go run .` runs
+	Dir string `env:"HXI2_STATICS_DIR" default:"."`
+	// Sends the Content Security Policy as Content-Security-Policy-Report-Only: violations are reported, not blocked
+	CSPReportOnly bool `env:"HXI2_CSP_REPORT_ONLY"`
+}
+
+// The pages open an EventSource on this path in dev mode, and reload when they receive an event
+const StaticsReloadPath = "/__statics/reload"
+
+const staticsReloadScriptPath = StaticsReloadPath + ".js"
+
+// Injected at the end of the HTML pages in dev mode; a file rather than an inline script, for the CSP
+const staticsReloadSnippet = `<script src="` + staticsReloadScriptPath + `"></script>`
+
+const staticsReloadScript = `(() => {
+    const events = new EventSource("` + StaticsReloadPath + `");
+    events.addEventListener("reload", () => location.reload());
+})();
+`
+
+const staticsDevPollInterval = 500 * time.Millisecond
+
+type staticFileVersion struct {
+	modTime time.Time
+	size    int64
+	etag    string
+}
+
+// The state of the dev mode: the hashes of the files, and the pages waiting for a reload
+type staticsDev struct {
+	hashesMutex sync.Mutex
+	hashes      map[string]staticFileVersion
+
+	clientsMutex sync.Mutex
+	clients      map[chan struct{}]struct{}
+	// closed when the watcher stops, so that the event streams don't hold the shutdown
+	done chan struct{}
+}
+
+// Like NewStaticFilesManager, but serves the dist directory under cfg.Dir in dev mode, instead of embedded
+// csp is usually DefaultContentSecurityPolicy, adapted to the service; nil for none
+func NewStaticFilesManagerFromConfig(cfg StaticsConfig, embedded fs.FS, baseDistPath string, csp *ContentSecurityPolicy) *StaticFilesManager {
+	if csp != nil && cfg.CSPReportOnly {
+		csp = csp.Clone()
+		csp.ReportOnly = true
+	}
+	if !cfg.Dev {
+		return newStaticFilesManager(embedded, baseDistPath, csp).withManifest()
+	}
+	// no manifest: the files change, and the pages would reference outdated versions
+	manager := newStaticFilesManager(os.DirFS(cfg.Dir), baseDistPath, csp)
+	manager.dev = &staticsDev{
+		hashes:  map[string]staticFileVersion{},
+		clients: map[chan struct{}]struct{}{},
+		done:    make(chan struct{}),
+	}
+	manager.logger.With("dir", cfg.Dir).Warn("Serving the frontend from the disk, in dev mode")
+	return manager
+}
+
+// Whether the files are served from the disk, see StaticsConfig
+func (manager *StaticFilesManager) IsDev() bool {
+	return manager.dev != nil
+}
+
+// The ETag of a file in dev mode, hashed again when its size or modification time changes
+func (manager *StaticFilesManager) devETag(file string) (string, error) {
+	info, err := fs.Stat(manager.FS, file)
+	if err != nil {
+		return "", err
+	}
+	manager.dev.hashesMutex.Lock()
+	defer manager.dev.hashesMutex.Unlock()
+	if v, ok := manager.dev.hashes[file]; ok && v.size == info.Size() && v.modTime.Equal(info.ModTime()) {
+		return v.etag, nil
+	}
+	etag, err := manager.readFileAndHashMD5(file)
+	if err != nil {
+		return "", err
+	}
+	manager.dev.hashes[file] = staticFileVersion{modTime: info.ModTime(), size: info.Size(), etag: etag}
+	return etag, nil
+}
+
+// Serves a file from the disk: the ETag follows its changes, and the HTML pages get the reload snippet
+func (manager *StaticFilesManager) generateDevFileHandler(file string, contentType string) http.HandlerFunc {
+	isHTML := strings.HasPrefix(contentType, "text/html")
+	return func(w http.ResponseWriter, r *http.Request) {
+		etag, err := manager.devETag(file)
+		if err != nil {
+			// e.g. while webpack cleans the dist directory
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", contentType)
+		nonce := ""
+		if isHTML && manager.csp.UsesNonce() {
+			// a new page for each nonce, see pageWithNonceHandler
+			nonce = manager.csp.Apply(w)
+			w.Header().Set("Cache-Control", "no-store")
+			etag = ""
+		} else {
+			manager.csp.setHeaders(w, "")
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Header().Set("ETag", etag)
+		}
+		if match := r.Header.Get("If-None-Match"); etag != "" && match == etag {
+			http.Error(w, http.StatusText(http.StatusNotModified), http.StatusNotModified)
+			return
+		}
+		if !isHTML {
+			http.ServeFileFS(w, r, manager.FS, file)
+			return
+		}
+
+		content, err := fs.ReadFile(manager.FS, file)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		page := string(content)
+		if i := strings.LastIndex(page, "</body>"); i >= 0 {
+			page = page[:i] + staticsReloadSnippet + page[i:]
+		} else {
+			page += staticsReloadSnippet
+		}
+		_, err = w.Write(InjectCSPNonce([]byte(page), nonce))
+		if err != nil {
+			manager.logger.With("error", err, "file", file).Error("Failed to write page")
+		}
+	}
+}
+
+// Serves the chunks that exist when requested, so that the ones created by a rebuild are found without a restart
+func (manager *StaticFilesManager) handleDevChunk(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("file")
+	if !strings.HasSuffix(name, chunkFileEnd) || !fs.ValidPath(name) {
+		http.NotFound(w, r)
+		return
+	}
+	manager.generateDevFileHandler(manager.baseDistPath+"/"+name, "application/javascript; charset=utf-8")(w, r)
+}
+
+// Mounts the reload event stream and its script, in dev mode only
+func (manager *StaticFilesManager) MountDevRoutes(router *http.ServeMux) {
+	if !manager.IsDev() {
+		return
+	}
+	router.HandleFunc("GET "+staticsReloadScriptPath, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/javascript; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-cache")
+		_, _ = w.Write([]byte(staticsReloadScript))
+	})
+	router.HandleFunc("GET "+StaticsReloadPath, manager.handleReloadEvents)
+}
+
+func (manager *StaticFilesManager) handleReloadEvents(w http.ResponseWriter, r *http.Request) {
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// reconnect quickly after a restart of the service
+	if _, err := fmt.Fprint(w, "retry: 1000\n\n"); err != nil || rc.Flush() != nil {
+		return
+	}
+
+	ch := make(chan struct{}, 1)
+	manager.dev.clientsMutex.Lock()
+	manager.dev.clients[ch] = struct{}{}
+	manager.dev.clientsMutex.Unlock()
+	defer func() {
+		manager.dev.clientsMutex.Lock()
+		delete(manager.dev.clients, ch)
+		manager.dev.clientsMutex.Unlock()
+	}()
+
+	keepAlive := time.NewTicker(30 * time.Second)
+	defer keepAlive.Stop()
+	for {
+		var event string
+		select {
+		case <-r.Context().Done():
+			return
+		case <-manager.dev.done:
+			return
+		case <-keepAlive.C:
+			event = ": keep-alive\n\n"
+		case <-ch:
+			event = "event: reload\ndata: {}\n\n"
+		}
+		if _, err := fmt.Fprint(w, event); err != nil || rc.Flush() != nil {
+			return
+		}
+	}
+}
+
+// Describes the files of the dist directory, to notice when webpack writes to it
+func (manager *StaticFilesManager) distSignature() string {
+	var sb strings.Builder
+	_ = fs.WalkDir(manager.FS, manager.baseDistPath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil //nolint:nilerr // a file removed during the walk is picked up by the next one
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil //nolint:nilerr
+		}
+		fmt.Fprintf(&sb, "%s:%d:%d\n", path, info.Size(), info.ModTime().UnixNano())
+		return nil
+	})
+	return sb.String()
+}
+
+// In dev mode, polls the dist directory until ctx is cancelled, and reloads the open pages once a rebuild is over
+// Returns right away otherwise; run it with Lifecycle.Go
+func (manager *StaticFilesManager) RunDevWatcher(ctx context.Context) {
+	if !manager.IsDev() {
+		return
+	}
+	defer close(manager.dev.done)
+
+	ticker := time.NewTicker(staticsDevPollInterval)
+	defer ticker.Stop()
+	last := manager.distSignature()
+	changed := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		signature := manager.distSignature()
+		if signature != last {
+			// webpack writes the files one by one: wait until they stop changing
+			last = signature
+			changed = true
+			continue
+		}
+		if !changed {
+			continue
+		}
+		changed = false
+
+		manager.dev.clientsMutex.Lock()
+		for ch := range manager.dev.clients {
+			select {
+			case ch <- struct{}{}:
+			default:
+			}
+		}
+		pages := len(manager.dev.clients)
+		manager.dev.clientsMutex.Unlock()
+		manager.logger.With("pages", pages).Info("Frontend rebuilt, reloading the pages")
+	}
+}
@@ -0,0 +1,149 @@
+package globalgoutils
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"html/template"
+	"io/fs"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// A bundle of the dist directory, with the hash of its content
+type staticAsset struct {
+	// appended to the URL, as ?<version>__hash__, so that it changes with the content
+	version string
+	// Subresource Integrity of the content, "sha384-..."
+	integrity string
+}
+
+// The assets by URL path, e.g. "/dist/main.bundle.js"; built at startup from the embedded files
+type staticsManifest map[string]staticAsset
+
+func buildStaticsManifest(fsys fs.FS, baseDistPath string) (staticsManifest, error) {
+	manifest := staticsManifest{}
+	err := fs.WalkDir(fsys, baseDistPath, func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || (path.Ext(file) != ".js" && path.Ext(file) != ".css") {
+			return nil
+		}
+		content, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return err
+		}
+		sum := sha512.Sum384(content)
+		manifest["/"+file] = staticAsset{
+			version:   hex.EncodeToString(sum[:8]),
+			integrity: "sha384-" + base64.StdEncoding.EncodeToString(sum[:]),
+		}
+		return nil
+	})
+	return manifest, err
+}
+
+// The URL of an asset of the dist directory with its version, cached by browsers until the content changes
+// Returns assetPath unchanged if it isn't in the manifest, e.g. in dev mode
+func (manager *StaticFilesManager) AssetURL(assetPath string) string {
+	asset, ok := manager.manifest[assetPath]
+	if !ok {
+		return assetPath
+	}
+	return assetPath + "?" + asset.version + "__hash__"
+}
+
+// The Subresource Integrity of an asset of the dist directory, "" if it isn't in the manifest
+func (manager *StaticFilesManager) AssetIntegrity(assetPath string) string {
+	return manager.manifest[assetPath].integrity
+}
+
+// For the pages rendered by the server with html/template:
+//
+//	<script src="{{asset "/dist/main.bundle.js"}}" integrity="{{integrity "/dist/main.bundle.js"}}"></script>
+func (manager *StaticFilesManager) TemplateFuncs() template.FuncMap {
+	return template.FuncMap{
+		"asset":     manager.AssetURL,
+		"integrity": manager.AssetIntegrity,
+	}
+}
+
+// The cache control for a request of file: the hashed one only if the version in the URL is the current one,
+// so that an outdated URL isn't cached forever with the new content
+func (manager *StaticFilesManager) chooseCacheControl(file string, cacheControl StaticFileCacheControlHeader, rawQuery string) string {
+	asset, ok := manager.manifest["/"+file]
+	if !ok {
+		return cacheControl.Chose(rawQuery)
+	}
+	if rawQuery == asset.version+"__hash__" {
+		return cacheControl.IfHashedURL
+	}
+	return cacheControl.BaseValue
+}
+
+var (
+	assetTagRegex  = regexp.MustCompile(`(?i)<(?:script|link)\b[^>]*>`)
+	assetAttrRegex = regexp.MustCompile(`(?i)\s(src|href)\s*=\s*("[^"]*"|'[^']*'|[^\s"'>]+)`)
+)
+
+// Points the <script> and <link> tags of a page to the versioned URLs of the assets, with their integrity
+// The query strings already in the page, e.g. added by webpack, are replaced
+func (manager *StaticFilesManager) rewriteAssetReferences(page []byte) []byte {
+	return assetTagRegex.ReplaceAllFunc(page, func(tag []byte) []byte {
+		attr := assetAttrRegex.FindSubmatchIndex(tag)
+		if attr == nil {
+			return tag
+		}
+		value := strings.Trim(string(tag[attr[4]:attr[5]]), `"'`)
+		assetPath, _, _ := strings.Cut(value, "?")
+		asset, ok := manager.manifest[assetPath]
+		if !ok {
+			return tag
+		}
+
+		var b bytes.Buffer
+		b.Write(tag[:attr[0]])
+		b.WriteString(" " + string(tag[attr[2]:attr[3]]) + `="` + manager.AssetURL(assetPath) + `"`)
+		rest := string(tag[attr[1]:])
+		if !strings.Contains(strings.ToLower(string(tag)), "integrity=") {
+			end := strings.TrimRight(strings.TrimSuffix(strings.TrimSuffix(rest, ">"), "/"), " \t\n")
+			b.WriteString(end + ` integrity="` + asset.integrity + `"` + rest[len(end):])
+		} else {
+			b.WriteString(rest)
+		}
+		return b.Bytes()
+	})
+}
+
+// An HTML page rewritten at startup, served from memory
+type staticPage struct {
+	content []byte
+	gzipped []byte
+	etag    string
+}
+
+// Returns nil if the page has no asset to rewrite, so that it is served as is with its compressed versions
+func (manager *StaticFilesManager) rewrittenPage(file string) (*staticPage, error) {
+	content, err := fs.ReadFile(manager.FS, file)
+	if err != nil {
+		return nil, err
+	}
+	rewritten := manager.rewriteAssetReferences(content)
+	if bytes.Equal(rewritten, content) {
+		return nil, nil
+	}
+
+	var gz bytes.Buffer
+	w, _ := gzip.NewWriterLevel(&gz, gzip.BestCompression)
+	_, _ = w.Write(rewritten)
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	sum := md5.Sum(rewritten) //nolint:gosec
+	return &staticPage{content: rewritten, gzipped: gz.Bytes(), etag: hex.EncodeToString(sum[:])}, nil
+}
@@ -7,6 +7,7 @@ import (
 	"io"
 	"io/fs"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -28,12 +29,18 @@ func (s *StaticFileCacheControlHeader) Chose(rawQuery string) string {
 }
 
 type StaticFilesManager struct {
-	FS                    fs.FS
-	baseDistPath          string
-	contentSecurityPolicy string
+	FS           fs.FS
+	baseDistPath string
+	// nil for none
+	csp *ContentSecurityPolicy
 	// Takes a filename and returns the cache control header for it
 	// calling it can be unoptimized, it's only called once per file
 	getCacheControl func(string) StaticFileCacheControlHeader
+	logger          *slog.Logger
+	// empty in dev mode
+	manifest staticsManifest
+	// nil unless the files are served from the disk, see NewStaticFilesManagerFromConfig
+	dev *staticsDev
 }
 
 // by default, if no hash only cache for 10 minutes, then ask for revalidation
@@ -62,18 +69,48 @@ func DefaultGetCacheControl(filename string) StaticFileCacheControlHeader {
 
 // for baseDistPath, if it's an embed FS, don't put a startig slash
 // recommended defaultCacheControl is "public, max-age=3600, must-revalidate"
+// The .js and .css files of baseDistPath are hashed, for the versioned URLs in the HTML pages (see AssetURL)
+// contentSecurityPolicy is a header value, see ParseContentSecurityPolicy
 func NewStaticFilesManager(fs fs.FS, baseDistPath string, contentSecurityPolicy string) *StaticFilesManager {
+	return newStaticFilesManager(fs, baseDistPath, ParseContentSecurityPolicy(contentSecurityPolicy)).withManifest()
+}
+
+func newStaticFilesManager(fs fs.FS, baseDistPath string, csp *ContentSecurityPolicy) *StaticFilesManager {
 	return &StaticFilesManager{
-		FS:                    fs,
-		baseDistPath:          baseDistPath,
-		contentSecurityPolicy: contentSecurityPolicy,
-		getCacheControl:       DefaultGetCacheControl,
+		FS:              fs,
+		baseDistPath:    baseDistPath,
+		csp:             csp,
+		getCacheControl: DefaultGetCacheControl,
+		logger:          GetServiceSpecificLogger("STATIC", "\033[38;5;38m"),
+		manifest:        staticsManifest{},
 	}
 }
 
+func (manager *StaticFilesManager) withManifest() *StaticFilesManager {
+	if manager.baseDistPath != "" {
+		manifest, err := buildStaticsManifest(manager.FS, manager.baseDistPath)
+		if err != nil {
+			log.Println("Error hashing static files")
+			panic(err)
+		}
+		manager.manifest = manifest
+	}
+	return manager
+}
+
+// The policy sent with the files, nil for none; the HTML handlers of the service use it with Apply
+func (manager *StaticFilesManager) ContentSecurityPolicy() *ContentSecurityPolicy {
+	return manager.csp
+}
+
 const chunkFileEnd = ".chunk.js"
 
 func (manager *StaticFilesManager) RegisterChunkHandlers(router *http.ServeMux) {
+	if manager.IsDev() {
+		// the routes registered for the bundles are more specific, and take precedence
+		router.HandleFunc("/dist/{file}", manager.handleDevChunk)
+		return
+	}
 	chunkFiles, err := fs.ReadDir(manager.FS, manager.baseDistPath)
 	if err != nil {
 		log.Println("Error reading static files directory")
@@ -104,8 +141,14 @@ func (manager *StaticFilesManager) WholeRouteRegisterHandlers(htmlPageURL string
 }
 
 // Returns handlers for the associated files to a base name, if they exist.
+// In dev mode, the three handlers are always returned, as the files can be built after the start
 func (manager *StaticFilesManager) WholeRouteHandlers(fileBaseName string) (handlerHTML http.HandlerFunc, handlerJS http.HandlerFunc, handlerCSS http.HandlerFunc) {
 	fileBaseName = filepath.Join(manager.baseDistPath, fileBaseName)
+	if manager.IsDev() {
+		return manager.GenerateStaticFileHandler(fileBaseName+".html", "text/html"),
+			manager.GenerateStaticFileHandler(fileBaseName+".bundle.js", "application/javascript; charset=utf-8"),
+			manager.GenerateStaticFileHandler(fileBaseName+".bundle.css", "text/css; charset=utf-8")
+	}
 	if manager.fileExists(fileBaseName + ".html") {
 		handlerHTML = manager.GenerateStaticFileHandler(fileBaseName+".html", "text/html")
 	}
@@ -119,6 +162,9 @@ func (manager *StaticFilesManager) WholeRouteHandlers(fileBaseName string) (hand
 }
 
 func (manager *StaticFilesManager) GenerateStaticFileHandler(file string, contentType string) http.HandlerFunc {
+	if manager.IsDev() {
+		return manager.generateDevFileHandler(file, contentType)
+	}
 	hasGzip := manager.fileExists(file + ".gz")
 	hasBrotli := manager.fileExists(file + ".br")
 	etag, err := manager.readFileAndHashMD5(file)
@@ -129,15 +175,35 @@ func (manager *StaticFilesManager) GenerateStaticFileHandler(file string, conten
 
 	cacheControl := manager.getCacheControl(file)
 
+	var page *staticPage
+	if strings.HasPrefix(contentType, "text/html") {
+		page, err = manager.rewrittenPage(file)
+		if err != nil {
+			log.Println("Error rewriting static file " + file)
+			panic(err)
+		}
+		if manager.csp.UsesNonce() {
+			content := []byte(nil)
+			if page != nil {
+				content = page.content
+			} else if content, err = fs.ReadFile(manager.FS, file); err != nil {
+				log.Println("Error reading static file " + file)
+				panic(err)
+			}
+			return manager.pageWithNonceHandler(file, contentType, content)
+		}
+		if page != nil {
+			etag = page.etag
+		}
+	}
+
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", contentType)
 
-		w.Header().Set("Cache-Control", cacheControl.Chose(r.URL.RawQuery))
+		w.Header().Set("Cache-Control", manager.chooseCacheControl(file, cacheControl, r.URL.RawQuery))
 
 		w.Header().Set("ETag", etag)
-		if manager.contentSecurityPolicy != "" {
-			w.Header().Set("Content-Security-Policy", manager.contentSecurityPolicy)
-		}
+		manager.csp.setHeaders(w, "")
 
 		if match := r.Header.Get("If-None-Match"); match == etag {
 			// If ETag matches, send Not Modified status
@@ -145,7 +211,17 @@ func (manager *StaticFilesManager) GenerateStaticFileHandler(file string, conten
 			return
 		}
 
-		if hasBrotli && canBrotli(r) {
+		if page != nil {
+			w.Header().Set("Vary", "Accept-Encoding")
+			body := page.content
+			if canGZIP(r) {
+				w.Header().Set("Content-Encoding", "gzip")
+				body = page.gzipped
+			}
+			if _, err := w.Write(body); err != nil {
+				manager.logger.With("error", err, "file", file).Error("Failed to write page")
+			}
+		} else if hasBrotli && canBrotli(r) {
 			w.Header().Set("Content-Encoding", "br")
 			w.Header().Set("Vary", "Accept-Encoding")
 			http.ServeFileFS(w, r, manager.FS, file+".br")
@@ -159,6 +235,19 @@ func (manager *StaticFilesManager) GenerateStaticFileHandler(file string, conten
 	}
 }
 
+// Serves a page with a new nonce on each request, compressed on the fly
+// The page isn't stored by browsers, nor revalidated: a cached copy would carry an outdated nonce
+func (manager *StaticFilesManager) pageWithNonceHandler(file string, contentType string, content []byte) http.HandlerFunc {
+	return CompressionMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nonce := manager.csp.Apply(w)
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Cache-Control", "no-store")
+		if _, err := w.Write(InjectCSPNonce(content, nonce)); err != nil {
+			manager.logger.With("error", err, "file", file).Error("Failed to write page")
+		}
+	})).ServeHTTP
+}
+
 func (manager *StaticFilesManager) fileExists(path string) bool {
 	if _, err := fs.Stat(manager.FS, path); errors.Is(err, os.ErrNotExist) {
 		return false
@@ -205,29 +294,10 @@ func canBrotli(req *http.Request) bool {
 	return true
 }
 
-const iconifyScriptSource = "https://cdn.jsdelivr.net/npm/iconify-icon@2.3.0/dist/iconify-icon.min.js"
-
-var iconifyIconsSources = []string{
-	"https://api.iconify.design/",
-	"https://api.unisvg.com/",
-	"https://api.simplesvg.com/",
-}
-
-// Genereates a default Content Security Policy for static files, that lets iconify through.
+// The default policy as a header value, without nonces nor reports, for NewStaticFilesManager
+// Prefer DefaultContentSecurityPolicy with NewStaticFilesManagerFromConfig
 func StaticsDefaultContentSecurityPolicy(hxi2Domain string) string {
-	iconifyIconsSources := strings.Join(iconifyIconsSources, " ")
-	if hxi2Domain != "" && strings.Trim(hxi2Domain, " ") != "" {
-		hxi2Domain = " https://static." + hxi2Domain + " "
-	}
-	return `default-src 'self'; 
-connect-src 'self' ` + iconifyIconsSources + `;
-img-src 'self'` + hxi2Domain + `; 
-script-src 'self' ` + iconifyScriptSource + ` https://unpkg.com/@github/filter-input-element@latest/dist/index.js ` + hxi2Domain + `;
-style-src 'self' 'unsafe-inline' ` + hxi2Domain + `;
-object-src ` + hxi2Domain + `; 
-frame-src 'none'; 
-base-uri 'self'; 
-form-action 'self'; 
-frame-ancestors 'none'; 
-manifest-src 'self';`
+	p := DefaultContentSecurityPolicy(hxi2Domain)
+	p.ReportURI = ""
+	return p.String("")
 }
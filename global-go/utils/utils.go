@@ -4,6 +4,7 @@ import (
 	"log/slog"
 	"os"
 	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/lmittmann/tint"
@@ -76,8 +77,19 @@ func Filter[T any](ss []T, test func(T) bool) (ret []T) {
 	return
 }
 
+var promotionsRangeMin atomic.Int64
+var promotionsRangeMax atomic.Int64
+
+func init() {
+	SetPromotionsRange(DefaultPromotions().Range())
+}
+
+// Defaults to the promotions of DefaultPromotions; services keep it up to date with SetPromotionsRange
 func GetPromotionsRange() (int, int) {
-	const minp = 2021
-	const maxp = 2025
-	return minp, maxp
+	return int(promotionsRangeMin.Load()), int(promotionsRangeMax.Load())
+}
+
+func SetPromotionsRange(minp, maxp int) {
+	promotionsRangeMin.Store(int64(minp))
+	promotionsRangeMax.Store(int64(maxp))
 }
@@ -0,0 +1,215 @@
+package globalgoutils
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	WebhookEventUserCreated        = "user.created"
+	WebhookEventUserUpdated        = "user.updated"
+	WebhookEventUserDeleted        = "user.deleted"
+	WebhookEventPermissionsChanged = "permissions.changed"
+	// sent after an academic year rollover, with the new PromotionsInfo as data
+	WebhookEventPromotionsChanged = "promotions.changed"
+)
+
+const WebhookSignatureHeader = "X-HXI2-Webhook-Signature"
+const WebhookEventHeader = "X-HXI2-Webhook-Event"
+const WebhookDeliveryHeader = "X-HXI2-Webhook-Delivery"
+
+// Signatures older than this are rejected, to prevent replays
+const WebhookSignatureTolerance = 5 * time.Minute
+
+// Body of every webhook sent by the auth service
+type WebhookEvent struct {
+	// Unique per event; the same event is delivered with the same ID when retried
+	ID        string          `json:"id"`
+	Type      string          `json:"type"`
+	CreatedAt time.Time       `json:"createdAt"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// Data of user.created, user.updated and permissions.changed events
+type WebhookUserData struct {
+	User ProjectUser `json:"user"`
+	// Only set for permissions.changed
+	OldPermissions int `json:"oldPermissions,omitempty"`
+}
+
+// Data of user.deleted events
+type WebhookUserDeletedData struct {
+	UserID int64 `json:"userID"`
+}
+
+// Signs the body with the given secret; the result is meant for the WebhookSignatureHeader header
+// Format: t=<unix timestamp>,v1=<hex HMAC-SHA256 of "<timestamp>.<body>">
+func SignWebhookPayload(secret []byte, t time.Time, body []byte) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	return "t=" + ts + ",v1=" + webhookHMAC(secret, ts, body)
+}
+
+func webhookHMAC(secret []byte, ts string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(ts))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func VerifyWebhookSignature(secret []byte, header string, body []byte, now time.Time) error {
+	var ts, sig string
+	for _, part := range strings.Split(header, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			continue
+		}
+		switch k {
+		case "t":
+			ts = v
+		case "v1":
+			sig = v
+		}
+	}
+	if ts == "" || sig == "" {
+		return errors.New("malformed webhook signature header")
+	}
+
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid webhook signature timestamp: %w", err)
+	}
+	age := now.Sub(time.Unix(unix, 0))
+	if age > WebhookSignatureTolerance || age < -WebhookSignatureTolerance {
+		return errors.New("webhook signature timestamp is outside of the tolerance window")
+	}
+
+	if !hmac.Equal([]byte(sig), []byte(webhookHMAC(secret, ts, body))) {
+		return errors.New("webhook signature mismatch")
+	}
+	return nil
+}
+
+type WebhookHandler func(event *WebhookEvent) error
+
+// http.Handler receiving the webhooks of the auth service
+// Events without a registered handler are acknowledged and ignored
+type WebhookReceiver struct {
+	secret   []byte
+	handlers map[string][]WebhookHandler
+	Logger   *slog.Logger
+}
+
+func NewWebhookReceiver(secret string) *WebhookReceiver {
+	return &WebhookReceiver{
+		secret:   []byte(secret),
+		handlers: map[string][]WebhookHandler{},
+		Logger:   GetServiceSpecificLogger("WEBHOK", "\033[38;2;0;150;100m"),
+	}
+}
+
+// Registers a handler for the given event types; should be called before the receiver starts serving
+func (wr *WebhookReceiver) On(handler WebhookHandler, eventTypes ...string) *WebhookReceiver {
+	for _, t := range eventTypes {
+		wr.handlers[t] = append(wr.handlers[t], handler)
+	}
+	return wr
+}
+
+func (wr *WebhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, "Failed to read body", http.StatusBadRequest)
+		return
+	}
+
+	err = VerifyWebhookSignature(wr.secret, r.Header.Get(WebhookSignatureHeader), body, time.Now())
+	if err != nil {
+		wr.Logger.With("error", err, SlogHTTPInfo(r)).Warn("Rejected webhook")
+		http.Error(w, "Invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	var event WebhookEvent
+	err = json.Unmarshal(body, &event)
+	if err != nil {
+		http.Error(w, "Invalid event", http.StatusBadRequest)
+		return
+	}
+
+	l := wr.Logger.With("event", event.Type, "eventID", event.ID)
+	for _, handler := range wr.handlers[event.Type] {
+		if err := handler(&event); err != nil {
+			// a non 2xx status makes the auth service retry the delivery later
+			l.With("error", err).Error("Failed to handle webhook")
+			http.Error(w, "Failed to handle event", http.StatusInternalServerError)
+			return
+		}
+	}
+	l.Debug("Handled webhook")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Returns a handler that makes the cacher refetch its value in the background
+func WebhookInvalidate[T any](c *Cacher[T]) WebhookHandler {
+	return func(_ *WebhookEvent) error {
+		c.ForceInvalidate()
+		return nil
+	}
+}
+
+// Returns a handler that applies user events to a cached list of users, instead of refetching it entirely
+// keep decides which users belong in the list (e.g. only students); it can be nil
+func WebhookPatchProjectUsers(c *Cacher[[]ProjectUser], keep func(ProjectUser) bool) WebhookHandler {
+	return func(event *WebhookEvent) error {
+		var removeID int64
+		var upsert *ProjectUser
+		switch event.Type {
+		case WebhookEventUserDeleted:
+			var data WebhookUserDeletedData
+			if err := json.Unmarshal(event.Data, &data); err != nil {
+				return err
+			}
+			removeID = data.UserID
+		case WebhookEventUserCreated, WebhookEventUserUpdated, WebhookEventPermissionsChanged:
+			var data WebhookUserData
+			if err := json.Unmarshal(event.Data, &data); err != nil {
+				return err
+			}
+			removeID = data.User.ID
+			if keep == nil || keep(data.User) {
+				upsert = &data.User
+			}
+		default:
+			return nil
+		}
+
+		c.Patch(func(users []ProjectUser) []ProjectUser {
+			patched := make([]ProjectUser, 0, len(users)+1)
+			for _, u := range users {
+				if u.ID != removeID {
+					patched = append(patched, u)
+				}
+			}
+			if upsert != nil {
+				patched = append(patched, *upsert)
+			}
+			return patched
+		})
+		return nil
+	}
+}
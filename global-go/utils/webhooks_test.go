@@ -0,0 +1,88 @@
+package globalgoutils
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func postWebhook(t *testing.T, receiver http.Handler, secret string, eventType string, data any) int {
+	t.Helper()
+	dataBytes, _ := json.Marshal(data)
+	body, _ := json.Marshal(WebhookEvent{ID: NewRequestID(), Type: eventType, CreatedAt: time.Now(), Data: dataBytes})
+	r := httptest.NewRequest(http.MethodPost, "/api/webhook", bytes.NewReader(body))
+	r.Header.Set(WebhookSignatureHeader, SignWebhookPayload([]byte(secret), time.Now(), body))
+	w := httptest.NewRecorder()
+	receiver.ServeHTTP(w, r)
+	return w.Code
+}
+
+func TestWebhookPatchProjectUsers(t *testing.T) {
+	var calls atomic.Int64
+	users := NewCacher("test_webhook_users", func() ([]ProjectUser, error) {
+		calls.Add(1)
+		return []ProjectUser{{ID: 1, Username: "alice", Permissions: RoleStudent}, {ID: 2, Username: "bob", Permissions: RoleStudent}}, nil
+	}, time.Hour, 0)
+	names := NewCacher("test_webhook_names", func() ([]string, error) {
+		u, err := users.Get()
+		if err != nil {
+			return nil, err
+		}
+		names := []string{}
+		for _, user := range *u {
+			names = append(names, user.Username)
+		}
+		slices.Sort(names)
+		return names, nil
+	}, time.Hour, 0)
+	names.DependsOn(users)
+	if _, err := names.Get(); err != nil {
+		t.Fatal(err)
+	}
+
+	isStudent := func(u ProjectUser) bool { return u.Permissions&RoleStudent != 0 }
+	receiver := NewWebhookReceiver("secret").On(
+		WebhookPatchProjectUsers(users, isStudent),
+		WebhookEventUserCreated, WebhookEventUserUpdated, WebhookEventUserDeleted, WebhookEventPermissionsChanged,
+	)
+
+	for _, step := range []struct {
+		event string
+		data  any
+		names []string
+	}{
+		{WebhookEventUserCreated, WebhookUserData{User: ProjectUser{ID: 3, Username: "carol", Permissions: RoleStudent}}, []string{"alice", "bob", "carol"}},
+		{WebhookEventUserUpdated, WebhookUserData{User: ProjectUser{ID: 1, Username: "alicia", Permissions: RoleStudent}}, []string{"alicia", "bob", "carol"}},
+		// a user that no longer passes keep is removed
+		{WebhookEventPermissionsChanged, WebhookUserData{User: ProjectUser{ID: 2, Username: "bob"}, OldPermissions: RoleStudent}, []string{"alicia", "carol"}},
+		{WebhookEventUserDeleted, WebhookUserDeletedData{UserID: 3}, []string{"alicia"}},
+	} {
+		if code := postWebhook(t, receiver, "secret", step.event, step.data); code != http.StatusNoContent {
+			t.Fatalf("%s: got %d", step.event, code)
+		}
+		// the dependents are rebuilt in the background after a patch
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			n, _ := names.Get()
+			if slices.Equal(*n, step.names) {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("after %s: %v, expected %v", step.event, *n, step.names)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	if calls.Load() != 1 {
+		t.Errorf("the users were fetched %d times", calls.Load())
+	}
+
+	if code := postWebhook(t, receiver, "other secret", WebhookEventUserDeleted, WebhookUserDeletedData{UserID: 1}); code != http.StatusUnauthorized {
+		t.Errorf("a payload signed with another secret got %d", code)
+	}
+}
@@ -11,22 +11,7 @@ import (
 	ggu "github.com/itsvyle/hxi2/global-go/utils"
 )
 
-func CheckClaimsIncludingTemp(c *ggu.HXI2JWTClaims) bool {
-	if c.Temporary && c.Username == "parrainsup" {
-		return true
-	}
-	if c.IsStudent() {
-		return true
-	}
-	return false
-}
-
 func HandleListUsers(w http.ResponseWriter, r *http.Request) {
-	c, err := authManager.AuthenticateHTTPRequestIncludingTemporary(w, r, true)
-	if err != nil || !CheckClaimsIncludingTemp(c) {
-		return
-	}
-
 	users, err := mainUsersCacher.Get()
 	if err != nil {
 		slog.With("error", err).Error("Failed to get users")
@@ -44,11 +29,8 @@ func HandleListUsers(w http.ResponseWriter, r *http.Request) {
 }
 
 func HandleGetUserMyself(w http.ResponseWriter, r *http.Request) {
-	c, err := authManager.AuthenticateHTTPRequest(w, r, true)
-	if err != nil || !c.CheckPermHTTP(w, ggu.RoleStudent) {
-		return
-	}
-	if c.Promotion != promoActive {
+	c := ggu.ClaimsFromContext(r.Context())
+	if c.Promotion != activePromotion() {
 		http.Error(w, "Promotion not active", http.StatusForbidden)
 		return
 	}
@@ -78,17 +60,14 @@ func HandleGetUserMyself(w http.ResponseWriter, r *http.Request) {
 }
 
 func HandleUpdateUserMyself(w http.ResponseWriter, r *http.Request) {
-	c, err := authManager.AuthenticateHTTPRequest(w, r, true)
-	if err != nil || !c.CheckPermHTTP(w, ggu.RoleStudent) {
-		return
-	}
-	if c.Promotion != promoActive {
+	c := ggu.ClaimsFromContext(r.Context())
+	if c.Promotion != activePromotion() {
 		http.Error(w, "Promotion not active", http.StatusForbidden)
 		return
 	}
 
 	var newUserRaw MainUser
-	err = json.NewDecoder(r.Body).Decode(&newUserRaw)
+	err := json.NewDecoder(r.Body).Decode(&newUserRaw)
 	if err != nil {
 		slog.With("error", err).Error("Failed to decode user data")
 		http.Error(w, "Invalid user data", http.StatusBadRequest)
@@ -152,3 +131,11 @@ func HandleUpdateUserMyself(w http.ResponseWriter, r *http.Request) {
 	}
 	mainUsersCacher.AskCacheRefresh()
 }
+
+func HandleGetActivePromotion(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(activePromotion())
+	if err != nil {
+		slog.With("error", err).Error("Failed to encode active promotion")
+	}
+}
@@ -225,3 +225,9 @@ func (db *DatabaseManager) UpdateMainUser(user *MainUser) error {
 
 	return nil
 }
+
+// Used when the user's account is deleted
+func (db *DatabaseManager) DeleteMainUser(userID int64) error {
+	_, err := db.DB.Exec("DELETE FROM MAIN WHERE user_id = ?", userID)
+	return err
+}
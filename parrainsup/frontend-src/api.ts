@@ -1,4 +1,5 @@
 import { checkAuthentication } from "../../global-frontend-dependencies/authUtils";
+import { csrfFetch } from "../../global-frontend-dependencies/csrf";
 
 export interface MainUser {
     user_id: number;
@@ -38,7 +39,7 @@ export function getMyself(): Promise<MainUser> {
 }
 
 export function updateMyself(data: MainUser): Promise<MainUser> {
-    return fetch(`/api/me`, {
+    return csrfFetch(`/api/me`, {
         method: "PUT",
         headers: {
             "Content-Type": "application/json",
@@ -51,3 +52,11 @@ export function updateMyself(data: MainUser): Promise<MainUser> {
         .then(checkAuthentication)
         .then((res) => res.json());
 }
+
+export function getActivePromotion(): Promise<number> {
+    return fetch(`/api/active_promotion`)
+        .catch((error) => {
+            throw error;
+        })
+        .then((res) => res.json());
+}
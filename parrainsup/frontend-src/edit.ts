@@ -1,25 +1,26 @@
 import "./edit.scss";
 import { fillWindowUserData } from "../../global-frontend-dependencies/authUtils";
 import { CustomWindow } from "../../tree/frontend-src/api";
-import { getMyself, listUsers, MainUser, updateMyself } from "./api";
+import {
+    getActivePromotion,
+    getMyself,
+    listUsers,
+    MainUser,
+    updateMyself,
+} from "./api";
 import { MainUserCard } from "./user-card";
 import dialog from "../../global-frontend-dependencies/ui_dialog";
 import loadingManager from "../../global-frontend-dependencies/ui_loader";
-export interface CustomAddWindow extends CustomWindow {
-    activePromotion: number;
-}
-declare const window: CustomAddWindow;
+declare const window: CustomWindow;
 
 let originalData: MainUser | null = null;
 let newData: MainUser | null = null;
 let previewCard: MainUserCard | null = null;
 
-document.addEventListener("DOMContentLoaded", () => {
+document.addEventListener("DOMContentLoaded", async () => {
     fillWindowUserData();
-    if (
-        !window.userData ||
-        window.userData.promotion !== window.activePromotion
-    ) {
+    const activePromotion = await getActivePromotion().catch(() => null);
+    if (!window.userData || window.userData.promotion !== activePromotion) {
         dialog.error(
             "Vous n'êtes pas autorisé à modifier vos informations car votre promotion n'est pas sur parrainsup.",
             true,
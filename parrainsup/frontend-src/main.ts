@@ -1,19 +1,14 @@
 import { fillWindowUserData } from "../../global-frontend-dependencies/authUtils";
 import { CustomWindow } from "../../tree/frontend-src/api";
-import { listUsers } from "./api";
+import { getActivePromotion, listUsers } from "./api";
 import "./main.scss";
 import { MainUserCard } from "./user-card";
-export interface CustomAddWindow extends CustomWindow {
-    activePromotion: number;
-}
-declare const window: CustomAddWindow;
+declare const window: CustomWindow;
 
-document.addEventListener("DOMContentLoaded", () => {
+document.addEventListener("DOMContentLoaded", async () => {
     fillWindowUserData();
-    if (
-        !window.userData ||
-        window.userData.promotion !== window.activePromotion
-    ) {
+    const activePromotion = await getActivePromotion().catch(() => null);
+    if (!window.userData || window.userData.promotion !== activePromotion) {
         document.getElementById("edit-button").style.display = "none";
     } else {
         document
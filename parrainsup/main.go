@@ -1,74 +1,73 @@
 package main
 
 import (
+	"context"
 	"embed"
+	"fmt"
 	"log/slog"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	_ "embed"
 
 	ggu "github.com/itsvyle/hxi2/global-go/utils"
+	"github.com/itsvyle/hxi2/global-go/utils/config"
+	"github.com/itsvyle/hxi2/global-go/utils/metrics"
 )
 
 var authManager *ggu.AuthManager
-var ConfigRunningPort = "42005"
-var HXI2TLD = ""
 
 var mainUsersCacher *ggu.Cacher[map[int64]*MainUser]
 
+// Only used when the promotions can't be fetched from the auth service
+//
 //go:embed promo-active.txt
 var promoActiveStr string
 
-var promoActive int
+var promoActiveFallback int
 
-func init() {
-	var err error
-	promoActive, err = strconv.Atoi(promoActiveStr)
-	if err != nil {
-		slog.Error("Failed to parse promo-active.txt", "error", err)
-		promoActive = 0
-		panic("e")
-	}
+var promotionsCacher *ggu.Cacher[ggu.PromotionsInfo]
 
-	ggu.InitGlobalSlog()
+type Config struct {
+	RunningPort string `env:"CONFIG_RUNNING_PORT" default:"42005"`
+	DBPath      string `env:"CONFIG_DB_PATH" required:"true"`
+	TLD         string `env:"HXI2_TLD"`
+	// Secret of the webhook registered for this project in the auth service; webhooks are disabled if empty
+	WebhookSecret string `env:"HXI2_WEBHOOK_SECRET" secret:"true"`
+	Auth          ggu.AuthManagerConfig
+	Statics       ggu.StaticsConfig
+}
 
-	fails := []string{}
-	fail := func(key string) {
-		fails = append(fails, key)
-	}
-	loadOrFail := func(key string) string {
-		v := os.Getenv(key)
-		if v == "" {
-			fail(key + " is not defined")
+// The promotion that can edit its profile: the one currently in MP2I
+func activePromotion() int {
+	promotions, err := promotionsCacher.Get()
+	if err == nil && promotions != nil {
+		if p := promotions.WithState(ggu.PromotionStateMP2I); p != 0 {
+			return p
 		}
-		return v
-	}
-
-	var ConfigDBPath = loadOrFail("CONFIG_DB_PATH")
-	if os.Getenv("CONFIG_RUNNING_PORT") != "" {
-		ConfigRunningPort = os.Getenv("CONFIG_RUNNING_PORT")
 	}
-	HXI2TLD = os.Getenv("HXI2_TLD")
+	return promoActiveFallback
+}
 
-	if len(fails) > 0 {
-		for _, f := range fails {
-			slog.Error(f)
-		}
-		panic("Failed to load configuration")
+func setup(cfg *Config) error {
+	var err error
+	promoActiveFallback, err = strconv.Atoi(strings.TrimSpace(promoActiveStr))
+	if err != nil {
+		return fmt.Errorf("failed to parse promo-active.txt: %w", err)
 	}
 
 	// #region Database
-	DB = NewDatabaseManager(ConfigDBPath)
+	DB = NewDatabaseManager(cfg.DBPath)
 	// #endregion
 
 	// #region Auth manager
 
-	authManager, err = ggu.NewAuthManagerFromEnv()
+	authManager, err = ggu.NewAuthManagerFromConfig(cfg.Auth)
 	if err != nil {
-		panic(err)
+		return err
 	}
 	// #endregion
 
@@ -80,29 +79,71 @@ func init() {
 		}
 		return users, nil
 	}, 60*time.Second, 5)
+
+	promotionsCacher = ggu.NewCacher("promotionsCacher", func() (ggu.PromotionsInfo, error) {
+		return authManager.ProjectGetPromotions()
+	}, 10*time.Minute, 0)
 	// #endregion
+	return nil
 }
 
 //go:embed dist/*
 var staticsFS embed.FS
 
 func main() {
+	ggu.InitGlobalSlog()
+	var cfg Config
+	config.MustLoad(&cfg)
+	err := setup(&cfg)
+	if err != nil {
+		slog.With("error", err).Error("Failed to start")
+		os.Exit(1)
+	}
+
 	slog.Info("Starting parrainsup-backend")
+	lc := ggu.NewLifecycle()
+	lc.OnShutdown("database", DB.DB.Close)
+	lc.OnShutdown("cachers", func() error {
+		mainUsersCacher.Stop()
+		promotionsCacher.Stop()
+		return nil
+	})
+	lc.OnShutdown("auth manager", authManager.Close)
+
+	lc.Go("deletion watcher", func(ctx context.Context) {
+		authManager.RunDeletionWatcher(ctx, 5*time.Minute, func(userID int64) error {
+			err := DB.DeleteMainUser(userID)
+			if err != nil {
+				return err
+			}
+			mainUsersCacher.AskCacheRefresh()
+			return nil
+		})
+	})
+
 	router := http.NewServeMux()
+	requireStudent := authManager.RequirePermission(ggu.RoleStudent)
+	// guests log in through /temp with the code they were given, and can only browse the users
+	allowGuests := authManager.AllowTemporary("parrainsup", ggu.RoleStudent)
+	csrf := ggu.NewCSRFProtection()
 
 	server := &http.Server{
-		Addr:              ":" + ConfigRunningPort,
-		Handler:           router,
+		Addr:              ":" + cfg.RunningPort,
+		Handler:           ggu.RequestLoggingMiddleware(metrics.Middleware(router)),
 		ReadHeaderTimeout: 5 * time.Second,
 	}
 
-	staticsManager := ggu.NewStaticFilesManager(
+	staticsManager := ggu.NewStaticFilesManagerFromConfig(
+		cfg.Statics,
 		staticsFS,
 		"dist",
-		ggu.StaticsDefaultContentSecurityPolicy(HXI2TLD),
+		ggu.DefaultContentSecurityPolicy(cfg.TLD),
 	)
+	lc.Go("statics watcher", staticsManager.RunDevWatcher)
 
 	staticsManager.RegisterChunkHandlers(router)
+	staticsManager.MountDevRoutes(router)
+	staticsManager.MountCSPReportRoute(router)
 
 	mainHTML, mainJS, mainCSS := staticsManager.WholeRouteHandlers("main")
 	router.Handle("/dist/main.bundle.js", mainJS)
@@ -110,17 +151,13 @@ func main() {
 		router.Handle("/dist/main.bundle.css", mainCSS)
 	}
 
-	router.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+	router.Handle("/", allowGuests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.URL.Path != "/" && r.URL.Path != "/index.html" {
 			http.NotFound(w, r)
 			return
 		}
-		c, err := authManager.AuthenticateHTTPRequestIncludingTemporary(w, r, false)
-		if err != nil || !CheckClaimsIncludingTemp(c) {
-			return
-		}
 		mainHTML.ServeHTTP(w, r)
-	})
+	})))
 
 	editHTML, editJS, editCSS := staticsManager.WholeRouteHandlers("edit")
 	router.Handle("/dist/edit.bundle.js", editJS)
@@ -128,17 +165,14 @@ func main() {
 		router.Handle("/dist/edit.bundle.css", editCSS)
 	}
 
-	router.HandleFunc("/edit", func(w http.ResponseWriter, r *http.Request) {
-		c, err := authManager.AuthenticateHTTPRequest(w, r, false)
-		if err != nil || !c.CheckPermHTTP(w, ggu.RoleStudent) {
-			return
-		}
-		if c.Promotion != promoActive {
+	router.Handle("/edit", requireStudent(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := ggu.ClaimsFromContext(r.Context())
+		if c.Promotion != activePromotion() {
 			http.Error(w, "You are not part of the active promotion - you can't edit a profile on Parrainsup", http.StatusForbidden)
 			return
 		}
 		editHTML.ServeHTTP(w, r)
-	})
+	})))
 
 	/* addHTML, addJS, addCSS := staticsManager.WholeRouteHandlers("add")
 	router.Handle("/dist/add.bundle.js", addJS)
@@ -168,15 +202,34 @@ func main() {
 		treeHTML.ServeHTTP(w, r)
 	})
 
-	router.Handle("/api/list_relations", ggu.GzipMiddleware(http.HandlerFunc(HandleListRelations)))
+	router.Handle("/api/list_relations", ggu.CompressionMiddleware(http.HandlerFunc(HandleListRelations)))
 	router.Handle("POST /api/relation", http.HandlerFunc(HandlePostRelation))
 	router.Handle("DELETE /api/relation", http.HandlerFunc(HandleDeleteRelation))
-	router.Handle("GET /api/global_tree", ggu.GzipMiddleware(http.HandlerFunc(HandleGetGlobalTree))) */
-	router.Handle("GET /api/list_users", ggu.GzipMiddleware(http.HandlerFunc(HandleListUsers)))
-	router.Handle("GET /api/me", http.HandlerFunc(HandleGetUserMyself))
-	router.Handle("PUT /api/me", http.HandlerFunc(HandleUpdateUserMyself))
-	router.Handle("GET /temp", authManager.HandleTempLogin("parrainsup", "https://parrainsup."+HXI2TLD))
-
-	slog.With("port", ConfigRunningPort).Info("Server is running")
-	slog.With("error", server.ListenAndServe()).Error("Server crashed")
+	router.Handle("GET /api/global_tree", ggu.CompressionMiddleware(http.HandlerFunc(HandleGetGlobalTree))) */
+	router.Handle("GET /api/list_users", allowGuests(ggu.CompressionMiddleware(http.HandlerFunc(HandleListUsers))))
+	router.Handle("GET /api/me", requireStudent(http.HandlerFunc(HandleGetUserMyself)))
+	router.Handle("GET /api/active_promotion", http.HandlerFunc(HandleGetActivePromotion))
+	if cfg.WebhookSecret != "" {
+		router.Handle("POST /api/webhook", ggu.NewWebhookReceiver(cfg.WebhookSecret).On(
+			ggu.WebhookInvalidate(promotionsCacher),
+			ggu.WebhookEventPromotionsChanged,
+		))
+	}
+	router.Handle("PUT /api/me", requireStudent(csrf.Protect(http.HandlerFunc(HandleUpdateUserMyself))))
+	router.Handle("GET "+ggu.CSRFTokenPath, requireStudent(http.HandlerFunc(csrf.HandleToken)))
+	router.Handle("GET /temp", authManager.HandleTempLogin("parrainsup", "parrainsup"))
+
+	authManager.MountMetrics(router)
+
+	health := ggu.NewHealthRegistry()
+	health.AddReadinessCheck("database", DB.DB.PingContext)
+	health.AddReadinessCheck("auth", authManager.HealthCheck)
+	health.AddReadinessCheck("mainUsersCacher", mainUsersCacher.HealthCheck)
+	health.AddReadinessCheck("promotionsCacher", promotionsCacher.HealthCheck)
+	health.Mount(router)
+
+	slog.With("port", cfg.RunningPort).Info("Server is running")
+	if err := lc.Serve(server); err != nil {
+		os.Exit(1)
+	}
 }
@@ -1,5 +1,4 @@
 import path from "path";
-import fs from "fs";
 import "webpack-dev-server";
 import { getDefaultConfig } from "../global-frontend-dependencies/_webpack-utils";
 
@@ -25,11 +24,6 @@ export default (env, argv) => {
             main: SRCDIR + "/main.ts",
             edit: SRCDIR + "/edit.ts",
         },
-        extraDefines: {
-            "window.activePromotion": fs
-                .readFileSync("promo-active.txt", "utf-8")
-                .trim(),
-        },
         outputDirName: "dist",
         srcDir: SRCDIR,
     });
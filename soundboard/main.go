@@ -12,16 +12,12 @@ import (
 	_ "embed"
 
 	ggu "github.com/itsvyle/hxi2/global-go/utils"
+	"github.com/itsvyle/hxi2/global-go/utils/config"
+	"github.com/itsvyle/hxi2/global-go/utils/metrics"
 )
 
-var ConfigRunningPort = "8037"
-
-func init() {
-	ggu.InitGlobalSlog()
-
-	if os.Getenv("CONFIG_RUNNING_PORT") != "" {
-		ConfigRunningPort = os.Getenv("CONFIG_RUNNING_PORT")
-	}
+type Config struct {
+	RunningPort string `env:"CONFIG_RUNNING_PORT" default:"8037"`
 }
 
 //go:embed memes/* main-out.html*
@@ -30,12 +26,17 @@ var staticsFS embed.FS
 const mp3ContentType = "audio/mpeg"
 
 func main() {
+	ggu.InitGlobalSlog()
+	var cfg Config
+	config.MustLoad(&cfg)
+
 	slog.Info("Starting soundboard backend")
+	lc := ggu.NewLifecycle()
 	router := http.NewServeMux()
 
 	server := &http.Server{
-		Addr:              ":" + ConfigRunningPort,
-		Handler:           router,
+		Addr:              ":" + cfg.RunningPort,
+		Handler:           ggu.RequestLoggingMiddleware(metrics.Middleware(router)),
 		ReadHeaderTimeout: 5 * time.Second,
 	}
 
@@ -75,8 +76,14 @@ func main() {
 
 	router.Handle("/", indexHandler)
 
-	slog.With("port", ConfigRunningPort).Info("Server is running")
-	slog.With("error", server.ListenAndServe()).Error("Server crashed")
+	metrics.ListenFromEnv()
+
+	ggu.NewHealthRegistry().Mount(router)
+
+	slog.With("port", cfg.RunningPort).Info("Server is running")
+	if err := lc.Serve(server); err != nil {
+		os.Exit(1)
+	}
 }
 
 // Excludes compressed files
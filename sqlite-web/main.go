@@ -1,7 +1,9 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"log/slog"
 	"net/http"
 	"net/http/httputil"
@@ -10,83 +12,66 @@ import (
 	"time"
 
 	ggu "github.com/itsvyle/hxi2/global-go/utils"
+	"github.com/itsvyle/hxi2/global-go/utils/config"
+	"github.com/itsvyle/hxi2/global-go/utils/metrics"
 )
 
 var authManager *ggu.AuthManager
-var ConfigRunningPort = "42004"
-var HXI2TLD = ""
 var BackupPublicKeyPath string
 var BackupOutputDirectory string
 
 var ConfigPath string
 var sqliteFiles = []SqliteFile{}
 
-var MainProcess = &SqliteWebProcess{
-	Port:          "42005",
-	CurrentFile:   nil,
-	SqliteWebHost: "127.0.0.1",
-}
+var MainProcess = &SqliteWebProcess{}
 
-func init() {
-	var err error
-	ggu.InitGlobalSlog()
+type Config struct {
+	RunningPort   string `env:"CONFIG_RUNNING_PORT" default:"42004"`
+	SqliteWebPort string `env:"SQLITE_WEB_PORT" default:"42005"`
+	SqliteWebHost string `env:"SQLITE_WEB_HOST" default:"127.0.0.1"`
+	// JSON list of the files that can be opened, also read by backup.py
+	FilesConfig           string `env:"SQLITE_WEB_FILES_CONFIG" required:"true"`
+	BackupPublicKeyPath   string `env:"SQLITE_BACKUP_PUBLIC_KEY"`
+	BackupOutputDirectory string `env:"SQLITE_BACKUP_OUTPUT_DIR"`
+	Auth                  ggu.AuthManagerConfig
+}
 
-	if port := os.Getenv("SQLITE_WEB_PORT"); port != "" {
-		MainProcess.Port = port
-	} else {
-		slog.Warn("No SQLITE_WEB_PORT environment variable set, using default port " + MainProcess.Port)
+func loadSqliteFiles(path string) ([]SqliteFile, error) {
+	configFile, err := os.Open(path)
+	if err != nil {
+		return nil, err
 	}
+	defer configFile.Close()
 
-	if host := os.Getenv("SQLITE_WEB_HOST"); host != "" {
-		MainProcess.SqliteWebHost = host
-	} else {
-		slog.Warn("No SQLITE_WEB_HOST environment variable set, using default host " + MainProcess.SqliteWebHost)
+	files := []SqliteFile{}
+	err = json.NewDecoder(configFile).Decode(&files)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %w", path, err)
 	}
+	return files, nil
+}
 
-	if configPath := os.Getenv("SQLITE_WEB_FILES_CONFIG"); configPath != "" {
-		slog.Info("Loading sqlite-web files config", "path", configPath)
-		ConfigPath = configPath
-		configFile, err := os.Open(configPath)
-		if err != nil {
-			slog.Error("Failed to open sqlite-web files config", "path", configPath, "error", err)
-			panic(err)
-		}
-		defer configFile.Close()
-
-		decoder := json.NewDecoder(configFile)
-		err = decoder.Decode(&sqliteFiles)
-		if err != nil {
-			slog.Error("Failed to decode sqlite-web files config", "path", configPath, "error", err)
-			panic(err)
-		}
-		slog.Info("Loaded sqlite-web files", "count", len(sqliteFiles))
-	} else {
-		slog.Error("No sqlite-web files config found, exiting")
-		panic("No sqlite-web files config found")
-	}
+func setup(cfg *Config) error {
+	var err error
+	MainProcess.Port = cfg.SqliteWebPort
+	MainProcess.SqliteWebHost = cfg.SqliteWebHost
 
-	if publicKeyPath := os.Getenv("SQLITE_BACKUP_PUBLIC_KEY"); publicKeyPath != "" {
-		slog.Info("Found backup public key path", "path", publicKeyPath)
-		BackupPublicKeyPath = string(publicKeyPath)
-	} else {
-		slog.Warn("No SQLITE_BACKUP_PUBLIC_KEY environment variable set, backups will not be available")
-	}
-	if outputDir := os.Getenv("SQLITE_BACKUP_OUTPUT_DIR"); outputDir != "" {
-		slog.Info("Found backup output directory", "path", outputDir)
-		BackupOutputDirectory = string(outputDir)
-	} else {
-		slog.Warn("No SQLITE_BACKUP_OUTPUT_DIR environment variable set, backups will not be available")
+	slog.Info("Loading sqlite-web files config", "path", cfg.FilesConfig)
+	ConfigPath = cfg.FilesConfig
+	sqliteFiles, err = loadSqliteFiles(cfg.FilesConfig)
+	if err != nil {
+		return err
 	}
+	slog.Info("Loaded sqlite-web files", "count", len(sqliteFiles))
 
-	if os.Getenv("CONFIG_RUNNING_PORT") != "" {
-		ConfigRunningPort = os.Getenv("CONFIG_RUNNING_PORT")
+	BackupPublicKeyPath = cfg.BackupPublicKeyPath
+	BackupOutputDirectory = cfg.BackupOutputDirectory
+	if BackupPublicKeyPath == "" || BackupOutputDirectory == "" {
+		slog.Warn("SQLITE_BACKUP_PUBLIC_KEY or SQLITE_BACKUP_OUTPUT_DIR isn't set, backups will not be available")
 	}
-	HXI2TLD = os.Getenv("HXI2_TLD")
 
-	authManager, err = ggu.NewAuthManagerFromEnv()
-	if err != nil {
-		panic(err)
-	}
+	authManager, err = ggu.NewAuthManagerFromConfig(cfg.Auth)
+	return err
 }
 
 func dbsHandler(w http.ResponseWriter, r *http.Request) {
@@ -195,40 +180,45 @@ func backupHandler(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
-func authCheckMiddleware(next http.Handler) http.Handler {
+// Sends to /dbs until a sqlite file is selected; the requests are already authenticated
+func currentFileMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-
-		c, err := authManager.AuthenticateHTTPRequest(w, r, false)
-		if err != nil || !c.CheckPermHTTP(w, ggu.RoleAdmin) {
-			return
-		}
-
-		if r.URL.Path == "/backup" {
-			next.ServeHTTP(w, r)
-			return
-		}
-
 		if MainProcess.CurrentFile == nil {
-			if r.URL.Path == "/dbs" {
-				next.ServeHTTP(w, r)
-			} else if r.URL.Path == "/" {
+			if r.URL.Path == "/" {
 				http.Redirect(w, r, "/dbs", http.StatusFound)
 			} else {
 				http.Error(w, "No sqlite file selected. Go to /dbs to select one.", http.StatusServiceUnavailable)
 			}
 			return
-		} else if r.URL.Path != "/dbs" {
-			MainProcess.Ping()
 		}
+		MainProcess.Ping()
 		next.ServeHTTP(w, r)
 	})
 }
 
 func main() {
+	ggu.InitGlobalSlog()
+	var cfg Config
+	config.MustLoad(&cfg)
+	err := setup(&cfg)
+	if err != nil {
+		slog.With("error", err).Error("Failed to start")
+		os.Exit(1)
+	}
+
+	lc := ggu.NewLifecycle()
+	lc.OnShutdown("sqlite_web", func() error {
+		MainProcess.UnloadFile()
+		return nil
+	})
+	lc.OnShutdown("auth manager", authManager.Close)
 
 	if BackupOutputDirectory != "" && BackupPublicKeyPath != "" {
 		slog.Info("Executing startup backup")
-		go DoBackup()
+		// waited for on shutdown, so that the archive isn't left half written
+		lc.Go("startup backup", func(_ context.Context) {
+			_ = DoBackup()
+		})
 	}
 
 	slog.Info("Starting sqlite-web backend")
@@ -242,17 +232,29 @@ func main() {
 	}
 	proxy := httputil.NewSingleHostReverseProxy(targetUrl)
 
-	router.Handle("/", authCheckMiddleware(proxy))
-	router.HandleFunc("/dbs", dbsHandler)
-	router.HandleFunc("/backup", backupHandler)
+	requireAdmin := authManager.RequirePermission(ggu.RoleAdmin)
+	// the forms of sqlite_web can't send a token, so its requests rely on the Origin checks
+	csrf := ggu.NewCSRFProtection()
+	router.Handle("/", requireAdmin(csrf.Protect(currentFileMiddleware(proxy))))
+	router.Handle("/dbs", requireAdmin(csrf.Protect(http.HandlerFunc(dbsHandler))))
+	router.Handle("/backup", requireAdmin(csrf.Protect(http.HandlerFunc(backupHandler))))
 
 	server := &http.Server{
-		Addr:              ":" + ConfigRunningPort,
-		Handler:           router,
+		Addr:              ":" + cfg.RunningPort,
+		Handler:           ggu.RequestLoggingMiddleware(metrics.Middleware(router)),
 		ReadHeaderTimeout: 5 * time.Second,
 	}
 
-	slog.With("port", ConfigRunningPort).Info("Server is running")
+	authManager.MountMetrics(router)
+
+	health := ggu.NewHealthRegistry()
+	health.AddReadinessCheck("auth", authManager.HealthCheck)
+	health.AddReadinessCheck("sqlite_web", MainProcess.HealthCheck)
+	health.Mount(router)
+
+	slog.With("port", cfg.RunningPort).Info("Server is running")
 	slog.With("sqlite_endpoint", sqliteEndpoint).Info("Proxying to sqlite-web")
-	slog.With("error", server.ListenAndServe()).Error("Server crashed")
+	if err := lc.Serve(server); err != nil {
+		os.Exit(1)
+	}
 }
@@ -1,9 +1,12 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"log/slog"
 	"os"
 	"os/exec"
+	"syscall"
 	"time"
 )
 
@@ -16,12 +19,17 @@ type SqliteWebProcess struct {
 	CurrentFile   *SqliteFile
 	SqliteWebHost string
 	Process       *os.Process
+	// closed once Process exited
+	exited        chan struct{}
 	lastActivity  time.Time
 	shutdownTimer *time.Timer
 }
 
 const idleTimeout = 10 * time.Minute
 
+// Time given to sqlite_web to exit after SIGTERM, before it is killed
+const processStopTimeout = 5 * time.Second
+
 func (s *SqliteWebProcess) OpenFile(file *SqliteFile) {
 	slog.Info("OpenFile called", "file", file.Path)
 	if s.Process != nil {
@@ -49,9 +57,12 @@ func (s *SqliteWebProcess) startProcess(filePath string) error {
 		return err
 	}
 	s.Process = cmd.Process
+	exited := make(chan struct{})
+	s.exited = exited
 	slog.Info("sqlite-web process started", "PID", s.Process.Pid)
 	go func() {
 		err := cmd.Wait()
+		close(exited)
 		if s.Process != nil && cmd.Process.Pid == s.Process.Pid {
 			slog.Info("sqlite-web process exited", "PID", s.Process.Pid, "error", err)
 			s.Process = nil
@@ -69,18 +80,28 @@ func (s *SqliteWebProcess) killCurrentProcess() {
 		slog.Info("No process to kill")
 		return
 	}
-	slog.Info("Killing process", "PID", s.Process.Pid)
+	process, exited := s.Process, s.exited
+	s.Process = nil
+	slog.Info("Stopping process", "PID", process.Pid)
 	if s.shutdownTimer != nil {
 		s.shutdownTimer.Stop()
 		s.shutdownTimer = nil
 	}
-	err := s.Process.Kill()
+	if err := process.Signal(syscall.SIGTERM); err == nil {
+		select {
+		case <-exited:
+			slog.Info("Process stopped successfully", "PID", process.Pid)
+			return
+		case <-time.After(processStopTimeout):
+			slog.Warn("Process didn't stop in time, killing it", "PID", process.Pid)
+		}
+	}
+	err := process.Kill()
 	if err != nil {
-		slog.Error("Failed to kill process", "PID", s.Process.Pid, "error", err)
+		slog.Error("Failed to kill process", "PID", process.Pid, "error", err)
 	} else {
-		slog.Info("Process killed successfully", "PID", s.Process.Pid)
+		slog.Info("Process killed successfully", "PID", process.Pid)
 	}
-	s.Process = nil
 }
 
 func (s *SqliteWebProcess) UnloadFile() {
@@ -110,6 +131,22 @@ func (s *SqliteWebProcess) shutdownIdleProcess() {
 	s.CurrentFile = nil
 }
 
+// Health check: when a file is open, the sqlite_web process serving it must be running
+func (s *SqliteWebProcess) HealthCheck(_ context.Context) error {
+	if s.CurrentFile == nil {
+		return nil
+	}
+	process := s.Process
+	if process == nil {
+		return fmt.Errorf("no sqlite_web process for %s", s.CurrentFile.Path)
+	}
+	err := process.Signal(syscall.Signal(0))
+	if err != nil {
+		return fmt.Errorf("sqlite_web process %d is not running: %w", process.Pid, err)
+	}
+	return nil
+}
+
 func (s *SqliteWebProcess) Ping() {
 	if s.Process != nil {
 		s.resetShutdownTimer()
@@ -4,18 +4,12 @@ import (
 	"encoding/json"
 	"log/slog"
 	"net/http"
-	"strconv"
 	"strings"
 
 	ggu "github.com/itsvyle/hxi2/global-go/utils"
 )
 
 func HandleListUsers(w http.ResponseWriter, r *http.Request) {
-	c, err := authManager.AuthenticateHTTPRequest(w, r, true)
-	if err != nil || !c.CheckPermHTTP(w, ggu.RoleStudent) {
-		return
-	}
-
 	users, err := usersCacher.Get()
 	if err != nil {
 		slog.With("error", err).Error("Failed to get users")
@@ -23,14 +17,6 @@ func HandleListUsers(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	etag := strconv.FormatInt(usersCacher.LastUpdated, 10)
-	w.Header().Set("ETag", etag)
-
-	if match := r.Header.Get("If-None-Match"); match == etag {
-		http.Error(w, http.StatusText(http.StatusNotModified), http.StatusNotModified)
-		return
-	}
-
 	if users == nil || len(*users) == 0 {
 		users = &[]ggu.ProjectUser{}
 	}
@@ -46,11 +32,9 @@ func HandleListUsers(w http.ResponseWriter, r *http.Request) {
 }
 
 func HandleListRelations(w http.ResponseWriter, r *http.Request) {
-	c, err := authManager.AuthenticateHTTPRequest(w, r, true)
-	if err != nil || !c.CheckPermHTTP(w, ggu.RoleStudent) {
-		return
-	}
-
+	// read before the values, so that a graph is never cached under newer versions than the data it was built from
+	relationsVersion := relationsCacher.LastUpdated().UnixNano()
+	promotionsVersion := promotionsCacher.LastUpdated().UnixNano()
 	cachedRelations, err := relationsCacher.Get()
 	if err != nil {
 		slog.With("error", err).Error("Failed to get parrainages")
@@ -66,19 +50,12 @@ func HandleListRelations(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		userGraph, err := ExtractUserGraph(userIDInt, cachedRelations.Graph)
+		mermaidCode, err := userGraphsCache.Get(userGraphKey{UserID: userIDInt, Relations: relationsVersion, Promotions: promotionsVersion})
 		if err != nil {
 			slog.With("error", err).Error("Failed to get user graph")
 			http.Error(w, "Failed to get user graph", http.StatusInternalServerError)
 			return
 		}
-
-		mermaidCode, _, err := GenerateMermaidCodeFromGraph(userGraph)
-		if err != nil {
-			slog.With("error", err).Error("Failed to generate mermaid code")
-			http.Error(w, "Failed to generate mermaid code", http.StatusInternalServerError)
-			return
-		}
 		w.Header().Set("Content-Type", "text/plain")
 
 		_, err = w.Write([]byte(mermaidCode))
@@ -106,10 +83,7 @@ func HandleListRelations(w http.ResponseWriter, r *http.Request) {
 }
 
 func HandlePostRelation(w http.ResponseWriter, r *http.Request) {
-	c, err := authManager.AuthenticateHTTPRequest(w, r, true)
-	if err != nil || !c.CheckPermHTTP(w, ggu.RoleStudent) {
-		return
-	}
+	c := ggu.ClaimsFromContext(r.Context())
 
 	parrainID := r.FormValue("parrainID")
 	filleulID := r.FormValue("filleulID")
@@ -136,7 +110,7 @@ func HandlePostRelation(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if !c.HasPermission(ggu.RoleAdmin) {
-		_, err := usersCacher.Get()
+		cachedRelations, err := relationsCacher.Get()
 		if err != nil {
 			slog.With("error", err).Error("Failed to get users for parrainage check")
 			http.Error(w, "Failed to get users", http.StatusInternalServerError)
@@ -146,7 +120,7 @@ func HandlePostRelation(w http.ResponseWriter, r *http.Request) {
 		filleulPromo := -1
 		if parrainIDInt == c.IDInt() {
 			parrainPromo = c.Promotion
-			filleul, ok := allUsersMap[filleulIDInt]
+			filleul, ok := cachedRelations.Users[filleulIDInt]
 			if !ok {
 				http.Error(w, "Filleul not found", http.StatusBadRequest)
 				return
@@ -154,7 +128,7 @@ func HandlePostRelation(w http.ResponseWriter, r *http.Request) {
 			filleulPromo = filleul.Promotion
 		} else if filleulIDInt == c.IDInt() {
 			filleulPromo = c.Promotion
-			parrain, ok := allUsersMap[parrainIDInt]
+			parrain, ok := cachedRelations.Users[parrainIDInt]
 			if !ok {
 				http.Error(w, "Parrain not found", http.StatusBadRequest)
 				return
@@ -184,7 +158,6 @@ func HandlePostRelation(w http.ResponseWriter, r *http.Request) {
 	}
 
 	relationsCacher.AskCacheRefresh()
-	globalTreeCacher.AskCacheRefresh()
 
 	w.Header().Set("Content-Type", "application/json")
 	err = json.NewEncoder(w).Encode(Parrainage{
@@ -200,10 +173,7 @@ func HandlePostRelation(w http.ResponseWriter, r *http.Request) {
 }
 
 func HandleDeleteRelation(w http.ResponseWriter, r *http.Request) {
-	c, err := authManager.AuthenticateHTTPRequest(w, r, true)
-	if err != nil || !c.CheckPermHTTP(w, ggu.RoleStudent) {
-		return
-	}
+	c := ggu.ClaimsFromContext(r.Context())
 
 	relationID := r.FormValue("id")
 	if relationID == "" {
@@ -244,7 +214,6 @@ func HandleDeleteRelation(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	relationsCacher.AskCacheRefresh()
-	globalTreeCacher.AskCacheRefresh()
 
 	_, err = w.Write([]byte(`{"success":true}`))
 	if err != nil {
@@ -253,11 +222,6 @@ func HandleDeleteRelation(w http.ResponseWriter, r *http.Request) {
 }
 
 func HandleGetGlobalTree(w http.ResponseWriter, r *http.Request) {
-	c, err := authManager.AuthenticateHTTPRequest(w, r, true)
-	if err != nil || !c.CheckPermHTTP(w, ggu.RoleStudent) {
-		return
-	}
-
 	globalTree, err := globalTreeCacher.Get()
 	if err != nil {
 		slog.With(ggu.SlogHTTPInfo(r), "error", err).Error("Failed to get global tree")
@@ -265,13 +229,6 @@ func HandleGetGlobalTree(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	w.Header().Set("ETag", globalTree.SVGHash)
-	if match := r.Header.Get("If-None-Match"); match == globalTree.SVGHash {
-		// If ETag matches, send Not Modified status
-		http.Error(w, http.StatusText(http.StatusNotModified), http.StatusNotModified)
-		return
-	}
-
 	w.Header().Set("Content-Type", "application/json")
 	err = json.NewEncoder(w).Encode(globalTree)
 	if err != nil {
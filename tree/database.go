@@ -83,3 +83,9 @@ func (db *DatabaseManager) DeleteParrainage(id int64) error {
 	_, err := db.DB.Exec("DELETE FROM parrainages WHERE ID = ?", id)
 	return err
 }
+
+// Removes every relation involving the user, used when their account is deleted
+func (db *DatabaseManager) DeleteUserParrainages(userID int64) error {
+	_, err := db.DB.Exec("DELETE FROM parrainages WHERE parrain_id = ? OR filleul_id = ?", userID, userID)
+	return err
+}
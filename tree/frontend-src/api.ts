@@ -3,6 +3,7 @@ import {
     SmallData,
     checkAuthentication,
 } from "../../global-frontend-dependencies/authUtils";
+import { csrfFetch } from "../../global-frontend-dependencies/csrf";
 
 export interface CustomWindow extends Window {
     isDev: boolean;
@@ -88,7 +89,7 @@ export function deleteRelation(id: number): Promise<ActionResponse> {
     let data = new FormData();
     data.append("id", String(id));
 
-    return fetch(`/api/relation`, {
+    return csrfFetch(`/api/relation`, {
         method: "DELETE",
         body: data,
     })
@@ -107,7 +108,7 @@ export function createRelation(
     data.append("parrainID", String(parrainID));
     data.append("filleulID", String(filleulID));
 
-    return fetch(`/api/relation`, {
+    return csrfFetch(`/api/relation`, {
         method: "POST",
         headers: {
             "Content-Type": "application/x-www-form-urlencoded",
@@ -9,8 +9,13 @@ import (
 	"log/slog"
 	"slices"
 	"strings"
+	"time"
 
 	_ "embed"
+
+	ggu "github.com/itsvyle/hxi2/global-go/utils"
+	"github.com/itsvyle/hxi2/global-go/utils/metrics"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 type GlobalTree struct {
@@ -22,16 +27,23 @@ type GlobalTree struct {
 	MermaidConfig mermaidInitializeConfig                   `json:"mermaidConfig"`
 }
 
-var treeBackgroundColors = map[int]string{
-	2021: "#b9291b",
-	2022: "#00c0c6",
-	2023: "#a05fdd",
-	2024: "#48e675",
+// The colors come from the promotions of the auth service, with the defaults as a fallback when it can't be reached
+func treeBackgroundColor(promotion int) (string, bool) {
+	promotions := ggu.DefaultPromotions()
+	if cached, err := promotionsCacher.Get(); err == nil && cached != nil {
+		promotions = *cached
+	}
+	p := promotions.Get(promotion)
+	if p == nil || p.Color == "" {
+		return "", false
+	}
+	return p.Color, true
 }
 
 type PeopleSet map[int64]struct{}
 type RelationGraphUser struct {
 	ID        int64     `json:"id"`
+	FirstName string    `json:"firstName"`
 	Promotion int       `json:"promotion"`
 	Parrains  PeopleSet `json:"parrains"`
 	Filleuls  PeopleSet `json:"filleuls"`
@@ -45,7 +57,8 @@ type RelationsGraph struct {
 
 const studentNodeClass = "studentnode"
 
-func BuildRelationsGraph(BaseRelationsPTR *[]Parrainage) *RelationsGraph {
+// users are the students, by ID; the relations of other users are left out
+func BuildRelationsGraph(BaseRelationsPTR *[]Parrainage, users map[int64]*ggu.ProjectUser) *RelationsGraph {
 	BaseRelations := *BaseRelationsPTR
 	if BaseRelations == nil {
 		BaseRelations = []Parrainage{}
@@ -64,10 +77,11 @@ func BuildRelationsGraph(BaseRelationsPTR *[]Parrainage) *RelationsGraph {
 		}
 
 		if _, ok := g.Users[r.ParrainID]; !ok {
-			u, ok := allUsersMap[r.ParrainID]
+			u, ok := users[r.ParrainID]
 			if ok {
 				g.Users[r.ParrainID] = &RelationGraphUser{
 					ID:        r.ParrainID,
+					FirstName: u.FirstName,
 					Promotion: u.Promotion,
 					Parrains:  PeopleSet{},
 					Filleuls:  PeopleSet{},
@@ -81,15 +95,16 @@ func BuildRelationsGraph(BaseRelationsPTR *[]Parrainage) *RelationsGraph {
 				}
 
 			} else {
-				slog.With("parrainID", r.ParrainID).Error("parrain not found in allUsersMap")
+				slog.With("parrainID", r.ParrainID).Error("parrain not found in the users")
 			}
 		}
 
 		if _, ok := g.Users[r.FilleulID]; !ok {
-			u, ok := allUsersMap[r.FilleulID]
+			u, ok := users[r.FilleulID]
 			if ok {
 				g.Users[r.FilleulID] = &RelationGraphUser{
 					ID:        r.FilleulID,
+					FirstName: u.FirstName,
 					Promotion: u.Promotion,
 					Parrains:  map[int64]struct{}{},
 					Filleuls:  map[int64]struct{}{},
@@ -102,7 +117,7 @@ func BuildRelationsGraph(BaseRelationsPTR *[]Parrainage) *RelationsGraph {
 					g.MaxGen = u.Promotion
 				}
 			} else {
-				slog.With("filleulID", r.FilleulID).Error("filleul not found in allUsersMap")
+				slog.With("filleulID", r.FilleulID).Error("filleul not found in the users")
 			}
 		}
 
@@ -181,7 +196,7 @@ graph TD;
 		}
 		tree += fmt.Sprintf("	subgraph Gen%d[\"Génération %d\"]\n", p, p)
 		for _, u := range us {
-			tree += fmt.Sprintf(" 	   %d(\"%q\")\n", u.ID, allUsersMap[u.ID].FirstName)
+			tree += fmt.Sprintf(" 	   %d(\"%q\")\n", u.ID, u.FirstName)
 		}
 		tree += "	end\n"
 	}
@@ -205,7 +220,7 @@ graph TD;
 	tree += "	\n"
 
 	for p := range bucketIter() {
-		if color, ok := treeBackgroundColors[p]; ok {
+		if color, ok := treeBackgroundColor(p); ok {
 			tree += fmt.Sprintf(`   style Gen%d fill:%s`, p, color) + "\n"
 		}
 	}
@@ -214,7 +229,7 @@ graph TD;
 
 	for _, us := range bucketIter() {
 		for _, u := range us {
-			tree += fmt.Sprintf("	click %d call nodeClicked() \"Voir graphe spécifique de %s\"\n", u.ID, allUsersMap[u.ID].FirstName)
+			tree += fmt.Sprintf("	click %d call nodeClicked() \"Voir graphe spécifique de %s\"\n", u.ID, u.FirstName)
 		}
 	}
 
@@ -225,12 +240,6 @@ graph TD;
 
 // code, hash, err
 func GenerateMermaidCode() (string, string, error) {
-	// Refresh users cache
-	_, err := usersCacher.Get()
-	if err != nil {
-		slog.With("error", err).Error("Failed to get users")
-		return "", "", err
-	}
 	cachedRelations, err := relationsCacher.Get()
 	if err != nil {
 		slog.With("error", err).Error("Failed to get parrainages")
@@ -321,7 +330,19 @@ func GetMermaidCompiler() (*ChromeCompiler[string, mermaidCompilationResponse],
 	return compiler, nil
 }
 
+var generatorDuration = metrics.Factory.NewHistogram(prometheus.HistogramOpts{
+	Namespace: metrics.Namespace,
+	Name:      "tree_generator_duration_seconds",
+	Help:      "Time to generate the global tree, rendering included",
+	Buckets:   []float64{0.5, 1, 2, 5, 10, 20, 40, 80},
+})
+
 func RunGenerator() (GlobalTree, error) {
+	start := time.Now()
+	defer func() {
+		generatorDuration.Observe(time.Since(start).Seconds())
+	}()
+
 	mermaidCode, mermaidCodeHash, err := GenerateMermaidCode()
 	if err != nil {
 		slog.With("error", err).Error("error generating mermaid code")
@@ -387,6 +408,7 @@ func ExtractUserGraph(userID int64, baseGraph *RelationsGraph) (*RelationsGraph,
 		}
 		g.Users[filleulID] = &RelationGraphUser{
 			ID:        filleul.ID,
+			FirstName: filleul.FirstName,
 			Promotion: filleul.Promotion,
 		}
 	}
@@ -401,6 +423,7 @@ func ExtractUserGraph(userID int64, baseGraph *RelationsGraph) (*RelationsGraph,
 			if _, ok := g.Users[parrain.ID]; !ok {
 				g.Users[parrain.ID] = &RelationGraphUser{
 					ID:        parrain.ID,
+					FirstName: parrain.FirstName,
 					Promotion: parrain.Promotion,
 					Filleuls:  parrain.Filleuls,
 					Parrains:  allAboveParrains(parrain),
@@ -418,6 +441,7 @@ func ExtractUserGraph(userID int64, baseGraph *RelationsGraph) (*RelationsGraph,
 		}
 		g.Users[parrainID] = &RelationGraphUser{
 			ID:        parrain.ID,
+			FirstName: parrain.FirstName,
 			Promotion: parrain.Promotion,
 			Filleuls:  parrain.Filleuls,
 			Parrains:  allAboveParrains(parrain),
@@ -432,6 +456,7 @@ func ExtractUserGraph(userID int64, baseGraph *RelationsGraph) (*RelationsGraph,
 			}
 			g.Users[coFilleulID] = &RelationGraphUser{
 				ID:        coFilleul.ID,
+				FirstName: coFilleul.FirstName,
 				Promotion: coFilleul.Promotion,
 				Parrains:  CommonKeys(coFilleul.Parrains, me.Parrains),
 			}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"embed"
 	"log/slog"
 	"net/http"
@@ -8,117 +9,195 @@ import (
 	"time"
 
 	ggu "github.com/itsvyle/hxi2/global-go/utils"
+	"github.com/itsvyle/hxi2/global-go/utils/config"
+	"github.com/itsvyle/hxi2/global-go/utils/metrics"
 )
 
 var authManager *ggu.AuthManager
-var ConfigRunningPort = "42002"
-var HXI2TLD = ""
 
 type CachedRelations struct {
 	Parrainages []Parrainage
 	Graph       *RelationsGraph
+	// the students, from usersCacher
+	Users map[int64]*ggu.ProjectUser
 }
 
 var usersCacher *ggu.Cacher[[]ggu.ProjectUser]
-var allUsersMap map[int64]*ggu.ProjectUser
 var globalTreeCacher *ggu.Cacher[GlobalTree]
 var relationsCacher *ggu.Cacher[CachedRelations]
+var promotionsCacher *ggu.Cacher[ggu.PromotionsInfo]
 
-func init() {
-	var err error
-	ggu.InitGlobalSlog()
+// Only the students are part of the tree
+func isStudent(u ggu.ProjectUser) bool {
+	return u.Permissions&ggu.RoleStudent != 0
+}
 
-	fails := []string{}
-	fail := func(key string) {
-		fails = append(fails, key)
-	}
-	loadOrFail := func(key string) string {
-		v := os.Getenv(key)
-		if v == "" {
-			fail(key + " is not defined")
-		}
-		return v
-	}
+// The versions of the relations and promotions are part of the key, so graphs built from older data are never
+// served, and age out of the cache
+type userGraphKey struct {
+	UserID     int64
+	Relations  int64
+	Promotions int64
+}
 
-	var ConfigDBPath = loadOrFail("CONFIG_DB_PATH")
-	if os.Getenv("CONFIG_RUNNING_PORT") != "" {
-		ConfigRunningPort = os.Getenv("CONFIG_RUNNING_PORT")
-	}
-	HXI2TLD = os.Getenv("HXI2_TLD")
+var userGraphsCache *ggu.KeyedCache[userGraphKey, string]
 
-	if len(fails) > 0 {
-		for _, f := range fails {
-			slog.Error(f)
-		}
-		panic("Failed to load configuration")
-	}
+type Config struct {
+	RunningPort string `env:"CONFIG_RUNNING_PORT" default:"42002"`
+	DBPath      string `env:"CONFIG_DB_PATH" required:"true"`
+	TLD         string `env:"HXI2_TLD"`
+	// Secret of the webhook registered for this project in the auth service; webhooks are disabled if empty
+	WebhookSecret string `env:"HXI2_WEBHOOK_SECRET" secret:"true"`
+	Auth          ggu.AuthManagerConfig
+	Statics       ggu.StaticsConfig
+}
+
+func setup(cfg *Config) error {
+	var err error
 
 	// #region Auth manager
 
-	authManager, err = ggu.NewAuthManagerFromEnv()
+	authManager, err = ggu.NewAuthManagerFromConfig(cfg.Auth)
 	if err != nil {
-		panic(err)
+		return err
 	}
 	// #endregion
 
-	DB = NewDatabaseManager(ConfigDBPath)
+	DB = NewDatabaseManager(cfg.DBPath)
 
 	// #region Cachers
+	// with webhooks, the users only need to be refetched when the auth service says they changed
+	usersRefreshInterval := 60 * time.Second
+	if cfg.WebhookSecret != "" {
+		usersRefreshInterval = 10 * time.Minute
+	}
 	usersCacher = ggu.NewCacher("usersCacher", func() ([]ggu.ProjectUser, error) {
 		a, err := authManager.ProjectListUsers()
 		if err != nil {
 			return nil, err
 		}
-		a = ggu.Filter(a, func(s ggu.ProjectUser) bool {
-			return s.Permissions&ggu.RoleStudent != 0
-		})
+		return ggu.Filter(a, isStudent), nil
+	}, usersRefreshInterval, 0)
 
-		allUsersMap = make(map[int64]*ggu.ProjectUser, len(a))
-		for i := range a {
-			allUsersMap[a[i].ID] = &a[i]
+	promotionsCacher = ggu.NewCacher("promotionsCacher", func() (ggu.PromotionsInfo, error) {
+		promotions, err := authManager.ProjectGetPromotions()
+		if err != nil {
+			return nil, err
 		}
-
-		return a, nil
-	}, 60*time.Second, 0)
-
-	globalTreeCacher = ggu.NewCacher("globalTreeCacher", func() (GlobalTree, error) {
-		return RunGenerator()
-	}, 60*time.Second, 10)
+		ggu.SetPromotionsRange(promotions.Range())
+		return promotions, nil
+	}, usersRefreshInterval, 0)
 
 	relationsCacher = ggu.NewCacher("relationsCacher", func() (CachedRelations, error) {
+		users, err := usersCacher.Get()
+		if err != nil {
+			return CachedRelations{}, err
+		}
+		usersMap := make(map[int64]*ggu.ProjectUser, len(*users))
+		for i := range *users {
+			usersMap[(*users)[i].ID] = &(*users)[i]
+		}
 		p, err := DB.ListParrainage(-1)
 		if err != nil {
 			return CachedRelations{}, err
 		}
 		return CachedRelations{
 			Parrainages: p,
-			Graph:       BuildRelationsGraph(&p),
+			Graph:       BuildRelationsGraph(&p, usersMap),
+			Users:       usersMap,
 		}, nil
 	}, 10*time.Second, 1)
+	relationsCacher.DependsOn(usersCacher)
+
+	// the colors of the generations come from the promotions
+	globalTreeCacher = ggu.NewCacher("globalTreeCacher", func() (GlobalTree, error) {
+		return RunGenerator()
+	}, 60*time.Second, 10)
+	globalTreeCacher.DependsOn(relationsCacher, promotionsCacher)
+
+	userGraphsCache = ggu.NewKeyedCache("userGraphsCache", func(key userGraphKey) (string, error) {
+		cachedRelations, err := relationsCacher.Get()
+		if err != nil {
+			return "", err
+		}
+		userGraph, err := ExtractUserGraph(key.UserID, cachedRelations.Graph)
+		if err != nil {
+			return "", err
+		}
+		mermaidCode, _, err := GenerateMermaidCodeFromGraph(userGraph)
+		return mermaidCode, err
+	}, 10*time.Minute, 500)
 
 	// #endregion
+	return nil
 }
 
 //go:embed dist/*
 var staticsFS embed.FS
 
 func main() {
+	ggu.InitGlobalSlog()
+	var cfg Config
+	config.MustLoad(&cfg)
+	err := setup(&cfg)
+	if err != nil {
+		slog.With("error", err).Error("Failed to start")
+		os.Exit(1)
+	}
+
 	slog.Info("Starting tree-backend")
+	lc := ggu.NewLifecycle()
+	lc.OnShutdown("database", DB.DB.Close)
+	lc.OnShutdown("cachers", func() error {
+		usersCacher.Stop()
+		promotionsCacher.Stop()
+		globalTreeCacher.Stop()
+		relationsCacher.Stop()
+		return nil
+	})
+	lc.OnShutdown("auth manager", authManager.Close)
+
+	lc.Go("deletion watcher", func(ctx context.Context) {
+		authManager.RunDeletionWatcher(ctx, 5*time.Minute, func(userID int64) error {
+			err := DB.DeleteUserParrainages(userID)
+			if err != nil {
+				return err
+			}
+			// the users are refreshed too, and the tree after both
+			usersCacher.ForceInvalidate()
+			relationsCacher.AskCacheRefresh()
+			return nil
+		})
+	})
+
+	if chromePath, err := FindChromeExecutable(); err != nil {
+		slog.With("error", err).Error("Chrome is missing, the global tree can't be rendered")
+	} else {
+		slog.With("path", chromePath).Debug("Found Chrome")
+	}
+
 	router := http.NewServeMux()
+	// the pages and the API are only for students
+	requireStudent := authManager.RequirePermission(ggu.RoleStudent)
+	csrf := ggu.NewCSRFProtection()
 
 	server := &http.Server{
-		Addr:              ":" + ConfigRunningPort,
-		Handler:           router,
+		Addr:              ":" + cfg.RunningPort,
+		Handler:           ggu.RequestLoggingMiddleware(metrics.Middleware(router)),
 		ReadHeaderTimeout: 5 * time.Second,
 	}
 
-	staticsManager := ggu.NewStaticFilesManager(
+	staticsManager := ggu.NewStaticFilesManagerFromConfig(
+		cfg.Statics,
 		staticsFS,
 		"dist",
-		ggu.StaticsDefaultContentSecurityPolicy(HXI2TLD),
+		ggu.DefaultContentSecurityPolicy(cfg.TLD),
 	)
+	lc.Go("statics watcher", staticsManager.RunDevWatcher)
 
 	staticsManager.RegisterChunkHandlers(router)
+	staticsManager.MountDevRoutes(router)
+	staticsManager.MountCSPReportRoute(router)
 
 	addHTML, addJS, addCSS := staticsManager.WholeRouteHandlers("add")
 	router.Handle("/dist/add.bundle.js", addJS)
@@ -126,13 +205,7 @@ func main() {
 		router.Handle("/dist/add.bundle.css", addCSS)
 	}
 
-	router.HandleFunc("/add", func(w http.ResponseWriter, r *http.Request) {
-		c, err := authManager.AuthenticateHTTPRequest(w, r, false)
-		if err != nil || !c.CheckPermHTTP(w, ggu.RoleStudent) {
-			return
-		}
-		addHTML.ServeHTTP(w, r)
-	})
+	router.Handle("/add", requireStudent(addHTML))
 
 	treeHTML, treeJS, treeCSS := staticsManager.WholeRouteHandlers("tree")
 	router.Handle("/dist/tree.bundle.js", treeJS)
@@ -140,20 +213,43 @@ func main() {
 		router.Handle("/dist/tree.bundle.css", treeCSS)
 	}
 
-	router.HandleFunc("/tree", func(w http.ResponseWriter, r *http.Request) {
-		c, err := authManager.AuthenticateHTTPRequest(w, r, false)
-		if err != nil || !c.CheckPermHTTP(w, ggu.RoleStudent) {
-			return
-		}
-		treeHTML.ServeHTTP(w, r)
+	router.Handle("/tree", requireStudent(treeHTML))
+
+	if cfg.WebhookSecret != "" {
+		// the user events are applied to the cached users without refetching them; the relations and the global tree
+		// depend on the users and promotions, and are refreshed after them
+		router.Handle("POST /api/webhook", ggu.NewWebhookReceiver(cfg.WebhookSecret).On(
+			ggu.WebhookPatchProjectUsers(usersCacher, isStudent),
+			ggu.WebhookEventUserCreated, ggu.WebhookEventUserUpdated, ggu.WebhookEventUserDeleted, ggu.WebhookEventPermissionsChanged,
+		).On(
+			ggu.WebhookInvalidate(promotionsCacher),
+			ggu.WebhookEventPromotionsChanged,
+		))
+	}
+	router.Handle("/api/list_users", requireStudent(ggu.CompressionMiddleware(http.HandlerFunc(HandleListUsers))))
+	router.Handle("/api/list_relations", requireStudent(ggu.CompressionMiddleware(http.HandlerFunc(HandleListRelations))))
+	router.Handle("POST /api/relation", requireStudent(csrf.Protect(http.HandlerFunc(HandlePostRelation))))
+	router.Handle("DELETE /api/relation", requireStudent(csrf.Protect(http.HandlerFunc(HandleDeleteRelation))))
+	router.Handle("GET "+ggu.CSRFTokenPath, requireStudent(http.HandlerFunc(csrf.HandleToken)))
+	router.Handle("GET /api/global_tree", requireStudent(ggu.CompressionMiddleware(http.HandlerFunc(HandleGetGlobalTree))))
+
+	authManager.MountMetrics(router)
+
+	health := ggu.NewHealthRegistry()
+	health.AddReadinessCheck("database", DB.DB.PingContext)
+	health.AddReadinessCheck("auth", authManager.HealthCheck)
+	health.AddReadinessCheck("chrome", func(_ context.Context) error {
+		_, err := FindChromeExecutable()
+		return err
 	})
-
-	router.Handle("/api/list_users", ggu.GzipMiddleware(http.HandlerFunc(HandleListUsers)))
-	router.Handle("/api/list_relations", ggu.GzipMiddleware(http.HandlerFunc(HandleListRelations)))
-	router.Handle("POST /api/relation", http.HandlerFunc(HandlePostRelation))
-	router.Handle("DELETE /api/relation", http.HandlerFunc(HandleDeleteRelation))
-	router.Handle("GET /api/global_tree", ggu.GzipMiddleware(http.HandlerFunc(HandleGetGlobalTree)))
-
-	slog.With("port", ConfigRunningPort).Info("Server is running")
-	slog.With("error", server.ListenAndServe()).Error("Server crashed")
+	health.AddReadinessCheck("usersCacher", usersCacher.HealthCheck)
+	health.AddReadinessCheck("promotionsCacher", promotionsCacher.HealthCheck)
+	health.AddReadinessCheck("globalTreeCacher", globalTreeCacher.HealthCheck)
+	health.AddReadinessCheck("relationsCacher", relationsCacher.HealthCheck)
+	health.Mount(router)
+
+	slog.With("port", cfg.RunningPort).Info("Server is running")
+	if err := lc.Serve(server); err != nil {
+		os.Exit(1)
+	}
 }
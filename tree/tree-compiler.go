@@ -6,7 +6,9 @@ import (
 	"context"
 	_ "embed" // for go:embed
 	"encoding/json"
+	"errors"
 	"fmt"
+	"os/exec"
 	"runtime"
 	"strings"
 	"sync"
@@ -15,6 +17,32 @@ import (
 	"github.com/chromedp/chromedp"
 )
 
+// The executables chromedp looks for when no ExecPath is given, on Linux
+var chromeExecutables = []string{
+	"headless_shell",
+	"headless-shell",
+	"chromium",
+	"chromium-browser",
+	"google-chrome",
+	"google-chrome-stable",
+	"google-chrome-beta",
+	"google-chrome-unstable",
+	"/usr/bin/google-chrome",
+	"/usr/local/bin/chrome",
+	"/snap/bin/chromium",
+	"chrome",
+}
+
+// Finds the browser chromedp will start, so that a missing one is reported before the first render
+func FindChromeExecutable() (string, error) {
+	for _, name := range chromeExecutables {
+		if path, err := exec.LookPath(name); err == nil {
+			return path, nil
+		}
+	}
+	return "", errors.New("no Chrome or Chromium executable found in the PATH")
+}
+
 // ChromeCompilerConfig specifies the configuration for a Compiler.
 type ChromeCompilerConfig[_ any, Output any] struct {
 	// JSSource is JavaScript code that will be injected into the headless browser as a base, before init.